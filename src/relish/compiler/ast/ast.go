@@ -107,6 +107,7 @@ type MethodDeclaration struct {
 	NumFreeVars int  // may be > 0 if this is a closure method
 	IsClosureMethod bool
 	ModifierKeywords map[string]bool  // modifiers (annotations) which do things like db transaction type etc
+	Route string  // "" or a web handler's URL path pattern, such as "/orders/{id}/items"
 }
 
 
@@ -176,6 +177,10 @@ type AttributeDecl struct {
 	Type                                                                                                  *TypeSpec
 	PublicReadable, PackageReadable, SubtypeReadable, PublicWriteable, PackageWriteable, SubtypeWriteable bool
 	Reassignable, CollectionMutable, Mutable, DeeplyMutable                                               bool
+	IsIndexed, IsUnique                                                                                   bool     // e.g. vin String unique
+	IndexWith                                                                                             []*Ident // other attributes of a composite index e.g. model String indexed with make year
+	WasName                                                                                               *Ident   // former name of a renamed attribute e.g. fullName String was name
+	Via                                                                                                   *Ident   // method which converts the stored values of the attribute e.g. mileage Float via kilometres
 }
 
 func (a *AttributeDecl) IsReassignable() bool {
@@ -235,6 +240,7 @@ type CollectionTypeSpec struct {
 	IsSorting   bool
 	IsAscending bool
 	OrderFunc   string
+	IsBig       bool // a list whose elements are kept only in the database, e.g. [big] Event
 }
 
 // ----------------------------------------------------------------------------
@@ -15,6 +15,7 @@ import (
 	"relish/runtime/interp"
 	"relish/rterr"	
 	"relish"
+	"relish/params"
 	. "relish/defs"
 	. "relish/dbg"
 )
@@ -59,9 +60,12 @@ Assumes imported packages have already been loaded; thus the objects defined in
 func (g *Generator) GenerateCode() {	
    types := make(map[*data.RType]bool)	
    attributeOrderings := make(map[string]*data.AttributeSpec)
+   migrationMethods := make(map[*data.AttributeSpec]string)
    g.generatePackage()
-   g.generateTypes(types, attributeOrderings)
+   g.generateTypes(types, attributeOrderings, migrationMethods)
    g.generateMethods()		
+   g.configureMigrationMethods(migrationMethods)
+   g.ensureTypeTables(types)
    g.generateConstants()
    g.generateRelations(types, attributeOrderings) 
    g.configureAttributeSortings(attributeOrderings)
@@ -399,19 +403,19 @@ func (g *Generator) ensureTypeName(typeSpec *ast.TypeSpec) string {
 
 /*
 Processes the TypeDecls from a set of ast.File objects (which have been created by the parser.)
-Generates the runtime environment's objects for datatypes and attributes, and also ensures that db tables exist for these.
+Generates the runtime environment's objects for datatypes and attributes. The db tables for these are ensured
+later, by ensureTypeTables, once the package's methods have been generated.
 
 Runtime *data.RType's are placed into the argument hashtable once created here.
 */
-func (g *Generator) generateTypes(types map[*data.RType]bool, attributeOrderings map[string]*data.AttributeSpec) {
+func (g *Generator) generateTypes(types map[*data.RType]bool, attributeOrderings map[string]*data.AttributeSpec, migrationMethods map[*data.AttributeSpec]string) {
 
 	allTypeDecls := make(map[string]*ast.TypeDecl)  // Map from full type name to *ast.TypeDecl
 
 	typeDeclFile := make(map[string]string)  // map of type name to which file it is declared in - the filenameroot is the value in the map
 	
 	g.generateTypesWithoutAttributes(allTypeDecls, types, typeDeclFile)
-	g.generateAttributes(allTypeDecls, types, typeDeclFile, attributeOrderings)
-	g.ensureTypeTables(types)
+	g.generateAttributes(allTypeDecls, types, typeDeclFile, attributeOrderings, migrationMethods)
 }
 
 /*
@@ -536,11 +540,12 @@ Processes the TypeDecls list of a ast.File object (which has been created by the
 Generates the runtime environment's objects for attributes of datatypes.
 Assumes the RType objects have already been created in the runtime for each datatype by a previous pass over the intermediate-code files.
 */
-func (g *Generator) generateAttributes(allTypeDecls map[string]*ast.TypeDecl, types map[*data.RType]bool, typeDeclFile map[string]string, orderings map[string]*data.AttributeSpec) {
+func (g *Generator) generateAttributes(allTypeDecls map[string]*ast.TypeDecl, types map[*data.RType]bool, typeDeclFile map[string]string, orderings map[string]*data.AttributeSpec, migrationMethods map[*data.AttributeSpec]string) {
     for theNewType := range types {
        typeName := theNewType.Name
        typeDeclaration := allTypeDecls[typeName]
        g.SetCodeFile(g.astFiles[typeDeclFile[typeName]])       
+       indexedAttrs := make(map[*ast.AttributeDecl]*data.AttributeSpec)
 
 	   for _,attrDecl := range typeDeclaration.Attributes {
 		  var minCard int32 = 1
@@ -576,6 +581,8 @@ func (g *Generator) generateAttributes(allTypeDecls map[string]*ast.TypeDecl, ty
 			           collectionType = "sortedlist"
                        orderFuncOrAttrName = attrDecl.Type.CollectionSpec.OrderFunc	
                        isAscending = attrDecl.Type.CollectionSpec.IsAscending			
+		            } else if attrDecl.Type.CollectionSpec.IsBig {
+			           collectionType = "biglist"
 		            } else {
 			           collectionType = "list"			
 		            }
@@ -663,25 +670,100 @@ RelEnd
 		   if attr.Part.Type.IsPrivate && g.pkg != attr.Part.Type.Package {
 		      rterr.Stopf1(g, attrDecl, "Error creating attribute %s.%s (%s): Type %s is private and not visible in this package.", typeName, attributeName, attributeTypeName)		   	
 		   }
+		   if attrDecl.IsIndexed || attrDecl.IsUnique {
+		      if ! isTypeTableColumn(attr) {
+		         rterr.Stopf1(g, attrDecl, "Error creating attribute %s.%s: Only a single-valued attribute of a primitive type can be declared indexed or unique.", typeName, attributeName)
+		      }
+		      attr.IsIndexed = attrDecl.IsIndexed
+		      attr.IsUnique = attrDecl.IsUnique
+		      indexedAttrs[attrDecl] = attr
+		   }
+		   if attrDecl.WasName != nil {
+		      attr.FormerName = attrDecl.WasName.Name
+		   }
+		   if attrDecl.Via != nil {
+		      migrationMethods[attr] = attrDecl.Via.Name
+		   }
         }
+
+        // Now that all of the type's attributes exist, link each composite index to its other attributes.
+
+	    for attrDecl, attr := range indexedAttrs {
+	       for _, otherName := range attrDecl.IndexWith {
+	          var other *data.AttributeSpec
+	          for _, a := range theNewType.Attributes {
+	             if a.Part.Name == otherName.Name {
+	                other = a
+	                break
+	             }
+	          }
+	          if other == nil || ! isTypeTableColumn(other) {
+		         rterr.Stopf1(g, attrDecl, "Error creating index on attribute %s.%s: %s is not a single-valued attribute of a primitive type declared in type %s.", typeName, attrDecl.Name.Name, otherName.Name, typeName)
+	          }
+	          attr.IndexWith = append(attr.IndexWith, other)
+	       }
+	    }
     }
 }
 
+/*
+Whether the attribute's values are stored in a column of its type's table, so that it can be indexed.
+*/
+func isTypeTableColumn(attr *data.AttributeSpec) bool {
+	return attr.Part.Type.IsPrimitive && attr.Part.CollectionType == "" && attr.Part.ArityHigh == 1 && ! attr.IsTransient
+}
+
 // g.Interp.Dispatcher()
 
 /*
-Ensure the persistence data model is created for the type.
+Ensure the persistence data model is created for the type, in the main database and in each attached
+database, first migrating the type's existing table if the type's declaration has changed since the table was created.
+In a migration dry run, only prints the migrations, and does not change the database.
+This had to be delayed until all methods in the package were generated, because attributes
+may have migration methods.
 */
 func (g *Generator) ensureTypeTables(types map[*data.RType]bool) {
 
     for theNewType := range types {
-		err := data.RT.DBT().EnsureTypeTable(theNewType) 
+       for _, dbt := range data.RT.DBTs() {
+		migration, err := dbt.MigrateTypeTable(g.th, theNewType, params.DbMigrationDryRun) 
 		if err != nil {
 		      panic(err)
 		}
+		if params.DbMigrationDryRun {
+		   if migration != nil {
+		      fmt.Println(migration)
+		   }
+		   continue
+		}
+		if migration != nil {
+		   Logln(ALWAYS_, migration)
+		}
+		err = dbt.EnsureTypeTable(theNewType) 
+		if err != nil {
+		      panic(err)
+		}
+       }
+       if ! params.DbMigrationDryRun {
+          data.RT.AddStoredType(theNewType)
+       }
     }
 }
 
+/*
+Give the attributes declared with a via method their migration method.
+This had to be delayed until all methods in the package were generated.
+*/
+func (g *Generator) configureMigrationMethods(migrationMethods map[*data.AttributeSpec]string) {
+	for attr, methodName := range migrationMethods {
+		migrationMethod, methodFound := g.pkg.MultiMethods[methodName]
+		if ! methodFound || len(migrationMethod.Methods[1]) == 0 || migrationMethod.NumReturnArgs != 1 {
+			rterr.Stopf("Can't migrate attribute %s.%s. No unary method '%s' returning a value found.", attr.WholeType.Name, attr.Part.Name, methodName)
+		}
+		attr.MigrationMethod = migrationMethod
+	}
+}
+
 
 
 /*
@@ -755,12 +837,17 @@ func (g *Generator) configureAttributeSorting(orderFuncOrAttrName string, attr *
 
 
 func (g *Generator) ensureAttributeAndRelationTables(types map[*data.RType]bool) {
+	if params.DbMigrationDryRun {
+		return
+	}
 	for typ := range types {
 		// ensure the persistence data model is created for  the type's attributes and relations
 
-		err := data.RT.DBT().EnsureAttributeAndRelationTables(typ) 
-		if err != nil {
-		      panic(err)
+		for _, dbt := range data.RT.DBTs() {
+		   err := dbt.EnsureAttributeAndRelationTables(typ) 
+		   if err != nil {
+		         panic(err)
+		   }
 		}		
 	}
 }
@@ -1081,6 +1168,8 @@ func (g *Generator) generateRelations(types map[*data.RType]bool, orderings map[
 		           collectionType1 = "sortedlist"
 	                     orderFuncOrAttrName1 = end1.Type.CollectionSpec.OrderFunc	
 	                     isAscending1 = end1.Type.CollectionSpec.IsAscending			
+	            } else if end1.Type.CollectionSpec.IsBig {
+		           collectionType1 = "biglist"
 	            } else {
 		           collectionType1 = "list"			
 	            }
@@ -1125,6 +1214,8 @@ func (g *Generator) generateRelations(types map[*data.RType]bool, orderings map[
 		           collectionType2 = "sortedlist"
 	                     orderFuncOrAttrName2 = end2.Type.CollectionSpec.OrderFunc	
 	                     isAscending2 = end2.Type.CollectionSpec.IsAscending			
+	            } else if end2.Type.CollectionSpec.IsBig {
+		           collectionType2 = "biglist"
 	            } else {
 		           collectionType2 = "list"			
 	            }
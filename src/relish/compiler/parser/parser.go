@@ -553,7 +553,7 @@ func (p *parser) parseTypeSpec(canBeMultiLineOrMap bool,  // if false, single li
        collectionTypeSpecFound = true
 	   p.required(p.Space(),"a space then a type name")
 	} else if forceCollection {
-	   collectionTypeSpec = &ast.CollectionTypeSpec{token.SET,p.Pos(),p.Pos()+1,false,false,""}
+	   collectionTypeSpec = &ast.CollectionTypeSpec{token.SET,p.Pos(),p.Pos()+1,false,false,"",false}
     }
 
 	var typeName *ast.Ident
@@ -2279,7 +2279,7 @@ func (p *parser) parseOneLineListConstruction(stmt **ast.ListConstruction, isIns
     isSorting := false // TODO allow sorting-list specifications in list constructions!!!!
     isAscending := false 
     orderFunc := "" 
-    collectionTypeSpec = &ast.CollectionTypeSpec{token.LIST,pos,end,isSorting,isAscending,orderFunc}
+    collectionTypeSpec = &ast.CollectionTypeSpec{token.LIST,pos,end,isSorting,isAscending,orderFunc,false}
 
     typeSpec.CollectionSpec = collectionTypeSpec
 */
@@ -2404,7 +2404,7 @@ func (p *parser) parseIndentedListConstruction(stmt **ast.ListConstruction) bool
     isSorting := false // TODO allow sorting-list specifications in empty list constructions!!!!
     isAscending := false 
     orderFunc := "" 
-    collectionTypeSpec = &ast.CollectionTypeSpec{token.LIST,pos,end,isSorting,isAscending,orderFunc}
+    collectionTypeSpec = &ast.CollectionTypeSpec{token.LIST,pos,end,isSorting,isAscending,orderFunc,false}
 
     typeSpec.CollectionSpec = collectionTypeSpec
 */
@@ -2589,9 +2589,9 @@ func (p *parser) parseOneLineMapOrSetConstruction(mapStmt **ast.MapConstruction,
     orderFunc := "" 
 
     if knownToBeMap {
-       collectionTypeSpec = &ast.CollectionTypeSpec{token.MAP,pos,end,isSorting,isAscending,orderFunc}
+       collectionTypeSpec = &ast.CollectionTypeSpec{token.MAP,pos,end,isSorting,isAscending,orderFunc,false}
     } else {
-       collectionTypeSpec = &ast.CollectionTypeSpec{token.SET,pos,end,isSorting,isAscending,orderFunc}	
+       collectionTypeSpec = &ast.CollectionTypeSpec{token.SET,pos,end,isSorting,isAscending,orderFunc,false}	
     }
     typeSpec.CollectionSpec = collectionTypeSpec
 */
@@ -2785,9 +2785,9 @@ func (p *parser) parseIndentedMapOrSetConstruction(mapStmt **ast.MapConstruction
     orderFunc := "" 
 
     if knownToBeMap {
-       collectionTypeSpec = &ast.CollectionTypeSpec{token.MAP,pos,end,isSorting,isAscending,orderFunc}
+       collectionTypeSpec = &ast.CollectionTypeSpec{token.MAP,pos,end,isSorting,isAscending,orderFunc,false}
     } else {
-       collectionTypeSpec = &ast.CollectionTypeSpec{token.SET,pos,end,isSorting,isAscending,orderFunc}  
+       collectionTypeSpec = &ast.CollectionTypeSpec{token.SET,pos,end,isSorting,isAscending,orderFunc,false}  
     }
     typeSpec.CollectionSpec = collectionTypeSpec
 */
@@ -4531,6 +4531,10 @@ func (p *parser) parseAttributeDecl(attrs *[]*ast.AttributeDecl, read, write boo
 
 	attr := &ast.AttributeDecl{Name:attrName, Arity:aritySpec, Type:typeSpec}
 
+	p.optional(p.parseAttributeMigrationSpec(attr))
+
+	p.optional(p.parseAttributeIndexSpec(attr))
+
   //PublicReadable, PackageReadable, SubtypeReadable, PublicWriteable, PackageWriteable, SubtypeWriteable bool
   // Reassignable, CollectionMutable, Mutable, DeeplyMutable                                               bool
 
@@ -4623,6 +4627,78 @@ func (p *parser) parseAttributeDecl(attrs *[]*ast.AttributeDecl, read, write boo
 	return true
 }
 
+/*
+   Parses the optional specification, after the type of an attribute declaration, of how the values of the
+   attribute which are stored in an existing database are migrated to the attribute's new name or type.
+
+   fullName String was name                 // the attribute was renamed
+   mileage Float via kilometres             // each stored value is converted by the unary method kilometres
+   fullName String was name via capitalized // both
+*/
+func (p *parser) parseAttributeMigrationSpec(attr *ast.AttributeDecl) bool {
+    if p.trace {
+       defer un(trace(p, "AttributeMigrationSpec"))
+    }
+    st := p.State()
+
+    if p.Space() && p.MatchWord("was") {
+       p.required(p.Space() && p.parseVarName(&attr.WasName, false), "a space then the former name of the attribute")
+    } else {
+       p.Fail(st)
+    }
+
+    viaSt := p.State()
+    if p.Space() && p.MatchWord("via") {
+       p.required(p.Space() && p.parseMethodName(false, &attr.Via), "a space then the name of a method which converts the stored values of the attribute")
+    } else {
+       p.Fail(viaSt)
+    }
+    return attr.WasName != nil || attr.Via != nil
+}
+
+/*
+   Parses the optional database index specification at the end of an attribute declaration.
+
+   vin String unique                   // a unique index on the attribute
+   make String indexed                 // a non-unique index on the attribute
+   model String indexed with make year // a composite index on the model, make and year attributes
+   serial Int unique with make         // a composite unique index
+*/
+func (p *parser) parseAttributeIndexSpec(attr *ast.AttributeDecl) bool {
+    if p.trace {
+       defer un(trace(p, "AttributeIndexSpec"))
+    }
+    st := p.State()
+
+    if ! p.Space() {
+       return false
+    }
+    if p.MatchWord("unique") {
+       attr.IsUnique = true
+    } else if p.MatchWord("indexed") {
+       attr.IsIndexed = true
+    } else {
+       return p.Fail(st)
+    }
+
+    withSt := p.State()
+    if p.Space() && p.MatchWord("with") {
+       for {
+          nameSt := p.State()
+          var attrName *ast.Ident
+          if ! (p.Space() && p.parseVarName(&attrName, false)) {
+             p.Fail(nameSt)
+             break
+          }
+          attr.IndexWith = append(attr.IndexWith, attrName)
+       }
+       p.required(len(attr.IndexWith) > 0, "a space then the name of another attribute of the type")
+    } else {
+       p.Fail(withSt)
+    }
+    return true
+}
+
 /*
    Temporary implementation - need to handle indented type spec
 
@@ -5283,11 +5359,13 @@ func (p *parser) parseReturnArgDecl(returnArgs *[]*ast.ReturnArgDecl) bool {
 
 
 
-var METHOD_MODIFIERS []string = []string{"READ","NOTX"}
+var METHOD_MODIFIERS []string = []string{"READ","NOTX","GET","POST","PUT","PATCH","DELETE","WEBSOCKET"}
 
 /*
 Parses modifier keywords to the right of the mandatory """ comment starting delimiter 
 at the top of a method declaration.
+A web dialog handler method may also have a route pattern there, such as /orders/{id}/items,
+which is the URL path (relative to the handler's package) that it handles.
 */  
 func (p *parser) parseMethodModifiers(methodDecl *ast.MethodDeclaration) bool {
    if p.trace {
@@ -5295,30 +5373,64 @@ func (p *parser) parseMethodModifiers(methodDecl *ast.MethodDeclaration) bool {
    }  
    st := p.State()
    mods := make(map[string]bool)
+   route := ""
    for p.Space() {
       for _,mod := range METHOD_MODIFIERS {
-         if mods[mod] {
-               p.stop("method modifier keyword repeated")
-         }
          if p.Match(mod) {
+            if mods[mod] {
+               p.stop("method modifier keyword repeated")
+            }
             mods[mod] = true
             st = p.State()
             break
          }     
       }
+      if p.Ch() == '/' {
+         if route != "" {
+            p.stop("A method cannot have more than one route pattern")
+         }
+         route = p.parseRoutePattern()
+         st = p.State()
+      }
    }
-   if len(mods) == 0 {
+   if len(mods) == 0 && route == "" {
       return p.Fail(st)
    } else {
       if mods["READ"] && mods["NOTX"] {
           p.stop("A method cannot have both READ and NOTX modifier")
       }
+      if mods["WEBSOCKET"] && (mods["READ"] || mods["POST"] || mods["PUT"] || mods["PATCH"] || mods["DELETE"]) {
+          p.stop("A WEBSOCKET method runs without a transaction, for GET requests only")
+      }
       methodDecl.ModifierKeywords = mods
+      methodDecl.Route = route
       p.Fail(st)
       return true
    }
 }
 
+/*
+Parses a route pattern such as /orders/{id}/items, whose {name} segments are the names
+of parameters of the method. Returns the pattern.
+*/
+func (p *parser) parseRoutePattern() string {
+   st := p.State()
+   for p.Ch() != ' ' && p.Ch() != '\n' && p.Ch() != -1 {
+      p.Next()
+   }
+   route := p.Substring(st.Offset, p.State().Offset)
+   for _,segment := range strings.Split(route[1:],"/") {
+      if strings.HasPrefix(segment,"{") {
+         if ! strings.HasSuffix(segment,"}") || len(segment) < 3 || strings.ContainsAny(segment[1:len(segment)-1],"{}") {
+            p.stop("A route pattern parameter must be written as {paramName}")
+         }
+      } else if strings.ContainsAny(segment,"{}") {
+         p.stop("A route pattern parameter must be a whole path segment, such as /{paramName}/")
+      }
+   }
+   return route
+}
+
 
 
 /*
@@ -5460,7 +5572,7 @@ func (p *parser) parseRelationDeclaration(relDecls *[]*ast.RelationDecl) bool {
      }
   } else { // max-arity of end1 is more than 1  
      if collection1Spec == nil {  // create a Set CollectionTypeSpec as a default
-        collection1Spec = &ast.CollectionTypeSpec{token.SET,pos,pos+1,false,false,""}
+        collection1Spec = &ast.CollectionTypeSpec{token.SET,pos,pos+1,false,false,"",false}
      }
   }    
 
@@ -5477,7 +5589,7 @@ func (p *parser) parseRelationDeclaration(relDecls *[]*ast.RelationDecl) bool {
      }
   } else { // max-arity of end2 is more than 1  
      if collection2Spec == nil {  // create a Set CollectionTypeSpec as a default
-        collection2Spec = &ast.CollectionTypeSpec{token.SET,pos,pos+1,false,false,""}
+        collection2Spec = &ast.CollectionTypeSpec{token.SET,pos,pos+1,false,false,"",false}
      }
   }
 
@@ -5573,6 +5685,8 @@ Parse the short-hand notation for List of SomeType  e.g. List of String, or List
 
 [<weight] Widget  // meaning a sorting list of Widgets, ordered by the (natural ordering of the) 
                   // weight attribute of the widget.
+
+[big] Event  // meaning a big list of events, whose elements are kept only in the database.
 */
 func (p *parser) parseListTypeSpec(collectionTypeSpec **ast.CollectionTypeSpec) bool {
     if p.trace {
@@ -5587,10 +5701,12 @@ func (p *parser) parseListTypeSpec(collectionTypeSpec **ast.CollectionTypeSpec)
     }
 
 	// TODO Have to do < and <attr and <foo
-	var isSorting, isAscending bool
+	var isSorting, isAscending, isBig bool
 	var orderFunc string
 	
-	if p.Match("<") {
+	if p.Match("big") {
+		isBig = true
+	} else if p.Match("<") {
 		isAscending = true
 		isSorting = true
 	} else if p.Match(">") {
@@ -5605,7 +5721,7 @@ func (p *parser) parseListTypeSpec(collectionTypeSpec **ast.CollectionTypeSpec)
     }	
     end := p.Pos()
 
-    *collectionTypeSpec = &ast.CollectionTypeSpec{token.LIST,pos,end,isSorting,isAscending,orderFunc}
+    *collectionTypeSpec = &ast.CollectionTypeSpec{token.LIST,pos,end,isSorting,isAscending,orderFunc,isBig}
 
     return true
 }
@@ -5650,7 +5766,7 @@ func (p *parser) parseSetTypeSpec(collectionTypeSpec **ast.CollectionTypeSpec) b
     }
     end := p.Pos()
 
-    *collectionTypeSpec = &ast.CollectionTypeSpec{token.SET,pos,end,isSorting,isAscending,orderFunc}
+    *collectionTypeSpec = &ast.CollectionTypeSpec{token.SET,pos,end,isSorting,isAscending,orderFunc,false}
 
     return true		
 }
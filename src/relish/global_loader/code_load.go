@@ -213,6 +213,30 @@ func (ldr *Loader) databaseDirPath(originAndArtifact string) string {
 }
 
 
+/*
+Return the database file path the artifact uses, without loading the artifact, for database maintenance commands.
+That is the path for a local artifact if a database exists there, or if the artifact is in the local artifacts
+directory and shared code is not required, and otherwise the path for a shared artifact.
+*/
+func (ldr *Loader) DatabasePath(originAndArtifact string) string {
+    localPath := ldr.RelishRuntimeLocation + "/data/" + originAndArtifact + "/" + ldr.DatabaseName
+    sharedPath := ldr.RelishRuntimeLocation + "/data_for_shared/" + originAndArtifact + "/" + ldr.DatabaseName
+    if ldr.SharedCodeOnly {
+       return sharedPath
+    }
+    if _, err := gos.Stat(localPath); err == nil {
+       return localPath
+    }
+    if _, err := gos.Stat(sharedPath); err == nil {
+       return sharedPath
+    }
+    if _, err := gos.Stat(ldr.RelishRuntimeLocation + "/artifacts/" + originAndArtifact); err == nil {
+       return localPath
+    }
+    return sharedPath
+}
+
+
 var parserDebugMode uint = parser.DeclarationErrors
 // Use the following line instead if you want to trace the parser execution:
 // var parserDebugMode uint = parser.DeclarationErrors | parser.Trace
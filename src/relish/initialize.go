@@ -10,6 +10,11 @@
 package relish
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+	. "relish/dbg"
 	. "relish/runtime/data"
 	. "relish/runtime/persist"	
    "relish/rterr"
@@ -29,10 +34,127 @@ func SetDatabaseURI(uri string) {
 
 func EnsureDatabase() {	
    if RT.DB() == nil {
-      db := NewDB(RT.DatabaseURI)
+      db := OpenDB(RT.DatabaseURI)
       RT.SetDB(db)
    }
 }
 
 
 
+
+/*
+Opens the database at location (a sqlite database name, kv:<name>, or a postgres:// URL, as in the -db option)
+and attaches it to the running program under the name, so that threads can use it with useDatabase.
+Ensures that the database has the tables of the types stored in the main database, migrating any whose
+type declarations have changed.
+Cannot be done in a transaction, since attaching a sqlite database to the main one cannot be.
+*/
+func AttachDatabase(th InterpreterThread, name string, location string) (err error) {
+   EnsureDatabase()
+   if th.Transaction() != nil {
+      err = fmt.Errorf("Cannot attach database '%s' within a transaction.", name)
+      return
+   }
+   if _, found := RT.NamedDB(name); found {
+      err = fmt.Errorf("A database named '%s' is already attached.", name)
+      return
+   }
+   db, err := OpenNamedDB(RT.DB(), RT.DatabaseURI, name, location)
+   if err != nil {
+      return
+   }
+   dbt := db.DefaultDBThread()
+   types := RT.StoredTypes()
+   for _, typ := range types {
+      var migration *SchemaMigration
+      migration, err = dbt.MigrateTypeTable(th, typ, false)
+      if err != nil {
+         return
+      }
+      if migration != nil {
+         Logln(ALWAYS_, migration)
+      }
+      err = dbt.EnsureTypeTable(typ)
+      if err != nil {
+         return
+      }
+   }
+   for _, typ := range types {
+      err = dbt.EnsureAttributeAndRelationTables(typ)
+      if err != nil {
+         return
+      }
+   }
+   err = RT.AttachDB(name, db)
+   return
+}
+
+/*
+Takes a consistent snapshot of the named database ("" for the main database) while it is in use,
+and writes it to a new database file at path. A relative path is relative to the directory of the main database.
+*/
+func BackupDatabase(name string, path string) (err error) {
+   EnsureDatabase()
+   db, found := RT.NamedDB(name)
+   if ! found {
+      err = fmt.Errorf("No database named '%s' is attached.", name)
+      return
+   }
+   err = db.Backup(DataFilePath(RT.DatabaseURI, path))
+   return
+}
+
+/*
+Takes a consistent snapshot of the database file at dbPath, which need not be in use by this program,
+and writes it to a new database file at path.
+*/
+func BackupDatabaseFile(dbPath string, path string) (err error) {
+   if _, err = os.Stat(dbPath); err != nil {
+      return
+   }
+   err = OpenDB(dbPath).Backup(path)
+   return
+}
+
+/*
+Begins shipping the write-ahead log of the main database, which must be a sqlite database, to the directory,
+every interval, for as long as the program runs.
+*/
+func ShipWAL(dir string, interval time.Duration) (err error) {
+   EnsureDatabase()
+   db, isSqlite := RT.DB().(*SqliteDB)
+   if ! isSqlite {
+      err = errors.New("WAL shipping needs a sqlite database.")
+      return
+   }
+   _, err = db.ShipWAL(dir, interval)
+   return
+}
+
+/*
+Exports the objects, collections and object names of the thread's database to a JSON or NDJSON dump file at path.
+A relative path is relative to the directory of the main database. Returns the number of objects and collections exported.
+*/
+func ExportDatabase(th InterpreterThread, path string) (n int, err error) {
+   EnsureDatabase()
+   if th.Transaction() != nil {
+      err = errors.New("Cannot export the database within a transaction.")
+      return
+   }
+   n, err = Export(th, DataFilePath(RT.DatabaseURI, path))
+   return
+}
+
+/*
+Imports a JSON or NDJSON dump made by ExportDatabase into the thread's database, giving the objects new ids.
+A relative path is relative to the directory of the main database. Returns the number of objects and collections imported.
+*/
+func ImportDatabase(th InterpreterThread, path string) (n int, err error) {
+   EnsureDatabase()
+   if th.Transaction() != nil {
+      err = errors.New("Cannot import into the database within a transaction.")
+      return
+   }
+   n, err = Import(th, DataFilePath(RT.DatabaseURI, path))
+   return
+}
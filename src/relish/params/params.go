@@ -22,4 +22,34 @@ var DbMaxConnections = 1
 var DbMaxReadConnections = -1  
 
 // Maximum write-connection pool size
-var DbMaxWriteConnections = -1  
\ No newline at end of file
+var DbMaxWriteConnections = -1  
+
+// Maximum number of times a transaction (or a BEGIN or COMMIT statement within it) is tried
+// when it fails because the database is busy or locked by another connection.
+var DbTxMaxTries = 10  
+
+// Delay (milliseconds) before the first retry of a busy or locked transaction. 
+// Doubles on each subsequent retry, up to DbTxMaxBackoffMs, plus a random factor.
+var DbTxBackoffMs = 100  
+
+// Maximum delay (milliseconds) between retries of a busy or locked transaction.
+var DbTxMaxBackoffMs = 6000  
+
+// Default maximum duration (seconds) of a transaction. A transaction still in progress 
+// after this long is rolled back by the transaction watchdog. 0 means no timeout.
+var DbTxTimeoutSeconds = 0  
+
+// Optimistic concurrency mode. Each persisted object has a version number in the db, which is checked and
+// incremented before the object's first write in a transaction, and a transaction which wrote to objects 
+// changed by another connection fails to commit. Threads reading objects which are dirty in another 
+// transaction do not wait for it to end, and read the objects' committed attribute values. Deleting
+// an object also checks and increments its version. All processes sharing a db should use the same mode.
+var DbOptimisticConcurrency = false  
+
+// Audit log mode. Each change to an attribute of a persistent object is also recorded, with its
+// transaction id, old and new values, time, and actor (see setActor), in the append-only RChangeLog table of the db.
+var DbAuditLog = false  
+
+// Schema migration dry run. When a package is loaded, the migrations of the db tables of its types whose
+// declarations have changed are printed, but not done, and no tables are created. The program is not run.
+var DbMigrationDryRun = false
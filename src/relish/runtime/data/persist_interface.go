@@ -10,6 +10,10 @@ package data
    persist_interface.go -  Abstraction of persistence service for relish data.
 */
    
+import (
+   "time"
+)
+
 
 type StatementGroup struct {
 	Statements []*SqlStatement
@@ -93,6 +97,56 @@ type DB interface {
    Returns a DBConnectionThread that is created upon creation of the db proxy. 
    */
    DefaultDBThread() DBT    
+
+   /*
+   The database whose connections this database uses: the database it is attached to, if it shares
+   that database's connections, or else itself. A transaction spans the databases which share connections.
+   */
+   ConnectionDB() DB
+
+   /*
+   Copies the database, as a consistent snapshot taken while it is in use, to a new database file at path.
+   */
+   Backup(path string) error
+}
+
+/*
+A change to an attribute of a persistent object, as recorded in the change log in audit log mode.
+Values are in the text form in which they are stored in the database. Object values are given as 
+the object's dbid.
+*/
+type ChangeLogEntry struct {
+   TxId int64       // Id of the transaction which made the change, unique in the database. 0 if made outside of a transaction.
+   ObjId int64      // dbid of the changed object (or of the independent collection which was changed)
+   AttrName string  // "" if an independent collection was changed, or for a "CREATE"
+   Op string        // "CREATE", "SET", "UNSET", "ADD", "REMOVE", "CLEAR", or "PUT"
+   Key string       // The map key, for an "ADD" or "PUT" to a map, or the element index in an ordered collection
+   OldVal string
+   HasOldVal bool   // false if the attribute had no value before the change, or the old value is not known
+   NewVal string
+   Time time.Time
+   Actor string     // Who the thread which made the change was acting for. "" if not known.
+}
+
+/*
+The changes which bring the database table of a type, created for an earlier declaration of the type,
+up to date with the type's current attributes.
+*/
+type SchemaMigration struct {
+   Type *RType
+   Changes []string     // Descriptions of the changes, e.g. "add attribute mileage Float"
+   Statements []string  // The SQL statements which migrate the tables
+}
+
+func (m *SchemaMigration) String() string {
+   s := "Migrate the db table of type " + m.Type.Name + ":\n"
+   for _, change := range m.Changes {
+      s += "   " + change + "\n"
+   }
+   for _, statement := range m.Statements {
+      s += "      " + statement + "\n"
+   }
+   return s
 }
 
 type DBT interface {
@@ -102,8 +156,28 @@ type DBT interface {
    EnsureObjectNameTable()
    EnsurePackageTable()
 
+   /*
+   Creates the append-only change log table, used in audit log mode, if it does not exist.
+   */
+   EnsureChangeLogTable()
+
+   /*
+   Creates the table which records the schema of each type's table, used to detect changes to the
+   declarations of types, if it does not exist.
+   */
+   EnsureTypeSchemaTable()
+
    EnsureTypeTable(typ *RType) (err error)
 
+   /*
+   Compares the schema of the type's existing table, as recorded when the table was created or last migrated, 
+   with the type's declared attributes. If they differ, and dryRun is false, migrates the table (and the tables of 
+   renamed attributes) to the new schema, using thread th to call the migration methods of the attributes.
+   Returns the migration, or nil if the table does not exist yet or is up to date.
+   Call before EnsureTypeTable, which then records the type's new schema.
+   */
+   MigrateTypeTable(th InterpreterThread, typ *RType, dryRun bool) (migration *SchemaMigration, err error)
+
 	 ExecStatements(statementGroup *StatementGroup) (err error)
 	 ExecStatement(statement string, args ...interface{}) (err error)	
 	 PersistSetAttr(th InterpreterThread, obj RObject, attr *AttributeSpec, val RObject, attrHadValue bool) (err error)
@@ -160,6 +234,52 @@ type DBT interface {
 	
     FetchN(typ *RType, oqlSelectionCriteria string, queryArgs []RObject, coll RCollection, radius int, objs *[]RObject) (mayContainProxies bool, err error) 
 
+    /*
+    Runs an aggregate query, such as "make, count(*), avg(speed) where speed > 0 group by make", against the 
+    objects of the type in the database (restricted to the members of coll if coll is non-nil), without fetching 
+    the objects. Returns the rows of selected values. 
+    Each value is a primitive value, an object (for a selected object-valued attribute), or NIL. 
+    */
+    FetchAggregate(typ *RType, oqlAggregateQuery string, queryArgs []RObject, coll RCollection) (rows [][]RObject, err error)
+
+    /*
+    Like FetchN, but returns a Cursor which reads the selected objects from the database batchSize at a time,
+    as they are asked for, rather than all at once. Any limit and offset in the selection criteria apply.
+    If after is not nil, only the objects which come after the object after, in the order given by the 
+    selection criteria, are selected. This allows paging through the results, a page per query.
+    */
+    OpenCursor(typ *RType, oqlSelectionCriteria string, queryArgs []RObject, coll RCollection, radius int, batchSize int, after RObject) (cursor Cursor, err error)
+
+    /*
+    Reads at most n elements of the persistent big list, starting at index start, from the list's
+    ordered collection table. Non-primitive elements are returned as proxies.
+    */
+    FetchBigListElements(list BigList, start int64, n int) (elements []RObject, err error)
+
+    /*
+    Returns the index of the first occurrence of the value in the persistent big list, at or after index start,
+    or -1 if the value is not in the list.
+    */
+    BigListIndex(list BigList, val RObject, start int64) (index int64, err error)
+
+    /*
+    Returns the changes to the attributes of the persistent object that were recorded in the change log 
+    (in audit log mode), oldest first.
+    */
+    ChangeHistory(obj RObject) (changes []*ChangeLogEntry, err error)
+
+    /*
+    Versions of Fetch, FetchByName and FetchN which return snapshots of the objects as they were at the
+    time asOf, reconstructed by undoing the changes recorded since then in the change log (in audit log mode).
+    A snapshot is a new, non-persistent object. It is not the object's in-memory instance, and changing it
+    does not change the database.
+    Objects which had not yet been created at time asOf are not found. 
+    FetchNAsOf evaluates the selection criteria against the objects as they were at time asOf.
+    */
+    FetchAsOf(id int64, radius int, asOf time.Time) (obj RObject, err error)
+    FetchByNameAsOf(name string, radius int, asOf time.Time) (obj RObject, err error)
+    FetchNAsOf(typ *RType, oqlSelectionCriteria string, queryArgs []RObject, coll RCollection, radius int, asOf time.Time, objs *[]RObject) (err error)
+
     /*
     Close the connection to the database.
     */
@@ -167,39 +287,64 @@ type DBT interface {
 
 
 	/*
-    Begins an immediate-mode database transaction.	
-    Implementations may also first lock program access to the database to ensure a single goroutine at a time
-    runs a database transaction and no other goroutines interact with the database at all during the transaction.
+    Begins a database transaction of the specified type ("DEFERRED", "IMMEDIATE", or "EXCLUSIVE").	
+    A "DEFERRED" transaction is used for reading only. Implementations may let it proceed concurrently with
+    other transactions, reading from a consistent snapshot of the database taken as the transaction begins.
+    Implementations must ensure that writing transactions are serialized.
     Accepts InterpreterThread so it can AllowGC() while waiting to Begin the Transaction.    
 	*/
 	 BeginTransaction(transactionType string) (err error)
 
 	/*
-    Implementations may also unlock program access to the database to allow other goroutines to use the database.
+    Implementations may also release the thread's db connection for use by other goroutines.
     Accepts InterpreterThread so it can AllowGC() while waiting to use db.   
 	*/
 	 CommitTransaction() (err error)
 
 	/*
-    Implementations may also unlock program access to the database to allow other goroutines to use the database.
+    Implementations may also release the thread's db connection for use by other goroutines.
 	*/
 	 RollbackTransaction() (err error)
 	
 	/*
-	Lock the dbMutex.
-	Used to ensure exlusive access to db for single db reads / writes 
+    Associates the in-progress database transaction with tx, the in-memory transaction which complements it,
+    so that if tx times out, the transaction watchdog can interrupt and roll back the database transaction.
+	*/
+	 BindTransaction(tx *RTransaction)
+
+	/*
+    Begins a nested transaction scope, by creating a savepoint with the given name, within the 
+    in-progress transaction.
+	*/
+	 BeginSavepoint(name string) (err error)
+
+	/*
+    Ends the nested transaction scope of the named savepoint, keeping its changes as part of 
+    the enclosing scope.
+	*/
+	 ReleaseSavepoint(name string) (err error)
+
+	/*
+    Undoes the database changes made since the named savepoint began, and ends the savepoint's
+    nested transaction scope.
+	*/
+	 RollbackToSavepoint(name string) (err error)
+	
+	/*
+	Claim the use of a db connection suitable for writing, for this thread-of-connection.
+	Used to ensure exclusive use of a connection for single db writes 
 	for which we don't want to manually start a long-running transaction.
 	(Or may also be used in multi-threaded extensions of the Begin,Commit,RollbackTransaction methods.)
 
-	This method will block until no other goroutine is using the database.
+	This method will block until a suitable connection is available.
   Accepts InterpreterThread so it can AllowGC() while waiting to use db.
 	*/
 	 UseDB()
 	
 	/*
-	If this db connection or thread-of-connection has no further interest in owning the database,
-	unlock the dbMutex.
-	If this db connection or thread-of-connection still has an interest in owning the database,
+	If this db connection or thread-of-connection has no further interest in its db connection,
+	release the connection.
+	If this db connection or thread-of-connection still has an interest in the db connection,
 	returns false. A series of calls to this should eventually return true meaning no further
 	calls to it by this thread-of-connection are appropriate until UseDB() is called again.
 	*/	
@@ -239,6 +384,22 @@ type Connection interface {
   Close() error
 
   Id() int  // A simple integer that is incremented each time a connection is created.
+
+  /*
+  The number of rows changed by the most recent INSERT, UPDATE, or DELETE statement on this connection.
+  */
+  RowsAffected() int
+
+  /*
+  Copies the database of the schema name ("main" unless attached), as a consistent snapshot, to a new database
+  file at path, while the database is in use, using the database's online backup facility.
+  */
+  Backup(schema string, path string) error
+
+  /*
+  Makes the statement which is running on the connection, if any, fail soon. Can be called from any goroutine.
+  */
+  Interrupt()
 }
 
 /* 
@@ -304,6 +465,19 @@ type InterpreterThread interface {
     connection is available for use.
   */
 	DBT() DBT
+
+  /*
+  The thread's db connection thread for the database attached under the name, creating it if need be.
+  The name "" is the main database. Returns an error if no database of that name is attached.
+  */
+  DatabaseThread(name string) (dbt DBT, err error)
+
+  /*
+  Makes the database attached under the name the one which DBT() accesses, so the one in which this thread
+  dubs, summons, queries and persists objects. The name "" is the main database.
+  Returns the name of the database which was in use.
+  */
+  UseDatabase(name string) (previous string, err error)
 	
 	/*
 	Will be "" unless we are in a stack-unrolling panic, in which case, should be the error message.
@@ -329,6 +503,22 @@ type InterpreterThread interface {
 
   SetTransaction(tx *RTransaction)
 
-}
+  /*
+  Who the thread is acting for, e.g. the user who made the web request it is handling, or "" if not known.
+  Recorded with each change in the audit log.
+  */
+  Actor() string
 
+  SetActor(actor string)
+
+}
 
+/*
+Reads the objects selected by a database query, a batch at a time.
+*/
+type Cursor interface {
+	/*
+	Returns the next batch of objects, or an empty batch if all of the objects have been read.
+	*/
+	NextBatch() (objs []RObject, err error)
+}
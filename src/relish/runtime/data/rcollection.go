@@ -97,7 +97,7 @@ type RCollection interface {
 	*/
 	Transaction() *RTransaction 
 
-	SetTransaction(tx *RTransaction)    
+	SetTransaction(tx *RTransaction) error
 }
 
 /*
@@ -1843,44 +1843,89 @@ func (o rlist) IsZero() bool {
 /*
 A list of relish objects constrained to be of some type.
 Implements RCollection
-An rbiglist is designed to represent a very large list of elements.
+An rbiglist is designed to represent a very large list of elements, such as an event log, which cannot fit in memory.
 As such, it has no in-memory array-based list, but only uses a database representation of the
-list, with metadata in memory.
+list (the ordered collection table of the list or of the multi-valued attribute), with metadata in memory.
 
+Elements are read from the database a page at a time, and a few recently used pages are cached.
+Adding, inserting, setting and removing elements update only the length and the page cache in memory; 
+the database table is then updated by the persistence layer, in the same way as for any other list.
 
+Until the list (or the object whose attribute it is) becomes persistent, its elements are kept in memory,
+in the unstored slice. Once the elements have been written to the database, the persistence layer calls
+SetStored, and from then on the elements are only in the database.
+
+A big list cannot be a sorting list.
 */
 type rbiglist struct {
 	rcollection
 	len int64
 
-	v *RVector   // TODO DELETE THIS FIELD
+	isStored bool  // The elements are in the database table, not in unstored.
+	unstored []RObject  // The elements, while the list is not yet persistent.
+
+	pages map[int64][]RObject  // Cached pages of elements, by page number. 
+	pageUse []int64  // The numbers of the cached pages, least recently used first.
+}
+
+/*
+The number of elements read from the database at a time by a big list.
+*/
+const BIGLIST_PAGE_SIZE = 64
+
+/*
+The maximum number of pages of elements cached by a big list.
+*/
+const BIGLIST_MAX_CACHED_PAGES = 8
 
+/*
+A very large list, whose elements are in the database rather than in memory.
+*/
+type BigList interface {
+	List
 
+	/*
+	Called by the persistence layer when the elements of the list are in the database table,
+	either because they have just been written there, or because the list has been fetched.
+	length is the number of elements in the table. Discards any elements held in memory.
+	*/
+	SetStored(length int64)
 }
 
 /*
-Return the underlying collection.
-TODO DELETE THIS
+Returns a copy of the elements of the list, in a vector. 
+Note that this reads the whole list into memory.
 */
 func (s *rbiglist) Vector() *RVector {
-	return s.v
+	var fakeThread FakeInterpreterThread	
+	v := RVector(s.AsSlice(fakeThread))
+	return &v
 }
 
-
+/*
+Shows at most the first 100 elements, since the list may be too big to read in full.
+*/
 func (o *rbiglist) String() string {
+   n := o.Length()
+   more := ""
+   if n > 100 {
+   	  n = 100
+   	  more = fmt.Sprintf(" ... (%d elements)", o.Length())
+   }
+   var fakeThread FakeInterpreterThread
    s := ""
-   if o.Length() > 4 {
+   if n > 4 {
 	   sep := "\n   ["
-	   for obj := range o.Iter(nil) {
-	      s += sep + obj.String()
+	   for i := 0; i < int(n); i++ {
+	      s += sep + o.At(fakeThread, i).String()
 	      sep = "\n      "
 	   }
-	   s += "\n   ]"
+	   s += more + "\n   ]"
    	} else { // Horizontal layout
 	   s = "["
 	   sep := ""
-	   for obj := range o.Iter(nil) {
-	      s += sep + obj.String()
+	   for i := 0; i < int(n); i++ {
+	      s += sep + o.At(fakeThread, i).String()
 	      sep = "   "
 	   }
 	   s += "]"
@@ -1889,13 +1934,77 @@ func (o *rbiglist) String() string {
 }
 
 func (o *rbiglist) Debug() string {
-	return fmt.Sprintf("%s len:%d\n%s",  (&(o.rcollection)).Debug() , o.Length(),o.String())
+	return fmt.Sprintf("%s len:%d stored:%v cachedPages:%d\n%s",  (&(o.rcollection)).Debug() , o.Length(), o.isStored, len(o.pages), o.String())
+}
+
+/*
+Returns the db thread to read the list's elements with. If th is nil, uses the runtime's db thread.
+*/
+func (s *rbiglist) dbt(th InterpreterThread) DBT {
+	if th == nil {
+		return RT.DBT()
+	}
+	return th.DBT()
+}
+
+/*
+Returns the page of elements with the page number, from the cache, or read from the database
+and cached.
+*/
+func (s *rbiglist) page(th InterpreterThread, pageNum int64) []RObject {
+	if page, found := s.pages[pageNum]; found {
+		for i, n := range s.pageUse {
+			if n == pageNum {
+				s.pageUse = append(append(s.pageUse[:i:i], s.pageUse[i+1:]...), pageNum)
+				break
+			}
+		}
+		return page
+	}
+	page, err := s.dbt(th).FetchBigListElements(s, pageNum * BIGLIST_PAGE_SIZE, BIGLIST_PAGE_SIZE)
+	if err != nil {
+		panic(fmt.Sprintf("Error fetching big list elements [%d:%d]: %s", pageNum * BIGLIST_PAGE_SIZE, (pageNum + 1) * BIGLIST_PAGE_SIZE, err))
+	}
+	if s.pages == nil {
+		s.pages = make(map[int64][]RObject)
+	}
+	if len(s.pageUse) >= BIGLIST_MAX_CACHED_PAGES {
+		delete(s.pages, s.pageUse[0])
+		s.pageUse = s.pageUse[1:]
+	}
+	s.pages[pageNum] = page
+	s.pageUse = append(s.pageUse, pageNum)
+	return page
+}
+
+/*
+Discards the cached pages from the page containing element i onwards, whose elements have moved.
+*/
+func (s *rbiglist) uncacheFrom(i int64) {
+	firstPage := i / BIGLIST_PAGE_SIZE
+	pageUse := s.pageUse[:0]
+	for _, n := range s.pageUse {
+		if n >= firstPage {
+			delete(s.pages, n)
+		} else {
+			pageUse = append(pageUse, n)
+		}
+	}
+	s.pageUse = pageUse
+}
+
+func (s *rbiglist) SetStored(length int64) {
+	s.isStored = true
+	s.unstored = nil
+	s.len = length
+	s.pages = nil
+	s.pageUse = nil
 }
 
 /*
 TODO: Reconsider the kludge of accepting a nil interpreterThread.
 Currently used in String method to list the elements.
-TODO biglist not sure if works if nil interpreterThread
+If th is nil, elements are read with the runtime's db thread.
 */
 func (c *rbiglist) Iter(th InterpreterThread) <-chan RObject {
 
@@ -1904,7 +2013,7 @@ func (c *rbiglist) Iter(th InterpreterThread) <-chan RObject {
 		var obj RObject
 		var length int = int(c.len)
 		for i := 0; i < length ; i++ {
-			obj = c.At(th, i)  // TODO What happens if th is nil???
+			obj = c.At(th, i)  
 			ch <- obj
 		}
 		close(ch)
@@ -1912,202 +2021,167 @@ func (c *rbiglist) Iter(th InterpreterThread) <-chan RObject {
 	return ch
 }
 
-
-
-
+/*
+Returns an ordinary in-memory list of the elements in the index range.
+*/
 func (c *rbiglist) Slice(th InterpreterThread, start int, end int) (slice List) {
 	slice = c.Type().Prototype().(List)
 	length := int(c.Length())	
 	if end < 0 {
 		end = length + end
 	}
-
-	defer sliceErrHandle(start,end, length)		
-
-	var obj RObject
+	if start < 0 || start > end || end > length {
+		rterr.Stopf("Error in list slice [%d:%d]: index out of range. List length is %d.",start,end,length)
+	}
 
     for i := start; i < end; i++ {
-    	obj = c.At(th, i)                // AtProxy(th, i) method ???
+    	slice.AddSimple(c.At(th, i))
     }
-
-    slice.AddSimple(obj) 
-
-    // What is the status of setMayContainProxies
-
 	return	
 }	
 
-
-	
-
-
-
-
-	    // substring or slice
-	/*
-		slice s String start Int end Int > String
-		
-		slice s String start Int > String		
-
-Counts in bytes.
-
-func builtinStringSlice(th InterpreterThread, objects []RObject) []RObject {
-	s := string(objects[0].(String))
-	start := int(objects[1].(Int))
-	length := len(s)
-	end := length
-	if len(objects) == 3 {
-		end = int(objects[2].(Int))
-		if end < 0 {
-			end = length + end
-		}
-	}
-	substr := s[start:end]
-    return []RObject{String(substr)}
-}
-*/
-
-
 /*
 If the object is not already marked as reachable, flag it as reachable.
 Return whether we had to flag it as reachable. false if was already marked reachable.
-Does not mark elements, since they are not wholesale fetched.
+Marks the elements held in memory, that is the unstored elements and those in cached pages.
 */
 func (o *rbiglist) Mark() bool { 
    if ! (&(o.rcollection.robject)).Mark() {
       return false
    }
+   for _, obj := range o.unstored {
+   	  obj.Mark()
+   }
+   for _, page := range o.pages {
+      for _, obj := range page {
+         obj.Mark()
+      }
+   }
    return true
 }
 
 /*
 Insert the element at the specified index. Shift elements from that index on to have
 the next higher index.
-TODO: DOES NOT HANDLE PERSISTENCE YET !!!!
+The caller is responsible for persisting the insertion, as with Add.
 */
 func (s *rbiglist)	Insert(i int, val RObject) (newLen int) {
-	if s.IsSorting() {
-        rterr.Stop("Cannot insert at specified index into a sorting list.")				
+	if i < 0 || int64(i) > s.len {
+       rterr.Stopf("Error in list-element insert: index %d is out of range.",i)		
 	}
-	if s.v == nil {
-		if i != 0 {
-           rterr.Stopf("Error in list-element insert: index %d is out of range.",i)			
-		}
-		newLen = s.AddSimple(val)
+	if ! s.isStored {
+		s.unstored = append(s.unstored, nil)
+		copy(s.unstored[i+1:], s.unstored[i:])
+		s.unstored[i] = val
 	} else {
-
-       s.v.Insert(i, val)
-       newLen = len(*(s.v))
+		s.uncacheFrom(int64(i))
 	}
+	s.len++
+	newLen = int(s.len)
 	return
 }
 
 /*
 Set the element at index i to be the specified value.
-Note: It is illegal to call this on a IsSorting() == true list. Not enforced. Watch out!
-
-TODO: Note that the current use of this e.g. Interpreter.go 2662 is not persisting the set operation.
+The caller is responsible for persisting the change.
 */
 func (s *rbiglist) Set(i int, val RObject) {	
-   if s.v == nil {
+	if i < 0 || int64(i) >= s.len {
       rterr.Stopf("Error in list-element set: index %d is out of range.",i)
-   }   
-   s.v.Set(i, val)
+	}   
+	if ! s.isStored {
+		s.unstored[i] = val
+	} else if page, found := s.pages[int64(i) / BIGLIST_PAGE_SIZE]; found {
+		page[int64(i) % BIGLIST_PAGE_SIZE] = val
+	}
 }
 
-
+/*
+Only valid for a big list which is not yet persistent.
+*/
 func (s *rbiglist) ReplaceContents(objs []RObject) {
-
-	var rv RVector = RVector(objs)
-	s.v = &rv
+	if s.isStored {
+		rterr.Stop("Cannot replace the contents of a persistent big list.")
+	}
+	s.unstored = objs
+	s.len = int64(len(objs))
 }
 
+/*
+Note that this reads the whole list into memory.
+*/
 func (s *rbiglist) AsSlice(th InterpreterThread) []RObject {
-	// s.deproxify(th)
-	if s.v == nil {
-		return []RObject{}
+	objs := make([]RObject, s.len)
+	for i := range objs {
+		objs[i] = s.At(th, i)
 	}
-	return []RObject(*(s.v))
+	return objs
 }
 
 func (s *rbiglist) Contains(th InterpreterThread, obj RObject) bool {
-	if s.v == nil {
-		return false
-	} 
-	for _,element := range s.AsSlice(th) {
-       if obj == element {
-       	   return true
-       }
-	}
-    return false
+	return s.Index(obj, 0) >= 0
 }
 
-
-
-
 func (s *rbiglist) Iterable() (interface{},error) {
 	var fakeThread FakeInterpreterThread
 	return s.AsSlice(fakeThread),nil
 }
 
-// RT.SetEvalContext(obj, context)
-// defer RT.UnsetEvalContext(obj)
-// context := RT.GetEvalContext(obj)	
-
 func (s *rbiglist) Add(obj RObject, context MethodEvaluationContext) (added bool, newLen int) {	
-
-	if s.v == nil {
-		s.v = new(RVector)
-	}
-	s.v.Push(obj)
-
-	if s.IsSorting() && ! s.IsSortingDeferred() {
-		RT.SetEvalContext(s, context)
-		defer RT.UnsetEvalContext(s)
-		// s.deproxify(context.InterpThread())
-		sort.Sort(s)
-	}
 	added = true
-	newLen = s.v.Len()
+	newLen = s.AddSimple(obj)
 	return
 }
 
+/*
+Appends the element. If the list is persistent, the caller is responsible for persisting the addition.
+*/
 func (s *rbiglist) AddSimple(obj RObject) (newLen int) {
-
-	if s.v == nil {
-		s.v = new(RVector)
+	if ! s.isStored {
+		s.unstored = append(s.unstored, obj)
+	} else if page, found := s.pages[s.len / BIGLIST_PAGE_SIZE]; found {
+		s.pages[s.len / BIGLIST_PAGE_SIZE] = append(page, obj)
 	}
-	s.v.Push(obj)
-	newLen = s.v.Len()
+	s.len++
+	newLen = int(s.len)
 	return
 }
 
 func (s *rbiglist) At(th InterpreterThread, i int) RObject {
-
-    defer vectorAtErrHandle(i, s.v)
-	obj := s.v.At(i).(RObject)
+	if i < 0 || int64(i) >= s.len {
+		panic(fmt.Sprintf("Error: index [%d] is out of range. Collection length is %d.", i, s.len))
+	}
+	if ! s.isStored {
+		return s.unstored[i]
+	}
+	page := s.page(th, int64(i) / BIGLIST_PAGE_SIZE)
+	j := int64(i) % BIGLIST_PAGE_SIZE
+	if j >= int64(len(page)) {
+		panic(fmt.Sprintf("Error fetching list element [%v]: not found in database.", i))
+	}
+	obj := page[j]
 	if obj.IsProxy() {
 		var err error
 		proxy := obj.(Proxy)
-		obj, err = th.DBT().Fetch(int64(proxy), 0)
+		obj, err = s.dbt(th).Fetch(int64(proxy), 0)
 		if err != nil {
 			panic(fmt.Sprintf("Error fetching list element [%v]: %s", i, err))
 		}
-		(*(s.v))[i] = obj		
+		page[j] = obj
 	}
 	return obj
 }
 
 func (s *rbiglist) IsInsertable() bool {
-   return ! s.IsSorting()
+   return true
 }
 
 func (s *rbiglist) IsIndexSettable() bool {
-    return ! s.IsSorting()
+    return true
 }
 
 func (s *rbiglist) Len() int {
-	return s.v.Len()
+	return int(s.len)
 }
 
 func (s *rbiglist) Less(i, j int) bool {
@@ -2276,49 +2350,61 @@ type sortOp {
 
 /*
 Not valid to call on indexes >= the length of the collection.
+A persistent big list cannot be sorted in place.
 */
 func (s *rbiglist) Swap(i, j int) {
-	s.v.Swap(i, j)
+	if s.isStored {
+		rterr.Stop("Cannot sort a persistent big list. Use a query with an order by clause instead.")
+	}
+	s.unstored[i], s.unstored[j] = s.unstored[j], s.unstored[i]
 }
 
 /*
 Returns the index of the first-found occurrence of the argument object with the search beginning at the start index.
+If the list is persistent, the search is done in the database.
 */
 func (s *rbiglist) Index(obj RObject, start int) int {
-	if s.v != nil {
-		ln := len(*(s.v))
-		for i := start; i < ln; i++ {
-			if obj == s.v.At(i) {
+	if ! s.isStored {
+		for i := start; i < len(s.unstored); i++ {
+			if obj == s.unstored[i] {
 				return i
 			}
 		}
+		return -1
 	}
-	return -1
+	index, err := s.dbt(nil).BigListIndex(s, obj, int64(start))
+	if err != nil {
+		panic(fmt.Sprintf("Error searching big list: %s", err))
+	}
+	return int(index)
 }
 
+/*
+Removes the first occurrence of the object. If the list is persistent, the caller is responsible for 
+persisting the removal, at the returned index.
+*/
 func (s *rbiglist) Remove(obj RObject) (removed bool, removedIndex int) {
-	
-	if s.v == nil {
-		removedIndex = -1
+	removedIndex = s.Index(obj, 0)
+	if removedIndex < 0 {
+		return
+	}
+	if ! s.isStored {
+		s.unstored = append(s.unstored[:removedIndex], s.unstored[removedIndex+1:]...)
 	} else {
-		// s.deproxify(nil)
-		removedIndex = s.Index(obj, 0)
-		if removedIndex >= 0 {
-			s.v.Delete(removedIndex)
-			removed = true
-		}
+		s.uncacheFrom(int64(removedIndex))
 	}
+	s.len--
+	removed = true
 	return
 }
 
 func (s *rbiglist) ClearInMemory() {
-
-	if s.v != nil {
-		s.v = s.v.Resize(0, s.v.Cap())
-	}
+	s.unstored = nil
+	s.len = 0
+	s.pages = nil
+	s.pageUse = nil
 }
 
-
 /*
 */
 func (c *rbiglist) FromMapListTree(th InterpreterThread, tree interface{}) (obj RObject, err error) {
@@ -2345,7 +2431,7 @@ func (c *rbiglist) FromMapListTree(th InterpreterThread, tree interface{}) (obj
 /*
    Constructor
 */
-func (rt *RuntimeEnv) Newrbiglist(elementType *RType, minCardinality, maxCardinality int64, owner RObject, attr *AttributeSpec, sortWith *sortOp) (coll List, err error) {
+func (rt *RuntimeEnv) Newrbiglist(elementType *RType, minCardinality, maxCardinality int64, owner RObject, attr *AttributeSpec) (coll List, err error) {
 	typ, err := rt.GetListType(elementType)
 	if err != nil {
 		return nil, err
@@ -2353,7 +2439,7 @@ func (rt *RuntimeEnv) Newrbiglist(elementType *RType, minCardinality, maxCardina
 	if maxCardinality == -1 {
 		maxCardinality = MAX_CARDINALITY
 	}
-	lst := &rbiglist{rcollection{robject{rtype: typ}, minCardinality, maxCardinality, elementType, owner, attr, sortWith, false, nil}, 0, nil}
+	lst := &rbiglist{rcollection: rcollection{robject{rtype: typ}, minCardinality, maxCardinality, elementType, owner, attr, nil, false, nil}}
 	lst.rcollection.robject.this = lst
 	coll = lst	
 	if ! markSense {
@@ -2369,12 +2455,12 @@ func (rt *RuntimeEnv) Newrbiglist(elementType *RType, minCardinality, maxCardina
 }
 
 func (s rbiglist) Length() int64   { return s.len }
-func (s rbiglist) Cap() int64      { if s.v == nil { return 0}; return int64(s.v.Cap()) }
+func (s rbiglist) Cap() int64      { return s.len }
 func (s rbiglist) IsMap() bool     { return false }
 func (s rbiglist) IsSet() bool     { return false }
 func (s rbiglist) IsList() bool    { return true }
-func (s rbiglist) IsOrdered() bool { return true } // This may change!! Depends on presence of an ordering function
-func (s rbiglist) IsSorting() bool { return s.sortWith != nil }
+func (s rbiglist) IsOrdered() bool { return true } 
+func (s rbiglist) IsSorting() bool { return false }
 func (s rbiglist) IsCardOk() bool  { return s.Length() >= s.MinCard() && s.Length() <= s.MaxCard() }
 
 func (o rbiglist) IsZero() bool {
@@ -3142,6 +3228,25 @@ func (f FakeInterpreterThread) DBT() DBT {
    return RT.DBT()	
 }
 
+func (f FakeInterpreterThread) DatabaseThread(name string) (dbt DBT, err error) {
+   if name == "" {
+      dbt = RT.DBT()
+      return
+   }
+   db, found := RT.NamedDB(name)
+   if ! found {
+      err = fmt.Errorf("No database named '%s' is attached.", name)
+      return
+   }
+   dbt = db.DefaultDBThread()
+   return
+}
+
+func (f FakeInterpreterThread) UseDatabase(name string) (previous string, err error) {
+   err = errors.New("Cannot change the database used by a collection iteration.")
+   return
+}
+
 func (f FakeInterpreterThread) Err() string {
 	return ""
 }
@@ -3181,4 +3286,11 @@ func (f FakeInterpreterThread) Transaction() *RTransaction {
 }
 
 func (f FakeInterpreterThread) SetTransaction(tx *RTransaction) {
+}
+
+func (f FakeInterpreterThread) Actor() string {
+   return ""
+}
+
+func (f FakeInterpreterThread) SetActor(actor string) {
 }
\ No newline at end of file
@@ -23,6 +23,7 @@ import (
 	"crypto/rand"
 	"strings"
 	. "relish/dbg"	
+	"relish/params"
 )
 
 ///////////////////////////////////////////////////////////////////////////
@@ -242,6 +243,8 @@ type robject struct {
 	uuid  []byte // will be 16 bytes
 	this  RObject
 	flags byte
+	db byte  // which of the program's databases the object is stored in. See RuntimeEnv.DBIndex. Fits in padding.
+	version uint32  // version of the object's db state this was loaded from or last committed as. Fits in padding.
 	transaction *RTransaction  // which db transaction this is dirty in, or nil
 }
 
@@ -575,29 +578,48 @@ func (o *robject) RestoreIdsAndFlags(id, id2 int64, flags int) {
 */
 type Persistable interface {
 	RestoreIdsAndFlags(id, id2 int64, flags int)
-	SetTransaction(tx *RTransaction)  // Set to nil to end association with a transaction
+	Version() uint32  // Version number of the object's state in the db. Used in optimistic concurrency mode.
+	SetVersion(version uint32)
+	SetTransaction(tx *RTransaction) error  // Set to nil to end association with a transaction. Fails if tx has ended.
 	Transaction() *RTransaction  // Transaction in which this is dirty, or nil, or RolledBackTransaction
 	RollBack()  // set the transaction to the RolledBackTransaction.
 	IsRolledBack() bool
 	This() RObject
 	Refresh(th InterpreterThread) error  // Re-fetch the object's state and associations from the database. Clear IsRolledBack() status.
+	StoredDB() int  // Which of the program's databases the object was fetched from or stored in. See RuntimeEnv.DBIndex.
+	SetStoredDB(dbIndex int)
 }
 
 func (o robject) Type() *RType { return o.rtype }
 
+func (o robject) StoredDB() int { return int(o.db) }
+func (o *robject) SetStoredDB(dbIndex int) { o.db = byte(dbIndex) }
 
 
-func (o *robject) SetTransaction(tx *RTransaction) {
-   o.transaction = tx
+
+func (o *robject) SetTransaction(tx *RTransaction) (err error) {
    if tx != nil && tx != RolledBackTransaction {
-   	   tx.DirtyObjects[o.This().(Persistable)] = true
+   	   err = tx.MarkDirty(o.This().(Persistable))
+   	   if err != nil {  // The transaction has ended. The object must not be left pointing at it.
+   	   	  return
+   	   }
    }
+   o.transaction = tx
+   return
 }
 
 func (o *robject) Transaction() *RTransaction {
    return o.transaction
 }
 
+func (o *robject) Version() uint32 {
+   return o.version
+}
+
+func (o *robject) SetVersion(version uint32) {
+   o.version = version
+}
+
 func (o *robject) RollBack() {
 	if o.IsBeingStored() && ! o.IsStoredLocally() {
 //		fmt.Println("Was not stored locally flag.")
@@ -632,6 +654,9 @@ A unitary object. i.e. Not a collection.
 type runit struct {
 	robject
 	attrs []RObject
+	committed []RObject  // In optimistic concurrency mode, while the unit is dirty in a transaction, the attribute
+	                     // values it had when it became dirty. Threads outside the transaction read these.
+	                     // The contents of a multi-valued attribute are not kept. Its collection is waited for.
 }
 
 func (o *runit) Mark() bool {
@@ -641,11 +666,45 @@ func (o *runit) Mark() bool {
 			   val.Mark()
 		    }
 		}
+		o.markCommitted()
 		return true
 	}
 	return false
 }
 
+/*
+Marks the committed attribute values, which other threads may still be reading, as reachable.
+*/
+func (o *runit) markCommitted() {
+	for _,val := range o.committed {
+		if val != nil {
+		   val.Mark()
+	    }
+	}
+}
+
+/*
+In optimistic concurrency mode, when the unit becomes dirty in a transaction, also keeps a copy of its
+attribute values, so that threads outside the transaction read its committed state until the transaction ends.
+*/
+func (o *runit) SetTransaction(tx *RTransaction) (err error) {
+   err = o.robject.SetTransaction(tx)
+   if err != nil {
+      return
+   }
+   if tx == nil || tx == RolledBackTransaction {
+      o.committed = nil
+   } else if params.DbOptimisticConcurrency && o.committed == nil {
+      o.committed = append([]RObject(nil), o.attrs...)
+   }
+   return
+}
+
+func (o *runit) RollBack() {
+	o.robject.RollBack()
+	o.committed = nil
+}
+
 /*
 Create the array of references to attribute values.
 */
@@ -657,6 +716,11 @@ func (r *runit) initialize(n int) {
    Refresh attributes from database.
 */
 func (u *runit) Refresh(th InterpreterThread) (err error) {
+	// The committed values are still valid if the transaction is only being rolled back to a savepoint.
+	isOwnTransaction := u.transaction != nil && u.transaction != RolledBackTransaction && u.transaction == th.Transaction()
+	if ! isOwnTransaction {
+		u.committed = nil
+	}
 	n := len(u.attrs)
 	for i := 0; i < n; i++ {
 		u.attrs[i] = nil
@@ -931,7 +995,7 @@ func (rt *RuntimeEnv) NewObject(typeName string) (RObject, error) {
 	   if typ.IsNative {
 		   // w := &GoWrapper{nil,typ,0}
 
-	       w := &GoWrapper{runit{robject{rtype: typ},nil},nil}
+	       w := &GoWrapper{runit{robject: robject{rtype: typ}},nil}
 
            w.initialize(typ.TotalAttributeCount)
 
@@ -953,7 +1017,7 @@ func (rt *RuntimeEnv) NewObject(typeName string) (RObject, error) {
     }
 	// It's not a primitive type nor a parameterized type
 
-	unit := &runit{robject{rtype: typ},nil}
+	unit := &runit{robject: robject{rtype: typ}}
 
 // NEED TO FIND OUT HOW BIG TO MAKE THE INSTANCE HERE ! HOW MANY ATTRIBUTES
 ///////////////////////////
@@ -205,7 +205,9 @@ func (rt *RuntimeEnv) CreatePackage(path string, isStandardLibPackage bool) *RPa
 		}
 		pkg.ShortName = candidateShortName
 	
-	    rt.DBT().RecordPackageName(pkg.Name, pkg.ShortName)
+	    for _, dbt := range rt.DBTs() {
+	       dbt.RecordPackageName(pkg.Name, pkg.ShortName)
+	    }
     	if err != nil {
 		   panic(fmt.Sprintf("Unable to record package name in db: %v", err))
 	    }	
@@ -89,6 +89,7 @@ var CollectionType *RType
 var SetType *RType
 var ListType *RType
 var MapType *RType
+var ResultSetType *RType
 
 var InChannelType *RType
 var OutChannelType *RType
@@ -187,6 +188,7 @@ func (rt *RuntimeEnv) createPrimitiveTypes() {
 	SetType, _ = rt.CreateType("Set", "", []string{"Collection"})	
 	ListType, _ = rt.CreateType("List", "", []string{"Collection"})	
 	MapType, _ = rt.CreateType("Map", "", []string{"Collection"})	
+	ResultSetType, _ = rt.CreateType("ResultSet", "", []string{"Collection"})	
 
 	// Do a need Iterable and InChannel <: Iterable, Collection <: Iterable
 	
@@ -325,7 +327,7 @@ func (t *RType) Zero() RObject {
 	    if t.IsNative {
 	       // z = &GoWrapper{nil,t,0}		
 
-	       gw := &GoWrapper{runit{robject{rtype: t},nil},nil}
+	       gw := &GoWrapper{runit{robject: robject{rtype: t}},nil}
 
            gw.initialize(t.TotalAttributeCount)
 
@@ -425,11 +427,33 @@ type RInChannel interface {
 	From() RObject
 }
 
+/*
+A channel, other than a Channel of Go values, such as a web socket, to which the <- operator sends values.
+The thread which sends is passed so that the value can be encoded.
+*/
+type ROutChannel interface {
+	RObject
+
+	Send(th InterpreterThread, val RObject)
+}
+
+/*
+A channel which buffers the values received from it, such as a Channel, a TimeChannel, or a web socket,
+whose buffer holds the client's messages not yet received by the handler method.
+*/
+type RBufferedChannel interface {
+	RObject
+
+	Length() int64
+	Cap() int64
+}
+
 
 
 type Channel struct {
 	Ch chan RObject
 	ElementType *RType
+	Done chan struct{} // closed when the channel's receiver has gone away, such as the client of a streamed response
 }
 
 func (c *Channel) From() RObject {	
@@ -440,6 +464,32 @@ func (c *Channel) To(val RObject) {
    c.Ch <- val
 }
 
+/*
+Panicked with, in a thread which sends to a channel whose receiver has gone away, such as a channel
+streamed to a web client which has disconnected, or a closed web socket, so that the thread ends
+instead of waiting forever. Recovered from where the thread began.
+*/
+type ReceiverGone struct{}
+
+var channelAbandonMutex sync.Mutex
+
+/*
+Records that nothing will receive from the channel any more, so that a thread which sends to it,
+or is blocked sending to it, stops instead of waiting forever.
+*/
+func (c *Channel) Abandon() {
+   if c.Done == nil {
+      return
+   }
+   channelAbandonMutex.Lock()
+   defer channelAbandonMutex.Unlock()
+   select {
+   case <-c.Done:
+   default:
+      close(c.Done)
+   }
+}
+
 // TODO
 
 func (p Channel) IsZero() bool {
@@ -4499,6 +4549,7 @@ func (o *GoWrapper) Mark() bool {
    o.ToggleMarked()
    Logln(GC3_,"Mark(): Marked with",o.IsMarked())
 	o.markAttributes()   
+	o.markCommitted()
    return true
 }
 
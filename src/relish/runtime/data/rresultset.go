@@ -0,0 +1,158 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+// this package implements data persistence in the relish language environment.
+
+package data
+
+/*
+   rresultset.go - a lazily read collection of the objects selected by a database query.
+*/
+
+import (
+	"errors"
+	"fmt"
+	. "relish/dbg"
+)
+
+/*
+A collection of the objects selected by a database query, which reads the objects from the database
+a batch at a time, as the result set is iterated over, rather than all at once. 
+A result set can be iterated over only once, from start to end. 
+It is intended for use in a relish for loop:
+
+   for car in stream "vehicles/Car" "speed > 60 order by speed desc"
+      ...
+
+Each batch is read in a read transaction of its own, unless the thread is in a transaction, so the batches
+may see different snapshots of the database. See package relish/runtime/persist, query_cursor.go.
+*/
+type ResultSet interface {
+	RCollection
+
+	/*
+	Returns the next object of the result set, reading the next batch of objects from the database if necessary.
+	Returns nil if there are no more objects.
+	*/
+	Next() (obj RObject, err error)
+}
+
+type rresultset struct {
+	rcollection
+	cursor Cursor
+	batch []RObject // the objects read from the database but not yet returned by Next
+	rest []RObject // the objects read by Iter, which its goroutine yields
+	n int64 // the number of objects returned so far by Next
+	done bool
+}
+
+/*
+   Constructor
+*/
+func (rt *RuntimeEnv) NewResultSet(elementType *RType, cursor Cursor) ResultSet {
+	rs := &rresultset{rcollection: rcollection{robject{rtype: ResultSetType}, 0, MAX_CARDINALITY, elementType, nil, nil, nil, false, nil}, cursor: cursor}
+	rs.rcollection.robject.this = rs
+	if ! markSense {
+	    rs.SetMarked()
+	}	
+	return rs
+}
+
+func (rs *rresultset) Next() (obj RObject, err error) {
+	if len(rs.batch) == 0 && ! rs.done {
+		rs.batch, err = rs.cursor.NextBatch()
+		if err != nil {
+			return
+		}
+		if len(rs.batch) == 0 {
+			rs.done = true
+		}
+	}
+	if len(rs.batch) == 0 {
+		return
+	}
+	obj = rs.batch[0]
+	rs.batch[0] = nil
+	rs.batch = rs.batch[1:]
+	rs.n++
+	return
+}
+
+/*
+Yields the objects not yet returned by Next. 
+The objects are all read from the database before Iter returns, by the calling thread, since the cursor
+reads them with the thread's db connection thread, which the thread goes on using while it receives
+the objects. A for loop over a result set alone does not use Iter, but reads the objects a batch at a time.
+*/
+func (rs *rresultset) Iter(th InterpreterThread) <-chan RObject {
+	var rest []RObject
+	for {
+		obj, err := rs.Next()
+		if err != nil {
+			Logln(ALWAYS_, "Error reading result set:", err)
+			break
+		}
+		if obj == nil {
+			break
+		}
+		rest = append(rest, obj)
+	}
+	rs.rest = rest
+	ch := make(chan RObject)
+	go func() {
+		for _, obj := range rest {
+			ch <- obj
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+/*
+A result set is consumed by iterating over it, so it cannot be searched.
+*/
+func (rs *rresultset) Contains(th InterpreterThread, obj RObject) bool {
+	panic("Cannot test whether a result set contains an object. Use asList on a query instead.")
+}
+
+/*
+Marks the objects which have been read from the database but not yet returned.
+*/
+func (rs *rresultset) Mark() bool { 
+   if ! (&(rs.rcollection.robject)).Mark() {
+      return false
+   }
+   for _, obj := range rs.batch {
+   	  obj.Mark()
+   }
+   for _, obj := range rs.rest {
+   	  obj.Mark()
+   }
+   return true
+}
+
+func (rs *rresultset) FromMapListTree(th InterpreterThread, tree interface{}) (obj RObject, err error) {
+   err = errors.New("Cannot unmarshal JSON into a ResultSet.")
+   return
+}
+
+func (rs *rresultset) String() string {
+	return fmt.Sprintf("ResultSet of %s (%d read)", rs.ElementType().ShortName(), rs.n)
+}
+
+func (rs *rresultset) Debug() string {
+	return fmt.Sprintf("%s %s", (&(rs.rcollection)).Debug(), rs.String())
+}
+
+/*
+The number of objects returned so far by iterating over the result set.
+*/
+func (rs rresultset) Length() int64   { return rs.n }
+func (rs rresultset) Cap() int64      { return rs.n }
+func (rs rresultset) IsMap() bool     { return false }
+func (rs rresultset) IsSet() bool     { return false }
+func (rs rresultset) IsList() bool    { return false }
+func (rs rresultset) IsOrdered() bool { return false } // Not index-accessible, though iterated over in query order. 
+func (rs rresultset) IsSorting() bool { return false }
+func (rs rresultset) IsCardOk() bool  { return true }
+func (rs rresultset) IsZero() bool    { return rs.done && len(rs.batch) == 0 }
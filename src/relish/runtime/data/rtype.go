@@ -643,6 +643,20 @@ type AttributeSpec struct {
 
 	PublicReadable, PackageReadable, SubtypeReadable, PublicWriteable, PackageWriteable, SubtypeWriteable bool
 	Reassignable, CollectionMutable, Mutable, DeeplyMutable                                               bool
+
+	IsIndexed bool  // The attribute's database column has an index.
+	IsUnique bool   // The attribute's database column has a unique index.
+	IndexWith []*AttributeSpec  // Other attributes of the type whose columns follow this one's in a composite index.
+
+	FormerName string  // The name of the attribute before it was renamed, whose stored values become this attribute's.
+	MigrationMethod *RMultiMethod  // Unary method which converts each stored value when the attribute's db schema is migrated.
+}
+
+/*
+Whether the attribute has a database index, declared by an indexed or unique annotation.
+*/
+func (attr *AttributeSpec) HasIndex() bool {
+	return attr.IsIndexed || attr.IsUnique
 }
 
 func (attr *AttributeSpec) IsRelation() bool {
@@ -787,6 +801,18 @@ func (end RelEnd) DbColumnDef() (colDef string) {
 	return
 }
 
+/*
+   Return the names of the sqlite column or columns of a primitive-type attribute.
+*/
+func (end RelEnd) DbColumnNames() []string {
+	if end.Type == ComplexType || end.Type == Complex32Type {
+		return []string{end.Name + "_r", end.Name + "_i"}
+	} else if end.Type == TimeType {
+		return []string{end.Name, end.Name + "_loc"}
+	}
+	return []string{end.Name}
+}
+
 /*
    Return the sqlite column definition of the part-end of a multi-valued primitive-type attribute
    or the value column(s) of a primitive value collection.
@@ -973,6 +999,40 @@ func (rt *RuntimeEnv) CreateType(typeName string, typeShortName string, parentTy
 
 }
 
+/*
+Finds the non-primitive datatype with the name. The name may be the full name of the type, its name qualified
+by the short name of its package (e.g. vehicles/Car), or just its local name (e.g. Car) if that is unambiguous.
+*/
+func (rt *RuntimeEnv) LookupType(name string) (typ *RType, err error) {
+	if typ = rt.Types[name]; typ != nil && ! typ.IsPrimitive {
+		return
+	}
+	typ = nil
+	var candidates []string
+	for _, t := range rt.Types {
+		if t.IsPrimitive {
+			continue
+		}
+		if t.ShortName() == name {
+			return t, nil
+		}
+		if LocalTypeName(t.ShortName()) == name {
+			typ = t
+			candidates = append(candidates, t.ShortName())
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		err = fmt.Errorf("'%s' is not the name of a datatype", name)
+	case 1:
+	default:
+		typ = nil
+		sort.Strings(candidates)
+		err = fmt.Errorf("'%s' is ambiguous. It could be any of %s", name, strings.Join(candidates, ", "))
+	}
+	return
+}
+
 /*
 Debugging function.
 */
@@ -1217,6 +1277,11 @@ func (rt *RuntimeEnv) CreateAttribute(typeName1 string,
 	    collectionMutable,
 	    mutable,
 	    deeplyMutable,
+	    false,
+	    false,
+	    nil,
+	    "",
+	    nil,
 	}
 
     if orderFuncOrAttrName != "" {
@@ -14,6 +14,7 @@ package data
 import (
 	"fmt"
 	. "relish/dbg"
+	"relish/params"
 	"sync"
 	"strings"
 	"errors"
@@ -60,7 +61,12 @@ type RuntimeEnv struct {
 	idGen     *IdGenerator
 	db        DB
 
-	dbt       DBT  // A database connection thread. 
+	dbt       DBT  // A database connection thread.
+
+	namedDBs map[string]DB  // Databases attached to the running program by name, in addition to the main database.
+	namedDBNames []string   // Their names, in order of attachment.
+	storedTypes []*RType    // The types whose tables have been ensured in the main database, so must be in the named ones.
+	dbsMutex sync.RWMutex
 
 	DatabaseURI string  // filepath (or eventually some other kind of db connection uri) of the database for persisting relish objects
 	Loader PackageLoader  // Loads code packages into the runtime.
@@ -280,6 +286,7 @@ func NewRuntimeEnv() *RuntimeEnv {
 		idGen:         NewIdGenerator(),
 		// attributes:    make(map[*AttributeSpec]map[RObject]RObject),
 		context:       make(map[string]RObject),
+		namedDBs:      make(map[string]DB),
 		constants:     make(map[string]RObject),
 		privateConstantPackage:     make(map[string]*RPackage),		
 		inTransit:     make(map[RObject]uint32),
@@ -312,6 +319,117 @@ func (rt *RuntimeEnv) SetDB(db DB) {
 	rt.dbt = db.DefaultDBThread()
 }
 
+/*
+Attaches a database to the running program under the name, in addition to the main database.
+Returns an error if a database of that name is already attached.
+*/
+func (rt *RuntimeEnv) AttachDB(name string, db DB) (err error) {
+	rt.dbsMutex.Lock()
+	defer rt.dbsMutex.Unlock()
+	if _, found := rt.namedDBs[name]; found {
+		err = fmt.Errorf("A database named '%s' is already attached.", name)
+		return
+	}
+	if len(rt.namedDBNames) == MAX_NAMED_DBS {
+		err = fmt.Errorf("Cannot attach database '%s'. At most %d databases can be attached.", name, MAX_NAMED_DBS)
+		return
+	}
+	rt.namedDBs[name] = db
+	rt.namedDBNames = append(rt.namedDBNames, name)
+	return
+}
+
+/*
+The database attached under the name. The name "" is the main database.
+*/
+func (rt *RuntimeEnv) NamedDB(name string) (db DB, found bool) {
+	if name == "" {
+		return rt.db, rt.db != nil
+	}
+	rt.dbsMutex.RLock()
+	defer rt.dbsMutex.RUnlock()
+	db, found = rt.namedDBs[name]
+	return
+}
+
+/*
+The maximum number of databases which can be attached to the running program, so that an object can record
+which database it is stored in, in a byte.
+*/
+const MAX_NAMED_DBS = 255
+
+/*
+Which of the program's databases db is: 0 for the main database, or n for the nth database attached.
+-1 if db is not yet attached.
+*/
+func (rt *RuntimeEnv) DBIndex(db DB) int {
+	if db == rt.db {
+		return 0
+	}
+	rt.dbsMutex.RLock()
+	defer rt.dbsMutex.RUnlock()
+	for i, name := range rt.namedDBNames {
+		if rt.namedDBs[name] == db {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+/*
+The name of the database whose DBIndex is dbIndex. "" is the main database.
+*/
+func (rt *RuntimeEnv) DBName(dbIndex int) string {
+	if dbIndex == 0 {
+		return ""
+	}
+	rt.dbsMutex.RLock()
+	defer rt.dbsMutex.RUnlock()
+	return rt.namedDBNames[dbIndex-1]
+}
+
+/*
+The names of the attached databases, in order of attachment. Does not include the main database.
+*/
+func (rt *RuntimeEnv) DBNames() []string {
+	rt.dbsMutex.RLock()
+	defer rt.dbsMutex.RUnlock()
+	return append([]string(nil), rt.namedDBNames...)
+}
+
+/*
+The default database connection threads of the main database and of each attached database.
+Schema changes are made through these, so that every database has the tables of the stored types.
+*/
+func (rt *RuntimeEnv) DBTs() []DBT {
+	rt.dbsMutex.RLock()
+	defer rt.dbsMutex.RUnlock()
+	dbts := []DBT{rt.dbt}
+	for _, name := range rt.namedDBNames {
+		dbts = append(dbts, rt.namedDBs[name].DefaultDBThread())
+	}
+	return dbts
+}
+
+/*
+Records that the tables of the type have been ensured in the databases.
+*/
+func (rt *RuntimeEnv) AddStoredType(typ *RType) {
+	rt.dbsMutex.Lock()
+	defer rt.dbsMutex.Unlock()
+	rt.storedTypes = append(rt.storedTypes, typ)
+}
+
+/*
+The types whose tables have been ensured in the databases, in the order they were ensured.
+A database attached later must have the tables of these types.
+*/
+func (rt *RuntimeEnv) StoredTypes() []*RType {
+	rt.dbsMutex.RLock()
+	defer rt.dbsMutex.RUnlock()
+	return append([]*RType(nil), rt.storedTypes...)
+}
+
 
 
 
@@ -329,14 +447,33 @@ func (rt *RuntimeEnv) AttrVal(th InterpreterThread, obj RObject, attr *Attribute
 
 var txOpsMutex sync.Mutex
 
+/*
+Re-fetches the object's state from the database.
+If the object was dirty in the thread's own transaction (and was flagged for re-load because 
+the transaction was rolled back to a savepoint), it remains dirty in that transaction.
+Can only be called while txOpsMutex is locked.
+*/
+func refreshPersistable(th InterpreterThread, obj Persistable) (err error) {
+	tx := obj.Transaction()
+	err = obj.Refresh(th)
+	if err == nil && tx != nil && tx != RolledBackTransaction && th != nil && tx == th.Transaction() {
+		err = obj.SetTransaction(tx)
+	}
+	return
+}
+
 /*
 Tries to make sure that if we are in a thread other than one participating in the transaction,
 the attribute value we will get will wait til a transaction that the
 object is dirty in commits or rolls back.
 Also makes sure that if the object state is invalid, due to a rolled back transaction it was dirty in,
 that the object state is first restored from database before getting the attribute value.
+Returns the attribute values to read. In optimistic concurrency mode, a thread does not wait for
+another thread's transaction, and reads the committed values of an object which is dirty in it.
+The contents of its multi-valued attributes are not kept, so it waits for their collections.
+See ensureMemoryTransactionConsistency3.
 */
-func ensureMemoryTransactionConsistency1(th InterpreterThread, unit *runit) {
+func ensureMemoryTransactionConsistency1(th InterpreterThread, unit *runit) (attrs []RObject) {
 	defer Un(Trace(PERSIST_TR,"ensureMemoryTransactionConsistency1"))
 	th.AllowGC()
 	// fmt.Println("txOpsMutex.Lock() ing etc1")
@@ -345,11 +482,15 @@ func ensureMemoryTransactionConsistency1(th InterpreterThread, unit *runit) {
     th.DisallowGC()
     defer txOpsMutex.Unlock()
 
+    if unit.committed != nil && th.Transaction() != unit.transaction {  // Dirty in another thread's transaction
+       return unit.committed
+    }
+
 
 //   fmt.Println("unit.transaction=",unit.transaction)
    if unit.transaction == RolledBackTransaction || unit.IsLoadNeeded() {  // The object state has been rolled back.
 //       fmt.Println("Yeah! Refreshing")
-       err := unit.Refresh(th)    // TODO Should we really refresh if not supposed to check persistence??
+       err := refreshPersistable(th, unit)    // TODO Should we really refresh if not supposed to check persistence??
                          // What does refresh mean if the object was only persisted in the db
                          // in the rolled back transaction. Need to abort the refresh before updating
                          // the attribute value.
@@ -361,27 +502,25 @@ func ensureMemoryTransactionConsistency1(th InterpreterThread, unit *runit) {
 
     if unit.transaction != nil {  // Is definitely stored locally. TODO Note the race condition here.
 
-    	if th != nil && th.Transaction() != unit.transaction {
+    	// In optimistic concurrency mode, the object has no committed values only if it was created in the transaction.
+    	if th != nil && th.Transaction() != unit.transaction && ! params.DbOptimisticConcurrency {
            tx := unit.transaction	
            txOpsMutex.Unlock()
 	       // fmt.Println("txOpsMutex.Unlock() etc1 diff xactions")
 
-           th.AllowGC()
-	       // fmt.Println("tx.RLock() ing etc1")           
-           tx.RLock()  // Block til the transaction that the object is dirty in commits or rolls back.
-	       // fmt.Println("tx.Lock() ed etc1")            
-           th.DisallowGC()
-           tx.RUnlock()
-	       // fmt.Println("tx.Unlock() etc1")            
+           awaitErr := tx.Await(th, unit)  // Block til the transaction that the object is dirty in commits, rolls back, or times out.
            th.AllowGC()
 	       // fmt.Println("txOpsMutex.Lock() ing etc1 #2")           
            txOpsMutex.Lock()
 	       // fmt.Println("txOpsMutex.Lock() ed etc1 #2")            
            th.DisallowGC()
+           if awaitErr != nil {
+              panic(awaitErr)
+           }
         }
         if unit.transaction == RolledBackTransaction || unit.IsLoadNeeded() {  // The object state has been rolled back.
 
-	       err := unit.Refresh(th)    // TODO Should we really refresh if not supposed to check persistence??
+	       err := refreshPersistable(th, unit)    // TODO Should we really refresh if not supposed to check persistence??
 	                         // What does refresh mean if the object was only persisted in the db
 	                         // in the rolled back transaction. Need to abort the refresh before updating
 	                         // the attribute value.
@@ -393,6 +532,7 @@ func ensureMemoryTransactionConsistency1(th InterpreterThread, unit *runit) {
     } 
 
 	// fmt.Println("txOpsMutex.Unlock() etc1 end")    
+    return unit.attrs
 }
 
 func ensureMemoryTransactionConsistency2(th InterpreterThread, unit *runit) (err error) {
@@ -403,7 +543,7 @@ func ensureMemoryTransactionConsistency2(th InterpreterThread, unit *runit) (err
     defer txOpsMutex.Unlock()
     if unit.transaction == RolledBackTransaction || unit.IsLoadNeeded() {
 // LOCK    	
-    	err = unit.Refresh(th)  // Should set the unit's transaction to nil
+    	err = refreshPersistable(th, unit)  // Should set the unit's transaction to nil
     	if err != nil {
     		return
     	}
@@ -414,30 +554,28 @@ func ensureMemoryTransactionConsistency2(th InterpreterThread, unit *runit) (err
 // LOCK
 
     	if unit.transaction == nil {  // Marking this object as dirty in the thread's transaction.
-    		unit.transaction = th.Transaction()
-
-     		unit.SetTransaction(th.Transaction())
-   	
-
+     		err = unit.SetTransaction(th.Transaction())  // Fails if the transaction has timed out.
     	} else if unit.transaction != th.Transaction() {
             err = errors.New("object transaction is different than goroutine's transaction.")
             return
+    	} else if th.Transaction().Savepoint() != nil {  // Already dirty, but may be newly dirty in a nested scope.
+            err = th.Transaction().MarkDirty(unit)
     	}
 // UNLOCK
 
     } else if unit.transaction != nil {  // This is a thread that is not participating in the transaction.
         tx := unit.transaction
         txOpsMutex.Unlock() 
-        th.AllowGC()               
-        tx.RLock()   // Wait for the transaction to commit or rollback.
-        th.DisallowGC()
-        tx.RUnlock()
+        awaitErr := tx.Await(th, unit)   // Wait for the transaction to commit, rollback, or time out.
         th.AllowGC()         
         txOpsMutex.Lock()
         th.DisallowGC()        
+        if awaitErr != nil {
+           return awaitErr
+        }
         if unit.transaction == RolledBackTransaction || unit.IsLoadNeeded() {  // The object state has been rolled back.
 
-	       err := unit.Refresh(th)    // TODO Should we really refresh if not supposed to check persistence??
+	       err := refreshPersistable(th, unit)    // TODO Should we really refresh if not supposed to check persistence??
 	                         // What does refresh mean if the object was only persisted in the db
 	                         // in the rolled back transaction. Need to abort the refresh before updating
 	                         // the attribute value.
@@ -456,6 +594,9 @@ the attribute value we will get will wait til a transaction that the
 object is dirty in commits or rolls back.
 Also makes sure that if the object state is invalid, due to a rolled back transaction it was dirty in,
 that the object state is first restored from database before getting the attribute value.
+Unlike a unit's attribute values, a collection's contents are not kept as they were before it became dirty,
+so a thread waits for another thread's transaction in optimistic concurrency mode too.
+Called when the collection is read as the value of a multi-valued attribute.
 */
 func ensureMemoryTransactionConsistency3(th InterpreterThread, coll RCollection) {
 	defer Un(Trace(PERSIST_TR,"ensureMemoryTransactionConsistency3"))		
@@ -466,7 +607,7 @@ func ensureMemoryTransactionConsistency3(th InterpreterThread, coll RCollection)
 
    if coll.Transaction() == RolledBackTransaction || coll.IsLoadNeeded() {  // The object state has been rolled back.
 
-       err := coll.(Persistable).Refresh(th)    // TODO Should we really refresh if not supposed to check persistence??
+       err := refreshPersistable(th, coll.(Persistable))    // TODO Should we really refresh if not supposed to check persistence??
                          // What does refresh mean if the object was only persisted in the db
                          // in the rolled back transaction. Need to abort the refresh before updating
                          // the attribute value.
@@ -481,17 +622,17 @@ func ensureMemoryTransactionConsistency3(th InterpreterThread, coll RCollection)
     	if th != nil && th.Transaction() != coll.Transaction() {
            tx := coll.Transaction()	
            txOpsMutex.Unlock()
-           th.AllowGC()            
-           tx.RLock()  // Block til the transaction that the object is dirty in commits or rolls back.
-           th.DisallowGC()            
-           tx.RUnlock()
+           awaitErr := tx.Await(th, coll)  // Block til the transaction that the object is dirty in commits, rolls back, or times out.
            th.AllowGC()             
            txOpsMutex.Lock()
            th.DisallowGC()             
+           if awaitErr != nil {
+              panic(awaitErr)
+           }
         }
         if coll.Transaction() == RolledBackTransaction || coll.IsLoadNeeded() {  // The object state has been rolled back.
 
-	       err := coll.(Persistable).Refresh(th)    // TODO Should we really refresh if not supposed to check persistence??
+	       err := refreshPersistable(th, coll.(Persistable))    // TODO Should we really refresh if not supposed to check persistence??
 	                         // What does refresh mean if the object was only persisted in the db
 	                         // in the rolled back transaction. Need to abort the refresh before updating
 	                         // the attribute value.
@@ -510,31 +651,33 @@ func ensureMemoryTransactionConsistency4(th InterpreterThread, coll RCollection)
     th.DisallowGC()        
     defer txOpsMutex.Unlock()
     if coll.Transaction() == RolledBackTransaction || coll.IsLoadNeeded() {   	
-    	err = coll.(Persistable).Refresh(th)  // Should set the unit's transaction to nil
+    	err = refreshPersistable(th, coll.(Persistable))  // Should set the unit's transaction to nil
     	if err != nil {
     		return
     	}   	
     }
     if th.Transaction() != nil {
     	if coll.Transaction() == nil {  // Marking this object as dirty in the thread's transaction.
-    		coll.SetTransaction(th.Transaction())
+    		err = coll.SetTransaction(th.Transaction())  // Fails if the transaction has timed out.
     	} else if coll.Transaction() != th.Transaction() {
             err = errors.New("object transaction is different than goroutine's transaction.")
             return
+    	} else if th.Transaction().Savepoint() != nil {  // Already dirty, but may be newly dirty in a nested scope.
+            err = th.Transaction().MarkDirty(coll.(Persistable))
     	}
     } else if coll.Transaction() != nil {  // This is a thread that is not participating in the transaction.
         tx := coll.Transaction()
         txOpsMutex.Unlock()  
-        th.AllowGC()              
-        tx.RLock()   // Wait for the transaction to commit or rollback.
-        th.DisallowGC()         
-        tx.RUnlock()
+        awaitErr := tx.Await(th, coll)   // Wait for the transaction to commit, rollback, or time out.
         th.AllowGC()           
         txOpsMutex.Lock()
         th.DisallowGC()          
+        if awaitErr != nil {
+           return awaitErr
+        }
         if coll.Transaction() == RolledBackTransaction || coll.IsLoadNeeded() {  // The object state has been rolled back.
 
-	       err := coll.(Persistable).Refresh(th)    // TODO Should we really refresh if not supposed to check persistence??
+	       err := refreshPersistable(th, coll.(Persistable))    // TODO Should we really refresh if not supposed to check persistence??
 	                         // What does refresh mean if the object was only persisted in the db
 	                         // in the rolled back transaction. Need to abort the refresh before updating
 	                         // the attribute value.
@@ -583,15 +726,20 @@ func (rt *RuntimeEnv) AttrValue(th InterpreterThread, obj RObject, attr *Attribu
         unit = &(obj.(*GoWrapper).runit)    	
     }
 
+    attrs := unit.attrs
     if obj.IsBeingStored() {
        // fmt.Println("AttrValue - ensureMemoryTransactionConsistency1") 
-       ensureMemoryTransactionConsistency1(th, unit)
+       attrs = ensureMemoryTransactionConsistency1(th, unit)
        // fmt.Println("done AttrValue - ensureMemoryTransactionConsistency1") 
     }
 
-    val = unit.attrs[i]
+    val = attrs[i]
 
     if val != nil {
+    	if coll, isCollection := val.(RCollection); isCollection && coll.IsBeingStored() {
+    	   // The contents of a multi-valued attribute may be dirty in another thread's transaction.
+    	   ensureMemoryTransactionConsistency3(th, coll)
+    	}
     	found = true
     	return
     }
@@ -784,6 +932,7 @@ func (rt *RuntimeEnv) SetAttr(th InterpreterThread, obj RObject, attr *Attribute
 
     if obj.IsBeingStored() {
        ensureMemoryTransactionConsistency2(th, unit)    	
+       recordChange(th, unit, attr.Part.Name)
     }
 
 
@@ -801,7 +950,10 @@ func (rt *RuntimeEnv) SetAttr(th InterpreterThread, obj RObject, attr *Attribute
 
 
 	if obj.IsBeingStored() {
-		th.DBT().PersistSetAttr(th, obj, attr, val, found)
+		err = th.DBT().PersistSetAttr(th, obj, attr, val, found)
+		if err != nil {
+			return
+		}
 	}
 
 	if ! isInverse && attr.Inverse != nil {
@@ -849,6 +1001,7 @@ func (rt *RuntimeEnv) AddToAttr(th InterpreterThread, obj RObject, attr *Attribu
     if obj.IsBeingStored() {
        unit := obj.(*runit)    	
        ensureMemoryTransactionConsistency2(th, unit)    	
+       recordChange(th, unit, attr.Part.Name)
     }	
 
 	// Note: Need to put in a check here as to whether the collection accepts NIL elements, and
@@ -961,6 +1114,44 @@ func (rt *RuntimeEnv) AddToCollection(coll AddableCollection, val RObject, typeC
 	return
 }
 
+/*
+Inserts val into the list at index i. The list may be an independent list or the value of a multi-valued attribute.
+If the list or its owner object is persistent, the insertion is persisted.
+*/
+func (rt *RuntimeEnv) InsertIntoCollection(th InterpreterThread, coll Insertable, i int, val RObject) (err error) {
+
+	if !val.Type().LessEq(coll.ElementType()) {
+		err = fmt.Errorf("Cannot insert a value of type '%v' into a list with element-type constraint '%v'.", val.Type(),coll.ElementType())
+		return
+	}
+	if coll.IsSorting() {
+		err = errors.New("Cannot insert into a sorting list at an index.")
+		return
+	}
+
+	owner := coll.Owner()
+	if owner != nil {
+		if owner.IsBeingStored() {
+			unit := owner.(*runit)
+			ensureMemoryTransactionConsistency2(th, unit)
+			recordChange(th, unit, coll.Attribute().Part.Name)
+		}
+	} else if coll.IsBeingStored() {
+		ensureMemoryTransactionConsistency4(th, coll)
+	}
+
+	coll.Insert(i, val)
+
+	if owner != nil {
+		if owner.IsBeingStored() {
+			err = th.DBT().PersistAddToAttr(th, owner, coll.Attribute(), val, i)
+		}
+	} else if coll.IsBeingStored() {
+		err = th.DBT().PersistAddToCollection(th, coll.(AddableCollection), val, i)
+	}
+	return
+}
+
 /*
 Removes val from the multi-valued attribute if val is in the collection. Does nothing and does not complain if val is not in the collection.
 If removePersistent is true, also removes the value from the persistent version of the attribute association.
@@ -1009,6 +1200,7 @@ func (rt *RuntimeEnv) ClearAttr(th InterpreterThread, obj RObject, attr *Attribu
     if obj.IsBeingStored() {
        unit := obj.(*runit)   	
        ensureMemoryTransactionConsistency2(th, unit)    	
+       recordChange(th, unit, attr.Part.Name)
     }	
 
 
@@ -1514,7 +1706,7 @@ func (rt *RuntimeEnv) NewCollection(
 	var sortWith *sortOp
 
    // Why not use
-   // "list" "set" "map" "stringmap" "intmap" "sortedlist" "sortedset" "sortedmap" "sortedstringmap" "sortedintmap"
+   // "list" "biglist" "set" "map" "stringmap" "intmap" "sortedlist" "sortedset" "sortedmap" "sortedstringmap" "sortedintmap"
    // in the type descriptor !!!!!!!
    //
    //
@@ -1579,6 +1771,8 @@ func (rt *RuntimeEnv) NewCollection(
 	switch collectionType {
 	case "list", "sortedlist":
 		objColl, err = rt.Newrlist(elementType, minCardinality, maxCardinality, owner, attribute, sortWith)
+	case "biglist":
+		objColl, err = rt.Newrbiglist(elementType, minCardinality, maxCardinality, owner, attribute)
 	case "set":
 		objColl, err = rt.Newrset(elementType, minCardinality, maxCardinality, owner, attribute)
 	case "sortedset":
@@ -1719,6 +1913,7 @@ func (rt *RuntimeEnv) RemoveFromAttr(th InterpreterThread, obj RObject, attr *At
     if obj.IsBeingStored() {
        unit := obj.(*runit)
        ensureMemoryTransactionConsistency2(th, unit)    	
+       recordChange(th, unit, attr.Part.Name)
     }	
 
 
@@ -1780,6 +1975,7 @@ func (rt *RuntimeEnv) UnsetAttr(th InterpreterThread, obj RObject, attr *Attribu
 
     if obj.IsBeingStored() {
        ensureMemoryTransactionConsistency2(th, unit)    	
+       recordChange(th, unit, attr.Part.Name)
     }	
 
     val := unit.attrs[i] 
@@ -1935,6 +2131,12 @@ type MethodEvaluationContext interface {
 	   Returns the result of the method call.
 	*/
 	EvalMultiMethodCall(mm *RMultiMethod, args []RObject) RObject
+
+	/*
+	   Applies the closure to the argument objects.
+	   Returns the results of the closure application.
+	*/
+	EvalClosureCall(closure *RClosure, args []RObject) []RObject
 	
 	/*
 	   Return the interpreter thread aspect of the evaluation context.
@@ -11,8 +11,9 @@ package data
                     Used as part of a mechanism which keeps the state of in-memory relish data objects
                     consistent with the committed database state of those objects.
 
-                    LIMITATION: Currently, each relish application serializes each database query/update and each
-                    transaction until committed/rolled back.
+                    LIMITATION: Currently, each relish application serializes each database update and each
+                    writing transaction until committed/rolled back. READ (DEFERRED) transactions
+                    run concurrently with these, each reading a snapshot of the database.
                     Also, if an application both reads and modifies relish persistent objects, then only
                     one instance of the application should be run at a time on a given computer with a local db.
 
@@ -26,12 +27,17 @@ package data
 
 import (
    "sync"
+   "sync/atomic"
    "fmt"
+   "strings"
+   "time"
+   "math/rand"
+   "relish/params"
    . "relish/dbg"
  )
 
 
-var transactionIdCounter uint64  // Ops on this assume that they are mutex locked.
+var transactionIdCounter uint64  // Incremented atomically, since transactions are begun by many threads.
 
 /*
 Represents (complements) a database transaction.
@@ -39,25 +45,105 @@ Represents (complements) a database transaction.
 type RTransaction struct {
    DirtyObjects map[Persistable]bool  // Objects dubbed in the scope of this transaction 
                                   // or persistent and having attributes changed 
-                                  // within the scope of this transaction
+                                  // within the scope of this transaction.
+                                  // Guarded by endMutex, since the watchdog may end the transaction at any time.
    mutex sync.RWMutex
    IsRolledBack bool
    Id uint64
    IsInProgress bool
+   savepoints []*Savepoint  // Stack of open nested transaction scopes. Innermost is last.
+
+   Deadline time.Time  // If non-zero, the transaction is rolled back by the watchdog if still in progress at this time.
+   isTimedOut bool     // The watchdog timed out the transaction because it passed its deadline. Guarded by endMutex.
+   endMutex sync.Mutex  // Serializes commit, rollback and time-out of the transaction, and changes to DirtyObjects
+   done chan struct{}   // Closed when the transaction commits, rolls back, or times out
+   interruptDb func()   // Interrupts and rolls back the database transaction. Called by the watchdog on time-out.
+
+   waitersMutex sync.Mutex
+   waiters map[*txWaiter]bool  // Threads currently waiting for the transaction to end
+
+   versionChecks map[Persistable]*versionCheck  // In optimistic concurrency mode, objects whose db version 
+                                                // has been checked and incremented in this transaction
+
+   ChangedAttrs map[Persistable][]string  // Names of the attributes changed in this transaction, of each dirty object
+   hooksRun bool  // The after-commit or after-rollback hooks have been run for this transaction
+
+   changeLogIds map[string]*changeLogId  // In audit log mode, the id of the transaction in the change log
+                                         // of each database, by schema name, that the transaction changed
 }
 
+/*
+The id which a transaction was given in the change log of a database, by inserting a row into its
+RChangeLogTx table. Unlike RTransaction.Id, it is unique among all the processes which share the database.
+*/
+type changeLogId struct {
+   id int64
+   depth int  // Savepoint nesting depth at which the row was inserted
+}
+
+/*
+The outcome of checking, in optimistic concurrency mode, that the version of an object's state in the db
+was still the version that the in-memory object was loaded from, before the object's first write in a transaction.
+*/
+type versionCheck struct {
+   depth int     // Savepoint nesting depth at which the check was made
+   isStale bool  // The db version had been changed by another connection. The transaction must not commit.
+}
+
+/*
+A thread which is waiting for a transaction to end, because it wants to use an object
+which is dirty in the transaction.
+*/
+type txWaiter struct {
+   th InterpreterThread
+   obj RObject
+   since time.Time
+}
+
+func (w *txWaiter) String() string {
+   var methodName string
+   if w.th != nil && w.th.Method() != nil {
+      methodName = w.th.Method().Name()
+   }
+   return fmt.Sprintf("thread %p (in method %s) waiting %v for %v", w.th, methodName, time.Since(w.since), w.obj)
+}
+
+/*
+A nested transaction scope within an RTransaction, corresponding to a database SAVEPOINT.
+*/
+type Savepoint struct {
+   Name string  // The name of the SAVEPOINT in the database
+   DirtyObjects map[Persistable]bool  // Objects dubbed or having attributes changed within the scope of this savepoint.
+                                      // Value is true if the object was not dirty in the transaction before the
+                                      // savepoint began.
+}
+
+/*
+Creates a new in-progress transaction. If the -txtimeout runtime flag was given,
+the transaction has a deadline that many seconds from now.
+*/
 func NewTransaction() (tx *RTransaction) {
-  transactionIdCounter++  
-	tx = &RTransaction{DirtyObjects: make(map[Persistable]bool), Id: transactionIdCounter, IsInProgress: true}
+	tx = &RTransaction{DirtyObjects: make(map[Persistable]bool), 
+	                   Id: atomic.AddUint64(&transactionIdCounter, 1), 
+	                   IsInProgress: true,
+	                   done: make(chan struct{}),
+	                   waiters: make(map[*txWaiter]bool),
+	                   versionChecks: make(map[Persistable]*versionCheck),
+	                   ChangedAttrs: make(map[Persistable][]string)}
   Log(PERSIST_TR2,"%s.Begin()",tx)     
   tx.mutex.Lock()
+  if params.DbTxTimeoutSeconds > 0 {
+     tx.SetTimeout(time.Duration(params.DbTxTimeoutSeconds) * time.Second)
+  }
   return tx
 }
 
 func (tx *RTransaction) String() string {
    status := "in progress"
    if ! tx.IsInProgress {
-       if tx.IsRolledBack {
+       if tx.isTimedOut {
+           status = "timed out"
+       } else if tx.IsRolledBack {
            status = "rolled back"
        } else {
            status = "committed"
@@ -81,6 +167,19 @@ is called.
 
 */
 func (tx *RTransaction) RollBack() {
+  tx.endMutex.Lock()
+  defer tx.endMutex.Unlock()
+  if ! tx.IsInProgress {  // Already rolled back, e.g. by the watchdog
+     return
+  }
+  tx.rollBack()
+}
+
+/*
+Rolls back the in-memory state of the dirty objects and ends the transaction.
+Must be called with the endMutex locked.
+*/
+func (tx *RTransaction) rollBack() {
   Log(PERSIST_TR2,"%s.RollBack()",tx)   
 	for object := range tx.DirtyObjects {
 //       fmt.Println("Rolling back",object)
@@ -88,10 +187,95 @@ func (tx *RTransaction) RollBack() {
        object.RollBack()
 	}
   tx.IsRolledBack = true
+  tx.end()
+}
+
+/*
+Marks the transaction as no longer in progress, releases threads waiting for it to end,
+and stops the watchdog from watching it.
+Must be called with the endMutex locked.
+*/
+func (tx *RTransaction) end() {
   tx.IsInProgress = false
+  close(tx.done)
+  if ! tx.Deadline.IsZero() {
+     watchdogMutex.Lock()
+     delete(watchedTransactions, tx)
+     watchdogMutex.Unlock()
+  }
   tx.mutex.Unlock()
 }
 
+/*
+Blocks until the transaction commits, rolls back, or times out. 
+The thread is waiting to use obj, which is dirty in the transaction.
+Returns an error if the transaction timed out, since the object state may then be
+inconsistent with the db until the thread which owns the transaction rolls it back in the db.
+*/
+func (tx *RTransaction) Await(th InterpreterThread, obj RObject) (err error) {
+  if tx.done == nil {  // RolledBackTransaction
+     return
+  }
+  w := &txWaiter{th: th, obj: obj, since: time.Now()}
+  tx.waitersMutex.Lock()
+  tx.waiters[w] = true
+  tx.waitersMutex.Unlock()
+
+  if th != nil {
+     th.AllowGC()
+  }
+  <-tx.done
+  if th != nil {
+     th.DisallowGC()
+  }
+
+  tx.waitersMutex.Lock()
+  delete(tx.waiters, w)
+  tx.waitersMutex.Unlock()
+
+  if tx.isTimedOut {
+     err = fmt.Errorf("Gave up waiting to use %v. %s timed out and was rolled back.", obj, tx)
+  }
+  return
+}
+
+/*
+Whether the watchdog timed out the transaction because it was still in progress at its deadline.
+*/
+func (tx *RTransaction) IsTimedOut() bool {
+  tx.endMutex.Lock()
+  defer tx.endMutex.Unlock()
+  return tx.isTimedOut
+}
+
+/*
+Returns a *TransactionError if the transaction must not be committed in the database, because it
+timed out, or because, in optimistic concurrency mode, it wrote to objects whose db state had been 
+changed by another connection. Otherwise returns nil. 
+Call before committing the transaction in the database, and roll back the transaction instead if non-nil.
+*/
+func (tx *RTransaction) CommitError() (err error) {
+  tx.endMutex.Lock()
+  err = tx.TimeoutError()
+  tx.endMutex.Unlock()
+  if err == nil {
+     err = tx.ConflictError()
+  }
+  return
+}
+
+/*
+If the transaction timed out, returns a *TransactionError saying so, 
+otherwise returns nil.
+Must be called with the endMutex locked.
+*/
+func (tx *RTransaction) TimeoutError() error {
+  if ! tx.isTimedOut {
+     return nil
+  }
+  return &TransactionError{Kind: TX_TIMED_OUT, Op: "TRANSACTION", Tries: 1, Err: fmt.Errorf("%s passed its deadline %v", tx, tx.Deadline)}
+}
+
 func (tx *RTransaction) RLock() {
   // Log(PERSIST_TR2,"%s.RLock() ing",tx) 
   tx.mutex.RLock()
@@ -104,15 +288,575 @@ func (tx *RTransaction) RUnlock() {
 }
 
 
+/*
+Records that the object is dirty (has been dubbed or has had attributes changed) in this transaction,
+and in its innermost savepoint if one is open.
+Returns an error, and does not record the object, if the transaction has already ended, e.g. because 
+the watchdog timed it out while the thread which owns it was still running.
+*/
+func (tx *RTransaction) MarkDirty(object Persistable) (err error) {
+   tx.endMutex.Lock()
+   defer tx.endMutex.Unlock()
+   if ! tx.IsInProgress {
+      err = tx.endedError()
+      return
+   }
+   _, wasDirty := tx.DirtyObjects[object]
+   tx.DirtyObjects[object] = true
+   if n := len(tx.savepoints); n > 0 {
+      sp := tx.savepoints[n-1]
+      if _, found := sp.DirtyObjects[object]; ! found {
+         sp.DirtyObjects[object] = ! wasDirty
+      }
+   }
+   return
+}
+
+/*
+The error of using a transaction which has ended.
+*/
+func (tx *RTransaction) endedError() error {
+   if err := tx.TimeoutError(); err != nil {
+      return err
+   }
+   return &TransactionError{Kind: TX_FAILED, Op: "TRANSACTION", Tries: 1, Err: fmt.Errorf("%s has already ended", tx)}
+}
+
+/*
+The name that the database savepoint of the next nested transaction scope should have.
+*/
+func (tx *RTransaction) NextSavepointName() string {
+   return fmt.Sprintf("sp%d_%d", tx.Id, len(tx.savepoints) + 1)
+}
+
+/*
+Opens a nested transaction scope. Call this after the database savepoint has been created
+with the name returned by NextSavepointName().
+*/
+func (tx *RTransaction) BeginSavepoint() (sp *Savepoint) {
+   sp = &Savepoint{Name: tx.NextSavepointName(), DirtyObjects: make(map[Persistable]bool)}
+   tx.savepoints = append(tx.savepoints, sp)
+   Log(PERSIST_TR2,"%s.BeginSavepoint() %s",tx,sp.Name)     
+   return
+}
+
+/*
+The innermost open nested transaction scope, or nil if none is open.
+*/
+func (tx *RTransaction) Savepoint() *Savepoint {
+   n := len(tx.savepoints)
+   if n == 0 {
+      return nil
+   }
+   return tx.savepoints[n-1]
+}
+
+/*
+Call this after the innermost savepoint has been released in the database.
+Changes made in its scope become part of the enclosing scope.
+*/
+func (tx *RTransaction) ReleaseSavepoint() {
+   tx.endMutex.Lock()
+   defer tx.endMutex.Unlock()
+   n := len(tx.savepoints)
+   sp := tx.savepoints[n-1]
+   tx.savepoints = tx.savepoints[:n-1]
+   Log(PERSIST_TR2,"%s.ReleaseSavepoint() %s",tx,sp.Name)     
+   if n > 1 {
+      parent := tx.savepoints[n-2]
+      for object, isNew := range sp.DirtyObjects {
+         if _, found := parent.DirtyObjects[object]; ! found {
+            parent.DirtyObjects[object] = isNew
+         }
+      }
+   }
+   for _, check := range tx.versionChecks {
+      if check.depth == n {
+         check.depth = n - 1
+      }
+   }
+   for _, logId := range tx.changeLogIds {
+      if logId.depth == n {
+         logId.depth = n - 1
+      }
+   }
+}
+
+/*
+Call this after the database has been rolled back to the innermost savepoint.
+Objects first dirtied within the savepoint's scope are rolled back and are no longer part of the transaction.
+Objects that were already dirty in the transaction before the savepoint began remain in the transaction,
+but are flagged to have their state re-loaded, from the database state as of the savepoint.
+*/
+func (tx *RTransaction) RollBackToSavepoint() {
+   tx.endMutex.Lock()
+   defer tx.endMutex.Unlock()
+   n := len(tx.savepoints)
+   sp := tx.savepoints[n-1]
+   tx.savepoints = tx.savepoints[:n-1]
+   Log(PERSIST_TR2,"%s.RollBackToSavepoint() %s",tx,sp.Name)     
+   for object, isNew := range sp.DirtyObjects {
+      if isNew {
+         delete(tx.DirtyObjects, object)
+         delete(tx.ChangedAttrs, object)
+         for _, outer := range tx.savepoints {
+            delete(outer.DirtyObjects, object)
+         }
+         object.RollBack()
+      } else {
+         object.This().SetLoadNeeded()
+      }
+   }
+   for object, check := range tx.versionChecks {  // The version increments were rolled back in the db too.
+      if check.depth >= n {
+         delete(tx.versionChecks, object)
+      }
+   }
+   for schema, logId := range tx.changeLogIds {  // The RChangeLogTx rows were rolled back in the db too.
+      if logId.depth >= n {
+         delete(tx.changeLogIds, schema)
+      }
+   }
+}
+
+/*
+The id of the transaction in the change log of the database which is attached under the schema name
+("" for a main database), or 0 if the transaction has not yet recorded a change there.
+*/
+func (tx *RTransaction) ChangeLogId(schema string) int64 {
+   if logId, found := tx.changeLogIds[schema]; found {
+      return logId.id
+   }
+   return 0
+}
+
+/*
+Records the id which the transaction was given in the change log of the database attached under the schema name.
+*/
+func (tx *RTransaction) SetChangeLogId(schema string, id int64) {
+   if tx.changeLogIds == nil {
+      tx.changeLogIds = make(map[string]*changeLogId)
+   }
+   tx.changeLogIds[schema] = &changeLogId{id: id, depth: len(tx.savepoints)}
+}
+
 /*
 Call this after the database commit occurs.
 */
 func (tx *RTransaction) Commit() {
+  tx.endMutex.Lock()
+  defer tx.endMutex.Unlock()
+  if ! tx.IsInProgress {  // Already rolled back in memory by the watchdog
+     return
+  }
   Log(PERSIST_TR2,"%s.Commit()",tx)     
 	for object := range tx.DirtyObjects {
        object.This().SetStoredLocally()
        object.SetTransaction(nil)
 	}
-  tx.IsInProgress = false  
-  tx.mutex.Unlock()
+  for object := range tx.versionChecks {
+       object.SetVersion(object.Version() + 1)
+  }
+  tx.end()
+}
+
+
+/*
+In optimistic concurrency mode, whether the version of the object's state in the db has yet to be checked 
+and incremented in this transaction. It is checked before the object's first write in the transaction.
+*/
+func (tx *RTransaction) NeedsVersionCheck(object Persistable) bool {
+   _, checked := tx.versionChecks[object]
+   return ! checked
+}
+
+/*
+Records the outcome of checking and incrementing the version of the object's state in the db. 
+isStale should be true if the db version was no longer the in-memory object's version, so was not incremented.
+*/
+func (tx *RTransaction) RecordVersionCheck(object Persistable, isStale bool) {
+   if isStale {
+      Log(PERSIST_TR2,"%s: stale object %v (version %d)",tx,object.This(),object.Version())     
+   }
+   tx.versionChecks[object] = &versionCheck{depth: len(tx.savepoints), isStale: isStale}
+}
+
+/*
+Whether the version check of the object in this transaction found that its db state had been changed by another connection.
+*/
+func (tx *RTransaction) IsStale(object Persistable) bool {
+   check, checked := tx.versionChecks[object]
+   return checked && check.isStale
+}
+
+/*
+If, in optimistic concurrency mode, the transaction wrote to objects whose state in the db had been 
+changed by another connection since the objects were loaded, returns a *TransactionError of kind TX_CONFLICT
+which lists the stale objects. Otherwise returns nil. 
+*/
+func (tx *RTransaction) ConflictError() error {
+  var stale []string
+  for object, check := range tx.versionChecks {
+     if check.isStale {
+        stale = append(stale, fmt.Sprintf("%v (version %d)", object.This(), object.Version()))
+     }
+  }
+  if len(stale) == 0 {
+     return nil
+  }
+  return &TransactionError{Kind: TX_CONFLICT, 
+                           Op: "TRANSACTION", 
+                           Tries: 1, 
+                           Err: fmt.Errorf("%d objects were changed by another connection: %s", len(stale), strings.Join(stale, ", "))}
+}
+
+
+/*
+The transactions which have deadlines and are still in progress.
+*/
+var watchedTransactions = make(map[*RTransaction]bool)
+
+var watchdogMutex sync.Mutex
+
+var watchdogOnce sync.Once
+
+// How often the watchdog checks for transactions which have passed their deadline.
+const WATCHDOG_INTERVAL = time.Second
+
+/*
+Gives the transaction a deadline, timeout from now. If the transaction is still in progress at its deadline,
+the transaction watchdog interrupts any statement the transaction is running in the database, and rolls back
+the db transaction, so that the db locks the transaction holds are released even if the thread which owns the
+transaction is stuck. It then rolls back the in-memory state of its dirty objects, and makes threads
+waiting for the transaction to end stop waiting and get an error. The owning thread's later
+db operations in the transaction fail, and it cannot dirty any more objects in the transaction.
+A timeout <= 0 removes the deadline.
+*/
+func (tx *RTransaction) SetTimeout(timeout time.Duration) {
+  watchdogMutex.Lock()
+  defer watchdogMutex.Unlock()
+  if timeout <= 0 {
+     tx.Deadline = time.Time{}
+     delete(watchedTransactions, tx)
+     return
+  }
+  tx.Deadline = time.Now().Add(timeout)
+  watchedTransactions[tx] = true
+  watchdogOnce.Do(func() { go transactionWatchdog() })
+}
+
+/*
+Runs forever in its own goroutine, timing out transactions which have passed their deadline.
+*/
+func transactionWatchdog() {
+  for {
+     time.Sleep(WATCHDOG_INTERVAL)
+     now := time.Now()
+     var overdue []*RTransaction
+     watchdogMutex.Lock()
+     for tx := range watchedTransactions {
+        if now.After(tx.Deadline) {
+           overdue = append(overdue, tx)
+        }
+     }
+     watchdogMutex.Unlock()
+     for _, tx := range overdue {
+        tx.timeOut()
+     }
+  }
+}
+
+/*
+Registers the function which interrupts and rolls back the database transaction that this transaction 
+complements. The watchdog calls it if the transaction times out.
+*/
+func (tx *RTransaction) SetDbInterrupt(interruptDb func()) {
+  tx.endMutex.Lock()
+  tx.interruptDb = interruptDb
+  tx.endMutex.Unlock()
+}
+
+/*
+Marks the transaction as timed out, so that it cannot be committed, then interrupts and rolls back the database
+transaction, then rolls back the in-memory state of the transaction, logs which threads were waiting for it and 
+for what, and releases those threads.
+The database transaction is interrupted first, without holding the in-memory locks, since the thread which owns
+the transaction may hold them while it runs the db operation which is stuck. The interrupted operation panics,
+and the thread abandons the transaction (see RunTransaction), which may roll it back in memory before the watchdog does.
+*/
+func (tx *RTransaction) timeOut() {
+  tx.endMutex.Lock()
+  if ! tx.IsInProgress || tx.isTimedOut {
+     tx.endMutex.Unlock()
+     return
+  }
+  tx.isTimedOut = true
+  interruptDb := tx.interruptDb
+  tx.endMutex.Unlock()
+
+  if interruptDb != nil {
+     interruptDb()
+  }
+  tx.timeOutInMemory()
+}
+
+/*
+Rolls back the in-memory state of the timed out transaction, if it is still in progress.
+*/
+func (tx *RTransaction) timeOutInMemory() {
+  txOpsMutex.Lock()
+  defer txOpsMutex.Unlock()
+  tx.endMutex.Lock()
+  defer tx.endMutex.Unlock()
+  if ! tx.IsInProgress {
+     return
+  }
+
+  Logln(ALWAYS_, fmt.Sprintf("%s passed its deadline %v with %d dirty objects. Rolling it back.", tx, tx.Deadline, len(tx.DirtyObjects)))
+  tx.waitersMutex.Lock()
+  for w := range tx.waiters {
+     Logln(ALWAYS_, "   ", w)
+  }
+  tx.waitersMutex.Unlock()
+
+  tx.rollBack()
+}
+
+
+
+/*
+Kinds of database transaction failure.
+*/
+const (
+   TX_FAILED = iota  // A real error. Retrying the transaction will not help.
+   TX_BUSY           // Another connection holds a conflicting lock on the database (SQLITE_BUSY).
+   TX_LOCKED         // A conflicting lock is held on a table, e.g. by another statement (SQLITE_LOCKED).
+   TX_TIMED_OUT      // The transaction was still in progress at its deadline, and was rolled back.
+   TX_CONFLICT       // Optimistic concurrency mode: objects written in the transaction were changed by another connection.
+)
+
+/*
+Prefixes of the error message of a TransactionError of each kind.
+Relish code receives transaction errors as Strings which begin with one of these.
+*/
+var TransactionErrorKindNames = []string{"TRANSACTION FAILED", "TRANSACTION BUSY", "TRANSACTION LOCKED", "TRANSACTION TIMED OUT", "TRANSACTION CONFLICT"}
+
+/*
+The outcome of a database transaction operation (BEGIN, COMMIT, ROLLBACK, or the whole transaction)
+which failed, possibly after retries.
+*/
+type TransactionError struct {
+   Kind int     // TX_FAILED, TX_BUSY, TX_LOCKED, TX_TIMED_OUT, or TX_CONFLICT
+   Op string    // e.g. "BEGIN", "COMMIT", "TRANSACTION"
+   Tries int    // How many times the operation was tried
+   Err error    // The error from the last try
+}
+
+func (e *TransactionError) Error() string {
+   return fmt.Sprintf("%s: %s failed after %d tries: %s", TransactionErrorKindNames[e.Kind], e.Op, e.Tries, e.Err)
+}
+
+/*
+Whether the failure was due to contention with other connections, so that
+re-running the transaction later may succeed. After a TX_CONFLICT, the stale objects are 
+re-loaded from the db when next used, so a re-run of the transaction sees their current state.
+*/
+func (e *TransactionError) IsRetryable() bool {
+   return e.Kind == TX_BUSY || e.Kind == TX_LOCKED || e.Kind == TX_CONFLICT
+}
+
+/*
+Returns true if err is a TransactionError which is retryable.
+*/
+func IsRetryableTransactionError(err error) bool {
+   txErr, isTxErr := err.(*TransactionError)
+   return isTxErr && txErr.IsRetryable()
+}
+
+
+/*
+Governs how many times, and how far apart, a busy or locked database transaction
+(or a statement that begins or commits one) is re-tried before giving up.
+*/
+type TransactionRetryPolicy struct {
+   MaxTries int                 // Total number of tries, including the first
+   Backoff time.Duration        // Delay before the first retry. Doubles for each subsequent retry.
+   MaxBackoff time.Duration     // Upper bound on the delay between retries
+}
+
+/*
+Returns the retry policy determined by the -txtries, -txbackoff and -txmaxbackoff runtime flags.
+*/
+func DefaultTransactionRetryPolicy() *TransactionRetryPolicy {
+   return &TransactionRetryPolicy{MaxTries: params.DbTxMaxTries, 
+                                  Backoff: time.Duration(params.DbTxBackoffMs) * time.Millisecond,
+                                  MaxBackoff: time.Duration(params.DbTxMaxBackoffMs) * time.Millisecond}
+}
+
+/*
+Returns true if another try should be made after the try-th try failed with an error of the specified kind.
+*/
+func (p *TransactionRetryPolicy) ShouldRetry(kind int, try int) bool {
+   return (kind == TX_BUSY || kind == TX_LOCKED) && try < p.MaxTries
+}
+
+/*
+Sleeps for the delay that should follow the try-th failed try.
+The delay is exponential in try, capped at MaxBackoff, with a random factor of up to 50% added
+so that contending goroutines do not retry in lockstep.
+*/
+func (p *TransactionRetryPolicy) Wait(try int) {
+   delay := p.Backoff
+   for i := 1; i < try && delay < p.MaxBackoff; i++ {
+      delay *= 2
+   }
+   if delay > p.MaxBackoff {
+      delay = p.MaxBackoff
+   }
+   if delay > 1 {
+      delay += time.Duration(rand.Int63n(int64(delay / 2) + 1))
+   }
+   time.Sleep(delay)
+}
+
+
+
+/*
+Runs block inside a database transaction of the specified type ("DEFERRED", "IMMEDIATE", or "EXCLUSIVE")
+on behalf of the interpreter thread, then commits the transaction.
+
+If the thread is already in a transaction, block is instead run in a nested transaction scope (a savepoint)
+of that transaction, and is not retried.
+
+If block returns an error, the transaction is rolled back and that error is returned. It is not retried.
+
+If the commit fails because the database is busy or locked, the transaction is rolled back, both in the
+database and in memory, and the whole of block is run again in a new transaction, after a delay, 
+as governed by the retry policy. If the tries are used up, returns a retryable *TransactionError
+whose Op is "TRANSACTION". Other begin or commit failures are returned as a non-retryable *TransactionError.
+
+If block panics, e.g. with a runtime error of the relish method it runs, or because the transaction watchdog
+interrupted the db transaction, the transaction is abandoned, so that its db connection is released,
+and the panic carries on.
+*/
+func RunTransaction(th InterpreterThread, transactionType string, policy *TransactionRetryPolicy, block func() error) (err error) {
+   if th.Transaction() != nil {
+      // Run block in a nested transaction scope. Retrying is up to the outermost transaction.
+      err = BeginNestedTransaction(th)
+      if err != nil {
+         return
+      }
+      err = block()
+      if err != nil {
+         RollbackNestedTransaction(th)
+         return
+      }
+      err = CommitNestedTransaction(th)
+      return
+   }
+   var tx *RTransaction
+   defer func() {
+      if r := recover(); r != nil {
+         if tx != nil && th.Transaction() == tx {
+            AbandonTransaction(th)
+         }
+         panic(r)
+      }
+   }()
+   var try int
+   for try = 1; ; try++ {
+      err = th.DBT().BeginTransaction(transactionType)
+      if err != nil {
+         return
+      }
+      tx = NewTransaction()
+      th.SetTransaction(tx)
+
+      err = block()
+      if err != nil {
+         AbandonTransaction(th)
+         return
+      }
+
+      err = tx.CommitError()  // Timed out, or wrote to objects changed by another connection
+      if err == nil {
+         err = th.DBT().CommitTransaction()
+         if err == nil {
+            tx.Commit()
+            th.SetTransaction(nil)
+            RunTransactionHooks(th, tx)
+            return
+         }
+      }
+      AbandonTransaction(th)
+      if ! IsRetryableTransactionError(err) || try >= policy.MaxTries {
+         break
+      }
+      Log(PERSIST_TR2,"%s failed to commit. Re-running transaction (try %d): %s\n", tx, try + 1, err)
+      policy.Wait(try)
+   }
+   kind := TX_FAILED
+   if txErr, isTxErr := err.(*TransactionError); isTxErr {
+      kind = txErr.Kind
+   }
+   err = &TransactionError{Kind: kind, Op: "TRANSACTION", Tries: try, Err: err}
+   return
+}
+
+/*
+Rolls back the thread's in-progress transaction in the database and in memory, and
+ends the thread's participation in the transaction.
+If the database rollback fails, releases the thread's db connection anyway, and returns the rollback error.
+*/
+func AbandonTransaction(th InterpreterThread) (err error) {
+   err = th.DBT().RollbackTransaction()
+   if err != nil {
+      Logln(ALWAYS_, err.Error())
+      for ! th.DBT().ReleaseDB() {}  // Loop til we definitely release the db connection
+   }
+   if tx := th.Transaction(); tx != nil {
+      tx.RollBack()
+      th.SetTransaction(nil)
+      RunTransactionHooks(th, tx)
+   }
+   return
+}
+
+
+/*
+Begins a nested transaction scope, using a database savepoint, within the thread's in-progress transaction.
+*/
+func BeginNestedTransaction(th InterpreterThread) (err error) {
+   tx := th.Transaction()
+   err = th.DBT().BeginSavepoint(tx.NextSavepointName())
+   if err == nil {
+      tx.BeginSavepoint()
+   }
+   return
+}
+
+/*
+Ends the innermost nested transaction scope of the thread's transaction, keeping its changes
+as part of the enclosing scope.
+*/
+func CommitNestedTransaction(th InterpreterThread) (err error) {
+   tx := th.Transaction()
+   err = th.DBT().ReleaseSavepoint(tx.Savepoint().Name)
+   if err == nil {
+      tx.ReleaseSavepoint()
+   }
+   return
+}
+
+/*
+Undoes the changes made in the innermost nested transaction scope of the thread's transaction, 
+in the database and in memory, and ends the scope.
+The in-memory objects are rolled back even if the database rollback fails, so that they will 
+be re-loaded from the database.
+*/
+func RollbackNestedTransaction(th InterpreterThread) (err error) {
+   tx := th.Transaction()
+   err = th.DBT().RollbackToSavepoint(tx.Savepoint().Name)
+   tx.RollBackToSavepoint()
+   return
 }
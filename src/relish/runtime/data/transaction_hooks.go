@@ -0,0 +1,173 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+// this package is concerned with the expression and management of runtime data (objects and values)
+// in the relish language.
+
+package data
+
+/*
+   transaction_hooks.go - after-commit and after-rollback callbacks, registered by relish code, which are told
+                          which persistent objects were dirty in a transaction, and which of their attributes changed.
+*/
+
+import (
+   "sync"
+   . "relish/dbg"
+)
+
+/*
+A relish closure to be called after each transaction commits (or rolls back)
+in which objects of the type (or of any type, if Type is nil) were dirty.
+*/
+type TransactionHook struct {
+   Type *RType  // If nil, the hook is called for every transaction that dirtied any persistent objects.
+   Callback *RClosure
+}
+
+var afterCommitHooks []*TransactionHook
+var afterRollbackHooks []*TransactionHook
+var transactionHooksMutex sync.RWMutex
+
+/*
+Registers a relish closure to be called, after a transaction commits, with a map from each object
+(of the type or a subtype, if typ is not nil) which was dirty in the transaction,
+to the list of names of its attributes which were changed in the transaction.
+The closure must accept a single argument of type {} Any > [] String
+*/
+func AddAfterCommitHook(typ *RType, callback *RClosure) {
+   transactionHooksMutex.Lock()
+   defer transactionHooksMutex.Unlock()
+   afterCommitHooks = append(afterCommitHooks, &TransactionHook{Type: typ, Callback: callback})
+}
+
+/*
+Registers a relish closure to be called, after a transaction rolls back, with the objects which were dirty in it.
+See AddAfterCommitHook.
+*/
+func AddAfterRollbackHook(typ *RType, callback *RClosure) {
+   transactionHooksMutex.Lock()
+   defer transactionHooksMutex.Unlock()
+   afterRollbackHooks = append(afterRollbackHooks, &TransactionHook{Type: typ, Callback: callback})
+}
+
+/*
+Records that an attribute of the persistent object was changed in this transaction.
+*/
+func (tx *RTransaction) RecordChange(object Persistable, attrName string) {
+   attrNames := tx.ChangedAttrs[object]
+   if attrName != "" {
+      for _, name := range attrNames {
+         if name == attrName {
+            return
+         }
+      }
+      attrNames = append(attrNames, attrName)
+   }
+   tx.ChangedAttrs[object] = attrNames
+}
+
+/*
+Records, in the thread's transaction if it has one, that an attribute of the persistent object was changed.
+*/
+func recordChange(th InterpreterThread, object Persistable, attrName string) {
+   if th == nil {
+      return
+   }
+   if tx := th.Transaction(); tx != nil {
+      tx.RecordChange(object, attrName)
+   }
+}
+
+/*
+Calls the after-commit hooks, if the transaction committed, or the after-rollback hooks, if it rolled back.
+Call this once the transaction has ended, and the thread is no longer participating in it, so that the
+hooks may use transactions of their own. Does nothing if the transaction is still in progress, or if
+the hooks have already been run for the transaction.
+*/
+func RunTransactionHooks(th InterpreterThread, tx *RTransaction) {
+   if tx == nil || tx.IsInProgress || tx.hooksRun || len(tx.DirtyObjects) == 0 {
+      return
+   }
+   tx.hooksRun = true
+
+   transactionHooksMutex.RLock()
+   hooks := afterCommitHooks
+   if tx.IsRolledBack {
+      hooks = afterRollbackHooks
+   }
+   transactionHooksMutex.RUnlock()
+
+   for _, hook := range hooks {
+      changes, err := tx.changesMap(hook.Type)
+      if err != nil {
+         Logln(ALWAYS_, "Unable to run transaction hook:", err)
+         return
+      }
+      if changes.Length() == 0 {
+         continue
+      }
+      results := th.EvaluationContext().EvalClosureCall(hook.Callback, []RObject{changes})
+      if len(results) > 0 && results[0] != nil {
+         if errStr, isString := results[0].(String); isString && errStr != "" {
+            Logln(ALWAYS_, tx, "hook:", string(errStr))
+         }
+      }
+   }
+}
+
+/*
+Returns a relish map from each object dirty in the transaction, whose type is typ or a subtype of typ,
+to a list of the names of its attributes that changed in the transaction. If typ is nil, includes all
+dirty objects. A dirty collection which is the value of a multi-valued attribute is reported as a change
+of that attribute of its owner object.
+*/
+func (tx *RTransaction) changesMap(typ *RType) (changes Map, err error) {
+   var objs []RObject
+   attrNamesOf := make(map[RObject][]string)
+   for object := range tx.DirtyObjects {
+      obj := object.This()
+      attrNames := tx.ChangedAttrs[object]
+      if coll, isCollection := obj.(RCollection); isCollection && coll.Owner() != nil && coll.Attribute() != nil {
+         obj = coll.Owner()
+         attrNames = []string{coll.Attribute().Part.Name}
+      }
+      if typ != nil && ! obj.Type().LessEq(typ) {
+         continue
+      }
+      existingNames, found := attrNamesOf[obj]
+      if ! found {
+         objs = append(objs, obj)
+      }
+      for _, attrName := range attrNames {
+         isDuplicate := false
+         for _, name := range existingNames {
+            if name == attrName {
+               isDuplicate = true
+               break
+            }
+         }
+         if ! isDuplicate {
+            existingNames = append(existingNames, attrName)
+         }
+      }
+      attrNamesOf[obj] = existingNames
+   }
+
+   changes, err = RT.Newmap(AnyType, ListOfStringType, 0, -1, nil, nil, nil)
+   if err != nil {
+      return
+   }
+   for _, obj := range objs {
+      var attrNameList List
+      attrNameList, err = RT.Newrlist(StringType, 0, -1, nil, nil, nil)
+      if err != nil {
+         return
+      }
+      for _, attrName := range attrNamesOf[obj] {
+         attrNameList.AddSimple(String(attrName))
+      }
+      changes.PutSimple(obj, attrNameList)
+   }
+   return
+}
@@ -50,6 +50,7 @@ import (
 	"strings"
 	. "relish/defs"
 	"net/http"
+	"relish/runtime/native_methods/standard_lib/http_methods"
 )
 
 
@@ -164,6 +165,39 @@ func (i *Interpreter) GetServiceMethodModifiers(mm *RMultiMethod) (modifiers map
     return
 }
 
+/*
+   Whether the URL-mapped method has an http_srv.Session parameter, and so must be given the request's session.
+*/
+func (i *Interpreter) ServiceMethodUsesSession(mm *RMultiMethod) bool {
+	method := i.dispatcher.GetSingletonMethod(mm)
+	if method == nil {
+		return false
+	}
+	for _, paramType := range method.Signature.Types {
+		if paramType.Name == http_methods.SESSION_TYPE_NAME {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+   Return the route pattern, such as "/orders/{id}/items", of the URL-mapped method,
+   or "" if it is mapped to URLs by its name.
+*/
+func (i *Interpreter) GetServiceMethodRoute(mm *RMultiMethod) (route string, err error) {
+	method := i.dispatcher.GetSingletonMethod(mm)
+
+	if method == nil {
+		err = fmt.Errorf("No method '%s' found.", mm.Name)
+		return
+	}
+	if method.Code != nil {
+       route = method.Code.Route
+    }
+    return
+}
+
 
 /*
 Runs a service handler method. 
@@ -176,6 +210,8 @@ The parameter to argument matching process is as follows:
 future:
 3. Additional positional and keyword arguments are assigned to variadic and kw parameters of the method, if such exist.
 Matching discrepencies such as unmapped leftover arguments, or not enough arguments, cause a non-nil error return value.
+routeArgStringValues, which may be nil, are the values of the {name} segments of the method's route pattern,
+and are used as the values of the method parameters of the same names, before any other arguments are matched.
 
 
 Runs the method in a new stack and returns a slice of the method's return values.
@@ -184,7 +220,7 @@ TODO WE HAVE SOME SERIOUS DRY VIOLATIONS between this method and a few others in
 
 TODO See EvalMethodCall for updates (to nArgs etc) that have not been applied here yet!!!!
 */
-func (i *Interpreter) RunServiceMethod(t *Thread, mm *RMultiMethod, positionalArgStringValues []string, keywordArgStringValues url.Values, request *http.Request) (resultObjects []RObject, err error) {
+func (i *Interpreter) RunServiceMethod(t *Thread, mm *RMultiMethod, routeArgStringValues map[string]string, positionalArgStringValues []string, keywordArgStringValues url.Values, request *http.Request) (resultObjects []RObject, err error) {
 	// defer UnM(t,TraceM(t,INTERP_TR, "RunServiceMethod", fmt.Sprintf("%s", mm.Name)))	
 	
 	method := i.dispatcher.GetSingletonMethod(mm)
@@ -194,7 +230,7 @@ func (i *Interpreter) RunServiceMethod(t *Thread, mm *RMultiMethod, positionalAr
 		return
 	}
 	
-	args, err := i.matchServiceArgsToMethodParameters(method, positionalArgStringValues, keywordArgStringValues, request)
+	args, err := i.matchServiceArgsToMethodParameters(method, routeArgStringValues, positionalArgStringValues, keywordArgStringValues, request)
 	if err != nil {
 		return
 	}
@@ -242,6 +278,37 @@ func (i *Interpreter) RunServiceMethod(t *Thread, mm *RMultiMethod, positionalAr
 	return 
 }
 
+/*
+Runs a web interceptor method, which runs before or after the service handler methods of a web package subtree.
+Its parameters are matched to the request's arguments as a service handler method's are, except that
+the request's arguments are meant for the handler, so those that do not name a parameter of the
+interceptor are ignored, and URI path components are not passed to the interceptor.
+Returns a copy of the interceptor's return values, so that another method can then be run in the thread.
+*/
+func (i *Interpreter) RunServiceInterceptor(t *Thread, mm *RMultiMethod, routeArgStringValues map[string]string, keywordArgStringValues url.Values, request *http.Request) (resultObjects []RObject, err error) {
+	method := i.dispatcher.GetSingletonMethod(mm)
+
+	if method == nil {
+		err = fmt.Errorf("No method '%s' found.", mm.Name)
+		return
+	}
+	interceptorRouteArgs := make(map[string]string)
+	interceptorKeywordArgs := make(url.Values)
+	for _, paramName := range method.ParameterNames {
+		if valStr, isRouteArg := routeArgStringValues[paramName]; isRouteArg {
+			interceptorRouteArgs[paramName] = valStr
+		} else if vals, isKeywordArg := keywordArgStringValues[paramName]; isKeywordArg {
+			interceptorKeywordArgs[paramName] = vals
+		}
+	}
+	resultObjects, err = i.RunServiceMethod(t, mm, interceptorRouteArgs, nil, interceptorKeywordArgs, request)
+	if err != nil {
+		return
+	}
+	resultObjects = append([]RObject(nil), resultObjects...)
+	return
+}
+
 /*
 TODO: Why is  this not in thread.go ???
 
@@ -249,47 +316,40 @@ In future, a thread panic would cause t.err to be an error message.
 
 TODO: Make some way of setting t.err when relish-panicking.
 
-TODO TODO: If error on the commit, wait, try again a couple of times, backing off,
-then try a rollback.
-If error on the rollback, wait, try again a couple of times, backing off, 
-then do a releaseDB.
-
+Commits the thread's transaction, or rolls it back if the thread has an error.
+Busy or locked commits have already been retried by the DBT, according to the transaction retry policy.
+If the commit finally fails, the transaction is rolled back, and the commit error 
+(a *TransactionError) is logged, and returned, so that the caller can also report it to the client.
+If the rollback fails, the thread's db connection is released anyway.
 
 TODO: If we get an exception percolating all the way up to here, should we
 have a recover(..) call in here so as to roll back the transaction. Seems like the
 best thing to do. Not sure if any exceptions can get up this high.
 
 */
-func (t *Thread) CommitOrRollback() {
+func (t *Thread) CommitOrRollback() (err error) {
 	if t.err == "" {
-	   err := t.DBT().CommitTransaction()
+	   if t.transaction != nil {
+	      err = t.transaction.CommitError()  // A timed-out or conflicting transaction must be rolled back in the db.
+	   }
+	   if err == nil {
+	      err = t.DBT().CommitTransaction()
+	   }
 	   if err != nil {
 	      Logln(ALWAYS_,err.Error())
-
-	      err := t.DBT().RollbackTransaction()
-	      if err != nil {
-	         Logln(ALWAYS_,err.Error())
-          }
-	      if t.transaction != nil {
-	          t.transaction.RollBack()
-	      }  	      
+          AbandonTransaction(t)
        } else {  // successful commit
-	      if t.transaction != nil {
-	         t.transaction.Commit()
+	      if tx := t.transaction; tx != nil {
+	         tx.Commit()
+	         t.transaction = nil
+	         RunTransactionHooks(t, tx)
 	      }     	
 	   }	   
     } else {
-	   err := t.DBT().RollbackTransaction()
-	   if err != nil {
-	      Logln(ALWAYS_,err.Error())
-       }
-	
-       if t.transaction != nil {
-          t.transaction.RollBack()
-       }
-	
-	   for ! t.DBT().ReleaseDB() {}  // Loop til we definitely unlock the dbMutex
+       AbandonTransaction(t)
+	   for ! t.DBT().ReleaseDB() {}  // Loop til we definitely release the db connection
     }
+    return
 }
 
 
@@ -297,6 +357,8 @@ func (t *Thread) CommitOrRollback() {
 Converts the arguments, whose values are all passed in as strings, into the appropriate primitive datatypes to match
 the method's parameter type signature, after matching the correct input arguments to method parameters.
 The parameter to argument matching process is as follows:
+0. Route arguments (the values of the {name} segments of the method's route pattern) are used as the values
+   of the method parameters of the same names. A keyword argument cannot also supply one of those parameters.
 1. Named arguments are used as the values of the matching named method parameter.
 2. Additional unmatched method parameters are filled (left to right i.e. top to bottom) from the positionalArgStringValues list.
 future:
@@ -309,7 +371,7 @@ RMethod
 	parameterNames []string               // names of parameters
 	Signature      *RTypeTuple            // types of parameters
 */
-func (i *Interpreter) matchServiceArgsToMethodParameters(method *RMethod, positionalArgStringValues []string, keywordArgStringValues url.Values, request *http.Request) (args []RObject, err error) {
+func (i *Interpreter) matchServiceArgsToMethodParameters(method *RMethod, routeArgStringValues map[string]string, positionalArgStringValues []string, keywordArgStringValues url.Values, request *http.Request) (args []RObject, err error) {
    
    arity := len(method.ParameterNames)
    args = make([]RObject,arity)
@@ -325,15 +387,59 @@ func (i *Interpreter) matchServiceArgsToMethodParameters(method *RMethod, positi
 	  }  			  
 	  firstNonSpecialArgIndex = 1
    }
+
+   // A parameter of type http_srv.Session, wherever it is, is given the session which the web listener
+   // loaded for the request. A parameter of type Channel, of a WEBSOCKET handler method, is given
+   // the web socket which the request opened.
+   isSpecialParam := make([]bool, arity)
+   webSocket := http_methods.RequestWebSocket(request)
+   for ix,paramType := range paramTypes {
+      if ix >= arity {
+         break
+      }
+      if paramType.Name == http_methods.SESSION_TYPE_NAME {
+         args[ix], err = http_methods.CreateSession(http_methods.RequestSession(request))
+         if err != nil {
+            return
+         }
+         isSpecialParam[ix] = true
+      } else if webSocket != nil && (paramType == ChannelType || strings.HasPrefix(paramType.Name, "Channel of ")) {
+         args[ix] = webSocket
+         isSpecialParam[ix] = true
+      }
+   }
+
+   for key, valStr := range routeArgStringValues {
+      foundKey := false
+      for ix,paramName := range method.ParameterNames {
+         if ix >= firstNonSpecialArgIndex && ! isSpecialParam[ix] && paramName == key {
+            // Convert string arg to an RObject, checking for type conversion errors
+            err = i.setMethodArg(args, paramTypes, ix, key, valStr) 
+            if err != nil {
+               return
+            }
+            foundKey = true
+            break
+         }
+      }
+      if ! foundKey {
+         err = fmt.Errorf("Route parameter {%s} of web service handler %s is not one of its parameters.", key, method)
+         return
+      }
+   }
 	
    var extraArgKeys []string
    for key := range keywordArgStringValues {
       foundKey := false
       for ix,paramName := range method.ParameterNames {
-         if ix < firstNonSpecialArgIndex {
+         if ix < firstNonSpecialArgIndex || isSpecialParam[ix] {
 	        continue
 	     }
       	 if paramName == key {
+            if _, isRouteArg := routeArgStringValues[key]; isRouteArg {
+               err = fmt.Errorf("Web service request argument %s is already given by the request's URI path.", key)
+               return
+            }
             valStr := keywordArgStringValues.Get(key)   
 //            if valStr == "" {
 //            	panic(fmt.Sprintf("How is it that the value of argument '%s' is the empty string? Shouldn't be able to happen.", key))
@@ -1293,6 +1399,9 @@ TODO This is NOT updated to handle closure applications yet !!!
 */
 func (i *Interpreter) GoApply(t *Thread, method *RMethod, file rterr.CodeFileLocated, pos rterr.Positioned) {
     
+    t.isGoThread = true
+    defer i.EndAbandonedThread(t)
+
 	t.Stack[t.Base+1] = method
 
 	t.ExecutingMethod = method       // Shortcut for dispatch efficiency
@@ -1323,6 +1432,33 @@ func (i *Interpreter) GoApply(t *Thread, method *RMethod, file rterr.CodeFileLoc
 
 
 
+/*
+To be deferred where a thread begins. If the thread is ending because the receiver of a channel it sends to
+has gone away, rolls back the thread's transaction, if any, and releases its db connections, and if it is
+a go thread, deregisters it. Any other panic is not recovered from.
+Relish mutexes locked by the thread are not unlocked.
+*/
+func (i *Interpreter) EndAbandonedThread(t *Thread) {
+   r := recover()
+   if r == nil {
+      return
+   }
+   if _, isReceiverGone := r.(ReceiverGone); ! isReceiverGone {
+      panic(r)
+   }
+   Logln(INTERP_, "Ended a thread, as the receiver of a channel it was sending to has gone away.")
+   if t.transaction != nil {
+      AbandonTransaction(t)
+   }
+   for ! t.dbConnectionThread.ReleaseDB() {}
+   for _, dbt := range t.dbThreads {
+      for ! dbt.ReleaseDB() {}
+   }
+   if t.isGoThread {
+      i.DeregisterThread(t)
+   }
+}
+
 /*
 If the type name is unqualified (has no package path), prefixes it with the specified package path.
 A little bit inefficient.
@@ -1789,6 +1925,13 @@ func (context *methodEvaluationContext) EvalMultiMethodCall(mm *RMultiMethod, ar
 	return context.interpreter.evalMultiMethodCall1ReturnVal(context.thread, mm, args)
 }
 
+/*
+Applies the closure to the arguments and returns the results of the application.
+*/
+func (context *methodEvaluationContext) EvalClosureCall(closure *RClosure, args []RObject) []RObject {
+	return context.interpreter.evalClosureCall(context.thread, closure, args)
+}
+
 func (context *methodEvaluationContext) InterpThread() InterpreterThread {
 	return context.thread
 }
@@ -1866,6 +2009,56 @@ func (i *Interpreter) evalMultiMethodCall1ReturnVal(t *Thread, mm *RMultiMethod,
 	return t.Pop() // Assuming single valued function!
 }
 
+/*
+Special-purpose variant of closure application, used as part of implementation of MethodEvaluationContext interface.
+Applies the closure to some pre-evaluated arguments, and returns the results, in order.
+
+Used for example by builtin functions which accept a block of relish code, as a closure, to run.
+*/
+func (i *Interpreter) evalClosureCall(t *Thread, closure *RClosure, args []RObject) []RObject {
+	method := closure.Method
+	nReturnArgs := method.NumReturnArgs
+
+	newBase := t.PushBase(nReturnArgs) // begin but don't complete, storing outer routine context. 
+
+	for _, arg := range args {
+		t.Push(arg)
+	}
+
+	t.SetBase(newBase) // Now we're in the context of the newly called function.
+
+	// put currently executing method on stack in reserved parking place
+	t.Stack[newBase+1] = method
+
+	errorContextMethod := t.ExecutingMethod 
+
+	t.ExecutingMethod = method       // Shortcut for dispatch efficiency
+	t.ExecutingPackage = method.Pkg  // Shortcut for dispatch efficiency	
+
+	t.Reserve(method.NumLocalVars)
+
+	for _,obj := range closure.Bindings {
+		t.Push(obj)
+	}
+
+	err := i.apply1(t, method, args) // Puts results on stack BELOW the current stack frame.	
+	if err != nil {
+		if errorContextMethod == nil {
+			rterr.Stopf("Error applying closure %v: %s", closure, err.Error())
+		}
+		rterr.Stopf1(t, errorContextMethod.File, "Error applying closure %v: %s", closure, err.Error())		
+	}
+
+	t.PopBase() // We need to worry about panics leaving the stack state inconsistent. TODO
+
+	results := make([]RObject, nReturnArgs)
+	copy(results, t.TopN(nReturnArgs))
+	if nReturnArgs > 0 {
+		t.PopN(nReturnArgs)
+	}
+	return results
+}
+
 ///// From here up to previous ///// is special purpose code
 
 /*
@@ -2173,7 +2366,8 @@ func (i *Interpreter) ExecForRangeStatement(t *Thread, stmt *ast.RangeStatement)
 			 if ! isCollection {
 				rterr.Stopf1(t, stmt, "Attempt to iterate over an object which is not a list, set, or map.")	
 			 }	
-			 if nCollections == 1 && collection.IsOrdered() && ! collection.IsMap() {
+			 _, isResultSet := collection.(ResultSet)
+			 if nCollections == 1 && (isResultSet || (collection.IsOrdered() && ! collection.IsMap())) {
 			    iter = nil
 			 } else {	 
 		      iter = collection.Iter(t)	
@@ -2205,6 +2399,12 @@ func (i *Interpreter) ExecForRangeStatement(t *Thread, stmt *ast.RangeStatement)
 	collPos := stackPosBefore + 1
 	collection := t.Stack[collPos].(RCollection)
 
+	if resultSet, isResultSet := collection.(ResultSet); isResultSet && nCollections == 1 {
+		breakLoop, continueLoop, returnFrom = i.execForRangeOverResultSet(t, stmt, resultSet, keyOffset)
+		t.PopN(nCollections)
+		return
+	}
+
 	switch keyOffset {
 	case 2:
 
@@ -2751,6 +2951,57 @@ func (i *Interpreter) ExecForRangeStatement(t *Thread, stmt *ast.RangeStatement)
 	return
 }
 
+/*
+Executes 'for val in resultSet' or 'for i val in resultSet'. The objects are read from the database
+by this thread, a batch at a time, as the loop asks for them, rather than by the goroutine of an iterator.
+*/
+func (i *Interpreter) execForRangeOverResultSet(t *Thread, stmt *ast.RangeStatement, resultSet ResultSet, keyOffset int) (breakLoop, continueLoop, returnFrom bool) {
+	if keyOffset != 0 && keyOffset != 1 {
+		rterr.Stop1(t,stmt,"Expecting 'for val in resultSet' or 'for i val in resultSet'.")
+	}
+
+	var idx int64 = 0 // value of index integer in each loop iteration
+
+	for {
+		obj, err := resultSet.Next()
+		if err != nil {
+			rterr.Stop1(t, stmt, err)
+		}
+		if obj == nil {
+			break
+		}
+
+		if keyOffset == 1 {
+
+			// Assign to the index variable
+
+			idxVar := stmt.KeyAndValues[0].(*ast.Ident)
+			LogM(t, INTERP2_, "for range assignment base %d varname %s offset %d\n", t.Base, idxVar.Name, idxVar.Offset)
+			t.Stack[t.Base+idxVar.Offset] = Int(idx)
+		}
+
+		// Assign to the value variable
+
+		valVar := stmt.KeyAndValues[keyOffset].(*ast.Ident)
+		LogM(t, INTERP2_, "for range assignment base %d varname %s offset %d\n", t.Base, valVar.Name, valVar.Offset)
+		t.Stack[t.Base+valVar.Offset] = obj
+
+		// Execute loop body	
+
+		breakLoop, _, returnFrom = i.ExecBlock(t, stmt.Body)
+
+		if breakLoop || returnFrom {
+			breakLoop = false
+			continueLoop = false
+			break
+		}
+
+		// increment the loop iteration index
+		idx += 1
+	}
+	return
+}
+
 
 /*
  */
@@ -2782,7 +3033,7 @@ func (i *Interpreter) ExecAssignmentStatement(t *Thread, stmt *ast.AssignmentSta
 
 	   lhsExpr := stmt.Lhs[0]
 			
-	   var c *Channel
+	   var chObj RObject
 	   switch lhsExpr.(type) {
 	   case *ast.Ident: // A local variable or parameter or result parameter
 		   LogM(t,INTERP2_, "send to channel varname %s\n", lhsExpr.(*ast.Ident).Name)
@@ -2790,12 +3041,12 @@ func (i *Interpreter) ExecAssignmentStatement(t *Thread, stmt *ast.AssignmentSta
 			if err != nil {
 				rterr.Stopf1(t, lhsExpr, "Attempt to access the value of unassigned variable %s.",lhsExpr.(*ast.Ident).Name)
 			}		
-            c= obj.(*Channel)
+            chObj = obj
 		case *ast.SelectorExpr:
 		   selector := lhsExpr.(*ast.SelectorExpr)			
 		   LogM(t,INTERP2_, "send to channel attr name %s\n", selector.Sel.Name)			
 	  	   i.EvalSelectorExpr(t, selector)	      
-		   c = t.Pop().(*Channel)      
+		   chObj = t.Pop()      
 
 
 		// TODO case index expression []
@@ -2803,6 +3054,13 @@ func (i *Interpreter) ExecAssignmentStatement(t *Thread, stmt *ast.AssignmentSta
        }
 
        val := t.Pop()
+
+       if oc, isOutChannel := chObj.(ROutChannel); isOutChannel {  // e.g. a web socket
+          oc.Send(t, val)
+          return
+       }
+       c := chObj.(*Channel)
+
        // TODO do a runtime type-compatibility check of val's type with c.ElementType
 
        if val.IsUnit() || val.IsCollection() || val.Type() == ClosureType {
@@ -2811,9 +3069,23 @@ func (i *Interpreter) ExecAssignmentStatement(t *Thread, stmt *ast.AssignmentSta
    
        // t.AllowGC(" Channel <-")      
        t.AllowGC()
-	   c.Ch <- val
+       var abandoned bool
+       select {
+	   case c.Ch <- val:
+       case <-c.Done:  // the receiver has gone away, so the value would never be received
+          abandoned = true
+       }
 	   // t.DisallowGC(" Channel <-")	  
 	   t.DisallowGC()	      
+       if abandoned {
+          if val.IsUnit() || val.IsCollection() || val.Type() == ClosureType {
+             i.rt.DecrementInTransitCount(val)
+          }
+          if t.isGoThread {
+             panic(ReceiverGone{})  // Ends the thread quietly. See EndAbandonedThread.
+          }
+          rterr.Stop1(t, stmt, "Cannot send to the channel. Its receiver has gone away.")
+       }
 
 
     } else { // assignment
@@ -45,6 +45,8 @@ func newThread(initialStackDepth int, i *Interpreter, parent *Thread) *Thread {
 	if parent != nil {
 		t.ExecutingMethod = parent.ExecutingMethod
 		t.ExecutingPackage = parent.ExecutingPackage
+		t.dbName = parent.dbName
+		t.actor = parent.actor
 	} 
 	t.EvalContext = &methodEvaluationContext{i, t}
 
@@ -100,6 +102,9 @@ type Thread struct {
 	dbConnectionThread DBT  // Manages serialized and transactional access to the database in
 	                              // multi-threaded environment
 
+	dbThreads map[string]DBT  // Access to the attached databases this thread has used, by database name
+	dbName string             // Name of the database in use by this thread. "" is the main database.
+
     // This may be temporary - it is used for generators inside collection constructors, but may
     // be replaced by proper go-routine-and-channel generators or closures.
     Objs       []RObject   // A list of objects that will be built up then become owned by a proper collection object 
@@ -113,6 +118,10 @@ type Thread struct {
 	                   // If positive, means this thread will keep holding an RLock on GCMutex and decrementing counter
 
 	transaction *RTransaction
+
+	actor string  // Who the thread is acting for. See Actor().
+
+	isGoThread bool  // Whether the thread runs the method call of a go statement
 }
 
 const MAX_GC_LOCKED_STACK_OPS = 100  // Do this many pops and pushes before relinquishing RLock on GCMutex.
@@ -480,7 +489,66 @@ func (t *Thread) Method() *RMethod {
 The DBThread which can execute db queries in a serialized fashion in a multi-threaded environment.
 */
 func (t *Thread) DBT() DBT {
-   return t.dbConnectionThread
+   if t.dbName == "" {
+      return t.dbConnectionThread
+   }
+   dbt, err := t.DatabaseThread(t.dbName)
+   if err != nil {
+      panic(err)
+   }
+   return dbt
+}
+
+/*
+The DBThread of the database attached under the name, created the first time this thread uses the database.
+The name "" is the main database.
+*/
+func (t *Thread) DatabaseThread(name string) (dbt DBT, err error) {
+   if name == "" {
+      dbt = t.dbConnectionThread
+      return
+   }
+   dbt, found := t.dbThreads[name]
+   if found {
+      return
+   }
+   db, found := RT.NamedDB(name)
+   if ! found {
+      err = fmt.Errorf("No database named '%s' is attached.", name)
+      return
+   }
+   dbt = db.NewDBThread(t)
+   if t.dbThreads == nil {
+      t.dbThreads = make(map[string]DBT)
+   }
+   t.dbThreads[name] = dbt
+   return
+}
+
+/*
+Makes the named database the one this thread dubs, summons, queries and persists objects in.
+Within a transaction, can only switch to a database which shares the connection of the database
+in use, i.e. to or from a sqlite database attached to it, since the transaction must span both.
+*/
+func (t *Thread) UseDatabase(name string) (previous string, err error) {
+   previous = t.dbName
+   if name == previous {
+      return
+   }
+   _, err = t.DatabaseThread(name)
+   if err != nil {
+      return
+   }
+   if t.transaction != nil {
+      db, _ := RT.NamedDB(name)
+      currentDB, _ := RT.NamedDB(previous)
+      if db.ConnectionDB() != currentDB.ConnectionDB() {
+         err = fmt.Errorf("Cannot use database '%s' within a transaction on a database it is not attached to.", name)
+         return
+      }
+   }
+   t.dbName = name
+   return
 }
 
 func (t *Thread) Err() string {
@@ -502,8 +570,29 @@ func (t *Thread) Transaction() *RTransaction {
    return t.transaction
 }
 
+/*
+Who the thread is acting for, e.g. the user who made the web request it is handling, or "" if not known.
+A thread started by another acts for the same actor.
+*/
+func (t *Thread) Actor() string {
+	return t.actor
+}
+
+func (t *Thread) SetActor(actor string) {
+	t.actor = actor
+}
+
+/*
+Makes tx the thread's transaction, and binds it to the thread's in-progress database transaction,
+so that the transaction watchdog can roll back the database transaction if tx times out.
+*/
 func (t *Thread) SetTransaction(tx *RTransaction) {
 	t.transaction = tx
+	if tx != nil {
+		if dbt, err := t.DatabaseThread(t.dbName); err == nil && dbt != nil {
+			dbt.BindTransaction(tx)
+		}
+	}
 }
 
 
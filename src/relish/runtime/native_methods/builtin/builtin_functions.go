@@ -33,6 +33,7 @@ import (
 	"sort"
 	"os/exec"
 	"sync"
+	"errors"
 )
 
 // Reader for reading from standard input
@@ -1207,6 +1208,18 @@ func InitBuiltinFunctions(relishRoot string) {
 		panic(err)
 	}
 	summonByIdMethod.PrimitiveCode = builtinSummonById
+
+	summonAsOfMethod, err := RT.CreateMethod("",nil,"summon", []string{"name","asOf"}, []string{"String","Time"}, []string{"Any"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	summonAsOfMethod.PrimitiveCode = builtinSummonAsOf
+
+	summonByIdAsOfMethod, err := RT.CreateMethod("",nil,"summon", []string{"dbid","asOf"}, []string{"Int","Time"}, []string{"Any"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	summonByIdAsOfMethod.PrimitiveCode = builtinSummonByIdAsOf
 	
 	existsMethod, err := RT.CreateMethod("",nil,"exists", []string{"name"}, []string{"String"}, []string{"Bool"}, false, 0, false)
 	if err != nil {
@@ -1231,7 +1244,92 @@ func InitBuiltinFunctions(relishRoot string) {
 	}
 	renameObjectMethod.PrimitiveCode = builtinRenameObject	
 
+    // err = attachDatabase "archive" "archive2014"  // Opens the database archive2014.db, in the directory of the main
+    //                                               // database, and attaches it to the program under the name "archive".
+    //                                               // The location may also be kv:<name> or a postgres:// URL, as with -db.
+    //                                               // A sqlite database is attached to a sqlite main database, so that
+    //                                               // a transaction can span both.
+    //
+	attachDatabaseMethod, err := RT.CreateMethod("",nil,"attachDatabase", []string{"name","location"}, []string{"String","String"}, []string{"String"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	attachDatabaseMethod.PrimitiveCode = builtinAttachDatabase
+
+    // previous err = useDatabase "archive"  // Subsequent dub, summon, exists, rename, delete and queries of this thread,
+    //                                       // and the persisting of changes this thread makes to objects, use the named
+    //                                       // database. "" is the main database. Returns the name of the database in use before.
+    //                                       // Within a transaction, can only switch between databases attached to each other.
+    //
+	useDatabaseMethod, err := RT.CreateMethod("",nil,"useDatabase", []string{"name"}, []string{"String"}, []string{"String","String"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	useDatabaseMethod.PrimitiveCode = builtinUseDatabase
+
+    // previous = setActor "alice"  // Records who this thread is acting for, e.g. the logged-in user of a web request,
+    //                              // with each change it makes to persistent objects in the audit log (-auditlog).
+    //                              // Threads it starts act for the same actor. A web request handler starts out acting
+    //                              // for the user named in the request's basic auth credentials, if any.
+    //                              // Returns who the thread was acting for before.
+    //
+	setActorMethod, err := RT.CreateMethod("",nil,"setActor", []string{"actor"}, []string{"String"}, []string{"String"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	setActorMethod.PrimitiveCode = builtinSetActor
+
+    // a = actor  // Who this thread is acting for, or "" if not known.
+    //
+	actorMethod, err := RT.CreateMethod("",nil,"actor", []string{}, []string{}, []string{"String"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	actorMethod.PrimitiveCode = builtinActor
+
+    // err = backupDatabase "backups/db1-2014-03-21.db"  // Takes a consistent snapshot of the main database while it is in use,
+    //                                                   // with the sqlite online backup API, and writes it to a new file.
+    //                                                   // A relative path is relative to the directory of the main database.
+    //
+	backupDatabaseMethod, err := RT.CreateMethod("",nil,"backupDatabase", []string{"path"}, []string{"String"}, []string{"String"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	backupDatabaseMethod.PrimitiveCode = builtinBackupDatabase
+
+    // err = backupDatabase "archive" "backups/archive-2014-03-21.db"  // Same, for an attached database.
+    //
+	backupDatabase2Method, err := RT.CreateMethod("",nil,"backupDatabase", []string{"name","path"}, []string{"String","String"}, []string{"String"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	backupDatabase2Method.PrimitiveCode = builtinBackupDatabase
+
+    // n err = exportDatabase "dumps/db1.ndjson"  // Exports every object, collection and object name of the database in use
+    //                                            // to a portable dump, a JSON array if the file name ends in .json,
+    //                                            // or NDJSON (a record per line) otherwise. Returns how many objects and
+    //                                            // collections were exported. A relative path is relative to the directory
+    //                                            // of the main database.
+    //
+	exportDatabaseMethod, err := RT.CreateMethod("",nil,"exportDatabase", []string{"path"}, []string{"String"}, []string{"Int","String"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	exportDatabaseMethod.PrimitiveCode = builtinExportDatabase
+
+    // n err = importDatabase "dumps/db1.ndjson"  // Imports a dump made by exportDatabase into the database in use,
+    //                                            // in one transaction, as new objects with new ids.
+    //                                            // Returns how many objects and collections were imported.
+    //
+	importDatabaseMethod, err := RT.CreateMethod("",nil,"importDatabase", []string{"path"}, []string{"String"}, []string{"Int","String"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	importDatabaseMethod.PrimitiveCode = builtinImportDatabase
+
     // err = begin  // Begins a db transaction. On success returns an empty string.
+    //              // If already in a transaction, begins a nested transaction scope (a savepoint),
+    //              // which the matching commit or rollback ends.
     //
 	beginMethod, err := RT.CreateMethod("",nil,"begin", []string{}, []string{}, []string{"String"}, false, 0, false)
 	if err != nil {
@@ -1247,6 +1345,22 @@ func InitBuiltinFunctions(relishRoot string) {
 	}
 	begin2Method.PrimitiveCode = builtinBeginTransaction
 
+    // err = begin 30  // Begins a db transaction which is rolled back if still in progress after 30 seconds.
+    //
+	begin3Method, err := RT.CreateMethod("",nil,"begin", []string{"timeoutSeconds"}, []string{"Int"}, []string{"String"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	begin3Method.PrimitiveCode = builtinBeginTransaction
+
+    // err = begin "READ" 30  // Begins a db transaction usable only for reading, with a 30 second timeout.
+    //
+	begin4Method, err := RT.CreateMethod("",nil,"begin", []string{"transactionType","timeoutSeconds"}, []string{"String","Int"}, []string{"String"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	begin4Method.PrimitiveCode = builtinBeginTransaction
+
 
     // err = local  // Begins a db transaction which TODO: never contributes new or fetched-from-db objects to the global
     //              // in-memory object cache. On success returns an empty string.
@@ -1281,6 +1395,67 @@ func InitBuiltinFunctions(relishRoot string) {
 	}
 	rollbackMethod.PrimitiveCode = builtinRollbackTransaction	
 
+    // err = transact block  // Runs the block (a closure with no parameters) in a db transaction, then commits.
+    //                       // If the commit fails because the db is busy or locked, rolls back then re-runs
+    //                       // the whole block in a new transaction, up to the -txtries limit.
+    //                       // If the block returns a non-empty String, that is taken to be an error; the
+    //                       // transaction is rolled back and the String is returned.
+    //                       // On success returns an empty string. If the db stayed busy or locked, returns a
+    //                       // String beginning with "TRANSACTION BUSY" or "TRANSACTION LOCKED". Other failures
+    //                       // to begin or commit return a String beginning with "TRANSACTION FAILED".
+    //
+	transactMethod, err := RT.CreateMethod("",nil,"transact", []string{"block"}, []string{"Callable"}, []string{"String"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	transactMethod.PrimitiveCode = builtinTransact	
+
+    // err = transact block "READ"  // Same, but the transaction is usable only for reading.
+    //
+	transact2Method, err := RT.CreateMethod("",nil,"transact", []string{"block","transactionType"}, []string{"Callable","String"}, []string{"String"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	transact2Method.PrimitiveCode = builtinTransact	
+
+    // err = onCommit callback  // Registers a closure to be called after each transaction commits that dirtied 
+    //                          // persistent objects. The closure is passed a map from each dirty object to the 
+    //                          // list of names of its attributes that were changed in the transaction:
+    //                          //    onCommit func changes {} Any > [] String > err String ...
+    //
+	onCommitMethod, err := RT.CreateMethod("",nil,"onCommit", []string{"callback"}, []string{"Callable"}, []string{"String"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	onCommitMethod.PrimitiveCode = builtinOnCommit	
+
+    // err = onCommit "shared.relish.pl2012/shapes/Circle" callback  // Same, but only called for transactions that dirtied 
+    //                                                             // objects of the type (or a subtype), and only
+    //                                                             // passed those objects.
+    //
+	onCommit2Method, err := RT.CreateMethod("",nil,"onCommit", []string{"typeName","callback"}, []string{"String","Callable"}, []string{"String"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	onCommit2Method.PrimitiveCode = builtinOnCommit	
+
+    // err = onRollback callback  // Registers a closure to be called after each transaction that dirtied persistent objects 
+    //                            // rolls back. Passed the same map as an onCommit callback.
+    //
+	onRollbackMethod, err := RT.CreateMethod("",nil,"onRollback", []string{"callback"}, []string{"Callable"}, []string{"String"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	onRollbackMethod.PrimitiveCode = builtinOnRollback	
+
+    // err = onRollback typeName callback
+    //
+	onRollback2Method, err := RT.CreateMethod("",nil,"onRollback", []string{"typeName","callback"}, []string{"String","Callable"}, []string{"String"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	onRollback2Method.PrimitiveCode = builtinOnRollback	
+
 
     ///////////////////////////////////////////////////////////
     // Context map functions. The context is a non-persistent map from String name to object, which
@@ -1954,6 +2129,30 @@ urlPathPartDecode s > String
 	}
 	clearMethod.PrimitiveCode = builtinClear
 
+	// insert list List i Int val Any
+	//
+	// Inserts the value into the list at index i, moving the elements at and after i up one place.
+	//
+	insertMethod, err := RT.CreateMethod("",nil,"insert", []string{"list","i","val"}, []string{"List","Int","Any"},  nil, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	insertMethod.PrimitiveCode = builtinInsert
+
+	// bigList elementTypeName String > List
+	//
+	// Returns a new, empty big list of the element type. A big list keeps its elements only in the database
+	// once it is persistent, and reads them a page at a time, so it can hold more elements than fit in memory.
+	// An attribute is declared to be a big list with e.g. 
+	//
+	//    events [big] Event
+	//
+	bigListMethod, err := RT.CreateMethod("",nil,"bigList", []string{"elementTypeName"}, []string{"String"},  []string{"List"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	bigListMethod.PrimitiveCode = builtinBigList
+
 	/*
 	Defers (disables) auto-sorting on add element.
 	*/
@@ -2012,6 +2211,136 @@ urlPathPartDecode s > String
 	asList3Method.PrimitiveCode = builtinAsList2	
 
 
+	// asList 
+	//    coll Collection of T 
+	//    selectConditions String
+	//    asOf Time
+	// > 
+	//    List of T	
+	//
+	// Like asList coll selectConditions, but the list contains snapshots of the selected objects as they were
+	// at time asOf. Requires audit log mode (-auditlog). The select conditions are applied to the state 
+	// of the objects at time asOf, so the list has the objects that the query would have selected then.
+	//
+	asList4Method, err := RT.CreateMethod("",nil,"asList", []string{"c","selectConditions","asOf"}, []string{"Collection","String","Time"},  []string{"List"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	asList4Method.PrimitiveCode = builtinAsList2	
+
+	asList5Method, err := RT.CreateMethod("",nil,"asList", []string{"c","selectConditionsWithArgs","asOf"}, []string{"Collection","List","Time"},  []string{"List"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	asList5Method.PrimitiveCode = builtinAsList2	
+
+
+	// aggregate 
+	//    typeName String 
+	//    aggregateQuery String
+	// > 
+	//    List of List	
+	//
+	// Runs an aggregate query such as "category, sum(price), count(*) where price > 0 group by category"
+	// in the database, against the objects of the named datatype, without fetching the objects.
+	// Returns a list of rows, each a list of the selected values.
+	// The aggregateQuery may instead be a list of the query String followed by the values of its ? parameters.
+	// The first argument may instead be a persistent collection, whose elements are queried.
+	//
+	aggregateMethod, err := RT.CreateMethod("",nil,"aggregate", []string{"typeName","aggregateQuery"}, []string{"String","String"},  []string{"List"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	aggregateMethod.PrimitiveCode = builtinAggregate	
+
+	aggregate2Method, err := RT.CreateMethod("",nil,"aggregate", []string{"typeName","aggregateQueryWithArgs"}, []string{"String","List"},  []string{"List"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	aggregate2Method.PrimitiveCode = builtinAggregate	
+
+	aggregate3Method, err := RT.CreateMethod("",nil,"aggregate", []string{"c","aggregateQuery"}, []string{"Collection","String"},  []string{"List"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	aggregate3Method.PrimitiveCode = builtinAggregate	
+
+	aggregate4Method, err := RT.CreateMethod("",nil,"aggregate", []string{"c","aggregateQueryWithArgs"}, []string{"Collection","List"},  []string{"List"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	aggregate4Method.PrimitiveCode = builtinAggregate	
+
+
+	// stream 
+	//    typeName String 
+	//    selectConditions String
+	// > 
+	//    ResultSet of T	
+	//
+	// Like asList, but returns a result set, which reads the selected objects from the database a batch at a time,
+	// as a for loop over the result set asks for them, so that a large result need not be held in memory.
+	// A result set can be iterated over only once.
+	// Each batch is read from its own snapshot of the database, unless the thread is in a transaction,
+	// so an object changed while the result set is being read may be missed or read twice.
+	// The selectConditions may instead be a list of the conditions String followed by the values of its ? parameters.
+	// The first argument may instead be a persistent collection, whose elements are selected.
+	//
+	// If an after argument is given, the result set starts after that object, in the order given by the
+	// order by clause of the conditions, so that successive pages of a listing can each be selected by 
+	// a query which starts after the last object of the previous page.
+	//
+	//    for car in stream "vehicles/Car" "speed > 60 order by speed desc limit 20" lastCarOfPreviousPage
+	//
+	streamMethod, err := RT.CreateMethod("",nil,"stream", []string{"typeName","selectConditions"}, []string{"String","String"},  []string{"ResultSet"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	streamMethod.PrimitiveCode = builtinStream	
+
+	stream2Method, err := RT.CreateMethod("",nil,"stream", []string{"typeName","selectConditionsWithArgs"}, []string{"String","List"},  []string{"ResultSet"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	stream2Method.PrimitiveCode = builtinStream	
+
+	stream3Method, err := RT.CreateMethod("",nil,"stream", []string{"c","selectConditions"}, []string{"Collection","String"},  []string{"ResultSet"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	stream3Method.PrimitiveCode = builtinStream	
+
+	stream4Method, err := RT.CreateMethod("",nil,"stream", []string{"c","selectConditionsWithArgs"}, []string{"Collection","List"},  []string{"ResultSet"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	stream4Method.PrimitiveCode = builtinStream	
+
+	stream5Method, err := RT.CreateMethod("",nil,"stream", []string{"typeName","selectConditions","after"}, []string{"String","String","Any"},  []string{"ResultSet"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	stream5Method.PrimitiveCode = builtinStream	
+
+	stream6Method, err := RT.CreateMethod("",nil,"stream", []string{"typeName","selectConditionsWithArgs","after"}, []string{"String","List","Any"},  []string{"ResultSet"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	stream6Method.PrimitiveCode = builtinStream	
+
+	stream7Method, err := RT.CreateMethod("",nil,"stream", []string{"c","selectConditions","after"}, []string{"Collection","String","Any"},  []string{"ResultSet"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	stream7Method.PrimitiveCode = builtinStream	
+
+	stream8Method, err := RT.CreateMethod("",nil,"stream", []string{"c","selectConditionsWithArgs","after"}, []string{"Collection","List","Any"},  []string{"ResultSet"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	stream8Method.PrimitiveCode = builtinStream	
+
+
 /*
 	slice s List of T start Int end Int > List of T
 
@@ -4042,6 +4371,101 @@ func builtinRenameObject(th InterpreterThread, objects []RObject) []RObject {
 }
 
 
+/*
+attachDatabase name String location String > err String
+*/
+func builtinAttachDatabase(th InterpreterThread, objects []RObject) []RObject {
+	name := objects[0].String()
+	location := objects[1].String()
+
+	var errStr string
+	err := relish.AttachDatabase(th, name, location)
+	if err != nil {
+		errStr = err.Error()
+	}
+	return []RObject{String(errStr)}
+}
+
+/*
+backupDatabase path String > err String
+backupDatabase name String path String > err String
+*/
+func builtinBackupDatabase(th InterpreterThread, objects []RObject) []RObject {
+	var name string
+	path := objects[len(objects)-1].String()
+	if len(objects) == 2 {
+		name = objects[0].String()
+	}
+
+	var errStr string
+	err := relish.BackupDatabase(name, path)
+	if err != nil {
+		errStr = err.Error()
+	}
+	return []RObject{String(errStr)}
+}
+
+/*
+exportDatabase path String > n Int err String
+*/
+func builtinExportDatabase(th InterpreterThread, objects []RObject) []RObject {
+	path := objects[0].String()
+
+	var errStr string
+	n, err := relish.ExportDatabase(th, path)
+	if err != nil {
+		errStr = err.Error()
+	}
+	return []RObject{Int(n), String(errStr)}
+}
+
+/*
+importDatabase path String > n Int err String
+*/
+func builtinImportDatabase(th InterpreterThread, objects []RObject) []RObject {
+	path := objects[0].String()
+
+	var errStr string
+	n, err := relish.ImportDatabase(th, path)
+	if err != nil {
+		errStr = err.Error()
+	}
+	return []RObject{Int(n), String(errStr)}
+}
+
+/*
+useDatabase name String > previous String err String
+*/
+func builtinUseDatabase(th InterpreterThread, objects []RObject) []RObject {
+	relish.EnsureDatabase()
+	name := objects[0].String()
+
+	var errStr string
+	previous, err := th.UseDatabase(name)
+	if err != nil {
+		errStr = err.Error()
+	}
+	return []RObject{String(previous), String(errStr)}
+}
+
+
+/*
+setActor actor String > previous String
+*/
+func builtinSetActor(th InterpreterThread, objects []RObject) []RObject {
+	previous := th.Actor()
+	th.SetActor(objects[0].String())
+	return []RObject{String(previous)}
+}
+
+/*
+actor > String
+*/
+func builtinActor(th InterpreterThread, objects []RObject) []RObject {
+	return []RObject{String(th.Actor())}
+}
+
+
 /*
 summon String > NonPrimitive
 
@@ -4077,6 +4501,42 @@ func builtinSummonById(th InterpreterThread, objects []RObject) []RObject {
 	return []RObject{obj}
 }
 
+/*
+summon name String asOf Time > NonPrimitive
+
+car1 = Car: summon "FEC 092" yesterday
+
+Returns a snapshot of the object as it was at the time, reconstructed from the change log. 
+Requires audit log mode (-auditlog).
+The snapshot is a new object which is not persistent. Its attributes refer to snapshots of associated objects,
+as of the same time, but the attributes of those associated objects that are not primitive-valued are unset.
+*/
+func builtinSummonAsOf(th InterpreterThread, objects []RObject) []RObject {
+	relish.EnsureDatabase()
+	name := objects[0].String()
+	asOf := time.Time(objects[1].(RTime))
+
+	obj, err := th.DBT().FetchByNameAsOf(name, 1, asOf)
+	if err != nil {
+		panic(err)
+	}
+
+	return []RObject{obj}
+}
+
+func builtinSummonByIdAsOf(th InterpreterThread, objects []RObject) []RObject {
+	relish.EnsureDatabase()
+	dbid := int64(objects[0].(Int))
+	asOf := time.Time(objects[1].(RTime))
+
+	obj, err := th.DBT().FetchAsOf(dbid, 1, asOf)
+	if err != nil {
+		panic(err)
+	}
+
+	return []RObject{obj}
+}
+
 /*
 exists String > Bool
 
@@ -4116,14 +4576,32 @@ var transactionMutex sync.Mutex
 
 
 // err = begin  // Begins a db transaction. On success returns an empty string.
+//              // If already in a transaction, begins a nested transaction scope (a savepoint),
+//              // which the matching commit or rollback ends. A rollback of a nested scope undoes only 
+//              // the changes made within that scope, in the database and in memory.
+//
+// err = begin "READ"  // Begins a db transaction usable only for reading.
+//
+// err = begin timeoutSeconds  // Begins a db transaction with a deadline, overriding the -txtimeout default.
+//                             // If the transaction is still in progress at its deadline, the transaction watchdog
+//                             // rolls back its in-memory changes, threads waiting on its dirty objects get an error, 
+//                             // and the commit fails with an error beginning "TRANSACTION TIMED OUT".
+//                             // The timeout is ignored when beginning a nested transaction scope.
+//
+// err = begin "READ" timeoutSeconds
 //
 func builtinBeginTransaction(th InterpreterThread, objects []RObject) []RObject {
 
     transactionType := "EXCLUSIVE"
-    if len(objects) > 0 {
-	   transactionTypeKeyword := objects[0].String()
-	   if transactionTypeKeyword == "READ" {
-	   	   transactionType = "DEFERRED"
+    timeoutSeconds := -1
+    for _, obj := range objects {
+       switch arg := obj.(type) {
+       case Int:
+          timeoutSeconds = int(arg)
+       default:
+	      if arg.String() == "READ" {
+	   	     transactionType = "DEFERRED"
+	      }
 	   }
     }
 	th.AllowGC()	
@@ -4134,7 +4612,11 @@ func builtinBeginTransaction(th InterpreterThread, objects []RObject) []RObject
     var errStr string
 
     if th.Transaction() != nil {
-    	errStr = "Cannot begin a transaction. Goroutine is already participating in an active transaction."
+    	// Nested begin. Begin a nested transaction scope (a savepoint) in the active transaction.
+    	err := BeginNestedTransaction(th)
+		if err != nil {
+			errStr = err.Error()
+		}
     } else {
 	    transactionMutex.Unlock()    	
 	    err := th.DBT().BeginTransaction(transactionType)
@@ -4146,7 +4628,11 @@ func builtinBeginTransaction(th InterpreterThread, objects []RObject) []RObject
 		if err != nil {
 			errStr = err.Error()
 		} else {
-		    th.SetTransaction(NewTransaction())
+		    tx := NewTransaction()
+		    if timeoutSeconds >= 0 {
+		       tx.SetTimeout(time.Duration(timeoutSeconds) * time.Second)
+		    }
+		    th.SetTransaction(tx)
 	    }
     }
 	return []RObject{String(errStr)}
@@ -4176,8 +4662,14 @@ func builtinBeginLocalTransaction(th InterpreterThread, objects []RObject) []ROb
 
 
 // err = commit  // Commits the in-progress db transaction. On success returns an empty string.
-//               // On failure, retries after 2 seconds, then again after 4 more seconds,
-//               // then if still failed, tries a rollback.         
+//               // If the db is busy or locked, retries with increasing delays, according to the
+//               // transaction retry policy, then if still failed, tries a rollback.         
+//               // The error String then begins with "TRANSACTION BUSY" or "TRANSACTION LOCKED".
+//               // If the transaction timed out, rolls it back, and the error String begins with "TRANSACTION TIMED OUT".
+//               // In optimistic concurrency mode (-optimistic), if objects written in the transaction had been changed 
+//               // by another connection since they were loaded, rolls it back, and the error String begins with 
+//               // "TRANSACTION CONFLICT" and lists the stale objects. Re-running the transaction will see their current state.
+//               // Use transact instead, to have the whole transaction re-run.
 //               // If failed, whether or not successfully rolled back, leaves the dirty persistent objects 
 //               // pointing to the RolledBackTransaction, so they will be refreshed from DB.
 //               // If succeeded, the dirty persistent objects are marked as clean.
@@ -4186,6 +4678,8 @@ func builtinBeginLocalTransaction(th InterpreterThread, objects []RObject) []ROb
 //               // global in-memory object cache if they were not already there.
 //
 func builtinCommitTransaction(th InterpreterThread, objects []RObject) []RObject {
+	var endedTx *RTransaction
+	defer runTransactionHooksOf(th, &endedTx)  // Deferred first, so runs after the mutex is unlocked
 	th.AllowGC()
 	transactionMutex.Lock()
 	th.DisallowGC()
@@ -4195,22 +4689,37 @@ func builtinCommitTransaction(th InterpreterThread, objects []RObject) []RObject
 
     if th.Transaction() == nil {
     	errStr = "Cannot commit transaction. Goroutine is not participating in an active transaction."
+    } else if th.Transaction().Savepoint() != nil {  // Commit the innermost nested transaction scope.
+        err := CommitNestedTransaction(th)
+		if err != nil {
+			errStr = err.Error()
+            rollBackErr := RollbackNestedTransaction(th)
+            if rollBackErr != nil {
+               errStr = fmt.Sprintf("%s. Rollback also failed: %s",errStr,rollBackErr)
+            }
+		}
     } else {
-	    err := th.DBT().CommitTransaction()
+	    err := th.Transaction().CommitError()  // A timed-out or conflicting transaction must be rolled back in the db.
+	    if err == nil {
+	       err = th.DBT().CommitTransaction()
+	    }
 		if err != nil {
 			errStr = err.Error()
 
-           rollBackErrStr := rollbackTransactionCore(th)
+           var rollBackErrStr string
+           rollBackErrStr, endedTx = rollbackTransactionCore(th)
            if rollBackErrStr != "" {
               errStr = fmt.Sprintf("%s. Rollback also failed: %s",errStr,rollBackErrStr)
               th.DBT().ReleaseDB()
               // Roll back the state of the in memory objects anyway, forcing re-load
               // of objects from database.
-              th.Transaction().RollBack()	
+              endedTx = th.Transaction()
+              endedTx.RollBack()	
               th.SetTransaction(nil)	
            }
 		} else {  // db commit succeeded
-		   th.Transaction().Commit()	
+		   endedTx = th.Transaction()
+		   endedTx.Commit()	
 		   th.SetTransaction(nil)	
 		}	
     }
@@ -4227,18 +4736,32 @@ func builtinCommitTransaction(th InterpreterThread, objects []RObject) []RObject
 //                 // RIGHT NOW UPON ROLLBACK, OR ON DEMAND IN GET-ATTR-VAL OPERATION?
 //
 func builtinRollbackTransaction(th InterpreterThread, objects []RObject) []RObject {
+	var endedTx *RTransaction
+	defer runTransactionHooksOf(th, &endedTx)  // Deferred first, so runs after the mutex is unlocked
 	th.AllowGC()
 	transactionMutex.Lock()
 	th.DisallowGC()
 	defer transactionMutex.Unlock()	
 	relish.EnsureDatabase()
-    errStr := rollbackTransactionCore(th)
 
-    if errStr != "" {
+    if th.Transaction() != nil && th.Transaction().Savepoint() != nil {  // Roll back the innermost nested transaction scope.
+       var errStr string
+       err := RollbackNestedTransaction(th)
+       if err != nil {
+          errStr = err.Error()
+       }
+	   return []RObject{String(errStr)}
+    }
+
+    var errStr string
+    errStr, endedTx = rollbackTransactionCore(th)
+
+    if errStr != "" && th.Transaction() != nil {
     	th.DBT().ReleaseDB()
         // Roll back the state of the in memory objects anyway, forcing re-load
         // of objects from database.
-        th.Transaction().RollBack()	
+        endedTx = th.Transaction()
+        endedTx.RollBack()	
         th.SetTransaction(nil)	
     }
 
@@ -4246,9 +4769,12 @@ func builtinRollbackTransaction(th InterpreterThread, objects []RObject) []RObje
 	return []RObject{String(errStr)}
 }
 
-func rollbackTransactionCore(th InterpreterThread) string {
-    var errStr string
-
+/*
+Rolls back the thread's transaction in the db and, if that succeeds, in memory.
+Returns the transaction, if it was ended, so that the caller can run its transaction hooks
+once it has unlocked the transactionMutex.
+*/
+func rollbackTransactionCore(th InterpreterThread) (errStr string, endedTx *RTransaction) {
     if th.Transaction() == nil {
     	errStr = "Cannot rollback transaction. Goroutine is not participating in an active transaction."
     } else {
@@ -4256,11 +4782,108 @@ func rollbackTransactionCore(th InterpreterThread) string {
 		if err != nil {
 			errStr = err.Error()
 		} else {
-		   th.Transaction().RollBack()	
+		   endedTx = th.Transaction()
+		   endedTx.RollBack()	
 		   th.SetTransaction(nil)			
 		}
     }
-	return errStr
+	return
+}
+
+/*
+Runs the hooks of the transaction *endedTx, if the commit or rollback builtin ended one.
+Must not be called with the transactionMutex locked, since a hook may begin, commit or roll back 
+a transaction of its own, and other threads must not wait for the hooks.
+*/
+func runTransactionHooksOf(th InterpreterThread, endedTx **RTransaction) {
+	if *endedTx != nil {
+		RunTransactionHooks(th, *endedTx)
+	}
+}
+
+
+// err = transact block  // Runs the block (a closure with no parameters) in a db transaction, then commits.
+//                       // If the commit fails because the db is busy or locked, rolls back then re-runs
+//                       // the whole block in a new transaction, according to the transaction retry policy.
+//
+// err = transact block "READ"  // Same, but the transaction is usable only for reading.
+//
+func builtinTransact(th InterpreterThread, objects []RObject) []RObject {
+	relish.EnsureDatabase()
+
+	closure, isClosure := objects[0].(*RClosure)
+	if ! isClosure {
+		return []RObject{String("transact requires a closure (func ...) as its block.")}
+	}
+	if len(closure.Method.ParameterNames) != 0 {
+		return []RObject{String("transact requires a closure with no parameters as its block.")}
+	}
+
+	transactionType := "EXCLUSIVE"
+	if len(objects) > 1 && objects[1].String() == "READ" {
+		transactionType = "DEFERRED"
+	}
+
+	err := RunTransaction(th, transactionType, DefaultTransactionRetryPolicy(), func() error {
+		results := th.EvaluationContext().EvalClosureCall(closure, nil)
+		if len(results) > 0 && results[0] != nil {
+			if errStr, isString := results[0].(String); isString && errStr != "" {
+				return errors.New(string(errStr))
+			}
+		}
+		return nil
+	})
+
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+	return []RObject{String(errStr)}
+}
+
+
+// err = onCommit callback  
+// err = onCommit typeName callback  
+//
+func builtinOnCommit(th InterpreterThread, objects []RObject) []RObject {
+	typ, closure, errStr := transactionHookArgs("onCommit", objects)
+	if errStr == "" {
+		AddAfterCommitHook(typ, closure)
+	}
+	return []RObject{String(errStr)}
+}
+
+// err = onRollback callback  
+// err = onRollback typeName callback  
+//
+func builtinOnRollback(th InterpreterThread, objects []RObject) []RObject {
+	typ, closure, errStr := transactionHookArgs("onRollback", objects)
+	if errStr == "" {
+		AddAfterRollbackHook(typ, closure)
+	}
+	return []RObject{String(errStr)}
+}
+
+/*
+Returns the data type (or nil if no type name was given) and the callback closure of a transaction hook.
+*/
+func transactionHookArgs(builtinName string, objects []RObject) (typ *RType, closure *RClosure, errStr string) {
+	if len(objects) > 1 {
+		typeName := objects[0].String()
+		var found bool
+		typ, found = RT.Types[typeName]
+		if ! found {
+			errStr = fmt.Sprintf("%s: No data type has name '%s'.", builtinName, typeName)
+			return
+		}
+	}
+	closure, isClosure := objects[len(objects)-1].(*RClosure)
+	if ! isClosure {
+		errStr = builtinName + " requires a closure (func ...) as its callback."
+	} else if len(closure.Method.ParameterNames) != 1 {
+		errStr = builtinName + " requires a closure with one parameter {} Any > [] String as its callback."
+	}
+	return
 }
 
 
@@ -4391,6 +5014,31 @@ func builtinClear(th InterpreterThread, objects []RObject) []RObject {
 	return []RObject{}
 }
 
+func builtinInsert(th InterpreterThread, objects []RObject) []RObject {
+	list,isInsertable := objects[0].(Insertable)
+	if ! isInsertable {
+		rterr.Stop("Can only insert into a list.")
+	}
+	i := int(int64(objects[1].(Int)))
+	err := RT.InsertIntoCollection(th, list, i, objects[2])
+	if err != nil {
+		rterr.Stop(err)
+	}
+	return []RObject{}
+}
+
+func builtinBigList(th InterpreterThread, objects []RObject) []RObject {
+	elementType, err := RT.LookupType(string(objects[0].(String)))
+	if err != nil {
+		rterr.Stop(err)
+	}
+	list, err := RT.Newrbiglist(elementType, 0, -1, nil, nil)
+	if err != nil {
+		rterr.Stop(err)
+	}
+	return []RObject{list}
+}
+
 /*
 Defers (disables) auto-sorting on add element.
 */
@@ -4455,25 +5103,11 @@ func builtinAsList(th InterpreterThread, objects []RObject) []RObject {
 
 
 /*
-In the database, select the elements of the persistent collection which meet the select clause conditions,
-to form a list with the same element type constraint as
-the collection.
+Returns the query and the values of its ? parameters from a query argument of a builtin function, 
+which must be a String or a list starting with the query String.
 */
-func builtinAsList2(th InterpreterThread, objects []RObject) []RObject {
-	coll := objects[0].(RCollection)
-    qExpr := objects[1]
-
-    if coll.ElementType().IsPrimitive {
-		  rterr.Stop("asList with query argument can only be applied to a collection of objects, not to a collection of primitive values.")	
-    }
-
-    list, err := RT.Newrlist(coll.ElementType(),0,-1,nil,nil,nil)
-	if err != nil {
-		panic(err)
-	}
-
-	query := ""
-	queryArgs := []RObject{}
+func queryAndArgs(qExpr RObject, funcName string) (query string, queryArgs []RObject) {
+	queryArgs = []RObject{}
 
 	isList := false
 	qS,isString := qExpr.(String)
@@ -4501,9 +5135,31 @@ func builtinAsList2(th InterpreterThread, objects []RObject) []RObject {
 			} 
 		}
 		if ! (isString || isList) {   
-		  rterr.Stop("asList second argument must be a String or a list starting with a String.")	
+		  rterr.Stopf("%s second argument must be a String or a list starting with a String.", funcName)	
 		}
 	}
+	return
+}
+
+/*
+In the database, select the elements of the persistent collection which meet the select clause conditions,
+to form a list with the same element type constraint as
+the collection.
+*/
+func builtinAsList2(th InterpreterThread, objects []RObject) []RObject {
+	coll := objects[0].(RCollection)
+    qExpr := objects[1]
+
+    if coll.ElementType().IsPrimitive {
+		  rterr.Stop("asList with query argument can only be applied to a collection of objects, not to a collection of primitive values.")	
+    }
+
+    list, err := RT.Newrlist(coll.ElementType(),0,-1,nil,nil,nil)
+	if err != nil {
+		panic(err)
+	}
+
+	query, queryArgs := queryAndArgs(qExpr, "asList")
 	radius := 1
 	if strings.HasPrefix(query, "lazy: ") {
 	 query = query[6:]
@@ -4512,6 +5168,16 @@ func builtinAsList2(th InterpreterThread, objects []RObject) []RObject {
 
 	objs := []RObject{} // TODO Use the existing List's RVector somehow
 
+	if len(objects) > 2 { // asOf time
+		asOf := time.Time(objects[2].(RTime))
+		err = th.DBT().FetchNAsOf(list.ElementType(), query, queryArgs, coll, radius, asOf, &objs)
+		if err != nil {
+		  rterr.Stop(err)
+		}	
+		list.ReplaceContents(objs)
+		return []RObject{list}
+	}
+
 	mayContainProxies, err := th.DBT().FetchN(list.ElementType(), query, queryArgs, coll, radius, &objs)		
 	if err != nil {
 	  rterr.Stop(err)
@@ -4525,6 +5191,103 @@ func builtinAsList2(th InterpreterThread, objects []RObject) []RObject {
 
 
 
+/*
+aggregate typeName String query String > List of List
+aggregate c Collection query String > List of List
+
+Runs the aggregate query in the database against the objects of the named datatype, or against the elements
+of the persistent collection, and returns a list of the rows of selected values. Each row is a list.
+*/
+func builtinAggregate(th InterpreterThread, objects []RObject) []RObject {
+	var typ *RType
+	var coll RCollection
+	if typeName, isString := objects[0].(String); isString {
+		var err error
+		typ, err = RT.LookupType(string(typeName))
+		if err != nil {
+		   rterr.Stop(err)
+		}
+	} else {
+		coll = objects[0].(RCollection)
+		if coll.ElementType().IsPrimitive {
+		   rterr.Stop("aggregate can only be applied to a collection of objects, not to a collection of primitive values.")	
+		}
+		typ = coll.ElementType()
+	}
+	query, queryArgs := queryAndArgs(objects[1], "aggregate")
+
+	rows, err := th.DBT().FetchAggregate(typ, query, queryArgs, coll)
+	if err != nil {
+	   rterr.Stop(err)
+	}
+
+	rowType, err := RT.GetListType(AnyType)
+	if err != nil {
+		panic(err)
+	}
+    list, err := RT.Newrlist(rowType,0,-1,nil,nil,nil)
+	if err != nil {
+		panic(err)
+	}
+	for _, row := range rows {
+	    rowList, err := RT.Newrlist(AnyType,0,-1,nil,nil,nil)
+		if err != nil {
+			panic(err)
+		}
+		rowList.ReplaceContents(row)
+		list.AddSimple(rowList)
+	}
+	return []RObject{list}
+}
+
+/*
+The number of objects that a result set reads from the database at a time.
+*/
+const STREAM_BATCH_SIZE = 100
+
+/*
+stream typeName String selectConditions String > ResultSet of T
+stream c Collection selectConditions String > ResultSet of T
+
+Returns a result set over the objects of the named datatype, or the elements of the persistent collection,
+which meet the select conditions. An optional third argument is the object to start after.
+The "lazy: " prefix on the conditions has the same meaning as in asList.
+*/
+func builtinStream(th InterpreterThread, objects []RObject) []RObject {
+	var typ *RType
+	var coll RCollection
+	if typeName, isString := objects[0].(String); isString {
+		var err error
+		typ, err = RT.LookupType(string(typeName))
+		if err != nil {
+		   rterr.Stop(err)
+		}
+	} else {
+		coll = objects[0].(RCollection)
+		if coll.ElementType().IsPrimitive {
+		   rterr.Stop("stream can only be applied to a collection of objects, not to a collection of primitive values.")	
+		}
+		typ = coll.ElementType()
+	}
+	query, queryArgs := queryAndArgs(objects[1], "stream")
+	radius := 1
+	if strings.HasPrefix(query, "lazy: ") {
+	 query = query[6:]
+	 radius = 0	 
+	}
+
+	var after RObject
+	if len(objects) > 2 && objects[2] != NIL {
+		after = objects[2]
+	}
+
+	cursor, err := th.DBT().OpenCursor(typ, query, queryArgs, coll, radius, STREAM_BATCH_SIZE, after)
+	if err != nil {
+	   rterr.Stop(err)
+	}
+	return []RObject{RT.NewResultSet(typ, cursor)}
+}
+
 /*
 Sort the sortable collection.
 */
@@ -4799,14 +5562,14 @@ func builtinTo(objects []RObject) []RObject {
 */
 
 func builtinChannelLen(th InterpreterThread, objects []RObject) []RObject {
-	c := objects[0].(*Channel)
+	c := objects[0].(RBufferedChannel)
 	var val RObject
 	val = Int(c.Length())
 	return []RObject{val}
 }
 
 func builtinChannelCap(th InterpreterThread, objects []RObject) []RObject {
-	c := objects[0].(*Channel)
+	c := objects[0].(RBufferedChannel)
 	var val RObject
 	val = Int(c.Cap())
 	return []RObject{val}
@@ -6381,6 +7144,7 @@ func builtinInitChannel(th InterpreterThread, objects []RObject) []RObject {
 		}
 	} 
 	c.Ch = make(chan RObject, n)
+	c.Done = make(chan struct{})
 	return []RObject{c}
 }
 
@@ -433,6 +433,8 @@ func InitHttpMethods() {
 		panic(err)
 	}
 	headers8Method.PrimitiveCode = headers						
+
+    initSessionMethods()
 }
 
 
@@ -0,0 +1,684 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU LESSER GPL v3 license, found in the LICENSE_LGPL3 file.
+
+package http_methods
+
+/*
+   session.go - server-side web sessions, which web dialog handler methods receive as an http_srv.Session
+   parameter, and the session stores which keep their state between requests.
+
+   A session is identified by a cookie. Its state is kept either in the cookie itself, which is signed so
+   that the client cannot alter it (the "cookie" store, the default), or in the relish database (the "db" store).
+   A session expires if it is not used for the session timeout. Each session has a CSRF token, which must
+   accompany POST, PUT, PATCH and DELETE requests to handlers that receive the session.
+*/
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"relish"
+	. "relish/dbg"
+	. "relish/runtime/data"
+	"strings"
+	"sync"
+	"time"
+)
+
+const SESSION_COOKIE_NAME = "RSESS"
+
+/*
+The name of the form field (keyword argument), or http header, which carries the session's CSRF token.
+*/
+const CSRF_TOKEN_FIELD = "csrf_token"
+const CSRF_TOKEN_HEADER = "X-CSRF-Token"
+
+const SESSION_TYPE_NAME = "shared.relish.pl2012/relish_lib/pkg/http_srv/Session"
+const STORED_SESSION_TYPE_NAME = "shared.relish.pl2012/relish_lib/pkg/http_srv/StoredSession"
+
+/*
+The state of a web session, as loaded from its session store at the start of a request.
+*/
+type Session struct {
+	id         string
+	csrfToken  string
+	values     map[string]string
+	expires    time.Time
+	isNew      bool
+	changed    bool   // values or ids changed, so the session must be saved
+	replacedId string // the id the session had before it was rotated or invalidated, whose stored state must be deleted
+	ended      bool   // invalidated; if no values are put afterwards, the session cookie is removed
+	mutex      sync.Mutex
+}
+
+/*
+Keeps the state of sessions between requests.
+Load returns the session identified by the value of the session cookie, or nil if there is no such unexpired session.
+Save stores the session and returns the session cookie value which identifies it.
+Delete removes the stored state of the session with the id, if the store keeps any.
+*/
+type SessionStore interface {
+	Load(th InterpreterThread, cookieValue string) (s *Session, err error)
+	Save(th InterpreterThread, s *Session) (cookieValue string, err error)
+	Delete(th InterpreterThread, id string) (err error)
+}
+
+var sessionStores = map[string]SessionStore{
+	"cookie": &cookieSessionStore{key: randomBytes(32)},
+	"db":     &dbSessionStore{},
+}
+
+var sessionStore SessionStore = sessionStores["cookie"]
+var sessionTimeout time.Duration = 30 * time.Minute
+var sessionConfigMutex sync.RWMutex
+
+/*
+Makes a session store available by name to configureSessions.
+*/
+func RegisterSessionStore(name string, store SessionStore) {
+	sessionConfigMutex.Lock()
+	defer sessionConfigMutex.Unlock()
+	sessionStores[name] = store
+}
+
+/*
+Selects the session store, the session timeout, and, if secret is not "", the secret with which the cookie store
+signs session cookies. Without a secret, the cookie store uses a random one, so sessions end when the program does.
+*/
+func ConfigureSessions(storeName string, timeout time.Duration, secret string) (err error) {
+	sessionConfigMutex.Lock()
+	defer sessionConfigMutex.Unlock()
+	store, found := sessionStores[storeName]
+	if !found {
+		err = fmt.Errorf("There is no session store named '%s'.", storeName)
+		return
+	}
+	if timeout <= 0 {
+		err = errors.New("The session timeout must be positive.")
+		return
+	}
+	if secret != "" {
+		sessionStores["cookie"].(*cookieSessionStore).setKey([]byte(secret))
+	}
+	sessionStore = store
+	sessionTimeout = timeout
+	return
+}
+
+func sessionConfig() (SessionStore, time.Duration) {
+	sessionConfigMutex.RLock()
+	defer sessionConfigMutex.RUnlock()
+	return sessionStore, sessionTimeout
+}
+
+/*
+Loads the session identified by the request's session cookie, or begins a new session if the request
+has none, or its session has expired or cannot be verified.
+*/
+func LoadSession(th InterpreterThread, r *http.Request) (s *Session, err error) {
+	store, timeout := sessionConfig()
+	if cookie, cookieErr := r.Cookie(SESSION_COOKIE_NAME); cookieErr == nil {
+		s, err = store.Load(th, cookie.Value)
+		if err != nil {
+			return
+		}
+	}
+	if s == nil {
+		s = newSession(timeout)
+	}
+	return
+}
+
+func newSession(timeout time.Duration) *Session {
+	return &Session{
+		id:        randomToken(),
+		csrfToken: randomToken(),
+		values:    make(map[string]string),
+		expires:   time.Now().Add(timeout),
+		isNew:     true,
+	}
+}
+
+/*
+Saves the session in the session store, if it has changed or must have its expiry extended, and returns the
+cookie that the response must set to identify it, or nil if the response need not set the cookie.
+*/
+func (s *Session) Save(th InterpreterThread, r *http.Request) (cookie *http.Cookie, err error) {
+	store, timeout := sessionConfig()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	if !s.changed && s.expires.Sub(now) > timeout*3/4 {
+		return // Saved recently enough that its expiry need not be extended yet.
+	}
+	if s.replacedId != "" {
+		err = store.Delete(th, s.replacedId)
+		if err != nil {
+			return
+		}
+		s.replacedId = ""
+	}
+	cookie = &http.Cookie{Name: SESSION_COOKIE_NAME, Path: "/", HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode}
+	if s.ended && len(s.values) == 0 {
+		err = store.Delete(th, s.id)
+		cookie.MaxAge = -1
+		return
+	}
+	s.expires = now.Add(timeout)
+	cookie.Value, err = store.Save(th, s)
+	if err != nil {
+		cookie = nil
+		return
+	}
+	cookie.MaxAge = int(timeout / time.Second)
+	s.changed = false
+	return
+}
+
+/*
+Returns a copy of the session's state, with which Reset can undo the changes made to the session since, such as
+by a handler method whose transaction is rolled back to be retried.
+*/
+func (s *Session) Snapshot() *Session {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	snapshot := &Session{}
+	s.copyTo(snapshot)
+	return snapshot
+}
+
+/*
+Returns the session to the state of the snapshot.
+*/
+func (s *Session) Reset(snapshot *Session) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	snapshot.copyTo(s)
+}
+
+func (s *Session) copyTo(to *Session) {
+	to.id = s.id
+	to.csrfToken = s.csrfToken
+	to.values = make(map[string]string, len(s.values))
+	for key, val := range s.values {
+		to.values[key] = val
+	}
+	to.expires = s.expires
+	to.isNew = s.isNew
+	to.changed = s.changed
+	to.replacedId = s.replacedId
+	to.ended = s.ended
+}
+
+/*
+Whether the token is the session's CSRF token. A new session has no token that a client could have sent.
+*/
+func (s *Session) CheckCSRFToken(token string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return !s.isNew && token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.csrfToken)) == 1
+}
+
+/*
+Gives the session a new id and CSRF token, keeping its values. Should be done when a user logs in, so that
+a session id which was known before the login cannot be used to act as the user.
+*/
+func (s *Session) rotate() {
+	if s.replacedId == "" && !s.isNew {
+		s.replacedId = s.id
+	}
+	s.id = randomToken()
+	s.csrfToken = randomToken()
+	s.changed = true
+}
+
+type sessionKey struct{}
+
+/*
+Returns a copy of the request which carries the session, for the handler method's session parameter.
+*/
+func WithSession(r *http.Request, s *Session) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionKey{}, s))
+}
+
+/*
+The session carried by the request, or nil.
+*/
+func RequestSession(r *http.Request) *Session {
+	s, _ := r.Context().Value(sessionKey{}).(*Session)
+	return s
+}
+
+/*
+Constructs an http_srv.Session object wrapping the session.
+*/
+func CreateSession(s *Session) (sessionObj RObject, err error) {
+	sessionObj, err = RT.NewObject(SESSION_TYPE_NAME)
+	if err != nil {
+		return
+	}
+	sessionObj.(*GoWrapper).GoObj = s
+	return
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func randomToken() string {
+	return base64.RawURLEncoding.EncodeToString(randomBytes(24))
+}
+
+/*
+The state of a session as it is encoded in a session cookie or stored in the database.
+*/
+type sessionState struct {
+	Id        string            `json:"id"`
+	CSRFToken string            `json:"csrf"`
+	Expires   int64             `json:"exp"`
+	Values    map[string]string `json:"values,omitempty"`
+}
+
+func (s *Session) state() *sessionState {
+	return &sessionState{s.id, s.csrfToken, s.expires.Unix(), s.values}
+}
+
+func (state *sessionState) session() *Session {
+	if state.Values == nil {
+		state.Values = make(map[string]string)
+	}
+	return &Session{id: state.Id, csrfToken: state.CSRFToken, values: state.Values, expires: time.Unix(state.Expires, 0)}
+}
+
+/////////////////////////////////////
+// Session stores
+
+/*
+Keeps the whole state of a session in the session cookie, signed with HMAC-SHA256 so that the client cannot alter it.
+The values are not encrypted, so the client can read them.
+As the client keeps the cookie, a session that is invalidated or rotated is revoked by remembering its id
+until its cookie would have expired. The revoked ids are kept in memory, so a program restarted with the
+same secret accepts the cookies of sessions revoked before the restart. The db store does not have this limit.
+*/
+type cookieSessionStore struct {
+	key     []byte
+	revoked map[string]time.Time // session id -> when the session's cookie expires at the latest
+	mutex   sync.RWMutex
+}
+
+func (store *cookieSessionStore) setKey(key []byte) {
+	store.mutex.Lock()
+	store.key = key
+	store.mutex.Unlock()
+}
+
+func (store *cookieSessionStore) sign(payload string) string {
+	store.mutex.RLock()
+	mac := hmac.New(sha256.New, store.key)
+	store.mutex.RUnlock()
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (store *cookieSessionStore) Load(th InterpreterThread, cookieValue string) (s *Session, err error) {
+	dot := strings.LastIndex(cookieValue, ".")
+	if dot < 0 || !hmac.Equal([]byte(store.sign(cookieValue[:dot])), []byte(cookieValue[dot+1:])) {
+		Logln(WEB_, "Ignoring a session cookie with an invalid signature.")
+		return
+	}
+	b, decodeErr := base64.RawURLEncoding.DecodeString(cookieValue[:dot])
+	if decodeErr != nil {
+		return
+	}
+	state := &sessionState{}
+	if json.Unmarshal(b, state) != nil || time.Now().Unix() > state.Expires {
+		return
+	}
+	store.mutex.RLock()
+	_, isRevoked := store.revoked[state.Id]
+	store.mutex.RUnlock()
+	if isRevoked {
+		return
+	}
+	s = state.session()
+	return
+}
+
+func (store *cookieSessionStore) Save(th InterpreterThread, s *Session) (cookieValue string, err error) {
+	b, err := json.Marshal(s.state())
+	if err != nil {
+		return
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	cookieValue = payload + "." + store.sign(payload)
+	if len(cookieValue) > 4000 {
+		err = errors.New("The session's values are too large to keep in a session cookie. Use the db session store.")
+	}
+	return
+}
+
+func (store *cookieSessionStore) Delete(th InterpreterThread, id string) (err error) {
+	_, timeout := sessionConfig()
+	now := time.Now()
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.revoked == nil {
+		store.revoked = make(map[string]time.Time)
+	}
+	for revokedId, expires := range store.revoked {
+		if now.After(expires) {
+			delete(store.revoked, revokedId)
+		}
+	}
+	store.revoked[id] = now.Add(timeout)
+	return
+}
+
+/*
+Keeps the state of each session in the relish database, as an http_srv.StoredSession object named by the
+session id, so that the session cookie only holds the id. Expired sessions are deleted as they are found,
+and all expired sessions are purged at most once per session timeout.
+*/
+type dbSessionStore struct {
+	lastPurge time.Time
+	mutex     sync.Mutex
+}
+
+const STORED_SESSION_NAME_PREFIX = "http_srv.session."
+
+func (store *dbSessionStore) Load(th InterpreterThread, cookieValue string) (s *Session, err error) {
+	if strings.Trim(cookieValue, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_") != "" {
+		return
+	}
+	relish.EnsureDatabase()
+	name := STORED_SESSION_NAME_PREFIX + cookieValue
+	found, err := th.DBT().ObjectNameExists(name)
+	if err != nil || !found {
+		return
+	}
+	obj, err := th.DBT().FetchByName(name, 1)
+	if err != nil {
+		return
+	}
+	state := &sessionState{}
+	data, _ := RT.AttrVal(th, obj, storedSessionAttr("data"))
+	if err = json.Unmarshal([]byte(data.String()), state); err != nil {
+		return
+	}
+	if time.Now().Unix() > state.Expires {
+		err = th.DBT().Delete(obj)
+		return
+	}
+	s = state.session()
+	return
+}
+
+func (store *dbSessionStore) Save(th InterpreterThread, s *Session) (cookieValue string, err error) {
+	relish.EnsureDatabase()
+	if err = store.Delete(th, s.id); err != nil {
+		return
+	}
+	b, err := json.Marshal(s.state())
+	if err != nil {
+		return
+	}
+	obj, err := RT.NewObject(STORED_SESSION_TYPE_NAME)
+	if err != nil {
+		return
+	}
+	RT.RestoreAttr(obj, storedSessionAttr("sessionId"), String(s.id))
+	RT.RestoreAttr(obj, storedSessionAttr("data"), String(b))
+	RT.RestoreAttr(obj, storedSessionAttr("expires"), RTime(s.expires))
+	dbt := th.DBT()
+	if err = dbt.EnsurePersisted(th, obj); err != nil {
+		return
+	}
+	if err = dbt.NameObject(obj, STORED_SESSION_NAME_PREFIX+s.id); err != nil {
+		return
+	}
+	cookieValue = s.id
+	err = store.purgeExpired(th)
+	return
+}
+
+func (store *dbSessionStore) Delete(th InterpreterThread, id string) (err error) {
+	name := STORED_SESSION_NAME_PREFIX + id
+	found, err := th.DBT().ObjectNameExists(name)
+	if err != nil || !found {
+		return
+	}
+	obj, err := th.DBT().FetchByName(name, 1)
+	if err != nil {
+		return
+	}
+	err = th.DBT().Delete(obj)
+	return
+}
+
+func (store *dbSessionStore) purgeExpired(th InterpreterThread) (err error) {
+	_, timeout := sessionConfig()
+	store.mutex.Lock()
+	if time.Since(store.lastPurge) < timeout {
+		store.mutex.Unlock()
+		return
+	}
+	store.lastPurge = time.Now()
+	store.mutex.Unlock()
+
+	var objs []RObject
+	_, err = th.DBT().FetchN(RT.Types[STORED_SESSION_TYPE_NAME], "expires < ?", []RObject{RTime(time.Now())}, nil, 1, &objs)
+	for _, obj := range objs {
+		if err != nil {
+			break
+		}
+		err = th.DBT().Delete(obj)
+	}
+	return
+}
+
+func storedSessionAttr(attrName string) *AttributeSpec {
+	typ, found := RT.Types[STORED_SESSION_TYPE_NAME]
+	if !found {
+		panic("The db session store needs the http_srv package to be imported.")
+	}
+	attr, _ := typ.GetAttribute(attrName)
+	return attr
+}
+
+/////////////////////////////////////
+// relish method to go method binding
+
+func initSessionMethods() {
+
+	// configureSessions store String timeoutMinutes Int secret String > err String
+	configureSessionsMethod, err := RT.CreateMethod("shared.relish.pl2012/relish_lib/pkg/http_srv", nil, "configureSessions", []string{"store", "timeoutMinutes", "secret"}, []string{"String", "Int", "String"}, []string{"String"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	configureSessionsMethod.PrimitiveCode = configureSessions
+
+	// get s Session key String > val String found Bool
+	getMethod, err := RT.CreateMethod("shared.relish.pl2012/relish_lib/pkg/http_srv", nil, "get", []string{"s", "key"}, []string{SESSION_TYPE_NAME, "String"}, []string{"String", "Bool"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	getMethod.PrimitiveCode = sessionGet
+
+	// put s Session key String val String
+	putMethod, err := RT.CreateMethod("shared.relish.pl2012/relish_lib/pkg/http_srv", nil, "put", []string{"s", "key", "val"}, []string{SESSION_TYPE_NAME, "String", "String"}, nil, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	putMethod.PrimitiveCode = sessionPut
+
+	// remove s Session key String
+	removeMethod, err := RT.CreateMethod("shared.relish.pl2012/relish_lib/pkg/http_srv", nil, "remove", []string{"s", "key"}, []string{SESSION_TYPE_NAME, "String"}, nil, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	removeMethod.PrimitiveCode = sessionRemove
+
+	// isNew s Session > Bool
+	isNewMethod, err := RT.CreateMethod("shared.relish.pl2012/relish_lib/pkg/http_srv", nil, "isNew", []string{"s"}, []string{SESSION_TYPE_NAME}, []string{"Bool"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	isNewMethod.PrimitiveCode = sessionIsNew
+
+	// expires s Session > Time
+	expiresMethod, err := RT.CreateMethod("shared.relish.pl2012/relish_lib/pkg/http_srv", nil, "expires", []string{"s"}, []string{SESSION_TYPE_NAME}, []string{"Time"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	expiresMethod.PrimitiveCode = sessionExpires
+
+	// csrfToken s Session > String
+	csrfTokenMethod, err := RT.CreateMethod("shared.relish.pl2012/relish_lib/pkg/http_srv", nil, "csrfToken", []string{"s"}, []string{SESSION_TYPE_NAME}, []string{"String"}, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	csrfTokenMethod.PrimitiveCode = sessionCsrfToken
+
+	// rotate s Session
+	rotateMethod, err := RT.CreateMethod("shared.relish.pl2012/relish_lib/pkg/http_srv", nil, "rotate", []string{"s"}, []string{SESSION_TYPE_NAME}, nil, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	rotateMethod.PrimitiveCode = sessionRotate
+
+	// invalidate s Session
+	invalidateMethod, err := RT.CreateMethod("shared.relish.pl2012/relish_lib/pkg/http_srv", nil, "invalidate", []string{"s"}, []string{SESSION_TYPE_NAME}, nil, false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	invalidateMethod.PrimitiveCode = sessionInvalidate
+}
+
+// configureSessions store String timeoutMinutes Int secret String > err String
+// """
+//  Selects the session store ("cookie" or "db"), the number of minutes after which an unused session expires,
+//  and the secret with which the cookie store signs session cookies. If secret is "", a random one is used,
+//  so sessions end when the program does.
+// """
+func configureSessions(th InterpreterThread, objects []RObject) []RObject {
+	storeName := string(objects[0].(String))
+	timeoutMinutes := int64(objects[1].(Int))
+	secret := string(objects[2].(String))
+
+	var errStr string
+	err := ConfigureSessions(storeName, time.Duration(timeoutMinutes)*time.Minute, secret)
+	if err != nil {
+		errStr = err.Error()
+	}
+	return []RObject{String(errStr)}
+}
+
+// get s Session key String > val String found Bool
+func sessionGet(th InterpreterThread, objects []RObject) []RObject {
+	s := objects[0].(*GoWrapper).GoObj.(*Session)
+	key := string(objects[1].(String))
+	s.mutex.Lock()
+	val, found := s.values[key]
+	s.mutex.Unlock()
+	return []RObject{String(val), Bool(found)}
+}
+
+// put s Session key String val String
+func sessionPut(th InterpreterThread, objects []RObject) []RObject {
+	s := objects[0].(*GoWrapper).GoObj.(*Session)
+	key := string(objects[1].(String))
+	val := string(objects[2].(String))
+	s.mutex.Lock()
+	s.values[key] = val
+	s.changed = true
+	s.mutex.Unlock()
+	return []RObject{}
+}
+
+// remove s Session key String
+func sessionRemove(th InterpreterThread, objects []RObject) []RObject {
+	s := objects[0].(*GoWrapper).GoObj.(*Session)
+	key := string(objects[1].(String))
+	s.mutex.Lock()
+	if _, found := s.values[key]; found {
+		delete(s.values, key)
+		s.changed = true
+	}
+	s.mutex.Unlock()
+	return []RObject{}
+}
+
+// isNew s Session > Bool
+// """
+//  Whether the session began with this request.
+// """
+func sessionIsNew(th InterpreterThread, objects []RObject) []RObject {
+	s := objects[0].(*GoWrapper).GoObj.(*Session)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return []RObject{Bool(s.isNew)}
+}
+
+// expires s Session > Time
+func sessionExpires(th InterpreterThread, objects []RObject) []RObject {
+	s := objects[0].(*GoWrapper).GoObj.(*Session)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return []RObject{RTime(s.expires)}
+}
+
+// csrfToken s Session > String
+// """
+//  The token which POST, PUT, PATCH and DELETE requests in the session must send, as the csrf_token form field
+//  or the X-CSRF-Token header. Typically put in a hidden field of each form of a page.
+// """
+func sessionCsrfToken(th InterpreterThread, objects []RObject) []RObject {
+	s := objects[0].(*GoWrapper).GoObj.(*Session)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.isNew {
+		s.changed = true // A new session must be kept, so that the token will be checkable.
+	}
+	return []RObject{String(s.csrfToken)}
+}
+
+// rotate s Session
+// """
+//  Gives the session a new id and CSRF token, keeping its values. Do this when a user logs in.
+// """
+func sessionRotate(th InterpreterThread, objects []RObject) []RObject {
+	s := objects[0].(*GoWrapper).GoObj.(*Session)
+	s.mutex.Lock()
+	s.rotate()
+	s.ended = false
+	s.mutex.Unlock()
+	return []RObject{}
+}
+
+// invalidate s Session
+// """
+//  Ends the session, removing its values, as when a user logs out.
+//  Values put in the session afterwards begin a new session.
+//  The session's cookie is no longer accepted, though with the cookie store, only until the program restarts.
+// """
+func sessionInvalidate(th InterpreterThread, objects []RObject) []RObject {
+	s := objects[0].(*GoWrapper).GoObj.(*Session)
+	s.mutex.Lock()
+	s.rotate()
+	s.values = make(map[string]string)
+	s.ended = true
+	s.mutex.Unlock()
+	return []RObject{}
+}
@@ -0,0 +1,432 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU LESSER GPL v3 license, found in the LICENSE_LGPL3 file.
+
+package http_methods
+
+/*
+   websocket.go - web sockets (RFC 6455), through which a WEBSOCKET web dialog handler method
+   exchanges messages with the client for as long as the method runs.
+
+   The handler method receives the web socket as its Channel parameter. Each message from the client
+   is received from the channel, as a String for a text message or as Bytes for a binary message.
+   Each value sent to the channel is sent to the client, as a text message if it is a String, as a
+   binary message if it is Bytes, or else as a text message of the value encoded in JSON.
+   Once the client has closed the web socket, receiving from the channel returns nil, and sending
+   to it ends the sending thread, which is the handler method's thread or a go thread.
+   The len and cap of the channel are those of its buffer of client messages not yet received.
+*/
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	. "relish/dbg"
+	"relish/rterr"
+	. "relish/runtime/data"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+The largest message which is accepted from a client. A larger one closes the web socket.
+*/
+const MAX_WEBSOCKET_MESSAGE_SIZE = 1 << 20
+
+/*
+The number of messages from the client which are buffered until the handler method receives them.
+*/
+const WEBSOCKET_CHANNEL_CAPACITY = 16
+
+/*
+How long closing a web socket waits to send the close frame to the client.
+*/
+const WEBSOCKET_CLOSE_TIMEOUT = 5 * time.Second
+
+const websocketAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsContinuationFrame = 0x0
+	wsTextFrame         = 0x1
+	wsBinaryFrame       = 0x2
+	wsCloseFrame        = 0x8
+	wsPingFrame         = 0x9
+	wsPongFrame         = 0xA
+)
+
+/*
+The close status codes which are sent to the client.
+*/
+const (
+	wsNormalClosure   = 1000
+	wsProtocolError   = 1002
+	wsMessageTooLarge = 1009
+)
+
+/*
+A web socket connection. It is a relish Channel, which receives the client's messages, and to which
+values can be sent to the client.
+*/
+type WebSocket struct {
+	Channel
+	conn       net.Conn
+	rw         *bufio.ReadWriter
+	writeMutex sync.Mutex
+	closed     <-chan struct{} // done once the web socket is closed
+	markClosed context.CancelFunc
+	closeOnce  sync.Once
+}
+
+/*
+Whether the request asks to open a web socket.
+*/
+func IsWebSocketRequest(r *http.Request) bool {
+	return r.Method == "GET" &&
+		headerContainsToken(r.Header, "Connection", "upgrade") &&
+		headerContainsToken(r.Header, "Upgrade", "websocket")
+}
+
+func headerContainsToken(header http.Header, name string, token string) bool {
+	for _, val := range header[name] {
+		for _, t := range strings.Split(val, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+Whether the web socket request comes from a page of the same host, or from no page. Browsers let pages
+of any site open web sockets to any host, with the user's cookies, so a web socket request from a page
+of another site must not be given the user's session.
+*/
+func IsSameOriginRequest(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	originUrl, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(originUrl.Host, r.Host)
+}
+
+/*
+Completes the web socket opening handshake, which the request must be, and starts receiving the client's messages.
+After this, the request's ResponseWriter can no longer be used.
+*/
+func AcceptWebSocket(w http.ResponseWriter, r *http.Request) (ws *WebSocket, err error) {
+	if !IsWebSocketRequest(r) {
+		err = errors.New("The request is not a web socket opening handshake.")
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		err = errors.New("Unsupported web socket protocol version.")
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		err = errors.New("The web socket opening handshake has no Sec-WebSocket-Key.")
+		return
+	}
+	hijacker, canHijack := w.(http.Hijacker)
+	if !canHijack {
+		err = errors.New("The web server cannot open web sockets.")
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	hash := sha1.Sum([]byte(key + websocketAcceptGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(hash[:]))
+	err = rw.Flush()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	closedContext, markClosed := context.WithCancel(context.Background())
+	ws = &WebSocket{
+		Channel:    Channel{Ch: make(chan RObject, WEBSOCKET_CHANNEL_CAPACITY), ElementType: AnyType},
+		conn:       conn,
+		rw:         rw,
+		closed:     closedContext.Done(),
+		markClosed: markClosed,
+	}
+	go ws.receive()
+	return
+}
+
+/*
+Receives the client's messages into the channel, answering pings, until the web socket is closed.
+A frame with an unknown opcode, a continuation frame with no message in progress, and a text or binary
+frame that starts a message before the previous message has ended, are protocol errors, which close
+the web socket.
+*/
+func (ws *WebSocket) receive() {
+	var message []byte
+	var messageOpcode byte
+	inMessage := false // whether a fragmented message has been started but not ended
+	for {
+		fin, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			if err != io.EOF {
+				Logln(WEB_, "Web socket:", err)
+			}
+			status := wsProtocolError
+			if err == errMessageTooLarge {
+				status = wsMessageTooLarge
+			}
+			ws.closeWithStatus(status)
+			return
+		}
+		switch opcode {
+		case wsPingFrame:
+			ws.writeFrame(wsPongFrame, payload)
+			continue
+		case wsPongFrame:
+			continue
+		case wsCloseFrame:
+			ws.closeWithStatus(wsNormalClosure)
+			return
+		case wsTextFrame, wsBinaryFrame:
+			if inMessage {
+				Logln(WEB_, "Web socket: new message started before the end of the fragmented message.")
+				ws.closeWithStatus(wsProtocolError)
+				return
+			}
+			message = payload
+			messageOpcode = opcode
+			inMessage = true
+		case wsContinuationFrame:
+			if !inMessage {
+				Logln(WEB_, "Web socket: continuation frame with no message in progress.")
+				ws.closeWithStatus(wsProtocolError)
+				return
+			}
+			message = append(message, payload...)
+		default:
+			Logln(WEB_, "Web socket: frame with unknown opcode", opcode)
+			ws.closeWithStatus(wsProtocolError)
+			return
+		}
+		if len(message) > MAX_WEBSOCKET_MESSAGE_SIZE {
+			ws.closeWithStatus(wsMessageTooLarge)
+			return
+		}
+		if !fin {
+			continue
+		}
+		inMessage = false
+		var val RObject
+		if messageOpcode == wsTextFrame {
+			val = String(message)
+		} else {
+			val = Bytes(message)
+		}
+		message = nil
+		RT.IncrementInTransitCount(val) // as if sent to the channel with the <- operator
+		select {
+		case ws.Ch <- val:
+		case <-ws.closed:
+			RT.DecrementInTransitCount(val)
+			return
+		}
+	}
+}
+
+var errMessageTooLarge = errors.New("Web socket message is too large.")
+
+/*
+Reads a frame sent by the client, which must be masked, and returns its unmasked payload.
+*/
+func (ws *WebSocket) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	_, err = io.ReadFull(ws.rw, header[:])
+	if err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	if header[1]&0x80 == 0 {
+		err = errors.New("Web socket frame from the client is not masked.")
+		return
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(ws.rw, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(ws.rw, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if err != nil {
+		return
+	}
+	if length > MAX_WEBSOCKET_MESSAGE_SIZE {
+		err = errMessageTooLarge
+		return
+	}
+	var mask [4]byte
+	_, err = io.ReadFull(ws.rw, mask[:])
+	if err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	_, err = io.ReadFull(ws.rw, payload)
+	if err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+/*
+Sends an unfragmented, unmasked frame to the client.
+*/
+func (ws *WebSocket) writeFrame(opcode byte, payload []byte) (err error) {
+	ws.writeMutex.Lock()
+	defer ws.writeMutex.Unlock()
+	header := []byte{0x80 | opcode, 0}
+	length := len(payload)
+	switch {
+	case length < 126:
+		header[1] = byte(length)
+	case length <= 0xFFFF:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+	_, err = ws.rw.Write(header)
+	if err == nil {
+		_, err = ws.rw.Write(payload)
+	}
+	if err == nil {
+		err = ws.rw.Flush()
+	}
+	return
+}
+
+/*
+Receives the next message from the client, or nil once the web socket is closed.
+*/
+func (ws *WebSocket) From() RObject {
+	select {
+	case val := <-ws.Ch:
+		return val
+	case <-ws.closed:
+	}
+	select {
+	case val := <-ws.Ch: // received before the web socket was closed
+		return val
+	default:
+	}
+	RT.IncrementInTransitCount(NIL) // the receiving thread takes NIL out of transit, as it would a sent value
+	return NIL
+}
+
+/*
+Sends the value to the client. If the web socket is closed, ends the thread, by panicking with ReceiverGone.
+*/
+func (ws *WebSocket) Send(th InterpreterThread, val RObject) {
+	var opcode byte = wsTextFrame
+	var payload []byte
+	switch v := val.(type) {
+	case String:
+		payload = []byte(string(v))
+	case Bytes:
+		opcode = wsBinaryFrame
+		payload = []byte(v)
+	default:
+		encoded, err := JsonMarshal(th, val, false)
+		if err != nil {
+			rterr.Stopf("Cannot send %v to the web socket: %s", val, err.Error())
+		}
+		payload = []byte(encoded)
+	}
+	select {
+	case <-ws.closed:
+		panic(ReceiverGone{})
+	default:
+	}
+	th.AllowGC()
+	err := ws.writeFrame(opcode, payload)
+	th.DisallowGC()
+	if err != nil {
+		Logln(WEB_, "Cannot send to the web socket:", err.Error())
+		ws.closeWithStatus(wsNormalClosure)
+		panic(ReceiverGone{})
+	}
+}
+
+/*
+Closes the web socket, if it is not already closed.
+*/
+func (ws *WebSocket) Close() {
+	ws.closeWithStatus(wsNormalClosure)
+}
+
+func (ws *WebSocket) closeWithStatus(status int) {
+	ws.closeOnce.Do(func() {
+		var payload [2]byte
+		binary.BigEndian.PutUint16(payload[:], uint16(status))
+		ws.conn.SetWriteDeadline(time.Now().Add(WEBSOCKET_CLOSE_TIMEOUT))
+		ws.writeFrame(wsCloseFrame, payload[:])
+		ws.markClosed()
+		ws.conn.Close()
+	})
+}
+
+func (ws *WebSocket) This() RObject {
+	return ws
+}
+
+func (ws *WebSocket) String() string {
+	return fmt.Sprintf("Channel (web socket %s)", ws.conn.RemoteAddr())
+}
+
+func (ws *WebSocket) Debug() string {
+	return ws.String()
+}
+
+type webSocketKey struct{}
+
+/*
+Returns a copy of the request which carries the web socket, for the handler method's Channel parameter.
+*/
+func WithWebSocket(r *http.Request, ws *WebSocket) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), webSocketKey{}, ws))
+}
+
+/*
+The web socket which the request opened, or nil.
+*/
+func RequestWebSocket(r *http.Request) *WebSocket {
+	if r == nil {
+		return nil
+	}
+	ws, _ := r.Context().Value(webSocketKey{}).(*WebSocket)
+	return ws
+}
@@ -399,6 +399,23 @@ func InitReflectMethods() {
 	getComplexAttributesMethod.PrimitiveCode = getComplexAttributes
 
 
+   changeLogEntryType := RT.Types["shared.relish.pl2012/relish_lib/pkg/reflect/ChangeLogEntry"]
+   changeLogEntryListType, err := RT.GetListType(changeLogEntryType) 
+ 	if err != nil {
+ 		panic(err)
+ 	}
+
+	getChangeHistoryMethod, err := RT.CreateMethod("shared.relish.pl2012/relish_lib/pkg/reflect",nil,"getChangeHistory", 
+		                                    []string{"reflectId"}, 
+		                                    []string{"String"}, 
+		                                    []string{changeLogEntryListType.Name}, 
+		                                    false, 0, false)
+	if err != nil {
+		panic(err)
+	}
+	getChangeHistoryMethod.PrimitiveCode = getChangeHistory
+
+
 	getCollectionInfoMethod, err := RT.CreateMethod("shared.relish.pl2012/relish_lib/pkg/reflect",nil,"getCollectionInfo", 
 		                                    []string{"reflectId"}, 
 		                                    []string{"String"}, 
@@ -1460,6 +1477,66 @@ func getComplexAttributes(th InterpreterThread, objects []RObject) []RObject {
 }
 
 
+/*
+getChangeHistory reflectId > [] ChangeLogEntry 
+"""
+ Get the changes to attributes of the persistent object that were recorded in the database's audit log,
+ oldest first. Empty if the object is not persistent or the program is not run with the -auditlog option.
+"""
+*/
+func getChangeHistory(th InterpreterThread, objects []RObject) []RObject {
+
+	reflectId := string(objects[0].(String))	
+    obj := objectByReflectId1(reflectId)
+
+    changeLogEntryType, typFound := RT.Types["shared.relish.pl2012/relish_lib/pkg/reflect/ChangeLogEntry"]
+    if ! typFound {
+    	panic("reflect.ChangeLogEntry is not defined.")
+    }
+
+    entryList, err := RT.Newrlist(changeLogEntryType, 0, -1, nil, nil, nil)
+    if err != nil {
+	   panic(err)
+    }
+
+    if obj == nil || obj == NIL || ! obj.IsStoredLocally() {
+    	return []RObject{entryList}
+    }
+
+    changes, err := th.DBT().ChangeHistory(obj)
+    if err != nil {
+	   panic(err)
+    }
+
+    for _, change := range changes {
+	    entry, err := RT.NewObject("shared.relish.pl2012/relish_lib/pkg/reflect/ChangeLogEntry")
+	    if err != nil {
+	       panic(err)
+	    }
+	    vals := map[string]RObject {
+	    	"txId": Int(change.TxId),
+	    	"attrName": String(change.AttrName),
+	    	"op": String(change.Op),
+	    	"key": String(change.Key),
+	    	"oldVal": String(change.OldVal),
+	    	"newVal": String(change.NewVal),
+	    	"time": RTime(change.Time),
+	    	"actor": String(change.Actor),
+	    }
+	    for attrName, val := range vals {
+	       attr, found := entry.Type().GetAttribute(attrName)
+	       if ! found {
+	    	  panic(fmt.Errorf("Hmm. Why does reflect.ChangeLogEntry not have an %s attribute?", attrName))
+	       }
+	       RT.RestoreAttr(entry, attr, val)
+	    }
+	    entryList.AddSimple(entry)
+    }
+
+	return []RObject{entryList}
+}
+
+
 func getCollectionInfo(th InterpreterThread, objects []RObject) []RObject {
 
 	reflectId := string(objects[0].(String))	
@@ -26,6 +26,7 @@ var NativeType = map [string] bool {
 	"shared.relish.pl2012/relish_lib/pkg/http_srv/UploadedFile" : true,	
 	"shared.relish.pl2012/relish_lib/pkg/http_srv/Cookie" : true,	
 	"shared.relish.pl2012/relish_lib/pkg/http_srv/Request" : true,
+	"shared.relish.pl2012/relish_lib/pkg/http_srv/Session" : true,
 	"shared.relish.pl2012/relish_lib/pkg/reflect/DataType" : true,	
 	"shared.relish.pl2012/relish_lib/pkg/reflect/Attribute" : true,		
 				
@@ -0,0 +1,137 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+// this package implements data persistence in the relish language environment.
+
+package persist
+
+/*
+   dialect.go - the differences between the SQL databases which can store relish data.
+
+   The persistence layer generates SQL in the sqlite dialect: table names are quoted with [ ],
+   parameters are ? or ?NNN, column types are sqlite's, and transactions are begun with
+   BEGIN DEFERRED|IMMEDIATE|EXCLUSIVE TRANSACTION. A Dialect translates each statement into the SQL of
+   its kind of database, as the statement is prepared by a connection to that database, and supplies the
+   few statements which cannot be translated one for one. It also classifies the database's errors.
+
+   The dialect of a database is chosen by the scheme of its name (see NewDB). The default is sqlite.
+*/
+
+import (
+   "strings"
+)
+
+type Dialect interface {
+   /*
+   The kind of database, e.g. "sqlite" or "postgres".
+   */
+   Name() string
+
+   /*
+   Translates a statement from the sqlite dialect into this dialect.
+   */
+   Translate(statement string) string
+
+   /*
+   The statements to execute when the database is opened. separatePools is true if there are separate
+   read and write connection pools, so that readers should see snapshots of the database without waiting
+   for writers.
+   */
+   SetupStatements(separatePools bool) []string
+
+   /*
+   A trivial read query, executed right after BEGIN DEFERRED TRANSACTION, so that the transaction
+   obtains its read snapshot of the database immediately.
+   */
+   SnapshotQuery() string
+
+   /*
+   A query which returns the value of the INTEGER PRIMARY KEY AUTOINCREMENT column of the row
+   most recently inserted by the connection.
+   */
+   LastInsertIdQuery() string
+
+   /*
+   The statements which make the table append-only, by rejecting updates and deletes.
+   */
+   AppendOnlyStatements(table string) []string
+
+   /*
+   A statement which inserts a row into the table, or replaces the row which has the same value of
+   the table's primary key column, keyCol.
+   */
+   UpsertStatement(table string, keyCol string, cols []string) string
+
+   /*
+   Determines whether a database error is due to contention with another connection (TX_BUSY),
+   or with a conflicting table lock (TX_LOCKED), in which case the operation may succeed if retried,
+   or is some other, real error (TX_FAILED).
+   */
+   ClassifyError(err error) int
+
+   /*
+   Whether the database error is a violation of a unique index.
+   */
+   IsUniqueViolation(err error) bool
+}
+
+/*
+The dialect of sqlite databases, in which relish generates its SQL.
+*/
+var SqliteDialect Dialect = sqliteDialect{}
+
+type sqliteDialect struct{}
+
+func (d sqliteDialect) Name() string {
+   return "sqlite"
+}
+
+func (d sqliteDialect) Translate(statement string) string {
+   return statement
+}
+
+func (d sqliteDialect) SetupStatements(separatePools bool) []string {
+   if separatePools {
+      // Use write-ahead logging so that readers each see a consistent snapshot of the db
+      // and are not blocked by writers. The journal mode is persistent in the db file.
+      return []string{"PRAGMA journal_mode=WAL"}
+   }
+   return nil
+}
+
+func (d sqliteDialect) SnapshotQuery() string {
+   return "select rowid from RPackage where rowid=1"
+}
+
+func (d sqliteDialect) LastInsertIdQuery() string {
+   return "SELECT last_insert_rowid()"
+}
+
+func (d sqliteDialect) AppendOnlyStatements(table string) []string {
+   return []string{
+      "CREATE TRIGGER IF NOT EXISTS " + table + "_noUpdate BEFORE UPDATE ON " + table + " BEGIN SELECT RAISE(ABORT, '" + table + " is append-only'); END",
+      "CREATE TRIGGER IF NOT EXISTS " + table + "_noDelete BEFORE DELETE ON " + table + " BEGIN SELECT RAISE(ABORT, '" + table + " is append-only'); END",
+   }
+}
+
+func (d sqliteDialect) UpsertStatement(table string, keyCol string, cols []string) string {
+   return "INSERT OR REPLACE INTO " + table + "(" + strings.Join(cols, ",") + ") VALUES(?" + strings.Repeat(",?", len(cols) - 1) + ")"
+}
+
+func (d sqliteDialect) ClassifyError(err error) int {
+   return sqliteClassifyError(err)
+}
+
+func (d sqliteDialect) IsUniqueViolation(err error) bool {
+   return sqliteIsUniqueViolation(err)
+}
+
+/*
+The database driver's error, if err is a *DbError, or else err.
+*/
+func dbErrorCause(err error) error {
+   if dbErr, isDbErr := err.(*DbError); isDbErr {
+      return dbErr.Cause
+   }
+   return err
+}
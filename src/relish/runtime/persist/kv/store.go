@@ -0,0 +1,600 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+// this package implements an embedded, ordered key-value store, in which relish data can be persisted
+// without a SQL database.
+
+package kv
+
+/*
+   store.go - an ordered key-value store held in memory and made durable by a log file.
+
+   The whole of the store's live data is held in memory, so a store is limited to what fits comfortably
+   in the memory of the process: each key takes its key and value, and about 100 bytes more. Opening the
+   store reads its log one record at a time, so needs no more memory than the live data besides.
+
+   The keys and values are byte strings. The keys are kept in order in a treap whose nodes are never changed
+   once they are part of a committed tree. A transaction which writes copies the nodes on the path to each
+   change, so the tree that each transaction began with stays intact. A read transaction therefore sees a
+   consistent snapshot of the store, as of when it began, without locking, and without waiting for writers.
+   Writing transactions are serialized: a writing transaction waits to begin until the previous one ends.
+
+   On commit, a transaction's changes are appended to the log file as a single record, which is then synced
+   to disk. The record begins with the length and CRC-32 checksum of its contents, so that a record which was
+   only partly written, when the process or machine failed, is detected and discarded when the store is next
+   opened. The store is rebuilt by replaying the records of the log. When the log has grown to several times
+   the size of the live data, it is compacted, by writing the live data to a new log which replaces the old one.
+   This is done by the commit which grows the log that large, while no other transaction can write, and
+   as the store is opened.
+
+   Log record:  [4-byte length][4-byte CRC-32 of contents] contents
+   contents:    a sequence of 'P' <uvarint key length> key <uvarint value length> value   (put)
+                           or 'D' <uvarint key length> key                                 (delete)
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	opPut    = 'P'
+	opDelete = 'D'
+
+	maxRecordSize = 1 << 30
+
+	// The store is compacted when its log is larger than compactionRatio times the live data
+	// and at least compactionMinSize bytes.
+	compactionRatio   = 4
+	compactionMinSize = 1 << 20
+
+	// The size of the records of a compacted log.
+	compactedRecordSize = 1 << 20
+)
+
+var ErrTxDone = errors.New("kv: the transaction has already been committed or rolled back")
+var ErrReadOnly = errors.New("kv: cannot write in a read-only transaction")
+
+/*
+A node of the treap. The tree is ordered by key, and each node's priority, which is a hash of its key,
+is no less than the priorities of its children.
+*/
+type node struct {
+	key   []byte
+	val   []byte
+	prio  uint32
+	left  *node
+	right *node
+}
+
+func priority(key []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(key)
+	return h.Sum32()
+}
+
+/*
+Returns a tree in which the key has the value, copying the nodes of the tree n that must change.
+*/
+func insert(n *node, key []byte, val []byte, prio uint32) *node {
+	if n == nil {
+		return &node{key: key, val: val, prio: prio}
+	}
+	m := *n
+	switch c := bytes.Compare(key, n.key); {
+	case c == 0:
+		m.val = val
+	case c < 0:
+		m.left = insert(n.left, key, val, prio)
+		if m.left.prio > m.prio {
+			l := m.left
+			m.left = l.right
+			l.right = &m
+			return l
+		}
+	default:
+		m.right = insert(n.right, key, val, prio)
+		if m.right.prio > m.prio {
+			r := m.right
+			m.right = r.left
+			r.left = &m
+			return r
+		}
+	}
+	return &m
+}
+
+/*
+Returns a tree without the key, copying the nodes of the tree n that must change, and whether the key was found.
+*/
+func remove(n *node, key []byte) (*node, bool) {
+	if n == nil {
+		return nil, false
+	}
+	switch c := bytes.Compare(key, n.key); {
+	case c == 0:
+		return merge(n.left, n.right), true
+	case c < 0:
+		l, found := remove(n.left, key)
+		if ! found {
+			return n, false
+		}
+		m := *n
+		m.left = l
+		return &m, true
+	default:
+		r, found := remove(n.right, key)
+		if ! found {
+			return n, false
+		}
+		m := *n
+		m.right = r
+		return &m, true
+	}
+}
+
+/*
+Joins two trees, all of whose keys in a are less than all of the keys in b.
+*/
+func merge(a *node, b *node) *node {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	case a.prio > b.prio:
+		m := *a
+		m.right = merge(a.right, b)
+		return &m
+	}
+	m := *b
+	m.left = merge(a, b.left)
+	return &m
+}
+
+func get(n *node, key []byte) []byte {
+	for n != nil {
+		switch c := bytes.Compare(key, n.key); {
+		case c == 0:
+			return n.val
+		case c < 0:
+			n = n.left
+		default:
+			n = n.right
+		}
+	}
+	return nil
+}
+
+/*
+Calls fn for each key no less than from, in order, until fn returns false. Returns false if fn did.
+*/
+func ascend(n *node, from []byte, fn func(key []byte, val []byte) bool) bool {
+	for n != nil {
+		if bytes.Compare(n.key, from) >= 0 {
+			if ! ascend(n.left, from, fn) || ! fn(n.key, n.val) {
+				return false
+			}
+		}
+		n = n.right
+	}
+	return true
+}
+
+/*
+The store, which is open on its log file.
+*/
+type Store struct {
+	path       string
+	file       *os.File
+	size       int64      // the length of the valid records in the log file
+	live       int64      // the size of the live data, as it would be in a compacted log
+	failedSize int64      // the log size when compaction last failed. Not retried until the log has doubled.
+	writeMu    sync.Mutex // held by the writing transaction
+	rootMu     sync.RWMutex
+	root       *node // the committed tree
+}
+
+/*
+Opens the store whose log is the file at path, creating the file if it does not exist.
+A partly written record at the end of the log is discarded.
+*/
+func Open(path string) (s *Store, err error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return
+	}
+	s = &Store{path: path, file: file}
+	err = s.replay()
+	if err == nil {
+		ascend(s.root, nil, func(key []byte, val []byte) bool {
+			s.live += liveSize(key, val)
+			return true
+		})
+		err = s.compactIfLarge()
+	}
+	if err != nil {
+		s.file.Close()
+		s = nil
+	}
+	return
+}
+
+/*
+Rebuilds the tree from the records of the log, reading one record at a time, and truncates the log after
+the last complete record.
+*/
+func (s *Store) replay() (err error) {
+	r := bufio.NewReader(s.file)
+	var offset int64
+	var header [8]byte
+	var contents []byte
+	for {
+		if _, readErr := io.ReadFull(r, header[:]); readErr != nil {
+			break // the end of the log, or a torn record header
+		}
+		n := int64(binary.BigEndian.Uint32(header[:]))
+		sum := binary.BigEndian.Uint32(header[4:])
+		if n > maxRecordSize {
+			break
+		}
+		if int64(cap(contents)) < n {
+			contents = make([]byte, n)
+		}
+		contents = contents[:n]
+		if _, readErr := io.ReadFull(r, contents); readErr != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(contents) != sum {
+			break
+		}
+		root, ok := apply(s.root, contents)
+		if ! ok {
+			break
+		}
+		s.root = root
+		offset += 8 + n
+	}
+	fileInfo, err := s.file.Stat()
+	if err != nil {
+		return
+	}
+	if offset < fileInfo.Size() {
+		if err = s.file.Truncate(offset); err != nil {
+			return
+		}
+	}
+	s.size = offset
+	_, err = s.file.Seek(offset, io.SeekStart)
+	return
+}
+
+/*
+Applies the operations of the contents of a log record to the tree. Returns false if the contents are malformed.
+The keys and values are copied, as the contents are reused.
+*/
+func apply(root *node, contents []byte) (*node, bool) {
+	for len(contents) > 0 {
+		op := contents[0]
+		contents = contents[1:]
+		key, rest, ok := readBytes(contents)
+		if ! ok {
+			return nil, false
+		}
+		contents = rest
+		switch op {
+		case opPut:
+			var val []byte
+			if val, contents, ok = readBytes(contents); ! ok {
+				return nil, false
+			}
+			key = append([]byte(nil), key...)
+			root = insert(root, key, append([]byte{}, val...), priority(key))
+		case opDelete:
+			root, _ = remove(root, key)
+		default:
+			return nil, false
+		}
+	}
+	return root, true
+}
+
+/*
+The size of the key and value in a compacted log.
+*/
+func liveSize(key []byte, val []byte) int64 {
+	return int64(len(key) + len(val) + 3)
+}
+
+func readBytes(b []byte) (field []byte, rest []byte, ok bool) {
+	n, size := binary.Uvarint(b)
+	if size <= 0 || uint64(len(b)-size) < n {
+		return
+	}
+	return b[size : size+int(n)], b[size+int(n):], true
+}
+
+func appendBytes(b []byte, field []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	b = append(b, buf[:binary.PutUvarint(buf[:], uint64(len(field)))]...)
+	return append(b, field...)
+}
+
+/*
+Appends a record with the contents to the log, and syncs the log to disk.
+If the record cannot be completely written, the log is truncated to remove any part of it.
+*/
+func (s *Store) writeRecord(contents []byte) (err error) {
+	if len(contents) > maxRecordSize {
+		return fmt.Errorf("kv: a transaction of %d bytes of changes is too large", len(contents))
+	}
+	record := make([]byte, 8, 8+len(contents))
+	binary.BigEndian.PutUint32(record, uint32(len(contents)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(contents))
+	record = append(record, contents...)
+	_, err = s.file.Write(record)
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		s.file.Truncate(s.size)
+		s.file.Seek(s.size, io.SeekStart)
+		return
+	}
+	s.size += int64(len(record))
+	return
+}
+
+/*
+If the log is much larger than the live data, replaces it by a log of only the live data.
+The new log is written to another file, which is then renamed to the log's name, so that a failure
+part way through leaves the old log intact.
+Must be called while no transaction can write, as the store is opened or by a commit.
+*/
+func (s *Store) compactIfLarge() (err error) {
+	if s.size < compactionMinSize || s.size < compactionRatio*s.live || s.size < 2*s.failedSize {
+		return
+	}
+	defer func() {
+		if err != nil {
+			s.failedSize = s.size
+		}
+	}()
+	compactPath := s.path + ".compact"
+	file, err := os.OpenFile(compactPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return
+	}
+	compacted := &Store{path: compactPath, file: file}
+	var contents []byte
+	ascend(s.root, nil, func(key []byte, val []byte) bool {
+		contents = appendBytes(appendBytes(append(contents, opPut), key), val)
+		if len(contents) >= compactedRecordSize {
+			err = compacted.writeRecord(contents)
+			contents = contents[:0]
+		}
+		return err == nil
+	})
+	if err == nil && len(contents) > 0 {
+		err = compacted.writeRecord(contents)
+	}
+	if err == nil {
+		err = os.Rename(compactPath, s.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(compactPath)
+		return
+	}
+	s.file.Close()
+	s.file = file
+	s.size = compacted.size
+	return
+}
+
+/*
+Closes the log file. The store must not be used afterwards.
+*/
+func (s *Store) Close() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.file.Close()
+}
+
+/*
+The number of bytes in the log file.
+*/
+func (s *Store) LogSize() int64 {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.size
+}
+
+/*
+Begins a transaction. A writable transaction waits until any other writable transaction has ended.
+A read-only transaction sees the store as of when it began.
+*/
+func (s *Store) Begin(writable bool) *Tx {
+	if writable {
+		s.writeMu.Lock()
+	}
+	s.rootMu.RLock()
+	root := s.root
+	s.rootMu.RUnlock()
+	return &Tx{store: s, writable: writable, root: root}
+}
+
+/*
+A transaction, which reads from, and changes, its own version of the store's tree.
+A Tx must only be used by one goroutine at a time.
+*/
+type Tx struct {
+	store      *Store
+	writable   bool
+	done       bool
+	root       *node
+	log        []byte // the contents of the log record of the transaction's changes
+	liveDelta  int64  // how much the transaction's changes grow the store's live data
+	savepoints []savepoint
+}
+
+type savepoint struct {
+	root      *node
+	logLen    int
+	liveDelta int64
+}
+
+func (tx *Tx) Writable() bool {
+	return tx.writable
+}
+
+/*
+Returns the value of the key, or nil if the key is not in the store. The value must not be modified.
+*/
+func (tx *Tx) Get(key []byte) []byte {
+	return get(tx.root, key)
+}
+
+/*
+Sets the value of the key. The key and value are copied.
+*/
+func (tx *Tx) Put(key []byte, val []byte) error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	key = append([]byte(nil), key...)
+	val = append([]byte{}, val...)
+	if old := get(tx.root, key); old != nil {
+		tx.liveDelta -= liveSize(key, old)
+	}
+	tx.liveDelta += liveSize(key, val)
+	tx.root = insert(tx.root, key, val, priority(key))
+	tx.log = appendBytes(appendBytes(append(tx.log, opPut), key), val)
+	return nil
+}
+
+/*
+Removes the key from the store, if it is there.
+*/
+func (tx *Tx) Delete(key []byte) error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	old := get(tx.root, key)
+	root, found := remove(tx.root, key)
+	if found {
+		tx.liveDelta -= liveSize(key, old)
+		tx.root = root
+		tx.log = appendBytes(append(tx.log, opDelete), key)
+	}
+	return nil
+}
+
+func (tx *Tx) checkWritable() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if ! tx.writable {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+/*
+Calls fn with each key no less than from, and its value, in key order, until fn returns false.
+The store must not be changed by fn.
+*/
+func (tx *Tx) Ascend(from []byte, fn func(key []byte, val []byte) bool) {
+	ascend(tx.root, from, fn)
+}
+
+/*
+Calls fn with each key which begins with the prefix, and its value, in key order, until fn returns false.
+The store must not be changed by fn.
+*/
+func (tx *Tx) AscendPrefix(prefix []byte, fn func(key []byte, val []byte) bool) {
+	ascend(tx.root, prefix, func(key []byte, val []byte) bool {
+		return bytes.HasPrefix(key, prefix) && fn(key, val)
+	})
+}
+
+/*
+Marks the current state of the transaction, so that later changes can be undone by RollbackTo.
+Returns the savepoint's number. Savepoints nest.
+*/
+func (tx *Tx) Savepoint() int {
+	tx.savepoints = append(tx.savepoints, savepoint{tx.root, len(tx.log), tx.liveDelta})
+	return len(tx.savepoints) - 1
+}
+
+/*
+Ends the savepoint, and the savepoints nested in it, keeping their changes.
+*/
+func (tx *Tx) ReleaseSavepoint(sp int) {
+	if sp < len(tx.savepoints) {
+		tx.savepoints = tx.savepoints[:sp]
+	}
+}
+
+/*
+Undoes the changes made since the savepoint began, and ends the savepoint and the savepoints nested in it.
+*/
+func (tx *Tx) RollbackTo(sp int) {
+	if sp < len(tx.savepoints) {
+		tx.root = tx.savepoints[sp].root
+		tx.log = tx.log[:tx.savepoints[sp].logLen]
+		tx.liveDelta = tx.savepoints[sp].liveDelta
+		tx.savepoints = tx.savepoints[:sp]
+	}
+}
+
+/*
+Makes the transaction's changes durable and visible to transactions which begin afterwards, and ends it.
+If the changes cannot be written to the log, they are discarded, and the transaction is ended.
+Committing a read-only transaction just ends it.
+If the log has grown much larger than the live data, compacts it before the next writing transaction
+can begin. The commit does not fail if compaction does; it is tried again once the log has doubled.
+*/
+func (tx *Tx) Commit() (err error) {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	if ! tx.writable {
+		return
+	}
+	defer tx.store.writeMu.Unlock()
+	if len(tx.log) == 0 {
+		return
+	}
+	if err = tx.store.writeRecord(tx.log); err != nil {
+		return
+	}
+	tx.store.rootMu.Lock()
+	tx.store.root = tx.root
+	tx.store.rootMu.Unlock()
+	tx.store.live += tx.liveDelta
+	tx.store.compactIfLarge()
+	return
+}
+
+/*
+Discards the transaction's changes and ends it. Does nothing if the transaction has already ended.
+*/
+func (tx *Tx) Rollback() {
+	if tx.done {
+		return
+	}
+	tx.done = true
+	if tx.writable {
+		tx.store.writeMu.Unlock()
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+package kv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func tempStore(t *testing.T) (s *Store, path string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "relish_kv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path = filepath.Join(dir, "test.kvdb")
+	s, err = Open(path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, path, func() { os.RemoveAll(dir) }
+}
+
+func keys(tx *Tx, prefix string) string {
+	var ks []string
+	tx.AscendPrefix([]byte(prefix), func(key []byte, val []byte) bool {
+		ks = append(ks, string(key)+"="+string(val))
+		return true
+	})
+	return strings.Join(ks, " ")
+}
+
+func TestStore(t *testing.T) {
+	s, path, cleanup := tempStore(t)
+	defer cleanup()
+
+	tx := s.Begin(true)
+	for _, k := range []string{"b2", "a1", "b1", "c1", "b3"} {
+		tx.Put([]byte(k), []byte("v"+k))
+	}
+	tx.Delete([]byte("b3"))
+	if got := keys(tx, "b"); got != "b1=vb1 b2=vb2" {
+		t.Errorf("keys in transaction = %q", got)
+	}
+	snapshot := s.Begin(false)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(snapshot, ""); got != "" {
+		t.Errorf("read transaction begun before commit sees %q", got)
+	}
+	if err := snapshot.Put([]byte("x"), nil); err != ErrReadOnly {
+		t.Errorf("Put in read-only transaction: err = %v", err)
+	}
+	snapshot.Rollback()
+
+	tx = s.Begin(true)
+	tx.Put([]byte("a1"), []byte("changed"))
+	sp := tx.Savepoint()
+	tx.Delete([]byte("b1"))
+	tx.Put([]byte("d1"), []byte("vd1"))
+	tx.RollbackTo(sp)
+	if got := keys(tx, ""); got != "a1=changed b1=vb1 b2=vb2 c1=vc1" {
+		t.Errorf("keys after rollback to savepoint = %q", got)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tx = s.Begin(true)
+	tx.Put([]byte("z"), []byte("rolled back"))
+	tx.Rollback()
+	tx.Rollback()
+
+	s.Close()
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx = s.Begin(false)
+	if got := keys(tx, ""); got != "a1=changed b1=vb1 b2=vb2 c1=vc1" {
+		t.Errorf("keys after reopening = %q", got)
+	}
+	tx.Rollback()
+	size := s.LogSize()
+	s.Close()
+
+	// A torn record at the end of the log is discarded.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 20, 1, 2, 3, 4, 'P', 1})
+	f.Close()
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.LogSize() != size {
+		t.Errorf("log size after discarding torn record = %d, want %d", s.LogSize(), size)
+	}
+	tx = s.Begin(true)
+	tx.Put([]byte("e1"), []byte("ve1"))
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(s.Begin(false), "e"); got != "e1=ve1" {
+		t.Errorf("keys after write following recovery = %q", got)
+	}
+}
+
+func TestStoreCompaction(t *testing.T) {
+	s, path, cleanup := tempStore(t)
+	defer cleanup()
+
+	written := 0
+	for i := 0; i < 2000; i++ {
+		tx := s.Begin(true)
+		tx.Put([]byte(fmt.Sprintf("k%d", i%10)), []byte(fmt.Sprintf("%04d%s", i, strings.Repeat("x", 996))))
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		written += 1000
+		if s.LogSize() > compactionMinSize+2000 {
+			t.Fatalf("log size = %d after %d commits, was not compacted", s.LogSize(), i+1)
+		}
+	}
+	if s.LogSize() >= int64(written/2) {
+		t.Errorf("log size = %d after writing %d bytes", s.LogSize(), written)
+	}
+	s.Close()
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	n := 0
+	s.Begin(false).Ascend(nil, func(key []byte, v []byte) bool {
+		if want := fmt.Sprintf("%04d", 1990+n); string(v[:4]) != want {
+			t.Errorf("%s = %s..., want %s...", key, v[:4], want)
+		}
+		n++
+		return true
+	})
+	if n != 10 {
+		t.Errorf("%d keys after compaction, want 10", n)
+	}
+}
@@ -0,0 +1,379 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+package oql
+
+/*
+   ast.go - the abstract syntax tree of an OQL query.
+*/
+
+import (
+	. "relish/runtime/data"
+	"strings"
+)
+
+/*
+A parsed query: selection conditions, followed optionally by an ordering and a limit.
+e.g. "speed > 60 and owner.name like 'J%' order by speed desc limit 10"
+Any of the parts may be absent.
+*/
+type Query struct {
+	Where   Expr // nil if there are no selection conditions
+	OrderBy []*OrderItem
+	Limit   Expr // nil if no limit
+	Offset  Expr // nil if no offset
+}
+
+/*
+A parsed aggregate query, which selects values computed from the objects, e.g.
+"category, sum(price), count(*) where price > 0 group by category having count(*) > 1 order by category"
+The where and group by clauses may be given in either order.
+*/
+type AggregateQuery struct {
+	Items   []Expr // the selected values
+	GroupBy []Expr
+	Having  Expr // nil if there are no conditions on the groups
+	Query        // where, order by, limit and offset
+}
+
+type OrderItem struct {
+	X    Expr
+	Desc bool
+}
+
+/*
+The kind of value that an expression evaluates to, as determined by the typechecker.
+*/
+type Kind int
+
+const (
+	UnknownKind Kind = iota // Not yet checked, or a ? parameter, whose value is only known when the query runs.
+	NumberKind
+	StringKind
+	BoolKind
+	TimeKind
+	ObjectKind
+	NullKind
+)
+
+var kindNames = [...]string{"unknown", "number", "String", "Bool", "Time", "object", "null"}
+
+func (k Kind) String() string {
+	return kindNames[k]
+}
+
+/*
+All expression nodes implement Expr.
+*/
+type Expr interface {
+	Pos() int    // column position of the first character of the expression
+	Kind() Kind
+}
+
+/*
+A path of attribute names, starting from the queried type. e.g. speed  or  owner.company.name
+After checking, Attrs holds the attribute that each name refers to.
+*/
+type Path struct {
+	Names []string
+	Cols  []int
+	Attrs []*AttributeSpec
+}
+
+/*
+A number, string, true, false or null literal. Value is the literal text as written.
+*/
+type Literal struct {
+	Tok   Token
+	Value string
+	Col   int
+}
+
+/*
+A ? parameter. Index is the position of the parameter among the query's parameters, from 0.
+*/
+type Param struct {
+	Index int
+	Col   int
+}
+
+/*
+A call of a database function. e.g. lower(name)  or of an aggregate function. e.g. sum(price)  count(*)
+*/
+type Call struct {
+	Fun  string
+	Col  int
+	Args []Expr
+	Star bool // count(*)
+}
+
+/*
+The aggregate functions, which compute a value from the values of an expression in a group of objects.
+*/
+var aggregateFuns = map[string]bool{"count": true, "sum": true, "avg": true, "min": true, "max": true, "total": true}
+
+/*
+Returns true if the call is of an aggregate function.
+*/
+func (x *Call) IsAggregate() bool {
+	return aggregateFuns[x.Fun]
+}
+
+type ParenExpr struct {
+	X   Expr
+	Col int
+}
+
+/*
+A NOT or unary minus expression.
+*/
+type UnaryExpr struct {
+	Op  Token
+	Col int
+	X   Expr
+}
+
+/*
+A comparison, arithmetic, concatenation, AND or OR expression.
+*/
+type BinaryExpr struct {
+	X     Expr
+	Op    Token
+	OpCol int
+	Y     Expr
+}
+
+/*
+x IS NULL  or  x IS NOT NULL
+*/
+type IsNullExpr struct {
+	X   Expr
+	Not bool
+}
+
+/*
+x LIKE pattern  or  x NOT LIKE pattern
+*/
+type LikeExpr struct {
+	X       Expr
+	Not     bool
+	Pattern Expr
+}
+
+/*
+x IN (a, b, c)  or  x NOT IN (a, b, c)  or  x IN (SELECT ...)
+*/
+type InExpr struct {
+	X     Expr
+	Not   bool
+	List  []Expr    // nil if the values are selected by a subquery
+	Query *Subquery // nil if the values are listed
+}
+
+/*
+A query of another datatype, whose results are tested for membership by an IN expression.
+  SELECT Person WHERE age > 30             selects the Person objects.
+  SELECT name FROM Person WHERE age > 30   selects an attribute (path) of the Person objects.
+*/
+type Subquery struct {
+	Col      int
+	Select   *Path // nil if the objects themselves are selected
+	TypeName string
+	TypeCol  int
+	Where    Expr   // nil if there are no selection conditions
+	Type     *RType // the queried datatype, once checked
+}
+
+/*
+EXISTS path  or  EXISTS (path WHERE conditions)
+True if the attribute at the end of the path has a value (for a multi-valued attribute, at least one value)
+which meets the conditions. The conditions are on the attributes of the value.
+*/
+type ExistsExpr struct {
+	Col  int
+	Path *Path
+	Cond Expr // nil if there are no conditions
+}
+
+/*
+x BETWEEN lo AND hi  or  x NOT BETWEEN lo AND hi
+*/
+type BetweenExpr struct {
+	X   Expr
+	Not bool
+	Lo  Expr
+	Hi  Expr
+}
+
+func (x *Path) Pos() int        { return x.Cols[0] }
+func (x *Literal) Pos() int     { return x.Col }
+func (x *Param) Pos() int       { return x.Col }
+func (x *Call) Pos() int        { return x.Col }
+func (x *ParenExpr) Pos() int   { return x.Col }
+func (x *UnaryExpr) Pos() int   { return x.Col }
+func (x *BinaryExpr) Pos() int  { return x.X.Pos() }
+func (x *IsNullExpr) Pos() int  { return x.X.Pos() }
+func (x *LikeExpr) Pos() int    { return x.X.Pos() }
+func (x *InExpr) Pos() int      { return x.X.Pos() }
+func (x *BetweenExpr) Pos() int { return x.X.Pos() }
+func (x *Subquery) Pos() int    { return x.Col }
+func (x *ExistsExpr) Pos() int  { return x.Col }
+
+/*
+The kind of the value of the final attribute of the path. UnknownKind if the path has not been checked.
+*/
+func (x *Path) Kind() Kind {
+	if len(x.Attrs) < len(x.Names) {
+		return UnknownKind
+	}
+	return attrKind(x.Attrs[len(x.Attrs)-1])
+}
+
+func (x *Literal) Kind() Kind {
+	switch x.Tok {
+	case NUMBER:
+		return NumberKind
+	case STRING:
+		return StringKind
+	case TRUE, FALSE:
+		return BoolKind
+	}
+	return NullKind
+}
+
+func (x *Param) Kind() Kind     { return UnknownKind }
+
+/*
+The kind of the value of an aggregate function. Other database functions return UnknownKind.
+*/
+func (x *Call) Kind() Kind {
+	switch x.Fun {
+	case "count", "sum", "avg", "total":
+		return NumberKind
+	case "min", "max":
+		if len(x.Args) == 1 {
+			return x.Args[0].Kind()
+		}
+	}
+	return UnknownKind
+}
+func (x *ParenExpr) Kind() Kind { return x.X.Kind() }
+
+func (x *UnaryExpr) Kind() Kind {
+	if x.Op == NOT {
+		return BoolKind
+	}
+	return NumberKind
+}
+
+func (x *BinaryExpr) Kind() Kind {
+	switch {
+	case x.Op == AND || x.Op == OR || x.Op.IsComparison():
+		return BoolKind
+	case x.Op == CONCAT:
+		return StringKind
+	}
+	return NumberKind
+}
+
+func (x *IsNullExpr) Kind() Kind  { return BoolKind }
+func (x *LikeExpr) Kind() Kind    { return BoolKind }
+func (x *InExpr) Kind() Kind      { return BoolKind }
+func (x *BetweenExpr) Kind() Kind { return BoolKind }
+func (x *ExistsExpr) Kind() Kind  { return BoolKind }
+
+/*
+The kind of the values selected by the subquery.
+*/
+func (x *Subquery) Kind() Kind {
+	if x.Select == nil {
+		return ObjectKind
+	}
+	return x.Select.Kind()
+}
+
+/*
+Returns the index in the path of the first multi-valued attribute, or -1 if the path passes through
+only unary attributes.
+*/
+func (x *Path) MultiIndex() int {
+	for i, attr := range x.Attrs {
+		if attr.IsCollection() {
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+Returns the names in the path up to and including the first multi-valued attribute,
+e.g. "owner.cars" for the path owner.cars.speed, or "" if the path passes through only unary attributes.
+*/
+func (x *Path) MultiPrefix() string {
+	i := x.MultiIndex()
+	if i < 0 {
+		return ""
+	}
+	return strings.Join(x.Names[:i+1], ".")
+}
+
+/*
+The kind of the values of a unary attribute.
+*/
+func attrKind(attr *AttributeSpec) Kind {
+	switch attr.Part.Type {
+	case IntType, Int32Type, UintType, Uint32Type, FloatType:
+		return NumberKind
+	case StringType:
+		return StringKind
+	case BoolType:
+		return BoolKind
+	case TimeType:
+		return TimeKind
+	}
+	if attr.Part.Type.IsPrimitive {
+		return UnknownKind
+	}
+	return ObjectKind
+}
+
+/*
+Calls f for each node in the tree of the expression, parents before children.
+Does not descend into the conditions of subqueries and EXISTS expressions, whose paths start from
+another datatype.
+*/
+func Walk(x Expr, f func(Expr)) {
+	if x == nil {
+		return
+	}
+	f(x)
+	switch x := x.(type) {
+	case *Call:
+		for _, arg := range x.Args {
+			Walk(arg, f)
+		}
+	case *ParenExpr:
+		Walk(x.X, f)
+	case *UnaryExpr:
+		Walk(x.X, f)
+	case *BinaryExpr:
+		Walk(x.X, f)
+		Walk(x.Y, f)
+	case *IsNullExpr:
+		Walk(x.X, f)
+	case *LikeExpr:
+		Walk(x.X, f)
+		Walk(x.Pattern, f)
+	case *InExpr:
+		Walk(x.X, f)
+		for _, y := range x.List {
+			Walk(y, f)
+		}
+	case *ExistsExpr:
+		Walk(x.Path, f)
+	case *BetweenExpr:
+		Walk(x.X, f)
+		Walk(x.Lo, f)
+		Walk(x.Hi, f)
+	}
+}
@@ -0,0 +1,390 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+package oql
+
+/*
+   check.go - typechecking of a parsed OQL query against the attributes of the datatype being queried.
+*/
+
+import (
+	. "relish/runtime/data"
+	"strings"
+)
+
+/*
+Resolves each attribute path in the query to the attributes of the queried type (or its supertypes)
+and of the types of the objects the path passes through, and checks that the values being compared,
+combined and ordered are of compatible kinds. Returns an *Error, giving the column of the first problem found.
+
+lookupType finds the datatype named in a subquery such as "select Person where age > 30".
+*/
+func Check(query *Query, typ *RType, lookupType func(name string) (*RType, error)) (err error) {
+	c := &checker{typ: typ, lookupType: lookupType}
+	defer func() {
+		if r := recover(); r != nil {
+			if e, isOqlError := r.(*Error); isOqlError {
+				err = e
+				return
+			}
+			panic(r)
+		}
+	}()
+	if query.Where != nil {
+		c.checkCondition(query.Where, "selection condition")
+	}
+	for _, item := range query.OrderBy {
+		c.check(item.X)
+		c.expectUnary(item.X, "order by")
+	}
+	if query.Limit != nil {
+		c.check(query.Limit)
+		c.expectKind(query.Limit, NumberKind, "limit")
+		c.expectUnary(query.Limit, "limit")
+	}
+	if query.Offset != nil {
+		c.check(query.Offset)
+		c.expectKind(query.Offset, NumberKind, "offset")
+		c.expectUnary(query.Offset, "offset")
+	}
+	return
+}
+
+/*
+Checks an aggregate query as Check does. In addition, checks that aggregate functions are used only in the 
+selected values, the having condition and the order by clause, and, if the query groups the objects or computes 
+aggregates, that each attribute path in the selected values outside of an aggregate function is one of the
+group by expressions.
+*/
+func CheckAggregate(query *AggregateQuery, typ *RType, lookupType func(name string) (*RType, error)) (err error) {
+	c := &checker{typ: typ, lookupType: lookupType}
+	defer func() {
+		if r := recover(); r != nil {
+			if e, isOqlError := r.(*Error); isOqlError {
+				err = e
+				return
+			}
+			panic(r)
+		}
+	}()
+	if query.Where != nil {
+		c.checkCondition(query.Where, "selection condition")
+	}
+	grouped := make(map[string]bool)
+	for _, x := range query.GroupBy {
+		c.check(x)
+		c.expectUnary(x, "group by")
+		if path, isPath := x.(*Path); isPath {
+			grouped[strings.Join(path.Names, ".")] = true
+		}
+	}
+	c.aggregatesAllowed = true
+	aggregated := len(query.GroupBy) > 0
+	for _, x := range query.Items {
+		c.check(x)
+		c.expectUnary(x, "a selected value")
+		walkOutsideAggregates(x, func(y Expr) {
+			if call, isCall := y.(*Call); isCall && call.IsAggregate() {
+				aggregated = true
+			}
+		})
+	}
+	if aggregated {
+		for _, x := range query.Items {
+			walkOutsideAggregates(x, func(y Expr) {
+				if path, isPath := y.(*Path); isPath && ! grouped[strings.Join(path.Names, ".")] {
+					panic(errorf(path.Pos(), "%s must be in the group by clause, or used in an aggregate function such as count, sum, min or max", strings.Join(path.Names, ".")))
+				}
+			})
+		}
+	}
+	if query.Having != nil {
+		c.check(query.Having)
+		c.expectKind(query.Having, BoolKind, "having condition")
+		c.expectUnary(query.Having, "having condition")
+	}
+	for _, item := range query.OrderBy {
+		c.check(item.X)
+		c.expectUnary(item.X, "order by")
+	}
+	c.aggregatesAllowed = false
+	if query.Limit != nil {
+		c.check(query.Limit)
+		c.expectKind(query.Limit, NumberKind, "limit")
+		c.expectUnary(query.Limit, "limit")
+	}
+	if query.Offset != nil {
+		c.check(query.Offset)
+		c.expectKind(query.Offset, NumberKind, "offset")
+		c.expectUnary(query.Offset, "offset")
+	}
+	return
+}
+
+/*
+Calls f for each node in the tree of the expression that is not inside a call of an aggregate function,
+and for each call of an aggregate function.
+*/
+func walkOutsideAggregates(x Expr, f func(Expr)) {
+	Walk(x, func(y Expr) {
+		if call, isCall := y.(*Call); isCall && call.IsAggregate() {
+			f(call)
+			return
+		}
+		if ! insideAggregate(x, y) {
+			f(y)
+		}
+	})
+}
+
+/*
+Returns true if y is inside the arguments of a call of an aggregate function within x.
+*/
+func insideAggregate(x Expr, y Expr) (inside bool) {
+	Walk(x, func(z Expr) {
+		if call, isCall := z.(*Call); isCall && call.IsAggregate() {
+			for _, arg := range call.Args {
+				Walk(arg, func(w Expr) {
+					if w == y {
+						inside = true
+					}
+				})
+			}
+		}
+	})
+	return
+}
+
+type checker struct {
+	typ               *RType
+	lookupType        func(name string) (*RType, error)
+	aggregatesAllowed bool
+	inAggregate       bool
+}
+
+/*
+Checks a condition. Below its and, or and not operators, each predicate of a condition (a comparison, 
+like, in, between, is null or exists) may refer to at most one multi-valued attribute path, such as 
+cars.speed. The predicate is true if any value of the multi-valued attribute satisfies it.
+*/
+func (c *checker) checkCondition(x Expr, what string) {
+	switch y := x.(type) {
+	case *BinaryExpr:
+		if y.Op == AND || y.Op == OR {
+			c.checkCondition(y.X, "operand of '"+y.Op.String()+"'")
+			c.checkCondition(y.Y, "operand of '"+y.Op.String()+"'")
+			return
+		}
+	case *UnaryExpr:
+		if y.Op == NOT {
+			c.checkCondition(y.X, "operand of 'not'")
+			return
+		}
+	case *ParenExpr:
+		c.checkCondition(y.X, what)
+		return
+	}
+	c.check(x)
+	c.expectKind(x, BoolKind, what)
+	prefix := ""
+	Walk(x, func(y Expr) {
+		if path, isPath := y.(*Path); isPath {
+			if p := path.MultiPrefix(); p != "" {
+				if prefix != "" && p != prefix {
+					panic(errorf(path.Pos(), "a condition can refer to only one multi-valued attribute, but refers to both %s and %s. Use separate conditions joined by 'and' or 'or'", prefix, p))
+				}
+				prefix = p
+			}
+		}
+	})
+}
+
+/*
+Checks that the expression refers to no multi-valued attribute.
+*/
+func (c *checker) expectUnary(x Expr, what string) {
+	Walk(x, func(y Expr) {
+		if path, isPath := y.(*Path); isPath {
+			if p := path.MultiPrefix(); p != "" {
+				panic(errorf(path.Pos(), "%s cannot refer to the multi-valued attribute %s", what, p))
+			}
+		}
+	})
+}
+
+func (c *checker) check(x Expr) {
+	switch x := x.(type) {
+	case *Path:
+		c.resolvePath(x)
+	case *Call:
+		if x.IsAggregate() {
+			c.checkAggregateCall(x)
+			return
+		}
+		for _, arg := range x.Args {
+			c.check(arg)
+		}
+	case *ParenExpr:
+		c.check(x.X)
+	case *UnaryExpr:
+		c.check(x.X)
+		if x.Op == NOT {
+			c.expectKind(x.X, BoolKind, "operand of 'not'")
+		} else {
+			c.expectKind(x.X, NumberKind, "operand of '-'")
+		}
+	case *BinaryExpr:
+		c.check(x.X)
+		c.check(x.Y)
+		switch {
+		case x.Op == AND || x.Op == OR:
+			c.expectKind(x.X, BoolKind, "operand of '"+x.Op.String()+"'")
+			c.expectKind(x.Y, BoolKind, "operand of '"+x.Op.String()+"'")
+		case x.Op.IsComparison():
+			if isNull(x.X) || isNull(x.Y) {
+				panic(errorf(x.OpCol, "cannot compare with null using '%s'. Use 'is null' or 'is not null'", x.Op))
+			}
+			c.expectComparable(x.X, x.Y, x.OpCol)
+		case x.Op == CONCAT:
+		default:
+			c.expectKind(x.X, NumberKind, "operand of '"+x.Op.String()+"'")
+			c.expectKind(x.Y, NumberKind, "operand of '"+x.Op.String()+"'")
+		}
+	case *IsNullExpr:
+		c.check(x.X)
+	case *LikeExpr:
+		c.check(x.X)
+		c.check(x.Pattern)
+		c.expectKind(x.X, StringKind, "operand of 'like'")
+		c.expectKind(x.Pattern, StringKind, "pattern of 'like'")
+	case *InExpr:
+		c.check(x.X)
+		for _, y := range x.List {
+			c.check(y)
+			c.expectComparable(x.X, y, y.Pos())
+		}
+		if x.Query != nil {
+			c.checkSubquery(x.Query)
+			c.expectComparable(x.X, x.Query, x.Query.Col)
+		}
+	case *ExistsExpr:
+		c.resolvePath(x.Path)
+		if x.Cond != nil {
+			attr := x.Path.Attrs[len(x.Path.Attrs)-1]
+			if attr.Part.Type.IsPrimitive {
+				panic(errorf(x.Cond.Pos(), "'%s' has primitive values, which have no attributes to test in a 'where' condition", attr.Part.Name))
+			}
+			elementChecker := &checker{typ: attr.Part.Type, lookupType: c.lookupType}
+			elementChecker.checkCondition(x.Cond, "condition of 'exists'")
+		}
+	case *BetweenExpr:
+		c.check(x.X)
+		c.check(x.Lo)
+		c.check(x.Hi)
+		c.expectComparable(x.X, x.Lo, x.Lo.Pos())
+		c.expectComparable(x.X, x.Hi, x.Hi.Pos())
+	}
+}
+
+func (c *checker) checkAggregateCall(x *Call) {
+	if c.inAggregate {
+		panic(errorf(x.Col, "the aggregate function %s cannot be used in the argument of another aggregate function", x.Fun))
+	}
+	if ! c.aggregatesAllowed {
+		panic(errorf(x.Col, "the aggregate function %s can only be used in the selected values, having condition and order by clause of an aggregate query", x.Fun))
+	}
+	if x.Star {
+		return
+	}
+	if len(x.Args) != 1 {
+		panic(errorf(x.Col, "the aggregate function %s takes one argument", x.Fun))
+	}
+	c.inAggregate = true
+	c.check(x.Args[0])
+	c.inAggregate = false
+	switch x.Fun {
+	case "sum", "avg", "total":
+		c.expectKind(x.Args[0], NumberKind, "argument of "+x.Fun)
+	}
+}
+
+/*
+Finds the datatype that the subquery selects from, and checks the subquery against it.
+*/
+func (c *checker) checkSubquery(sub *Subquery) {
+	if c.lookupType == nil {
+		panic(errorf(sub.Col, "subqueries are not supported here"))
+	}
+	typ, err := c.lookupType(sub.TypeName)
+	if err != nil {
+		panic(errorf(sub.TypeCol, "%s", err))
+	}
+	sub.Type = typ
+	subChecker := &checker{typ: typ, lookupType: c.lookupType}
+	if sub.Select != nil {
+		subChecker.resolvePath(sub.Select)
+	}
+	if sub.Where != nil {
+		subChecker.checkCondition(sub.Where, "condition of 'select'")
+	}
+}
+
+/*
+Finds the attribute named by each element of the path. Every attribute but the last must have values
+which are structured objects. Multi-valued attributes (such as cars in owner.cars.speed) are allowed, but
+not collection-valued attributes, whose value is a single independent collection object, nor maps.
+*/
+func (c *checker) resolvePath(path *Path) {
+	typ := c.typ
+	path.Attrs = nil
+	for i, name := range path.Names {
+		attr, found := typ.GetAttribute(name)
+		if ! found {
+			panic(errorf(path.Cols[i], "'%s' is not an attribute of type %s or its supertypes", name, typ.ShortName()))
+		}
+		if attr.IsIndependentCollection() {
+			panic(errorf(path.Cols[i], "'%s' is a collection-valued attribute. Only unary and multi-valued attributes can be used in conditions", name))
+		}
+		if strings.Contains(attr.Part.CollectionType, "map") {
+			panic(errorf(path.Cols[i], "'%s' is a map-valued attribute. Only unary and multi-valued attributes can be used in conditions", name))
+		}
+		if attr.Part.Type == ComplexType || attr.Part.Type == Complex32Type {
+			panic(errorf(path.Cols[i], "'%s' has a complex number value, which cannot be used in conditions", name))
+		}
+		path.Attrs = append(path.Attrs, attr)
+		if i < len(path.Names)-1 {
+			if attr.Part.Type.IsPrimitive {
+				panic(errorf(path.Cols[i+1], "'%s' has a primitive value, which has no attribute '%s'", name, path.Names[i+1]))
+			}
+			typ = attr.Part.Type
+		}
+	}
+}
+
+func isNull(x Expr) bool {
+	lit, isLiteral := x.(*Literal)
+	return isLiteral && lit.Tok == NULL
+}
+
+func (c *checker) expectKind(x Expr, kind Kind, what string) {
+	k := x.Kind()
+	if k == kind || k == UnknownKind {
+		return
+	}
+	panic(errorf(x.Pos(), "%s must be a %s value, not a %s value", what, kind, k))
+}
+
+/*
+Checks that the two expressions may be compared with each other. Times may be compared with Strings, since
+time literals are written as Strings, e.g. '2014-05-20 12:00:00'.
+*/
+func (c *checker) expectComparable(x Expr, y Expr, col int) {
+	kx, ky := x.Kind(), y.Kind()
+	if kx == ky || kx == UnknownKind || ky == UnknownKind || kx == NullKind || ky == NullKind {
+		return
+	}
+	if (kx == TimeKind && ky == StringKind) || (kx == StringKind && ky == TimeKind) {
+		return
+	}
+	panic(errorf(col, "cannot compare a %s value with a %s value", kx, ky))
+}
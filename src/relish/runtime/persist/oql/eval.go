@@ -0,0 +1,885 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+package oql
+
+/*
+   eval.go - evaluation of a checked OQL query directly against stored objects, for databases which
+   cannot run SQL.
+
+   The values of the evaluator are nil (SQL NULL), int64, float64, string and ObjectRef. Bool values are
+   treated as the integers 1 and 0, and Times as Strings in the database's time format, as they are stored
+   in a SQL database, so that a query selects the same objects as its SQL translation would:
+
+   - Conditions have SQL's three-valued logic. A comparison with NULL is NULL, and an object is selected
+     only if the condition is true.
+   - A predicate which refers to a multi-valued attribute, such as cars.speed > 60, is true if any value
+     of the attribute satisfies it.
+   - A String is compared with a number as a number, if it is the text of one.
+   - like is case-insensitive for ASCII letters.
+   - NULLs are ordered before all other values.
+*/
+
+import (
+	"fmt"
+	. "relish/runtime/data"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+The database id of a stored object.
+*/
+type ObjectRef int64
+
+/*
+The stored objects that a query is evaluated against.
+*/
+type Objects interface {
+	/*
+	   Returns the stored values of the attribute of the object. A unary attribute has at most one value.
+	   Primitive values are returned as Go values (int64, float64, string, bool ...), and objects as ObjectRefs.
+	*/
+	AttrValues(obj ObjectRef, attr *AttributeSpec) (vals []interface{}, err error)
+
+	/*
+	   Returns the stored objects of the type, including the objects of its subtypes.
+	*/
+	Extent(typ *RType) (objs []ObjectRef, err error)
+}
+
+/*
+Returns the candidate objects which meet the query's selection conditions, in the query's order,
+then in order of id, and restricted by its limit and offset.
+The query must have been checked. params are the values of the query's ? parameters.
+*/
+func Select(query *Query, candidates []ObjectRef, objects Objects, params []interface{}) (selected []ObjectRef, err error) {
+	return SelectPage(query, candidates, objects, params, nil, nil, -1)
+}
+
+/*
+Like Select, but selects only the objects which come after the object after in the order of the query.
+The object after need not be one of the candidates, nor meet the selection conditions.
+*/
+func SelectAfter(query *Query, candidates []ObjectRef, objects Objects, params []interface{}, after ObjectRef) (selected []ObjectRef, err error) {
+	return SelectPage(query, candidates, objects, params, &after, nil, -1)
+}
+
+/*
+Returns a page of at most n of the objects selected by SelectAfter (or by Select, if after is nil):
+those which come after the object last, in the order of the query, or the first n if last is nil.
+A negative n means no maximum. Reading a selection a page at a time this way, each page continuing
+from the last object of the previous page, is a cursor over the selection.
+*/
+func SelectPage(query *Query, candidates []ObjectRef, objects Objects, params []interface{}, after *ObjectRef, last *ObjectRef, n int) (selected []ObjectRef, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, isEvalError := r.(evalError); isEvalError {
+				err = e.err
+				return
+			}
+			panic(r)
+		}
+	}()
+	shared := &evalShared{objects: objects, params: params, subqueries: make(map[*Subquery][]interface{})}
+
+	type row struct {
+		obj  ObjectRef
+		keys []interface{}
+	}
+	var rows []*row
+	for _, obj := range candidates {
+		e := shared.evaluator(obj)
+		if query.Where != nil && ! truth(e.eval(query.Where)) {
+			continue
+		}
+		rows = append(rows, &row{obj, e.orderKeys(query)})
+	}
+
+	less := func(aKeys []interface{}, a ObjectRef, bKeys []interface{}, b ObjectRef) bool {
+		for i, item := range query.OrderBy {
+			c := compareOrder(aKeys[i], bKeys[i])
+			if item.Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return a < b
+	}
+	following := func(rows []*row, obj ObjectRef) []*row {
+		objKeys := shared.evaluator(obj).orderKeys(query)
+		var after []*row
+		for _, r := range rows {
+			if less(objKeys, obj, r.keys, r.obj) {
+				after = append(after, r)
+			}
+		}
+		return after
+	}
+	if after != nil {
+		rows = following(rows, *after)
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		return less(rows[i].keys, rows[i].obj, rows[j].keys, rows[j].obj)
+	})
+
+	if query.Limit != nil {
+		e := shared.evaluator(0)
+		offset := int64(0)
+		if query.Offset != nil {
+			offset = toInt(e.eval(query.Offset))
+		}
+		if offset > int64(len(rows)) {
+			offset = int64(len(rows))
+		}
+		if offset > 0 {
+			rows = rows[offset:]
+		}
+		if limit := toInt(e.eval(query.Limit)); limit >= 0 && limit < int64(len(rows)) {
+			rows = rows[:limit]
+		}
+	}
+	if last != nil {
+		rows = following(rows, *last)
+	}
+	if n >= 0 && n < len(rows) {
+		rows = rows[:n]
+	}
+	for _, r := range rows {
+		selected = append(selected, r.obj)
+	}
+	return
+}
+
+/*
+Returns the values of the query's limit and offset. The limit is -1 if the query has none.
+The query must have been checked. params are the values of the query's ? parameters.
+*/
+func Limits(query *Query, params []interface{}) (limit int64, offset int64, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, isEvalError := r.(evalError); isEvalError {
+				err = e.err
+				return
+			}
+			panic(r)
+		}
+	}()
+	limit = -1
+	if query.Limit == nil {
+		return
+	}
+	shared := &evalShared{params: params, subqueries: make(map[*Subquery][]interface{})}
+	e := shared.evaluator(0)
+	if limit = toInt(e.eval(query.Limit)); limit < 0 {
+		limit = -1
+	}
+	if query.Offset != nil {
+		if offset = toInt(e.eval(query.Offset)); offset < 0 {
+			offset = 0
+		}
+	}
+	return
+}
+
+/*
+An error which occurs while evaluating a query, which is panicked with to abandon the evaluation.
+*/
+type evalError struct {
+	err error
+}
+
+func fail(format string, args ...interface{}) {
+	panic(evalError{fmt.Errorf(format, args...)})
+}
+
+/*
+State shared by the evaluators of a query.
+*/
+type evalShared struct {
+	objects    Objects
+	params     []interface{}
+	subqueries map[*Subquery][]interface{} // the values selected by each subquery, once evaluated
+}
+
+func (s *evalShared) evaluator(root ObjectRef) *evaluator {
+	return &evaluator{evalShared: s, root: root, scopes: make(map[string]interface{})}
+}
+
+/*
+Evaluates expressions whose attribute paths start from the object root.
+*/
+type evaluator struct {
+	*evalShared
+	root   ObjectRef
+	scopes map[string]interface{} // the value of the multi-valued attribute at each path prefix that a predicate is being tested for
+}
+
+func (e *evaluator) attrValues(obj ObjectRef, attr *AttributeSpec) []interface{} {
+	vals, err := e.objects.AttrValues(obj, attr)
+	if err != nil {
+		panic(evalError{err})
+	}
+	return vals
+}
+
+func (e *evaluator) orderKeys(query *Query) (keys []interface{}) {
+	for _, item := range query.OrderBy {
+		keys = append(keys, e.eval(item.X))
+	}
+	return
+}
+
+/*
+Returns the value of the expression, for the root object.
+*/
+func (e *evaluator) eval(x Expr) interface{} {
+	if path, i := e.unboundMulti(x); path != nil {
+		return e.exists(x, path, i)
+	}
+	switch x := x.(type) {
+	case *Path:
+		return e.path(x, len(x.Attrs))
+	case *Literal:
+		switch x.Tok {
+		case TRUE:
+			return int64(1)
+		case FALSE:
+			return int64(0)
+		case NULL:
+			return nil
+		case STRING:
+			return strings.Replace(x.Value[1:len(x.Value)-1], "''", "'", -1)
+		}
+		return number(x.Value)
+	case *Param:
+		if x.Index >= len(e.params) {
+			fail("The query has more ? parameters than the %d query arguments given.", len(e.params))
+		}
+		return normalize(e.params[x.Index])
+	case *Call:
+		return e.call(x)
+	case *ParenExpr:
+		return e.eval(x.X)
+	case *UnaryExpr:
+		v := e.eval(x.X)
+		if v == nil {
+			return nil
+		}
+		if x.Op == NOT {
+			return boolVal(! truth(v))
+		}
+		switch n := toNumber(v).(type) {
+		case int64:
+			return -n
+		case float64:
+			return -n
+		}
+	case *BinaryExpr:
+		return e.binary(x)
+	case *IsNullExpr:
+		return boolVal((e.eval(x.X) == nil) != x.Not)
+	case *LikeExpr:
+		v, pattern := e.eval(x.X), e.eval(x.Pattern)
+		if v == nil || pattern == nil {
+			return nil
+		}
+		return boolVal(like(text(v), text(pattern)) != x.Not)
+	case *InExpr:
+		v := e.eval(x.X)
+		var items []interface{}
+		if x.Query != nil {
+			items = e.subquery(x.Query)
+		} else {
+			for _, item := range x.List {
+				items = append(items, e.eval(item))
+			}
+		}
+		result := in(v, items)
+		if result == nil || ! x.Not {
+			return result
+		}
+		return boolVal(! truth(result))
+	case *BetweenExpr:
+		v := e.eval(x.X)
+		result := and(compareOp(GEQ, v, e.eval(x.Lo)), compareOp(LEQ, v, e.eval(x.Hi)))
+		if result == nil || ! x.Not {
+			return result
+		}
+		return boolVal(! truth(result))
+	case *ExistsExpr:
+		v := e.eval(x.Path)
+		if v == nil {
+			return int64(0)
+		}
+		if x.Cond == nil {
+			return int64(1)
+		}
+		return boolVal(truth(e.evaluator(v.(ObjectRef)).eval(x.Cond)))
+	}
+	panic(fmt.Sprintf("Unexpected OQL expression %T", x))
+}
+
+/*
+Returns a path in the predicate which passes through a multi-valued attribute whose values are not being
+tested, and the index of the attribute in the path, or nil if there is none. Returns nil for an and, or or not
+expression, whose operands are separate predicates.
+*/
+func (e *evaluator) unboundMulti(x Expr) (path *Path, index int) {
+	switch y := x.(type) {
+	case *BinaryExpr:
+		if y.Op == AND || y.Op == OR {
+			return
+		}
+	case *UnaryExpr:
+		if y.Op == NOT {
+			return
+		}
+	case *ParenExpr:
+		return
+	}
+	Walk(x, func(y Expr) {
+		p, isPath := y.(*Path)
+		if ! isPath || path != nil {
+			return
+		}
+		for i, attr := range p.Attrs {
+			if attr.IsCollection() {
+				if _, bound := e.scopes[strings.Join(p.Names[:i+1], ".")]; ! bound {
+					path, index = p, i
+					return
+				}
+			}
+		}
+	})
+	return
+}
+
+/*
+Returns 1 if the predicate is true for some value of the multi-valued attribute at index i of the path,
+otherwise 0.
+*/
+func (e *evaluator) exists(x Expr, path *Path, i int) interface{} {
+	owner, isObject := e.path(path, i).(ObjectRef)
+	if ! isObject {
+		return int64(0)
+	}
+	prefix := strings.Join(path.Names[:i+1], ".")
+	defer delete(e.scopes, prefix)
+	for _, val := range e.attrValues(owner, path.Attrs[i]) {
+		e.scopes[prefix] = normalize(val)
+		if truth(e.eval(x)) {
+			return int64(1)
+		}
+	}
+	return int64(0)
+}
+
+/*
+Returns the value of the first n attributes of the path, starting from the root object, or from the value
+of a multi-valued attribute of the path which is being tested. nil if an attribute along the way has no value.
+*/
+func (e *evaluator) path(path *Path, n int) interface{} {
+	var v interface{} = e.root
+	start := 0
+	for j := n; j > 0; j-- {
+		if val, bound := e.scopes[strings.Join(path.Names[:j], ".")]; bound {
+			v, start = val, j
+			break
+		}
+	}
+	for _, attr := range path.Attrs[start:n] {
+		obj, isObject := v.(ObjectRef)
+		if ! isObject {
+			return nil
+		}
+		vals := e.attrValues(obj, attr)
+		if len(vals) == 0 {
+			return nil
+		}
+		v = normalize(vals[0])
+	}
+	return v
+}
+
+/*
+Returns the values selected by the subquery. The subquery is evaluated once per query.
+*/
+func (e *evaluator) subquery(q *Subquery) []interface{} {
+	if vals, found := e.subqueries[q]; found {
+		return vals
+	}
+	objs, err := e.objects.Extent(q.Type)
+	if err != nil {
+		panic(evalError{err})
+	}
+	vals := []interface{}{}
+	for _, obj := range objs {
+		sub := e.evaluator(obj)
+		if q.Where != nil && ! truth(sub.eval(q.Where)) {
+			continue
+		}
+		if q.Select == nil {
+			vals = append(vals, obj)
+		} else if v := sub.eval(q.Select); v != nil {
+			vals = append(vals, v)
+		}
+	}
+	e.subqueries[q] = vals
+	return vals
+}
+
+func (e *evaluator) binary(x *BinaryExpr) interface{} {
+	switch x.Op {
+	case AND:
+		return and(e.eval(x.X), e.eval(x.Y))
+	case OR:
+		a, b := e.eval(x.X), e.eval(x.Y)
+		if truth(a) || truth(b) {
+			return int64(1)
+		}
+		if a == nil || b == nil {
+			return nil
+		}
+		return int64(0)
+	}
+	a, b := e.eval(x.X), e.eval(x.Y)
+	if x.Op.IsComparison() {
+		return compareOp(x.Op, a, b)
+	}
+	if a == nil || b == nil {
+		return nil
+	}
+	if x.Op == CONCAT {
+		return text(a) + text(b)
+	}
+	return arithmetic(x.Op, toNumber(a), toNumber(b))
+}
+
+func (e *evaluator) call(x *Call) interface{} {
+	args := make([]interface{}, len(x.Args))
+	for i, arg := range x.Args {
+		args[i] = e.eval(arg)
+	}
+	switch x.Fun {
+	case "coalesce", "ifnull":
+		for _, arg := range args {
+			if arg != nil {
+				return arg
+			}
+		}
+		return nil
+	}
+	nArgs := map[string][]int{
+		"lower": {1}, "upper": {1}, "length": {1}, "abs": {1}, "trim": {1}, "ltrim": {1}, "rtrim": {1},
+		"round": {1, 2}, "substr": {2, 3}, "replace": {3},
+	}[x.Fun]
+	if nArgs == nil {
+		fail("no such function: %s", x.Fun)
+	}
+	if len(args) < nArgs[0] || len(args) > nArgs[len(nArgs)-1] {
+		fail("wrong number of arguments to function %s()", x.Fun)
+	}
+	for _, arg := range args {
+		if arg == nil {
+			return nil
+		}
+	}
+	switch x.Fun {
+	case "lower":
+		return strings.ToLower(text(args[0]))
+	case "upper":
+		return strings.ToUpper(text(args[0]))
+	case "length":
+		return int64(len([]rune(text(args[0]))))
+	case "abs":
+		switch n := toNumber(args[0]).(type) {
+		case int64:
+			if n < 0 {
+				return -n
+			}
+			return n
+		case float64:
+			if n < 0 {
+				return -n
+			}
+			return n
+		}
+	case "trim":
+		return strings.TrimSpace(text(args[0]))
+	case "ltrim":
+		return strings.TrimLeft(text(args[0]), " \t\r\n")
+	case "rtrim":
+		return strings.TrimRight(text(args[0]), " \t\r\n")
+	case "round":
+		digits := int64(0)
+		if len(args) == 2 {
+			digits = toInt(args[1])
+		}
+		f, _ := strconv.ParseFloat(strconv.FormatFloat(toFloat(args[0]), 'f', int(digits), 64), 64)
+		return f
+	case "substr":
+		s := []rune(text(args[0]))
+		start := toInt(args[1])
+		n := int64(len(s))
+		if len(args) == 3 {
+			n = toInt(args[2])
+		}
+		if start > 0 {
+			start--
+		} else if start < 0 {
+			start += int64(len(s))
+			if start < 0 {
+				n += start
+				start = 0
+			}
+		}
+		if start > int64(len(s)) || n <= 0 {
+			return ""
+		}
+		if start+n > int64(len(s)) {
+			n = int64(len(s)) - start
+		}
+		return string(s[start : start+n])
+	case "replace":
+		if text(args[1]) == "" {
+			return text(args[0])
+		}
+		return strings.Replace(text(args[0]), text(args[1]), text(args[2]), -1)
+	}
+	return nil
+}
+
+/*
+Converts a stored value or query argument to a value of the evaluator.
+*/
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, int64, float64, string, ObjectRef:
+		return v
+	case bool:
+		return boolVal(v)
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case uint64:
+		return int64(v)
+	case float32:
+		return float64(v)
+	}
+	return fmt.Sprint(v)
+}
+
+func boolVal(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+/*
+Whether the value is true, as the value of a condition.
+*/
+func truth(v interface{}) bool {
+	switch n := toNumber(v).(type) {
+	case int64:
+		return n != 0
+	case float64:
+		return n != 0
+	}
+	return false
+}
+
+func and(a interface{}, b interface{}) interface{} {
+	if (a != nil && ! truth(a)) || (b != nil && ! truth(b)) {
+		return int64(0)
+	}
+	if a == nil || b == nil {
+		return nil
+	}
+	return int64(1)
+}
+
+/*
+Returns the number written in the text, as an int64 if it is an integer, otherwise as a float64.
+*/
+func number(s string) interface{} {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i
+	}
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
+
+/*
+Returns the value as an int64 or float64 number. A String which is not the text of a number is 0.
+*/
+func toNumber(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int64, float64:
+		return v
+	case ObjectRef:
+		return int64(v)
+	case string:
+		s := strings.TrimSpace(v)
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+		return int64(0)
+	}
+	return nil
+}
+
+func toInt(v interface{}) int64 {
+	switch n := toNumber(v).(type) {
+	case int64:
+		return n
+	case float64:
+		return int64(n)
+	}
+	return 0
+}
+
+func toFloat(v interface{}) float64 {
+	switch n := toNumber(v).(type) {
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
+/*
+Returns the text of the value.
+*/
+func text(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case ObjectRef:
+		return strconv.FormatInt(int64(v), 10)
+	case float64:
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if ! strings.ContainsAny(s, ".eEIN") {
+			s += ".0"
+		}
+		return s
+	}
+	return ""
+}
+
+func arithmetic(op Token, a interface{}, b interface{}) interface{} {
+	x, xIsInt := a.(int64)
+	y, yIsInt := b.(int64)
+	if xIsInt && yIsInt {
+		switch op {
+		case ADD:
+			return x + y
+		case SUB:
+			return x - y
+		case MUL:
+			return x * y
+		case QUO:
+			if y == 0 {
+				return nil
+			}
+			return x / y
+		case REM:
+			if y == 0 {
+				return nil
+			}
+			return x % y
+		}
+	}
+	f, g := toFloat(a), toFloat(b)
+	switch op {
+	case ADD:
+		return f + g
+	case SUB:
+		return f - g
+	case MUL:
+		return f * g
+	case QUO:
+		if g == 0 {
+			return nil
+		}
+		return f / g
+	case REM:
+		if int64(g) == 0 {
+			return nil
+		}
+		return float64(int64(f) % int64(g))
+	}
+	return nil
+}
+
+/*
+Compares two non-NULL values. Numbers are less than Strings, unless the String is the text of a number.
+Returns -1, 0 or 1.
+*/
+func compare(a interface{}, b interface{}) int {
+	if s, isString := a.(string); isString {
+		if _, bIsString := b.(string); ! bIsString {
+			if n, isNumber := numberText(s); isNumber {
+				a = n
+			}
+		}
+	}
+	if s, isString := b.(string); isString {
+		if _, aIsString := a.(string); ! aIsString {
+			if n, isNumber := numberText(s); isNumber {
+				b = n
+			}
+		}
+	}
+	s, aIsString := a.(string)
+	t, bIsString := b.(string)
+	switch {
+	case aIsString && bIsString:
+		return strings.Compare(s, t)
+	case aIsString:
+		return 1
+	case bIsString:
+		return -1
+	}
+	x, xIsInt := toNumber(a).(int64)
+	y, yIsInt := toNumber(b).(int64)
+	if xIsInt && yIsInt {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	f, g := toFloat(a), toFloat(b)
+	switch {
+	case f < g:
+		return -1
+	case f > g:
+		return 1
+	}
+	return 0
+}
+
+/*
+The number, if the String is the text of a number.
+*/
+func numberText(s string) (n interface{}, isNumber bool) {
+	s = strings.TrimSpace(s)
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i, true
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, true
+	}
+	return nil, false
+}
+
+/*
+Compares two values for ordering, with NULL before all other values.
+*/
+func compareOrder(a interface{}, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	return compare(a, b)
+}
+
+func compareOp(op Token, a interface{}, b interface{}) interface{} {
+	if a == nil || b == nil {
+		return nil
+	}
+	c := compare(a, b)
+	switch op {
+	case EQL:
+		return boolVal(c == 0)
+	case NEQ:
+		return boolVal(c != 0)
+	case LSS:
+		return boolVal(c < 0)
+	case LEQ:
+		return boolVal(c <= 0)
+	case GTR:
+		return boolVal(c > 0)
+	case GEQ:
+		return boolVal(c >= 0)
+	}
+	return nil
+}
+
+func in(v interface{}, items []interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	sawNull := false
+	for _, item := range items {
+		if item == nil {
+			sawNull = true
+		} else if compare(v, item) == 0 {
+			return int64(1)
+		}
+	}
+	if sawNull {
+		return nil
+	}
+	return int64(0)
+}
+
+/*
+Whether the String matches the like pattern, in which % matches any sequence of characters and _ matches
+any single character. ASCII letters match regardless of case.
+*/
+func like(s string, pattern string) bool {
+	return likeRunes([]rune(strings.ToLower(s)), []rune(strings.ToLower(pattern)))
+}
+
+func likeRunes(s []rune, p []rune) bool {
+	for len(p) > 0 {
+		switch p[0] {
+		case '%':
+			for len(p) > 0 && p[0] == '%' {
+				p = p[1:]
+			}
+			if len(p) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if likeRunes(s[i:], p) {
+					return true
+				}
+			}
+			return false
+		case '_':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != p[0] {
+				return false
+			}
+		}
+		s, p = s[1:], p[1:]
+	}
+	return len(s) == 0
+}
@@ -0,0 +1,153 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+package oql
+
+import (
+	"fmt"
+	. "relish/runtime/data"
+	"testing"
+)
+
+/*
+Objects held in maps, for evaluating queries without a database.
+*/
+type testObjects struct {
+	vals    map[ObjectRef]map[*AttributeSpec][]interface{}
+	extents map[*RType][]ObjectRef
+}
+
+func (o *testObjects) AttrValues(obj ObjectRef, attr *AttributeSpec) ([]interface{}, error) {
+	return o.vals[obj][attr], nil
+}
+
+func (o *testObjects) Extent(typ *RType) ([]ObjectRef, error) {
+	return o.extents[typ], nil
+}
+
+func (o *testObjects) add(typ *RType, obj ObjectRef, vals map[*AttributeSpec][]interface{}) {
+	o.vals[obj] = vals
+	o.extents[typ] = append(o.extents[typ], obj)
+}
+
+func newTestType(name string) *RType {
+	return &RType{Name: name, IsStruct: true, AttributesByName: make(map[string]*AttributeSpec)}
+}
+
+func addTestAttr(typ *RType, name string, partType *RType, collectionType string) *AttributeSpec {
+	attr := &AttributeSpec{WholeType: typ, Part: RelEnd{Name: name, Type: partType, ArityLow: 0, ArityHigh: 1, CollectionType: collectionType}}
+	if collectionType != "" {
+		attr.Part.ArityHigh = -1
+	}
+	typ.Attributes = append(typ.Attributes, attr)
+	typ.AttributesByName[name] = attr
+	return attr
+}
+
+func TestSelect(t *testing.T) {
+	person := newTestType("test/Person")
+	car := newTestType("test/Car")
+	name := addTestAttr(person, "name", StringType, "")
+	age := addTestAttr(person, "age", IntType, "")
+	nicknames := addTestAttr(person, "nicknames", StringType, "set")
+	make_ := addTestAttr(car, "make", StringType, "")
+	speed := addTestAttr(car, "speed", IntType, "")
+	fast := addTestAttr(car, "fast", BoolType, "")
+	owner := addTestAttr(car, "owner", person, "")
+	cars := addTestAttr(person, "cars", car, "list")
+
+	objs := &testObjects{make(map[ObjectRef]map[*AttributeSpec][]interface{}), make(map[*RType][]ObjectRef)}
+	objs.add(person, 10, map[*AttributeSpec][]interface{}{name: {"Jane"}, age: {int64(40)}, nicknames: {"JJ", "Janey"}, cars: {ObjectRef(1), ObjectRef(2)}})
+	objs.add(person, 11, map[*AttributeSpec][]interface{}{name: {"O'Brien"}, age: {int64(25)}, cars: {ObjectRef(3)}})
+	objs.add(person, 12, map[*AttributeSpec][]interface{}{name: {"Nobody"}})
+	objs.add(car, 1, map[*AttributeSpec][]interface{}{make_: {"Ford"}, speed: {int64(120)}, fast: {true}, owner: {ObjectRef(10)}})
+	objs.add(car, 2, map[*AttributeSpec][]interface{}{make_: {"Fiat"}, speed: {int64(90)}, fast: {false}, owner: {ObjectRef(10)}})
+	objs.add(car, 3, map[*AttributeSpec][]interface{}{make_: {"ford"}, speed: {int64(150)}, fast: {true}, owner: {ObjectRef(11)}})
+	objs.add(car, 4, map[*AttributeSpec][]interface{}{make_: {"Tata"}})
+
+	lookupType := func(typeName string) (*RType, error) {
+		for _, typ := range []*RType{person, car} {
+			if typ.Name == typeName {
+				return typ, nil
+			}
+		}
+		return nil, fmt.Errorf("no type %s", typeName)
+	}
+
+	tests := []struct {
+		typ    *RType
+		src    string
+		params []interface{}
+		want   string
+	}{
+		{car, "", nil, "[1 2 3 4]"},
+		{car, "speed > 100", nil, "[1 3]"},
+		{car, "speed > ?", []interface{}{"100"}, "[1 3]"},
+		{car, "not speed > 100", nil, "[2]"},
+		{car, "speed is null or fast", nil, "[1 3 4]"},
+		{car, "fast = true and make like 'f%'", nil, "[1 3]"},
+		{car, "make not like 'F_rd'", nil, "[2 4]"},
+		{car, "owner.name = 'O''Brien'", nil, "[3]"},
+		{car, "owner.age between 30 and 50", nil, "[1 2]"},
+		{car, "make in ('Fiat', 'Tata')", nil, "[2 4]"},
+		{car, "lower(make) = 'ford' and speed + 10 >= 160", nil, "[3]"},
+		{car, "make || '!' = 'Tata!'", nil, "[4]"},
+		{car, "owner in (select test/Person where age < 30)", nil, "[3]"},
+		{car, "make in (select name from test/Person)", nil, "[]"},
+		{car, "order by speed desc", nil, "[3 1 2 4]"},
+		{car, "order by speed", nil, "[4 2 1 3]"},
+		{car, "order by owner.name, make limit 2 offset 1", nil, "[2 1]"},
+		{car, "speed > 0 order by speed limit ?", []interface{}{int64(2)}, "[2 1]"},
+		{person, "cars.speed > 140", nil, "[11]"},
+		{person, "not cars.speed > 100", nil, "[12]"},
+		{person, "nicknames = 'Janey'", nil, "[10]"},
+		{person, "exists cars", nil, "[10 11]"},
+		{person, "not exists (cars where make = 'Fiat')", nil, "[11 12]"},
+		{person, "exists (cars where owner.age > 30) and age > 30", nil, "[10]"},
+		{person, "length(name) = 4 or substr(name, 1, 2) = 'No'", nil, "[10 12]"},
+	}
+	for _, test := range tests {
+		query, err := Parse(test.src)
+		if err != nil {
+			t.Errorf("Parse(%q): %s", test.src, err)
+			continue
+		}
+		if err = Check(query, test.typ, lookupType); err != nil {
+			t.Errorf("Check(%q): %s", test.src, err)
+			continue
+		}
+		selected, err := Select(query, objs.extents[test.typ], objs, test.params)
+		if err != nil {
+			t.Errorf("Select(%q): %s", test.src, err)
+			continue
+		}
+		if got := fmt.Sprint(selected); got != test.want {
+			t.Errorf("Select(%q) = %s, want %s", test.src, got, test.want)
+		}
+	}
+
+	query, _ := Parse("order by speed desc")
+	Check(query, car, lookupType)
+	selected, err := SelectAfter(query, objs.extents[car], objs, nil, 1)
+	if err != nil || fmt.Sprint(selected) != "[2 4]" {
+		t.Errorf("SelectAfter = %v, %v, want [2 4]", selected, err)
+	}
+
+	last := ObjectRef(2)
+	selected, err = SelectPage(query, objs.extents[car], objs, nil, nil, &last, 1)
+	if err != nil || fmt.Sprint(selected) != "[4]" {
+		t.Errorf("SelectPage = %v, %v, want [4]", selected, err)
+	}
+
+	query, _ = Parse("order by speed limit ? offset 3")
+	Check(query, car, lookupType)
+	if limit, offset, err := Limits(query, []interface{}{int64(2)}); err != nil || limit != 2 || offset != 3 {
+		t.Errorf("Limits = %d, %d, %v, want 2, 3", limit, offset, err)
+	}
+
+	query, _ = Parse("nosuch(make) = 1")
+	Check(query, car, lookupType)
+	if _, err = Select(query, objs.extents[car], objs, nil); err == nil {
+		t.Errorf("Select with an unknown function should have failed")
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+package oql
+
+/*
+   lexer.go - breaks the text of an OQL query into tokens.
+*/
+
+import (
+	"fmt"
+)
+
+/*
+An error in an OQL query, at a column position (starting at 1) in the query text.
+*/
+type Error struct {
+	Col int
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("column %d: %s", e.Col, e.Msg)
+}
+
+func errorf(col int, format string, args ...interface{}) *Error {
+	return &Error{col, fmt.Sprintf(format, args...)}
+}
+
+/*
+Scans the text of a query one token at a time.
+*/
+type Lexer struct {
+	src    string
+	offset int // byte offset of the next unscanned character
+}
+
+func NewLexer(src string) *Lexer {
+	return &Lexer{src: src}
+}
+
+/*
+Returns the next token, its column position, and its literal text.
+The literal text of a STRING is as written, including the quotes.
+Returns an error if the text at the current position is not a valid token.
+*/
+func (l *Lexer) Next() (tok Token, col int, lit string, err error) {
+	for l.offset < len(l.src) && isSpace(l.src[l.offset]) {
+		l.offset++
+	}
+	start := l.offset
+	col = start + 1
+	if start >= len(l.src) {
+		tok = EOF
+		return
+	}
+
+	ch := l.src[start]
+	l.offset++
+	switch {
+	case isLetter(ch):
+		for l.offset < len(l.src) && (isLetter(l.src[l.offset]) || isDigit(l.src[l.offset])) {
+			l.offset++
+		}
+		lit = l.src[start:l.offset]
+		tok = Lookup(lit)
+		return
+	case isDigit(ch):
+		tok = NUMBER
+		l.scanDigits()
+		if l.offset+1 < len(l.src) && l.src[l.offset] == '.' && isDigit(l.src[l.offset+1]) {
+			l.offset++
+			l.scanDigits()
+		}
+		if l.offset < len(l.src) && (l.src[l.offset] == 'e' || l.src[l.offset] == 'E') {
+			l.offset++
+			if l.offset < len(l.src) && (l.src[l.offset] == '+' || l.src[l.offset] == '-') {
+				l.offset++
+			}
+			if l.offset >= len(l.src) || ! isDigit(l.src[l.offset]) {
+				err = errorf(col, "malformed number exponent")
+				return
+			}
+			l.scanDigits()
+		}
+		lit = l.src[start:l.offset]
+		return
+	case ch == '\'':
+		for {
+			if l.offset >= len(l.src) {
+				err = errorf(col, "string literal not terminated")
+				return
+			}
+			if l.src[l.offset] == '\'' {
+				l.offset++
+				if l.offset < len(l.src) && l.src[l.offset] == '\'' { // '' is an escaped quote
+					l.offset++
+					continue
+				}
+				break
+			}
+			l.offset++
+		}
+		tok = STRING
+		lit = l.src[start:l.offset]
+		return
+	}
+
+	next := byte(0)
+	if l.offset < len(l.src) {
+		next = l.src[l.offset]
+	}
+	switch ch {
+	case '?':
+		tok = PARAM
+	case '(':
+		tok = LPAREN
+	case ')':
+		tok = RPAREN
+	case ',':
+		tok = COMMA
+	case '.':
+		tok = DOT
+	case '+':
+		tok = ADD
+	case '-':
+		tok = SUB
+	case '*':
+		tok = MUL
+	case '/':
+		tok = QUO
+	case '%':
+		tok = REM
+	case '=':
+		tok = EQL
+		if next == '=' {
+			l.offset++
+		}
+	case '!':
+		if next != '=' {
+			err = errorf(col, "unexpected character '!'")
+			return
+		}
+		l.offset++
+		tok = NEQ
+	case '<':
+		tok = LSS
+		if next == '=' {
+			l.offset++
+			tok = LEQ
+		} else if next == '>' {
+			l.offset++
+			tok = NEQ
+		}
+	case '>':
+		tok = GTR
+		if next == '=' {
+			l.offset++
+			tok = GEQ
+		}
+	case '|':
+		if next != '|' {
+			err = errorf(col, "unexpected character '|'")
+			return
+		}
+		l.offset++
+		tok = CONCAT
+	default:
+		err = errorf(col, "unexpected character %q", ch)
+		return
+	}
+	lit = l.src[start:l.offset]
+	return
+}
+
+func (l *Lexer) scanDigits() {
+	for l.offset < len(l.src) && isDigit(l.src[l.offset]) {
+		l.offset++
+	}
+}
+
+func isSpace(ch byte) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r'
+}
+
+func isLetter(ch byte) bool {
+	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_'
+}
+
+func isDigit(ch byte) bool {
+	return '0' <= ch && ch <= '9'
+}
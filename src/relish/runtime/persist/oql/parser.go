@@ -0,0 +1,459 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+package oql
+
+/*
+   parser.go - recursive-descent parser of OQL queries.
+
+   Grammar, from lowest to highest precedence:
+
+   query      = [ expr ] orderLimit
+   aggregate  = concat { "," concat } { "where" expr | "group" "by" concat { "," concat } }
+                [ "having" expr ] orderLimit
+   orderLimit = [ "order" "by" orderItem { "," orderItem } ] [ "limit" additive [ "offset" additive ] ]
+   orderItem  = additive [ "asc" | "desc" ]
+   expr       = andExpr { "or" andExpr }
+   andExpr    = notExpr { "and" notExpr }
+   notExpr    = "not" notExpr | exists | predicate
+   exists     = "exists" ( path | "(" path [ "where" expr ] ")" )
+   predicate  = concat [ compareOp concat
+                       | "is" [ "not" ] "null"
+                       | [ "not" ] "like" concat
+                       | [ "not" ] "in" "(" ( expr { "," expr } | subquery ) ")"
+                       | [ "not" ] "between" concat "and" concat ]
+   subquery   = "select" [ path "from" ] typeName [ "where" expr ]
+   typeName   = ident { ( "." | "/" ) ident }
+   concat     = additive { "||" additive }
+   additive   = term { ( "+" | "-" ) term }
+   term       = unary { ( "*" | "/" | "%" ) unary }
+   unary      = "-" unary | primary
+   primary    = number | string | "true" | "false" | "null" | "?"
+              | ident "(" [ "*" | expr { "," expr } ] ")"
+              | path
+              | "(" expr ")"
+   path       = ident { "." ident }
+*/
+
+import (
+	"strings"
+)
+
+type parser struct {
+	lexer *Lexer
+	tok   Token  // current token
+	col   int    // column of current token
+	lit   string // literal text of current token
+	numParams int
+}
+
+/*
+Parses the text of an OQL query. Returns an *Error, giving the column of the problem, if the query is not
+syntactically valid.
+*/
+func Parse(src string) (query *Query, err error) {
+	p := &parser{lexer: NewLexer(src)}
+	defer func() {
+		if r := recover(); r != nil {
+			if e, isOqlError := r.(*Error); isOqlError {
+				err = e
+				return
+			}
+			panic(r)
+		}
+	}()
+	p.next()
+	query = p.parseQuery()
+	return
+}
+
+/*
+Parses the text of an aggregate query, which selects values computed from the queried objects.
+Returns an *Error, giving the column of the problem, if the query is not syntactically valid.
+*/
+func ParseAggregate(src string) (query *AggregateQuery, err error) {
+	p := &parser{lexer: NewLexer(src)}
+	defer func() {
+		if r := recover(); r != nil {
+			if e, isOqlError := r.(*Error); isOqlError {
+				err = e
+				return
+			}
+			panic(r)
+		}
+	}()
+	p.next()
+	query = p.parseAggregateQuery()
+	return
+}
+
+func (p *parser) next() {
+	var err error
+	p.tok, p.col, p.lit, err = p.lexer.Next()
+	if err != nil {
+		panic(err)
+	}
+}
+
+/*
+Parses an attribute path: ident { "." ident }
+*/
+func (p *parser) parsePath(what string) *Path {
+	if p.tok != IDENT {
+		p.errorExpected(what)
+	}
+	name, col := p.lit, p.col
+	p.next()
+	return p.parsePathRest(name, col)
+}
+
+/*
+Parses the rest of an attribute path whose first name has been read.
+*/
+func (p *parser) parsePathRest(name string, col int) *Path {
+	path := &Path{Names: []string{name}, Cols: []int{col}}
+	for p.tok == DOT {
+		p.next()
+		if p.tok != IDENT {
+			p.errorExpected("attribute name after '.'")
+		}
+		path.Names = append(path.Names, p.lit)
+		path.Cols = append(path.Cols, p.col)
+		p.next()
+	}
+	return path
+}
+
+func (p *parser) errorExpected(what string) {
+	found := "'" + p.lit + "'"
+	if p.tok == EOF {
+		found = p.tok.String()
+	}
+	panic(errorf(p.col, "expected %s, found %s", what, found))
+}
+
+func (p *parser) expect(tok Token) int {
+	col := p.col
+	if p.tok != tok {
+		p.errorExpected("'" + tok.String() + "'")
+	}
+	p.next()
+	return col
+}
+
+func (p *parser) parseQuery() *Query {
+	query := &Query{}
+	if p.tok != ORDER && p.tok != LIMIT && p.tok != EOF {
+		query.Where = p.parseExpr()
+	}
+	p.parseOrderLimit(query)
+	if p.tok != EOF {
+		if query.Where == nil && query.OrderBy == nil && query.Limit == nil {
+			p.errorExpected("condition")
+		}
+		p.errorExpected("'and', 'or', 'order by', 'limit' or end of query")
+	}
+	return query
+}
+
+func (p *parser) parseAggregateQuery() *AggregateQuery {
+	query := &AggregateQuery{}
+	query.Items = []Expr{p.parseConcat()}
+	for p.tok == COMMA {
+		p.next()
+		query.Items = append(query.Items, p.parseConcat())
+	}
+	for {
+		if p.tok == WHERE && query.Where == nil {
+			p.next()
+			query.Where = p.parseExpr()
+		} else if p.tok == GROUP && query.GroupBy == nil {
+			p.next()
+			p.expect(BY)
+			query.GroupBy = []Expr{p.parseConcat()}
+			for p.tok == COMMA {
+				p.next()
+				query.GroupBy = append(query.GroupBy, p.parseConcat())
+			}
+		} else {
+			break
+		}
+	}
+	if p.tok == HAVING {
+		p.next()
+		query.Having = p.parseExpr()
+	}
+	p.parseOrderLimit(&query.Query)
+	if p.tok != EOF {
+		p.errorExpected("',', 'where', 'group by', 'having', 'order by', 'limit' or end of query")
+	}
+	return query
+}
+
+func (p *parser) parseOrderLimit(query *Query) {
+	if p.tok == ORDER {
+		p.next()
+		p.expect(BY)
+		for {
+			item := &OrderItem{X: p.parseAdditive()}
+			if p.tok == ASC {
+				p.next()
+			} else if p.tok == DESC {
+				item.Desc = true
+				p.next()
+			}
+			query.OrderBy = append(query.OrderBy, item)
+			if p.tok != COMMA {
+				break
+			}
+			p.next()
+		}
+	}
+	if p.tok == LIMIT {
+		p.next()
+		query.Limit = p.parseAdditive()
+		if p.tok == OFFSET {
+			p.next()
+			query.Offset = p.parseAdditive()
+		}
+	}
+}
+
+func (p *parser) parseExpr() Expr {
+	x := p.parseAnd()
+	for p.tok == OR {
+		col := p.col
+		p.next()
+		x = &BinaryExpr{X: x, Op: OR, OpCol: col, Y: p.parseAnd()}
+	}
+	return x
+}
+
+func (p *parser) parseAnd() Expr {
+	x := p.parseNot()
+	for p.tok == AND {
+		col := p.col
+		p.next()
+		x = &BinaryExpr{X: x, Op: AND, OpCol: col, Y: p.parseNot()}
+	}
+	return x
+}
+
+func (p *parser) parseNot() Expr {
+	if p.tok == NOT {
+		col := p.col
+		p.next()
+		return &UnaryExpr{Op: NOT, Col: col, X: p.parseNot()}
+	}
+	if p.tok == EXISTS {
+		return p.parseExists()
+	}
+	return p.parsePredicate()
+}
+
+func (p *parser) parseExists() Expr {
+	exists := &ExistsExpr{Col: p.col}
+	p.next()
+	if p.tok != LPAREN {
+		exists.Path = p.parsePath("attribute name after 'exists'")
+		return exists
+	}
+	p.next()
+	exists.Path = p.parsePath("attribute name after 'exists ('")
+	if p.tok == WHERE {
+		p.next()
+		exists.Cond = p.parseExpr()
+	}
+	p.expect(RPAREN)
+	return exists
+}
+
+func (p *parser) parsePredicate() Expr {
+	x := p.parseConcat()
+	if p.tok.IsComparison() {
+		op, col := p.tok, p.col
+		p.next()
+		return &BinaryExpr{X: x, Op: op, OpCol: col, Y: p.parseConcat()}
+	}
+	if p.tok == IS {
+		p.next()
+		isNull := &IsNullExpr{X: x}
+		if p.tok == NOT {
+			isNull.Not = true
+			p.next()
+		}
+		p.expect(NULL)
+		return isNull
+	}
+	not := false
+	if p.tok == NOT {
+		not = true
+		p.next()
+		if p.tok != LIKE && p.tok != IN && p.tok != BETWEEN {
+			p.errorExpected("'like', 'in' or 'between' after 'not'")
+		}
+	}
+	switch p.tok {
+	case LIKE:
+		p.next()
+		return &LikeExpr{X: x, Not: not, Pattern: p.parseConcat()}
+	case IN:
+		p.next()
+		return p.parseInList(x, not)
+	case BETWEEN:
+		p.next()
+		between := &BetweenExpr{X: x, Not: not}
+		between.Lo = p.parseConcat()
+		p.expect(AND)
+		between.Hi = p.parseConcat()
+		return between
+	}
+	return x
+}
+
+func (p *parser) parseInList(x Expr, not bool) Expr {
+	in := &InExpr{X: x, Not: not}
+	p.expect(LPAREN)
+	if p.tok == SELECT {
+		in.Query = p.parseSubquery()
+	} else {
+		in.List = p.parseExprList()
+	}
+	p.expect(RPAREN)
+	return in
+}
+
+/*
+Parses "select [path from] typeName [where expr]". The selected path and the type name look alike until
+a "from" is or is not found after them, so both are first read as a type name.
+*/
+func (p *parser) parseSubquery() *Subquery {
+	sub := &Subquery{Col: p.col}
+	p.next()
+	names, cols, name, col := p.parseTypeName()
+	if p.tok == FROM {
+		if strings.Contains(name, "/") {
+			panic(errorf(col, "expected attribute path before 'from', found '%s'", name))
+		}
+		sub.Select = &Path{Names: names, Cols: cols}
+		p.next()
+		_, _, name, col = p.parseTypeName()
+	}
+	sub.TypeName, sub.TypeCol = name, col
+	if p.tok == WHERE {
+		p.next()
+		sub.Where = p.parseExpr()
+	}
+	return sub
+}
+
+/*
+Parses a datatype name such as Car, vehicles/Car or shared.relish.pl2012/relish_tests/pkg/vehicles/Car.
+Also returns the individual names, for use if the name turns out to be an attribute path.
+*/
+func (p *parser) parseTypeName() (names []string, cols []int, name string, col int) {
+	col = p.col
+	for {
+		if p.tok != IDENT {
+			p.errorExpected("datatype name")
+		}
+		names = append(names, p.lit)
+		cols = append(cols, p.col)
+		name += p.lit
+		p.next()
+		if p.tok != DOT && p.tok != QUO {
+			return
+		}
+		name += p.tok.String()
+		p.next()
+	}
+}
+
+func (p *parser) parseExprList() (list []Expr) {
+	list = append(list, p.parseExpr())
+	for p.tok == COMMA {
+		p.next()
+		list = append(list, p.parseExpr())
+	}
+	return
+}
+
+func (p *parser) parseConcat() Expr {
+	x := p.parseAdditive()
+	for p.tok == CONCAT {
+		col := p.col
+		p.next()
+		x = &BinaryExpr{X: x, Op: CONCAT, OpCol: col, Y: p.parseAdditive()}
+	}
+	return x
+}
+
+func (p *parser) parseAdditive() Expr {
+	x := p.parseTerm()
+	for p.tok == ADD || p.tok == SUB {
+		op, col := p.tok, p.col
+		p.next()
+		x = &BinaryExpr{X: x, Op: op, OpCol: col, Y: p.parseTerm()}
+	}
+	return x
+}
+
+func (p *parser) parseTerm() Expr {
+	x := p.parseUnary()
+	for p.tok == MUL || p.tok == QUO || p.tok == REM {
+		op, col := p.tok, p.col
+		p.next()
+		x = &BinaryExpr{X: x, Op: op, OpCol: col, Y: p.parseUnary()}
+	}
+	return x
+}
+
+func (p *parser) parseUnary() Expr {
+	if p.tok == SUB {
+		col := p.col
+		p.next()
+		return &UnaryExpr{Op: SUB, Col: col, X: p.parseUnary()}
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() Expr {
+	col := p.col
+	switch p.tok {
+	case NUMBER, STRING, TRUE, FALSE, NULL:
+		lit := &Literal{Tok: p.tok, Value: p.lit, Col: col}
+		p.next()
+		return lit
+	case PARAM:
+		param := &Param{Index: p.numParams, Col: col}
+		p.numParams++
+		p.next()
+		return param
+	case LPAREN:
+		p.next()
+		x := p.parseExpr()
+		p.expect(RPAREN)
+		return &ParenExpr{X: x, Col: col}
+	case IDENT:
+		name := p.lit
+		p.next()
+		if p.tok == LPAREN {
+			p.next()
+			call := &Call{Fun: strings.ToLower(name), Col: col}
+			if p.tok == MUL && call.Fun == "count" {
+				call.Star = true
+				p.next()
+			} else if p.tok != RPAREN {
+				call.Args = p.parseExprList()
+			}
+			p.expect(RPAREN)
+			return call
+		}
+		return p.parsePathRest(name, col)
+	}
+	if p.tok >= keyword_beg && p.tok <= keyword_end {
+		p.errorExpected("attribute name or value ('" + p.lit + "' is a reserved word)")
+	}
+	p.errorExpected("attribute name or value")
+	return nil
+}
@@ -0,0 +1,186 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+package oql
+
+import (
+	"strings"
+	"testing"
+)
+
+var validQueries = []string{
+	"",
+	"speed > 60",
+	"speed > 60 order by speed desc",
+	"num < 5 order by num",
+	"order by name",
+	"name = 'O''Brien' AND speed >= ?",
+	"not (a = 1 or b = 2) and c != 3",
+	"owner.company.name like 'Acme%'",
+	"lower(name) = 'x' or length(name) between 2 and ?",
+	"speed not in (1, 2, 3) and colour is not null",
+	"price * 2 + 1 < 10 limit 5 offset 10",
+	"name || 'x' == 'ax'",
+	"a <> -1",
+	"owner.company.country.name = ?",
+	"exists wheels",
+	"not exists (wheels where pressure < 30 and flat)",
+	"owner in (select Person where age > 30)",
+	"owner.name not in (select name from vehicles/Person where exists cars)",
+	"cars.speed > 60 and exists (cars where owner in (select Person))",
+}
+
+func TestParseValid(t *testing.T) {
+	for _, src := range validQueries {
+		if _, err := Parse(src); err != nil {
+			t.Errorf("Parse(%q) failed: %s", src, err)
+		}
+	}
+}
+
+var invalidQueries = []struct {
+	src string
+	col int
+	msg string
+}{
+	{"speed >", 8, "expected attribute name or value"},
+	{"speed > 60 60", 12, "expected 'and', 'or'"},
+	{"name = 'abc", 8, "string literal not terminated"},
+	{"a = 1 and", 10, "expected attribute name or value"},
+	{"a not = 1", 7, "expected 'like', 'in' or 'between'"},
+	{"owner. = 1", 8, "expected attribute name after '.'"},
+	{"a = 1 order speed", 13, "expected 'by'"},
+	{"a in (1, 2", 11, "expected ')'"},
+	{"a = #", 5, "unexpected character"},
+	{"order = 1", 7, "expected 'by'"},
+	{"exists (wheels where)", 21, "expected attribute name or value"},
+	{"exists 3", 8, "expected attribute name after 'exists'"},
+	{"a in (select)", 13, "expected datatype name"},
+	{"a in (select b from vehicles/Car", 33, "expected ')'"},
+	{"a in (select a/b from Car)", 14, "expected attribute path before 'from'"},
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, test := range invalidQueries {
+		_, err := Parse(test.src)
+		if err == nil {
+			t.Errorf("Parse(%q) should have failed", test.src)
+			continue
+		}
+		e, isOqlError := err.(*Error)
+		if ! isOqlError {
+			t.Errorf("Parse(%q) returned %T, not *Error", test.src, err)
+			continue
+		}
+		if e.Col != test.col || ! strings.Contains(e.Msg, test.msg) {
+			t.Errorf("Parse(%q): got %q, want column %d: %s...", test.src, e.Error(), test.col, test.msg)
+		}
+	}
+}
+
+func TestParsePrecedence(t *testing.T) {
+	query, err := Parse("a = 1 or b = 2 and not c = 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	or, isBinary := query.Where.(*BinaryExpr)
+	if ! isBinary || or.Op != OR {
+		t.Fatalf("top-level operator should be or, got %#v", query.Where)
+	}
+	and, isBinary := or.Y.(*BinaryExpr)
+	if ! isBinary || and.Op != AND {
+		t.Fatalf("right operand of or should be an and, got %#v", or.Y)
+	}
+	if not, isUnary := and.Y.(*UnaryExpr); ! isUnary || not.Op != NOT {
+		t.Fatalf("right operand of and should be a not, got %#v", and.Y)
+	}
+}
+
+func TestParsePathsAndParams(t *testing.T) {
+	query, err := Parse("owner.company.name = ? and speed > ? order by owner.name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []*Path
+	var params []*Param
+	Walk(query.Where, func(x Expr) {
+		switch x := x.(type) {
+		case *Path:
+			paths = append(paths, x)
+		case *Param:
+			params = append(params, x)
+		}
+	})
+	if len(paths) != 2 || strings.Join(paths[0].Names, ".") != "owner.company.name" || paths[0].Cols[2] != 15 {
+		t.Errorf("unexpected paths %#v", paths)
+	}
+	if len(params) != 2 || params[0].Index != 0 || params[1].Index != 1 {
+		t.Errorf("unexpected params %#v", params)
+	}
+	if len(query.OrderBy) != 1 || query.OrderBy[0].Desc {
+		t.Errorf("unexpected order by %#v", query.OrderBy)
+	}
+}
+
+func TestParseSubquery(t *testing.T) {
+	query, err := Parse("owner in (select name from vehicles/Person where age > ?)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, isIn := query.Where.(*InExpr)
+	if ! isIn || in.Query == nil || in.List != nil {
+		t.Fatalf("expected an in subquery, got %#v", query.Where)
+	}
+	sub := in.Query
+	if sub.Select == nil || strings.Join(sub.Select.Names, ".") != "name" {
+		t.Errorf("unexpected selected path %#v", sub.Select)
+	}
+	if sub.TypeName != "vehicles/Person" || sub.TypeCol != 28 {
+		t.Errorf("unexpected type name %q at column %d", sub.TypeName, sub.TypeCol)
+	}
+	if sub.Where == nil {
+		t.Errorf("subquery should have a condition")
+	}
+
+	query, err = Parse("exists (owner.cars where speed > 60)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, isExists := query.Where.(*ExistsExpr)
+	if ! isExists || strings.Join(exists.Path.Names, ".") != "owner.cars" || exists.Cond == nil {
+		t.Fatalf("unexpected exists %#v", query.Where)
+	}
+}
+
+func TestParseAggregate(t *testing.T) {
+	query, err := ParseAggregate("category, sum(price), count(*) group by category where price > ? having count(*) > 1 order by category limit 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(query.Items) != 3 || len(query.GroupBy) != 1 || query.Where == nil || query.Having == nil {
+		t.Fatalf("unexpected aggregate query %#v", query)
+	}
+	if count, isCall := query.Items[2].(*Call); ! isCall || ! count.Star || ! count.IsAggregate() {
+		t.Errorf("expected count(*), got %#v", query.Items[2])
+	}
+	if len(query.OrderBy) != 1 || query.Limit == nil {
+		t.Errorf("unexpected order by or limit in %#v", query)
+	}
+
+	for _, test := range []struct {
+		src string
+		col int
+		msg string
+	}{
+		{"", 1, "expected attribute name or value"},
+		{"sum(price) where a = 1 where b = 2", 24, "expected ',', 'where', 'group by'"},
+		{"count(*) group category", 16, "expected 'by'"},
+		{"sum(*)", 5, "expected attribute name or value"},
+	} {
+		_, err := ParseAggregate(test.src)
+		e, isOqlError := err.(*Error)
+		if ! isOqlError || e.Col != test.col || ! strings.Contains(e.Msg, test.msg) {
+			t.Errorf("ParseAggregate(%q): got %v, want column %d: %s...", test.src, err, test.col, test.msg)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+// Package oql implements the object query language used in the selection criteria of relish
+// database queries, such as the "speed > 60 order by speed desc" of
+//
+//    cars = asList allCars "speed > 60 order by speed desc"
+//
+// Aggregate queries, such as "category, sum(price) where price > 0 group by category", select
+// values computed from the queried objects rather than the objects themselves.
+//
+// It provides a lexer, a parser which produces an abstract syntax tree, and a typechecker
+// which resolves the attribute paths in the tree against the attributes of a relish datatype
+// and its supertypes. Translation of the checked tree to SQL is done by the persistence layer.
+//
+package oql
+
+import "strings"
+
+/*
+The lexical tokens of the object query language.
+*/
+type Token int
+
+const (
+	ILLEGAL Token = iota
+	EOF
+
+	IDENT  // speed
+	NUMBER // 60  3.5
+	STRING // 'abc'
+	PARAM  // ?
+
+	LPAREN // (
+	RPAREN // )
+	COMMA  // ,
+	DOT    // .
+
+	EQL    // = or ==
+	NEQ    // != or <>
+	LSS    // <
+	LEQ    // <=
+	GTR    // >
+	GEQ    // >=
+	ADD    // +
+	SUB    // -
+	MUL    // *
+	QUO    // /
+	REM    // %
+	CONCAT // ||
+
+	keyword_beg
+	AND
+	OR
+	NOT
+	IN
+	IS
+	NULL
+	LIKE
+	BETWEEN
+	TRUE
+	FALSE
+	ORDER
+	BY
+	ASC
+	DESC
+	LIMIT
+	OFFSET
+	EXISTS
+	SELECT
+	FROM
+	WHERE
+	GROUP
+	HAVING
+	keyword_end
+)
+
+var tokens = [...]string{
+	ILLEGAL: "ILLEGAL",
+	EOF:     "end of query",
+
+	IDENT:  "identifier",
+	NUMBER: "number",
+	STRING: "string",
+	PARAM:  "?",
+
+	LPAREN: "(",
+	RPAREN: ")",
+	COMMA:  ",",
+	DOT:    ".",
+
+	EQL:    "=",
+	NEQ:    "!=",
+	LSS:    "<",
+	LEQ:    "<=",
+	GTR:    ">",
+	GEQ:    ">=",
+	ADD:    "+",
+	SUB:    "-",
+	MUL:    "*",
+	QUO:    "/",
+	REM:    "%",
+	CONCAT: "||",
+
+	AND:     "and",
+	OR:      "or",
+	NOT:     "not",
+	IN:      "in",
+	IS:      "is",
+	NULL:    "null",
+	LIKE:    "like",
+	BETWEEN: "between",
+	TRUE:    "true",
+	FALSE:   "false",
+	ORDER:   "order",
+	BY:      "by",
+	ASC:     "asc",
+	DESC:    "desc",
+	LIMIT:   "limit",
+	OFFSET:  "offset",
+	EXISTS:  "exists",
+	SELECT:  "select",
+	FROM:    "from",
+	WHERE:   "where",
+	GROUP:   "group",
+	HAVING:  "having",
+}
+
+func (tok Token) String() string {
+	if 0 <= tok && tok < Token(len(tokens)) && tokens[tok] != "" {
+		return tokens[tok]
+	}
+	return "token"
+}
+
+var keywords map[string]Token
+
+func init() {
+	keywords = make(map[string]Token)
+	for i := keyword_beg + 1; i < keyword_end; i++ {
+		keywords[tokens[i]] = i
+	}
+}
+
+/*
+Returns the keyword token for the word, or IDENT if the word is not a keyword.
+Keywords are not case sensitive.
+*/
+func Lookup(word string) Token {
+	if tok, isKeyword := keywords[strings.ToLower(word)]; isKeyword {
+		return tok
+	}
+	return IDENT
+}
+
+/*
+Returns true if the token is a comparison operator.
+*/
+func (tok Token) IsComparison() bool {
+	return EQL <= tok && tok <= GEQ
+}
@@ -24,19 +24,25 @@ package persist
 */
 
 import (
-	sqlite "code.google.com/p/go-sqlite/go1/sqlite3"
+	"errors"
 	"fmt"
 	. "relish/dbg"
 	. "relish/runtime/data"
 	"relish/params"
   "os"
+	"sync"
+	"time"
 )
 
 
 
 func (db *SqliteDB) NewDBThread(th InterpreterThread) DBT {
    dbti := &SqliteDBThread{db:db}
-   dbt := &DBThread{db: db, dbti: dbti, th: th}
+   conn := &dbConnection{}
+   if db.attachedTo != nil {
+      conn = db.attachedTo.threadConnection(th)
+   }
+   dbt := &DBThread{db: db, dbti: dbti, dbConnection: conn, th: th}
    dbti.dbt = dbt
    return dbt
 }
@@ -58,55 +64,104 @@ type DBThread struct {
 
 	dbti DBT  // the database-type specific implementation of a db connection thread
 
-	acquiringDbLock bool  // This thread is in the process of acquiring and locking the dbMutex 
-	                      // (but may still be blocked waiting for the mutex to be unlocked by another thread)
+	*dbConnection  // The thread's hold on a db connection. Shared with the DBThreads, of the same interpreter thread,
+	               // of the databases attached to this one, so that one transaction spans all of them.
+
+  th InterpreterThread
+}
+
+/*
+An interpreter thread's hold on a connection from a database's connection pool.
+*/
+type dbConnection struct {
+	acquiringDbLock bool  // This thread is in the process of acquiring a connection from the connection pool 
+	                      // (but may still be blocked waiting for a connection to be released by another thread)
 	
-	dbLockOwnershipDepth int  // How many nested claims has this thread currently made for ownership of the dbMutex
-                              // If > 0, this thread owns and has locked the dbMutex.
-                              // Note: thread "ownership" of dbMutex is an abstract concept imposed by this DBThread s/w,
-                              // because Go Mutexes are not inherently owned by any particular goroutine.	
+	dbLockOwnershipDepth int  // How many nested claims has this thread currently made for use of its db connection.
+                              // If > 0, this thread holds a connection grabbed from the connection pool.
 
   conn Connection // SQL db connection
 
-  isReadOnlyTransaction bool  // Experiment
+  isReadOnlyTransaction bool  // This thread is in a DEFERRED (READ) transaction, so it holds a connection from the
+                              // read pool, and sees the WAL snapshot that was taken when the transaction began.
 
-  th InterpreterThread
+  txDepth int  // The dbLockOwnershipDepth of the hold that the thread's database transaction has on the connection,
+               // or 0 if the thread is not in a database transaction.
+
+  opMutex sync.Mutex  // Held while the thread runs a db operation in its transaction, and while the transaction
+                      // watchdog rolls back the transaction, so that the two do not use the connection at once.
+
+  txMutex sync.Mutex  // Guards tx and txConn, which the watchdog reads while the thread may be running a db operation
+  tx *RTransaction    // The in-memory transaction which complements the thread's database transaction
+  txConn Connection   // The connection of the thread's database transaction
+
+  isInterrupted bool  // The watchdog has rolled back the thread's database transaction. Guarded by opMutex.
+}
+
+/*
+The error of a db operation in a database transaction which the watchdog has rolled back.
+*/
+var errTransactionInterrupted = &TransactionError{Kind: TX_TIMED_OUT, 
+                                                  Op: "TRANSACTION", 
+                                                  Tries: 1, 
+                                                  Err: errors.New("The transaction passed its deadline and was rolled back by the transaction watchdog.")}
+
+/*
+Implemented by the database-type specific db connection threads.
+*/
+type transactionInterrupter interface {
+   /*
+   Rolls back the database transaction of the thread's connection. Called by the transaction watchdog,
+   not by the thread, so must not touch the interpreter thread.
+   */
+   interruptTransaction() error
 }
 
 /*
-Grabs the dbMutex when it can (blocking until then) then executes a BEGIN IMMEDIATE TRANSACTION sql statement.
-Does not unlock the dbMutex or release this thread's ownership of the mutex. 
+Grabs a db connection when it can (blocking until then) then executes a BEGIN transactionType TRANSACTION sql statement.
+A "DEFERRED" transaction is a read transaction. It uses a connection from the read pool, and does not 
+wait for writers; it sees a consistent snapshot of the database as of the moment the transaction began.
+Any other transaction type uses a connection from the write pool, so writers are serialized there.
+Does not release this thread's connection. 
 Use CommitTransaction or RollbackTransaction to do that.
 */
 func (dbt * DBThread) BeginTransaction(transactionType string) (err error) {
    Logln(PERSIST2_,"DBThread.BeginTransaction") 	
 
-   if transactionType == "DEFERRED" {
-       dbt.isReadOnlyTransaction = true
+   if dbt.dbLockOwnershipDepth == 0 {
+      dbt.isReadOnlyTransaction = (transactionType == "DEFERRED")
    }
    
-   dbt.UseDB()	
-
-   dbt.isReadOnlyTransaction = false  // was only needed to influence UseDB()
+   dbt.useDB(! dbt.isReadOnlyTransaction)	
 
    err = dbt.dbti.BeginTransaction(transactionType) 
    if err != nil {
    	   dbt.ReleaseDB()
+   	   return
    }
+   dbt.txDepth = dbt.dbLockOwnershipDepth
    return
 }
 
 /*
-Executes a COMMIT TRANSACTION sql statement. If it succeeds, unlocks the dbMutex and releases this thread's ownership
-of the mutex.
-If it fails (returns a non-nil error), does not unlock the dbMutex or release this thread's ownership of the mutex.
+Executes a COMMIT TRANSACTION sql statement. If it succeeds, releases this thread's db connection back to the pool.
+If it fails (returns a non-nil error), does not release this thread's db connection.
 
 In the error case, the correct behaviour is to either retry the commit, do a rollback, or just call ReleaseDB to
-unlock the dbMutex and release this thread's ownership of the mutex.
+release this thread's db connection.
 */
 func (dbt * DBThread) CommitTransaction() (err error) {
     Logln(PERSIST2_,"DBThread.CommitTransaction") 		
-	err = dbt.dbti.CommitTransaction()
+    dbt.opMutex.Lock()
+    if dbt.isInterrupted {
+       err = errTransactionInterrupted
+    } else {
+	   err = dbt.dbti.CommitTransaction()
+	}
+	if err == nil {
+	   dbt.endTransaction()
+	}
+    dbt.opMutex.Unlock()
 	if err == nil {
 	   dbt.ReleaseDB()
     }
@@ -114,16 +169,28 @@ func (dbt * DBThread) CommitTransaction() (err error) {
 }
 
 /*
-Executes a ROLLBACK TRANSACTION sql statement. If it succeeds, unlocks the dbMutex and releases this thread's ownership
-of the mutex.
-If it fails (returns a non-nil error), does not unlock the dbMutex or release this thread's ownership of the mutex.
+Executes a ROLLBACK TRANSACTION sql statement. If it succeeds, releases this thread's db connection back to the pool.
+If it fails (returns a non-nil error), does not release this thread's db connection.
 
 In the error case, the correct behaviour is to either retry the rollback, or just call ReleaseDB to
-unlock the dbMutex and release this thread's ownership of the mutex.
+release this thread's db connection.
+If the transaction watchdog has already rolled back the transaction, just releases the connection.
+If a panic left a db operation in the transaction unfinished, the operation's hold on the connection is
+released first.
 */
 func (dbt * DBThread) RollbackTransaction() (err error) {
     Logln(PERSIST2_,"DBThread.RollbackTransaction") 	
-	err = dbt.dbti.RollbackTransaction()
+    for dbt.txDepth > 0 && dbt.dbLockOwnershipDepth > dbt.txDepth {
+       dbt.ReleaseDB()
+    }
+    dbt.opMutex.Lock()
+    if ! dbt.isInterrupted {
+	   err = dbt.dbti.RollbackTransaction()
+	}
+	if err == nil {
+	   dbt.endTransaction()
+	}
+    dbt.opMutex.Unlock()
 	if err == nil {
 		dbt.ReleaseDB()
 	}
@@ -131,14 +198,122 @@ func (dbt * DBThread) RollbackTransaction() (err error) {
 }
 
 /*
-If the thread does not already own the dbMutex, lock the mutex and
-flag that this thread owns it.
-Used to ensure exlusive access to db for single db reads / writes 
+Records that the thread is no longer in a database transaction.
+Must be called with the opMutex locked.
+*/
+func (dbt * DBThread) endTransaction() {
+   dbt.txMutex.Lock()
+   dbt.tx = nil
+   dbt.txConn = nil
+   dbt.txMutex.Unlock()
+   dbt.txDepth = 0
+   dbt.isInterrupted = false
+}
+
+/*
+Associates the thread's in-progress database transaction with tx, the in-memory transaction which complements it,
+so that if tx times out, the transaction watchdog interrupts and rolls back the database transaction.
+*/
+func (dbt * DBThread) BindTransaction(tx *RTransaction) {
+   if tx == nil || dbt.txDepth == 0 {
+      return
+   }
+   dbt.txMutex.Lock()
+   dbt.tx = tx
+   dbt.txConn = dbt.conn
+   dbt.txMutex.Unlock()
+   tx.SetDbInterrupt(func() { dbt.interruptTransaction(tx) })
+}
+
+/*
+Called by the transaction watchdog, when tx times out, to interrupt the statement, if any, that the thread
+is running in the database transaction which tx complements, then roll back the database transaction, 
+so that it does not keep holding db locks. Does nothing if the thread has ended the transaction.
+The thread's later db operations in the transaction fail, until it rolls back the transaction.
+*/
+func (dbt * DBThread) interruptTransaction(tx *RTransaction) {
+   dbt.txMutex.Lock()
+   conn := dbt.txConn
+   isBound := dbt.tx == tx
+   dbt.txMutex.Unlock()
+   if ! isBound {
+      return
+   }
+   conn.Interrupt()
+
+   dbt.opMutex.Lock()  // Waits for the interrupted db operation to return
+   defer dbt.opMutex.Unlock()
+   if dbt.tx != tx || dbt.isInterrupted {  // The thread ended the transaction meanwhile
+      return
+   }
+   err := dbt.dbti.(transactionInterrupter).interruptTransaction()
+   if err != nil {
+      Logln(ALWAYS_, "Unable to roll back", tx, "in the database:", err)
+   }
+   dbt.isInterrupted = true
+}
+
+/*
+Executes a SAVEPOINT sql statement on this thread's connection, which must be in a transaction.
+*/
+func (dbt * DBThread) BeginSavepoint(name string) (err error) {
+    Logln(PERSIST2_,"DBThread.BeginSavepoint",name) 	
+    dbt.UseDB()
+	err = dbt.dbti.BeginSavepoint(name)
+	dbt.ReleaseDB()
+	return
+}
+
+/*
+Executes a RELEASE SAVEPOINT sql statement on this thread's connection.
+*/
+func (dbt * DBThread) ReleaseSavepoint(name string) (err error) {
+    Logln(PERSIST2_,"DBThread.ReleaseSavepoint",name) 	
+    dbt.UseDB()
+	err = dbt.dbti.ReleaseSavepoint(name)
+	dbt.ReleaseDB()
+	return
+}
+
+/*
+Executes a ROLLBACK TO SAVEPOINT sql statement, then releases the savepoint, on this thread's connection.
+*/
+func (dbt * DBThread) RollbackToSavepoint(name string) (err error) {
+    Logln(PERSIST2_,"DBThread.RollbackToSavepoint",name) 	
+    dbt.UseDB()
+	err = dbt.dbti.RollbackToSavepoint(name)
+	dbt.ReleaseDB()
+	return
+}
+
+/*
+If the thread does not already hold a db connection, grab a write connection from the pool 
+and flag that this thread holds it.
+Used to ensure exclusive use of a connection for single db writes 
 for which we don't want to manually start a long-running transaction.
 
-This method will block until no other DBThread is using the database.
+This method will block until a write connection is available.
 */
 func (dbt * DBThread) UseDB() {
+   dbt.useDB(true)
+}
+
+/*
+If the thread does not already hold a db connection, grab a connection from the read pool
+and flag that this thread holds it. Used for single db reads which are not in a transaction.
+A read connection does not wait for writers to finish.
+
+If this thread already holds a connection (e.g. it is in a transaction), that connection is used.
+*/
+func (dbt * DBThread) useDBForRead() {
+   dbt.useDB(false)
+}
+
+/*
+Implements UseDB and useDBForRead. The doingWrite argument only matters if the thread
+does not already hold a db connection.
+*/
+func (dbt * DBThread) useDB(doingWrite bool) {
    Logln(PERSIST2_,"DBThread.UseDB when ownership level is",dbt.dbLockOwnershipDepth) 		
    if dbt.acquiringDbLock {  // Umm, shouldn't this be impossible? The same thread is blocked further inside this method.
       return	
@@ -149,39 +324,55 @@ func (dbt * DBThread) UseDB() {
        if dbt.th != nil {
           dbt.th.AllowGC()          
        }
-       dbt.conn = dbt.db.GrabConnection(! dbt.isReadOnlyTransaction)
+       dbt.conn = dbt.db.GrabConnection(doingWrite)
        if dbt.th != nil {
           dbt.th.DisallowGC()
        }
-      
-
-   	   // dbt.db.UseDB()
        
        dbt.acquiringDbLock = false      	
    }
    dbt.dbLockOwnershipDepth++
    Logln(PERSIST2_,"DBThread.UseDB: Set ownership level to",dbt.dbLockOwnershipDepth)    
+
+   if dbt.txDepth > 0 && dbt.dbLockOwnershipDepth == dbt.txDepth + 1 {  // Beginning a db operation in the transaction
+      if dbt.th != nil {
+         dbt.th.AllowGC()          
+      }
+      dbt.opMutex.Lock()
+      if dbt.th != nil {
+         dbt.th.DisallowGC()
+      }
+      if dbt.isInterrupted {  // Otherwise the operation would run outside of any transaction.
+         dbt.opMutex.Unlock()
+         dbt.dbLockOwnershipDepth--
+         panic(errTransactionInterrupted)
+      }
+   }
 }
 
 /*
-
-Remove one level of interest of this thread in the dbMutex.
-If we have lost all interest in it, and
-if the thread owns the dbMutex, unlock the mutex and
-flag that this thread no longer owns it.
-Returns false if this thread still has an interest in and lock on the dbMutex.
+Remove one level of interest of this thread in its db connection.
+If we have lost all interest in it, release the connection back to the pool.
+Returns false if this thread still has an interest in its db connection.
 */	
 func (dbt * DBThread) ReleaseDB() bool {
     Logln(PERSIST2_,"DBThread.ReleaseDB when ownership level is",dbt.dbLockOwnershipDepth) 		
     if dbt.dbLockOwnershipDepth > 0 {
+       if dbt.txDepth > 0 && dbt.dbLockOwnershipDepth == dbt.txDepth + 1 {  // Ending a db operation in the transaction
+          dbt.opMutex.Unlock()
+       }
 	   dbt.dbLockOwnershipDepth--
        Logln(PERSIST2_,"DBThread.ReleaseDB: Set ownership level to",dbt.dbLockOwnershipDepth)  	
 	   if dbt.dbLockOwnershipDepth == 0 {
+        if dbt.txDepth > 0 {  // Released without committing or rolling back, e.g. after a failed rollback
+           dbt.opMutex.Lock()
+           dbt.endTransaction()
+           dbt.opMutex.Unlock()
+        }
         dbt.db.ReleaseConnection(dbt.conn)
          
         dbt.conn = nil
-
-		  // dbt.db.ReleaseDB()	
+        dbt.isReadOnlyTransaction = false
 	   } else {
 	      return false	
 	   }
@@ -208,6 +399,12 @@ func (dbt * DBThread) EnsurePackageTable() {
    dbt.ReleaseDB()  
 }
 
+func (dbt * DBThread) EnsureChangeLogTable() {
+   dbt.UseDB()	
+   dbt.dbti.EnsureChangeLogTable()
+   dbt.ReleaseDB()  
+}
+
 func (dbt * DBThread) EnsureTypeTable(typ *RType) (err error) {
    dbt.UseDB()	
    err = dbt.dbti.EnsureTypeTable(typ)
@@ -215,6 +412,19 @@ func (dbt * DBThread) EnsureTypeTable(typ *RType) (err error) {
    return 
 }
 
+func (dbt * DBThread) EnsureTypeSchemaTable() {
+   dbt.UseDB()	
+   dbt.dbti.EnsureTypeSchemaTable()
+   dbt.ReleaseDB()  
+}
+
+func (dbt * DBThread) MigrateTypeTable(th InterpreterThread, typ *RType, dryRun bool) (migration *SchemaMigration, err error) {
+   dbt.UseDB()	
+   migration, err = dbt.dbti.MigrateTypeTable(th, typ, dryRun)
+   dbt.ReleaseDB()  
+   return 
+}
+
 func (dbt * DBThread) ExecStatements(statementGroup *StatementGroup) (err error) {
    dbt.UseDB()
    err = dbt.dbti.ExecStatements(statementGroup)
@@ -229,7 +439,52 @@ func (dbt * DBThread) ExecStatement(statement string, args ...interface{}) (err
    return
 }
 
+/*
+Returns an error if any of the objects is stored in another of the program's databases than this one.
+An object's changes are persisted in the database which the thread is using, so must be made while the thread
+uses the database the object was fetched from or stored in, and an object cannot refer to one in another database.
+*/
+func (dbt * DBThread) checkStoredDB(objs ...RObject) (err error) {
+   dbIndex := -2
+   for _, obj := range objs {
+      pers, isPersistable := obj.(Persistable)
+      if ! isPersistable || ! (obj.IsStoredLocally() || obj.IsBeingStored()) {
+         continue
+      }
+      if dbIndex == -2 {
+         dbIndex = RT.DBIndex(dbt.db)
+      }
+      if dbIndex >= 0 && pers.StoredDB() != dbIndex {
+         err = fmt.Errorf("%v is stored in %s, but the thread is using %s. Use the object's database to change it.",
+                          obj, dbDescription(pers.StoredDB()), dbDescription(dbIndex))
+         return
+      }
+   }
+   return
+}
+
+/*
+Records that the object was fetched from or stored in this database.
+*/
+func (dbt * DBThread) recordStoredDB(obj RObject) {
+   if pers, isPersistable := obj.(Persistable); isPersistable {
+      if dbIndex := RT.DBIndex(dbt.db); dbIndex >= 0 {
+         pers.SetStoredDB(dbIndex)
+      }
+   }
+}
+
+func dbDescription(dbIndex int) string {
+   if dbIndex == 0 {
+      return "the main database"
+   }
+   return fmt.Sprintf("database '%s'", RT.DBName(dbIndex))
+}
+
 func (dbt * DBThread) PersistSetAttr(th InterpreterThread, obj RObject, attr *AttributeSpec, val RObject, attrHadValue bool) (err error) {
+   if err = dbt.checkStoredDB(obj, val); err != nil {
+      return
+   }
    dbt.UseDB()	
    err = dbt.dbti.PersistSetAttr(th, obj, attr, val, attrHadValue)
    dbt.ReleaseDB()
@@ -237,6 +492,9 @@ func (dbt * DBThread) PersistSetAttr(th InterpreterThread, obj RObject, attr *At
 }
 
 func (dbt * DBThread) PersistAddToAttr(th InterpreterThread, obj RObject, attr *AttributeSpec, val RObject, insertedIndex int) (err error) {
+   if err = dbt.checkStoredDB(obj, val); err != nil {
+      return
+   }
    dbt.UseDB()	
    err = dbt.dbti.PersistAddToAttr(th, obj, attr, val, insertedIndex)
    dbt.ReleaseDB()
@@ -244,6 +502,9 @@ func (dbt * DBThread) PersistAddToAttr(th InterpreterThread, obj RObject, attr *
 }
 
 func (dbt * DBThread) PersistRemoveFromAttr(obj RObject, attr *AttributeSpec, val RObject, removedIndex int) (err error) {
+   if err = dbt.checkStoredDB(obj); err != nil {
+      return
+   }
    dbt.UseDB()	
    err = dbt.dbti.PersistRemoveFromAttr(obj, attr, val, removedIndex)
    dbt.ReleaseDB()
@@ -251,6 +512,9 @@ func (dbt * DBThread) PersistRemoveFromAttr(obj RObject, attr *AttributeSpec, va
 }
 
 func (dbt * DBThread) PersistRemoveAttr(obj RObject, attr *AttributeSpec) (err error) {
+   if err = dbt.checkStoredDB(obj); err != nil {
+      return
+   }
    dbt.UseDB()	
    err = dbt.dbti.PersistRemoveAttr(obj, attr)
    dbt.ReleaseDB() 
@@ -258,6 +522,9 @@ func (dbt * DBThread) PersistRemoveAttr(obj RObject, attr *AttributeSpec) (err e
 }
 
 func (dbt * DBThread) PersistClearAttr(obj RObject, attr *AttributeSpec) (err error) {
+   if err = dbt.checkStoredDB(obj); err != nil {
+      return
+   }
    dbt.UseDB()	
    err = dbt.dbti.PersistClearAttr(obj, attr)
    dbt.ReleaseDB()
@@ -266,6 +533,9 @@ func (dbt * DBThread) PersistClearAttr(obj RObject, attr *AttributeSpec) (err er
 
 
 func (dbt * DBThread) PersistSetAttrElement(th InterpreterThread, obj RObject, attr *AttributeSpec, val RObject, index int) (err error) {
+   if err = dbt.checkStoredDB(obj, val); err != nil {
+      return
+   }
    dbt.UseDB()	
    err = dbt.dbti.PersistSetAttrElement(th, obj, attr, val, index)
    dbt.ReleaseDB()
@@ -276,6 +546,9 @@ func (dbt * DBThread) PersistSetAttrElement(th InterpreterThread, obj RObject, a
 
       
 func (dbt * DBThread) PersistMapPut(th InterpreterThread, theMap Map, key RObject,val RObject, isNewKey bool) (err error) {
+   if err = dbt.checkStoredDB(theMap, key, val); err != nil {
+      return
+   }
    dbt.UseDB()	
    err = dbt.dbti.PersistMapPut(th, theMap, key, val, isNewKey)
    dbt.ReleaseDB()
@@ -284,6 +557,9 @@ func (dbt * DBThread) PersistMapPut(th InterpreterThread, theMap Map, key RObjec
       
       
 func (dbt * DBThread) PersistSetCollectionElement(th InterpreterThread, coll IndexSettable, val RObject, index int) (err error) {
+   if err = dbt.checkStoredDB(coll, val); err != nil {
+      return
+   }
    dbt.UseDB()	
    err = dbt.dbti.PersistSetCollectionElement(th, coll, val, index)
    dbt.ReleaseDB()
@@ -291,6 +567,9 @@ func (dbt * DBThread) PersistSetCollectionElement(th InterpreterThread, coll Ind
 }
   
 func (dbt * DBThread) PersistAddToCollection(th InterpreterThread, coll AddableCollection, val RObject, insertedIndex int) (err error) {
+   if err = dbt.checkStoredDB(coll, val); err != nil {
+      return
+   }
    dbt.UseDB()	
    err = dbt.dbti.PersistAddToCollection(th, coll, val, insertedIndex)
    dbt.ReleaseDB()
@@ -298,6 +577,9 @@ func (dbt * DBThread) PersistAddToCollection(th InterpreterThread, coll AddableC
 }
 
 func (dbt * DBThread) PersistRemoveFromCollection(coll RemovableCollection, val RObject, removedIndex int) (err error) {
+   if err = dbt.checkStoredDB(coll); err != nil {
+      return
+   }
    dbt.UseDB()	
    err = dbt.dbti.PersistRemoveFromCollection(coll, val, removedIndex)
    dbt.ReleaseDB()
@@ -305,6 +587,9 @@ func (dbt * DBThread) PersistRemoveFromCollection(coll RemovableCollection, val
 }
 
 func (dbt * DBThread) PersistClearCollection(coll RemovableCollection) (err error) {
+   if err = dbt.checkStoredDB(coll); err != nil {
+      return
+   }
    dbt.UseDB()	
    err = dbt.dbti.PersistClearCollection(coll)
    dbt.ReleaseDB()
@@ -319,6 +604,9 @@ func (dbt * DBThread) PersistClearCollection(coll RemovableCollection) (err erro
 
 
 func (dbt * DBThread) EnsurePersisted(th InterpreterThread, obj RObject) (err error) {
+   if err = dbt.checkStoredDB(obj); err != nil {
+      return
+   }
    dbt.UseDB()	
    err = dbt.dbti.EnsurePersisted(th, obj)
    dbt.ReleaseDB() 
@@ -333,21 +621,52 @@ func (dbt * DBThread) EnsureAttributeAndRelationTables(t *RType) (err error) {
 }
 
 func (dbt * DBThread) ObjectNameExists(name string) (found bool, err error) {
-   dbt.UseDB()
+   dbt.useDBForRead()
    found,err = dbt.dbti.ObjectNameExists(name)
    dbt.ReleaseDB()
    return
 }
 
 func (dbt * DBThread) ObjectNames(prefix string) (names []string, err error) {
-   dbt.UseDB()
+   dbt.useDBForRead()
    names,err = dbt.dbti.ObjectNames(prefix)
    dbt.ReleaseDB()
    return  
 }
 
+func (dbt * DBThread) ChangeHistory(obj RObject) (changes []*ChangeLogEntry, err error) {
+   dbt.useDBForRead()
+   changes,err = dbt.dbti.ChangeHistory(obj)
+   dbt.ReleaseDB()
+   return  
+}
+
+func (dbt * DBThread) FetchAsOf(id int64, radius int, asOf time.Time) (obj RObject, err error) {
+   dbt.useDBForRead()
+   obj, err = dbt.dbti.FetchAsOf(id, radius, asOf)
+   dbt.ReleaseDB()  
+   return 
+}
+
+func (dbt * DBThread) FetchByNameAsOf(name string, radius int, asOf time.Time) (obj RObject, err error) {
+   dbt.useDBForRead()
+   obj, err = dbt.dbti.FetchByNameAsOf(name, radius, asOf)
+   dbt.ReleaseDB()  
+   return 
+}
+
+func (dbt * DBThread) FetchNAsOf(typ *RType, oqlSelectionCriteria string, queryArgs []RObject, coll RCollection, radius int, asOf time.Time, objs *[]RObject) (err error) {
+   dbt.useDBForRead()
+   err = dbt.dbti.FetchNAsOf(typ, oqlSelectionCriteria, queryArgs, coll, radius, asOf, objs)
+   dbt.ReleaseDB()	
+   return
+}
+
 
 func (dbt * DBThread) NameObject(obj RObject, name string) (err error) {
+   if err = dbt.checkStoredDB(obj); err != nil {
+      return
+   }
    dbt.UseDB()
    err = dbt.dbti.NameObject(obj, name)
    dbt.ReleaseDB() 
@@ -363,6 +682,9 @@ func (dbt * DBThread) RenameObject(oldName string, newName string) (err error) {
 
 
 func (dbt * DBThread)  Delete(obj RObject) (err error) {
+   if err = dbt.checkStoredDB(obj); err != nil {
+      return
+   }
    dbt.UseDB()
    err = dbt.dbti.Delete(obj)
    dbt.ReleaseDB() 
@@ -378,21 +700,21 @@ func (dbt * DBThread) RecordPackageName(name string, shortName string) {
 }
 
 func (dbt * DBThread) FetchByName(name string, radius int) (obj RObject, err error) {
-   dbt.UseDB()
+   dbt.useDBForRead()
    obj, err = dbt.dbti.FetchByName(name, radius)   
    dbt.ReleaseDB() 
    return  
 }
 
 func (dbt * DBThread) Fetch(id int64, radius int) (obj RObject, err error) {
-   dbt.UseDB()
+   dbt.useDBForRead()
    obj, err = dbt.dbti.Fetch(id, radius)
    dbt.ReleaseDB()  
    return 
 }
 
 func (dbt * DBThread) Refresh(obj RObject, radius int) (err error) {
-   dbt.UseDB()
+   dbt.useDBForRead()
    err = dbt.dbti.Refresh(obj, radius)
    dbt.ReleaseDB()  
    return 
@@ -400,7 +722,7 @@ func (dbt * DBThread) Refresh(obj RObject, radius int) (err error) {
 
 
 func (dbt * DBThread) FetchAttribute(th InterpreterThread, objId int64, obj RObject, attr *AttributeSpec, radius int) (val RObject, err error) {
-   dbt.UseDB()
+   dbt.useDBForRead()
    val, err = dbt.dbti.FetchAttribute(th, objId, obj, attr, radius)
    dbt.ReleaseDB()  
    return 
@@ -414,12 +736,94 @@ e.g. of first two arguments: vehicles/Car, "speed > 60 order by speed desc"
 */
 	
 func (dbt * DBThread) FetchN(typ *RType, oqlSelectionCriteria string, queryArgs []RObject, coll RCollection, radius int, objs *[]RObject) (mayContainProxies bool, err error) {
-   dbt.UseDB()
+   dbt.useDBForRead()
    mayContainProxies, err = dbt.dbti.FetchN(typ, oqlSelectionCriteria, queryArgs, coll, radius, objs)
    dbt.ReleaseDB()	
    return
 }
 
+/*
+Runs the aggregate query against the objects of the type in the database, and returns the rows of selected values.
+
+e.g. of first two arguments: vehicles/Car, "make, count(*), avg(speed) group by make"
+*/
+func (dbt * DBThread) FetchAggregate(typ *RType, oqlAggregateQuery string, queryArgs []RObject, coll RCollection) (rows [][]RObject, err error) {
+   dbt.useDBForRead()
+   rows, err = dbt.dbti.FetchAggregate(typ, oqlAggregateQuery, queryArgs, coll)
+   dbt.ReleaseDB()	
+   return
+}
+
+/*
+Returns a cursor which reads the objects selected by the query batchSize at a time. 
+See the FetchN method for the meaning of the other arguments.
+*/
+func (dbt * DBThread) OpenCursor(typ *RType, oqlSelectionCriteria string, queryArgs []RObject, coll RCollection, radius int, batchSize int, after RObject) (cursor Cursor, err error) {
+   dbt.useDBForRead()
+   c, err := dbt.dbti.OpenCursor(typ, oqlSelectionCriteria, queryArgs, coll, radius, batchSize, after)
+   dbt.ReleaseDB()
+   if err == nil {
+      cursor = &dbtCursor{dbt, c}
+   }	
+   return
+}
+
+/*
+A cursor which reads each batch in a read transaction, so that the objects of the batch are fetched from
+a consistent snapshot of the database, or in the thread's current transaction if it is in one.
+The connection is released between batches, so the thread may write to the database while it reads a cursor.
+So each batch may see a different snapshot. See query_cursor.go.
+*/
+type dbtCursor struct {
+   dbt *DBThread
+   cursor Cursor
+}
+
+func (c *dbtCursor) NextBatch() (objs []RObject, err error) {
+   if c.dbt.dbLockOwnershipDepth > 0 {
+      c.dbt.useDBForRead()
+      objs, err = c.cursor.NextBatch()
+      c.dbt.ReleaseDB()
+      return
+   }
+   err = c.dbt.BeginTransaction("DEFERRED")
+   if err != nil {
+      return
+   }
+   objs, err = c.cursor.NextBatch()
+   if err != nil {
+      if c.dbt.RollbackTransaction() != nil {
+         c.dbt.ReleaseDB()
+      }
+      return
+   }
+   err = c.dbt.CommitTransaction()
+   if err != nil {
+      c.dbt.ReleaseDB()
+   }
+   return
+}
+
+/*
+Reads a page of the elements of a persistent big list.
+*/
+func (dbt * DBThread) FetchBigListElements(list BigList, start int64, n int) (elements []RObject, err error) {
+   dbt.useDBForRead()
+   elements, err = dbt.dbti.FetchBigListElements(list, start, n)
+   dbt.ReleaseDB()
+   return
+}
+
+/*
+Searches a persistent big list for a value.
+*/
+func (dbt * DBThread) BigListIndex(list BigList, val RObject, start int64) (index int64, err error) {
+   dbt.useDBForRead()
+   index, err = dbt.dbti.BigListIndex(list, val, start)
+   dbt.ReleaseDB()
+   return
+}
+
 /*
 Close the connection to the database.
 */
@@ -443,61 +847,112 @@ func (dbt * DBThread) Close() {
    A handle to the sqlite database that holds the open connection	   
    and has lots of specific methods for creating and working with relish
    data and metadata in the database.
+   The database may instead be another kind of SQL database, whose Dialect translates
+   the sqlite SQL that these methods generate.
 */
 type SqliteDB struct {
 	dbName         string
 	// conn           *sqlite.Conn
 	pool           *ConnectionPool
+	dialect        Dialect
 	
 	statementQueue chan string
 	// preparedStatements map[string]*sqlite.Stmt
 
 	defaultDBThread DBT
+
+	named bool  // Attached to the running program by name, in addition to the main database.
+
+	schema string          // If attached to another sqlite database, the schema name it is attached as. Else "".
+	attachedTo *SqliteDB   // The database whose connections it shares, if attached to another sqlite database.
+
+	attachments []sqliteAttachment    // The databases attached to this one
+	attachedCounts map[Connection]int // How many of the attachments each connection has attached
+	attachMutex sync.Mutex
 }
 
 /*
    Opens a connection to a sqlite database of the specified name.
    Creates the database file if does not already exist.
+   If the name is a postgres://... or postgresql://... URL, opens a connection to that 
+   PostgreSQL database instead.
    Returns a handle to the database that holds the open connection
    and has lots of specific methods for creating and working with relish
    data and metadata in the database.
 */
 func NewDB(dbName string) *SqliteDB {
-	db := &SqliteDB{dbName: dbName, statementQueue: make(chan string, 1000)}
+	return newDB(dbName, false)
+}
+
+func newDB(dbName string, named bool) *SqliteDB {
+	db := &SqliteDB{dbName: dbName, named: named, statementQueue: make(chan string, 1000)}
+	newConn := NewSqliteConn
+	db.dialect = SqliteDialect
+	if IsPostgresURI(dbName) {
+		newConn = NewPostgresConn
+		db.dialect = PostgresDialect
+	}
 	// conn, err := sqlite.Open(dbName)
 	// if err != nil {
 	//	panic(fmt.Sprintf("Unable to open the database '%s': %s", dbName, err))
 	// }
 	// db.conn = conn
 
-  maxConnections := params.DbMaxConnections
-  if params.DbMaxWriteConnections != -1 {
-     if params.DbMaxConnections > 1 {
-          Logln(ALWAYS_,"Error. Specify either -pool or both -rpool and -wpool")
-          os.Exit(1)     
-     } 
-     if params.DbMaxReadConnections != -1 {
-         maxConnections = params.DbMaxReadConnections
-     } else {
-         Logln(ALWAYS_,"Error. Specify either -pool or both -rpool and -wpool")
-         os.Exit(1)
-     }
-  }
-	db.pool = NewConnectionPool(dbName, maxConnections, params.DbMaxWriteConnections, NewSqliteConn)
+	db.pool = NewConnectionPool(dbName, poolSize(), params.DbMaxWriteConnections, newConn)
+
+  db.setUp()
 
+	return db
+}
+
+/*
+Creates the default db thread of the database, and the tables every relish database has.
+*/
+func (db *SqliteDB) setUp() {
   db.defaultDBThread = db.NewDBThread(nil)
 
+  for _, s := range db.dialect.SetupStatements(params.DbMaxWriteConnections != -1) {
+     err := db.defaultDBThread.ExecStatement(s)
+     if err != nil {
+        Logln(ALWAYS_,"Unable to set up db:",s,err)
+     }
+  }
+
     // db.preparedStatements = make(map[string]*sqlite.Stmt)
 	db.defaultDBThread.EnsureObjectTable()
 	db.defaultDBThread.EnsureObjectNameTable()
 	db.defaultDBThread.EnsurePackageTable()	
+	db.defaultDBThread.EnsureTypeSchemaTable()
+	if params.DbAuditLog {
+		db.defaultDBThread.EnsureChangeLogTable()
+	}
 	
 	
     // Obsolete I think. Was going to do db statement execution asynchronously from
     // relish code execution for efficiency, but not happening.
 	// go db.executeStatements()
+}
 
-	return db
+
+/*
+Returns the maximum number of connections of the connection pool, or of its read pool if there is
+a separate write pool, as given by the -pool, or -rpool and -wpool, options.
+*/
+func poolSize() int {
+  maxConnections := params.DbMaxConnections
+  if params.DbMaxWriteConnections != -1 {
+     if params.DbMaxConnections > 1 {
+          Logln(ALWAYS_,"Error. Specify either -pool or both -rpool and -wpool")
+          os.Exit(1)     
+     } 
+     if params.DbMaxReadConnections != -1 {
+         maxConnections = params.DbMaxReadConnections
+     } else {
+         Logln(ALWAYS_,"Error. Specify either -pool or both -rpool and -wpool")
+         os.Exit(1)
+     }
+  }
+  return maxConnections
 }
 
 
@@ -534,76 +989,30 @@ type ConnectionFactory func (string,int) (conn Connection, err error)
 
 
 /*
-A SQLITE3 connection which implements the Connection interface.
+Grabs a connection from the pool, in which the databases attached to this one are attached.
+A database which is attached to another grabs the other's connections.
 */
-type SqliteConn struct {
-	conn *sqlite.Conn
-	preparedStatements map[string]*sqlite.Stmt
-  isReadOnly bool
-  id int
-}
-
-/*
-Set whether this connection is only to be used for read operations on the database.
-e.g. selects but not inserts or updates. If never set, the connection defaults to 
-read-or-write-enabled.
-*/
-func (conn *SqliteConn) SetReadOnly(isReadOnly bool) {
-  conn.isReadOnly = isReadOnly
+func (db *SqliteDB) GrabConnection(doingWrite bool) Connection {
+	if db.attachedTo != nil {
+		return db.attachedTo.GrabConnection(doingWrite)
+	}
+	conn := db.pool.GrabConnection(doingWrite)
+	db.ensureAttached(conn)
+	return conn
 }
 
-/*
-Returns whether this connection is restricted to reading from the database.
-*/
-func (conn *SqliteConn) IsReadOnly() bool {
-  return conn.isReadOnly
+func (db *SqliteDB) ReleaseConnection(conn Connection) {
+	db.pool.ReleaseConnection(conn)
 }
 
-
 /*
-Return a prepared statement based on the sql string.
-Returns a cached, pre-prepared statement if the sql string has been used before in this connection.
+The database whose connections this database uses.
 */
-func (conn *SqliteConn) Prepare(sql string) (statement Statement, err error) {
-	statement, err = conn.conn.Prepare(sql)
-	return
-}
-
-func (conn *SqliteConn) PreparedStatement(sql string) (statement Statement, found bool) {
-	statement, found = conn.preparedStatements[sql]
-	return
-}
-
-func (conn *SqliteConn) CachePreparedStatement(sql string, statement Statement) {
-	conn.preparedStatements[sql] = statement.(*sqlite.Stmt)
-	return
-}
-
-func (conn *SqliteConn) Close() error {
-	return conn.conn.Close()
-}
-
-func (conn *SqliteConn) Id() int {
-  return conn.id
-}
-
-
-func NewSqliteConn(dbName string, connectionId int) (conn Connection, err error) {
-	s3conn, err := sqlite.Open(dbName)
-    if err != nil {
-    	return
-    }
-    sConn := &SqliteConn{conn: s3conn, preparedStatements: make(map[string]*sqlite.Stmt), id: connectionId}    
-	conn = sConn
-	return
-}
-
-func (db *SqliteDB) GrabConnection(doingWrite bool) Connection {
-	return db.pool.GrabConnection(doingWrite)
-}
-
-func (db *SqliteDB) ReleaseConnection(conn Connection) {
-	db.pool.ReleaseConnection(conn)
+func (db *SqliteDB) ConnectionDB() DB {
+	if db.attachedTo != nil {
+		return db.attachedTo
+	}
+	return db
 }
 
 
@@ -625,17 +1034,16 @@ type SqliteDBThread struct {
 
  TODO maybe should do stmt.Reset() if found in hashtable
 */
-func (db *SqliteDBThread) Prepare(cmd string) (stmt *sqlite.Stmt, err error) {
-   var statement Statement	
-   statement,found := db.dbt.conn.PreparedStatement(cmd)
+func (db *SqliteDBThread) Prepare(cmd string) (stmt Statement, err error) {
+   cmd = db.db.qualify(cmd)
+   stmt,found := db.dbt.conn.PreparedStatement(cmd)
    if ! found {
-	  statement,err = db.dbt.conn.Prepare(cmd)   	 
+	  stmt,err = db.dbt.conn.Prepare(cmd)   	 
 	  if err != nil {
          return
       }
-	  db.dbt.conn.CachePreparedStatement(cmd, statement)
+	  db.dbt.conn.CachePreparedStatement(cmd, stmt)
    }	
-   stmt = statement.(*sqlite.Stmt)   
    return
 }
 
@@ -671,7 +1079,7 @@ func (db *SqliteDBThread) ExecStatement(statement string, args ...interface{}) (
 		
     stmt, prepareErr := db.Prepare(statement)
     if prepareErr != nil {
-	err = fmt.Errorf("DB ERROR preparing statement:\n%s\nDetail: %s\n\n", statement, prepareErr) 	   
+	err = &DbError{Action: "preparing", Statement: statement, Cause: prepareErr} 	   
 	    return
     }
 
@@ -679,12 +1087,26 @@ func (db *SqliteDBThread) ExecStatement(statement string, args ...interface{}) (
 
     err = stmt.Exec(args...)
     if err != nil {
-       err = fmt.Errorf("DB ERROR executing statement:\n%s\nDetail: %s\n\n", statement, err) 	
+       err = &DbError{Action: "executing", Statement: statement, Cause: err} 	
 	   return
     }   
     return
 }
 
+/*
+An error which occurred while preparing or executing a SQL statement.
+Retains the database driver's error as the Cause, so that the kind of failure can be determined.
+*/
+type DbError struct {
+   Action string     // "preparing" or "executing"
+   Statement string
+   Cause error
+}
+
+func (e *DbError) Error() string {
+   return fmt.Sprintf("DB ERROR %s statement:\n%s\nDetail: %s\n\n", e.Action, e.Statement, e.Cause)
+}
+
 
 /*
 OBSOLETE
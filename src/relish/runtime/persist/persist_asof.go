@@ -0,0 +1,510 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+// this package implements data persistence in the relish language environment.
+
+package persist
+
+/*
+    persist_asof.go - reconstruction of persistent relish objects as they were at an earlier time.
+
+    An object is reconstructed as of a time by fetching its current attribute values from the database,
+    then undoing, newest first, the changes to its attributes that were recorded in the RChangeLog table
+    (see persist_changelog.go) after that time.
+
+    The result is a snapshot: a new object which is not persistent, is not cached, and has no dbid.
+    The runtime never confuses it with the object's real in-memory instance, and changing it does not
+    change the database.
+
+    A query as of a time selects among the objects as they were at that time: its selection criteria are
+    evaluated by the oql evaluator (see oql/eval.go) against the attribute values that are reconstructed
+    the same way.
+
+    Limitations:
+    - Only changes made while the program was running in audit log mode (-auditlog) can be undone.
+    - Map-valued and independent-collection-valued attributes are left unset in snapshots, and have
+      no values in the selection criteria of queries.
+    - Object names are resolved as they are now, not as they were.
+    - Objects that have since been deleted cannot be reconstructed.
+*/
+
+import (
+	"errors"
+	"fmt"
+	. "relish/dbg"
+	. "relish/runtime/data"
+	"relish/params"
+	"relish/runtime/persist/oql"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"io"
+)
+
+/*
+Returned (internally) when asked for a snapshot of an object as of a time before the object was created.
+*/
+var errNotYetCreated = errors.New("The object did not exist at that time.")
+
+/*
+Returns a snapshot of the object with the dbid as it was at the time asOf.
+radius determines how many associated objects are included, as snapshots, in the object graph.
+0 means the object's unary primitive attributes only. 1 means also its other attributes, with snapshots
+of the objects they refer to, etc. Attributes beyond the radius are unset in the snapshot.
+*/
+func (db *SqliteDBThread) FetchAsOf(id int64, radius int, asOf time.Time) (obj RObject, err error) {
+	defer Un(Trace(PERSIST_TR, "FetchAsOf", id, radius, asOf))
+	err = checkAuditLog()
+	if err != nil {
+		return
+	}
+	obj, err = db.newSnapshotter(asOf).snapshot(id, radius)
+	if err == errNotYetCreated {
+		err = fmt.Errorf("No object found in database with id=%v as of %v.", id, asOf)
+	}
+	return
+}
+
+/*
+Returns a snapshot of the object which now has the name, as the object was at the time asOf.
+See FetchAsOf.
+*/
+func (db *SqliteDBThread) FetchByNameAsOf(name string, radius int, asOf time.Time) (obj RObject, err error) {
+	defer Un(Trace(PERSIST_TR, "FetchByNameAsOf", name, radius, asOf))
+	err = checkAuditLog()
+	if err != nil {
+		return
+	}
+	current, err := db.FetchByName(name, 0)
+	if err != nil {
+		return
+	}
+	obj, err = db.newSnapshotter(asOf).snapshot(current.DBID(), radius)
+	if err == errNotYetCreated {
+		err = fmt.Errorf("No object found in database with name='%s' as of %v.", name, asOf)
+	}
+	return
+}
+
+/*
+Sets objs to snapshots, as of the time asOf, of the objects which match the query. Objects which did not
+yet exist at that time are omitted.
+
+The selection criteria, and the query's order, are evaluated against the objects as they were at time asOf,
+by the oql evaluator (see asOfObjects), so the objects are those the query would have selected then, from
+among the objects which still exist (and, if coll is not nil, are now members of the collection).
+*/
+func (db *SqliteDBThread) FetchNAsOf(typ *RType, oqlSelectionCriteria string, queryArgs []RObject, coll RCollection, radius int, asOf time.Time, objs *[]RObject) (err error) {
+	defer Un(Trace(PERSIST_TR, "FetchNAsOf", typ, oqlSelectionCriteria, radius, asOf))
+	err = checkAuditLog()
+	if err != nil {
+		return
+	}
+	query, err := parseQuery(typ, oqlSelectionCriteria)
+	if err != nil {
+		return
+	}
+	objects := db.newAsOfObjects(asOf)
+	candidates, err := objects.existing(typ, coll)
+	if err != nil {
+		return
+	}
+	selected, err := oql.Select(query, candidates, objects, queryArgValues(queryArgs))
+	if err != nil {
+		err = fmt.Errorf("%v\n while evaluating selection criteria:\n\"%s\"", err, oqlSelectionCriteria)
+		return
+	}
+	s := db.newSnapshotter(asOf)
+	for _, ref := range selected {
+		var snapshot RObject
+		snapshot, err = s.snapshot(int64(ref), radius)
+		if err != nil {
+			return
+		}
+		*objs = append(*objs, snapshot)
+	}
+	return
+}
+
+/*
+The objects of the database as they were at a time, as seen by the oql evaluator. The values of an
+attribute are its current values in the database, with the changes recorded since the time undone.
+Map-valued and independent-collection-valued attributes have no values, and an object which has since
+been deleted has no attribute values.
+*/
+type asOfObjects struct {
+	db         *SqliteDBThread
+	asOf       time.Time
+	changes    map[int64][]*ChangeLogEntry // the changes to each object since the time, newest first
+	notCreated map[int64]bool              // the objects which had not yet been created at the time
+}
+
+func (db *SqliteDBThread) newAsOfObjects(asOf time.Time) *asOfObjects {
+	return &asOfObjects{db: db, asOf: asOf, changes: make(map[int64][]*ChangeLogEntry), notCreated: make(map[int64]bool)}
+}
+
+/*
+Returns the changes to the object since the time, newest first, or errNotYetCreated.
+*/
+func (o *asOfObjects) changesSince(id int64) (changes []*ChangeLogEntry, err error) {
+	if o.notCreated[id] {
+		err = errNotYetCreated
+		return
+	}
+	changes, found := o.changes[id]
+	if found {
+		return
+	}
+	changes, err = o.db.changesSince(id, o.asOf)
+	if err != nil {
+		return
+	}
+	for _, change := range changes {
+		if change.Op == "CREATE" {
+			o.notCreated[id] = true
+			changes = nil
+			err = errNotYetCreated
+			return
+		}
+	}
+	o.changes[id] = changes
+	return
+}
+
+/*
+The objects of the type which exist now and had been created at the time, in order of id.
+If coll is not nil, only those which are now members of the persistent collection.
+*/
+func (o *asOfObjects) existing(typ *RType, coll RCollection) (refs []oql.ObjectRef, err error) {
+	var current []RObject
+	_, err = o.db.FetchN(typ, "", nil, coll, 0, &current)
+	if err != nil {
+		return
+	}
+	for _, obj := range current {
+		var id int64
+		if obj.IsProxy() {
+			id = int64(obj.(Proxy))
+		} else {
+			id = obj.DBID()
+		}
+		_, err = o.changesSince(id)
+		if err == errNotYetCreated {
+			err = nil
+			continue
+		}
+		if err != nil {
+			return
+		}
+		refs = append(refs, oql.ObjectRef(id))
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i] < refs[j] })
+	return
+}
+
+func (o *asOfObjects) AttrValues(ref oql.ObjectRef, attr *AttributeSpec) (vals []interface{}, err error) {
+	id := int64(ref)
+	changes, err := o.changesSince(id)
+	if err == errNotYetCreated {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	var texts []string
+	if attr.Part.Type.IsPrimitive && attr.Part.CollectionType == "" {
+		var text string
+		var found bool
+		text, found, err = o.db.attrValText(Proxy(id), attr)
+		if found {
+			texts = []string{text}
+		}
+	} else {
+		texts, err = o.db.attrValTexts(Proxy(id), attr)
+	}
+	if err != nil {
+		return
+	}
+	for _, change := range changes {
+		if change.AttrName == attr.Part.Name {
+			texts = undoChange(texts, attr, change)
+		}
+	}
+	for _, text := range texts {
+		if ! attr.Part.Type.IsPrimitive {
+			objId, parseErr := strconv.ParseInt(text, 10, 64)
+			if parseErr == nil {
+				vals = append(vals, oql.ObjectRef(objId))
+			}
+			continue
+		}
+		v := valFromText(text, attr.Part.Type)
+		if v == nil {
+			continue
+		}
+		var val interface{}
+		val, err = queryValue(v)
+		if err != nil {
+			return
+		}
+		vals = append(vals, val)
+	}
+	return
+}
+
+func (o *asOfObjects) Extent(typ *RType) (objs []oql.ObjectRef, err error) {
+	return o.existing(typ, nil)
+}
+
+func checkAuditLog() error {
+	if ! params.DbAuditLog {
+		return errors.New("Fetching objects as of an earlier time requires the change log. Run relish with the -auditlog option.")
+	}
+	return nil
+}
+
+/*
+Makes the snapshots of an object graph as of a time. Each object in the graph has a single snapshot,
+so that references among the snapshots have the same shape as the references among the objects.
+*/
+type snapshotter struct {
+	db *SqliteDBThread
+	asOf time.Time
+	snapshots map[int64]RObject
+}
+
+func (db *SqliteDBThread) newSnapshotter(asOf time.Time) *snapshotter {
+	return &snapshotter{db: db, asOf: asOf, snapshots: make(map[int64]RObject)}
+}
+
+/*
+Returns the snapshot of the object with the dbid, making it if it has not been made yet.
+*/
+func (s *snapshotter) snapshot(id int64, radius int) (obj RObject, err error) {
+	obj, found := s.snapshots[id]
+	if found {
+		return
+	}
+
+	// Fetching the current object ensures that the package defining its type is loaded.
+
+	current, err := s.db.Fetch(id, 0)
+	if err != nil {
+		return
+	}
+	if current.IsCollection() {
+		err = fmt.Errorf("Cannot fetch collection %v as of an earlier time. Only structured objects can be fetched as of a time.", current)
+		return
+	}
+
+	changes, err := s.db.changesSince(id, s.asOf)
+	if err != nil {
+		return
+	}
+	for _, change := range changes {
+		if change.Op == "CREATE" {
+			err = errNotYetCreated
+			return
+		}
+	}
+
+	obj, err = RT.NewObject(current.Type().Name)
+	if err != nil {
+		return
+	}
+	s.snapshots[id] = obj
+
+	err = s.db.fetchUnaryPrimitiveAttributeValues(id, obj)
+	if err != nil {
+		return
+	}
+
+	// The current values of the other attributes, as text, to have changes undone to them.
+
+	valsOf := make(map[*AttributeSpec][]string)
+	var attrs []*AttributeSpec
+	if radius > 0 {
+		typs := append([]*RType{obj.Type()}, obj.Type().Up...)
+		for _, typ := range typs {
+			for _, attr := range typ.Attributes {
+				if attr.IsSimple() || attr.IsIndependentCollection() || strings.HasSuffix(attr.Part.CollectionType, "map") {
+					continue
+				}
+				valsOf[attr], err = s.db.attrValTexts(obj, attr)
+				if err != nil {
+					return
+				}
+				attrs = append(attrs, attr)
+			}
+		}
+	}
+
+	for _, change := range changes {
+		attr, found := obj.Type().GetAttribute(change.AttrName)
+		if ! found {
+			continue
+		}
+		if attr.IsSimple() {
+			if change.Op == "SET" || change.Op == "UNSET" {
+				var val RObject
+				if change.HasOldVal {
+					val = valFromText(change.OldVal, attr.Part.Type)
+				}
+				RT.RestoreAttr(obj, attr, val)
+			}
+			continue
+		}
+		vals, tracked := valsOf[attr]
+		if tracked {
+			valsOf[attr] = undoChange(vals, attr, change)
+		}
+	}
+
+	for _, attr := range attrs {
+		err = s.restoreAttr(obj, attr, valsOf[attr], radius)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+/*
+Returns the values of the attribute (a unary non-primitive attribute or a multi-valued list or set attribute)
+as they were before the change.
+*/
+func undoChange(vals []string, attr *AttributeSpec, change *ChangeLogEntry) []string {
+	index := -1
+	if change.Key != "" {
+		index, _ = strconv.Atoi(change.Key)
+	}
+	switch change.Op {
+	case "SET", "UNSET":
+		if attr.Part.CollectionType == "" {
+			vals = nil
+			if change.HasOldVal {
+				vals = []string{change.OldVal}
+			}
+		} else if change.HasOldVal && index >= 0 && index < len(vals) {
+			vals[index] = change.OldVal
+		}
+	case "ADD":
+		if index < 0 || index >= len(vals) || vals[index] != change.NewVal {
+			index = -1
+			for i, val := range vals {
+				if val == change.NewVal {
+					index = i
+					break
+				}
+			}
+		}
+		if index >= 0 {
+			vals = append(vals[:index], vals[index+1:]...)
+		}
+	case "REMOVE":
+		if index < 0 || index > len(vals) {
+			index = len(vals)
+		}
+		vals = append(vals, "")
+		copy(vals[index+1:], vals[index:])
+		vals[index] = change.OldVal
+	}
+	return vals
+}
+
+/*
+Sets the attribute of the snapshot to the values, which are given in text form.
+Object values become snapshots of the objects. If an object no longer exists, it is omitted.
+*/
+func (s *snapshotter) restoreAttr(obj RObject, attr *AttributeSpec, vals []string, radius int) (err error) {
+	var objs []RObject
+	for _, text := range vals {
+		var val RObject
+		if attr.Part.Type.IsPrimitive {
+			val = valFromText(text, attr.Part.Type)
+		} else {
+			id, parseErr := strconv.ParseInt(text, 10, 64)
+			if parseErr != nil {
+				continue
+			}
+			val, err = s.snapshot(id, radius-1)
+			if err != nil {
+				Logln(PERSIST_, "Omitting value of", attr.Part.Name, "from snapshot:", err)
+				err = nil
+				continue
+			}
+		}
+		objs = append(objs, val)
+	}
+
+	if attr.Part.CollectionType == "" {
+		if len(objs) > 0 {
+			RT.RestoreAttr(obj, attr, objs[0])
+		}
+		return
+	}
+
+	collection, err := RT.EnsureMultiValuedAttributeCollection(obj, attr)
+	if err != nil {
+		return
+	}
+	addColl := collection.(AddableMixin)
+	for _, val := range objs {
+		addColl.AddSimple(val)
+	}
+	return
+}
+
+/*
+Converts the text form of a primitive value, as recorded in the change log, back to a value of the type.
+*/
+func valFromText(text string, typ *RType) (val RObject) {
+	switch typ {
+	case StringType:
+		val = String(text)
+	case TimeType, ComplexType, Complex32Type:
+		i := strings.LastIndex(text, " ")
+		if i < 0 {
+			return
+		}
+		convertValTwoFields([]byte(text[:i]), []byte(text[i+1:]), typ, "change log value", &val)
+	default:
+		convertVal([]byte(text), typ, "change log value", &val)
+	}
+	return
+}
+
+/*
+Returns the changes recorded in the change log for the object after the time, newest first.
+*/
+func (db *SqliteDBThread) changesSince(objId int64, asOf time.Time) (changes []*ChangeLogEntry, err error) {
+	query := "SELECT attr,op,mapKey,oldVal,newVal FROM RChangeLog WHERE objId=? AND time>? ORDER BY id DESC"
+	selectStmt, err := db.Prepare(query)
+	if err != nil {
+		return
+	}
+
+	defer selectStmt.Reset() // Ensure statement is not left open
+
+	err = selectStmt.Query(objId, asOf.UTC().Format(TIME_LAYOUT))
+	for ; err == nil; err = selectStmt.Next() {
+		change := &ChangeLogEntry{ObjId: objId}
+		var key, oldVal []byte
+		err = selectStmt.Scan(&change.AttrName, &change.Op, &key, &oldVal, &change.NewVal)
+		if err != nil {
+			return
+		}
+		change.Key = string(key)
+		change.OldVal = string(oldVal)
+		change.HasOldVal = oldVal != nil
+		changes = append(changes, change)
+	}
+	if err == io.EOF {
+		err = nil
+	} else {
+		err = fmt.Errorf("DB ERROR on query:\n%s\nDetail: %s\n\n", query, err)
+	}
+	return
+}
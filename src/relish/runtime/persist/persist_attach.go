@@ -0,0 +1,296 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+// this package implements data persistence in the relish language environment.
+
+package persist
+
+/*
+   persist_attach.go - databases attached to the running program by name, in addition to the main database.
+
+   A named sqlite database, when the main database is also sqlite, is attached to the main database with
+   ATTACH DATABASE, so that it shares the main database's connections and one transaction can span both.
+   Its tables are then qualified by its schema name in each statement. Other named databases have
+   connections of their own.
+
+   An object remembers the database it was fetched from or stored in. Changes are persisted in the
+   database in use by the thread which makes them, so a change to an object of another database, or one
+   which would refer from an object to an object of another database, fails with an error. A program
+   must switch to an object's database before changing the object. In WAL journal mode (-rpool and -wpool), sqlite does not guarantee that
+   a transaction spanning attached databases is atomic across them if the process crashes while committing.
+*/
+
+import (
+	"fmt"
+	"path/filepath"
+	. "relish/runtime/data"
+	"sort"
+	"strings"
+)
+
+/*
+The maximum number of databases which can be attached to a sqlite database (SQLITE_MAX_ATTACHED).
+*/
+const MAX_ATTACHED_DBS = 10
+
+/*
+A database attached to a sqlite database, as the schema name, from the database file at path.
+*/
+type sqliteAttachment struct {
+	schema string
+	path   string
+}
+
+/*
+Opens the database at location, to be attached to the running program under the name.
+The location is a sqlite database name, kv:<name> for a key-value database, or a postgres:// URL,
+as in the -db option. Database files are in the directory of the main database, which is mainURI,
+unless the location is an absolute path.
+If the main database and the named database are both sqlite databases, the named database
+is attached to the main database.
+*/
+func OpenNamedDB(main DB, mainURI string, name string, location string) (db DB, err error) {
+	if name == "" || strings.IndexFunc(name, func(r rune) bool { return r > 127 || !isWordByte(byte(r)) }) >= 0 {
+		err = fmt.Errorf("Invalid database name '%s'. A database name must consist of letters, digits and underscores.", name)
+		return
+	}
+	if strings.EqualFold(name, "main") || strings.EqualFold(name, "temp") {
+		err = fmt.Errorf("Invalid database name '%s'. The name is reserved.", name)
+		return
+	}
+	if IsPostgresURI(location) {
+		db = newDB(location, true)
+		return
+	}
+	path := DataFilePath(mainURI, DatabaseFileName(location))
+	if IsKVDBName(path) {
+		db = newKVDB(path, true)
+		return
+	}
+	if mainDB, isSqlite := main.(*SqliteDB); isSqlite && mainDB.dialect == SqliteDialect && mainDB.attachedTo == nil {
+		db, err = mainDB.attach(name, path)
+		return
+	}
+	db = newDB(path, true)
+	return
+}
+
+/*
+The path of a file of the program's data, such as a database or a backup, given a path relative to the directory
+of the main database, whose name is mainURI. A path is relative to the working directory instead if the main
+database is not a file.
+*/
+func DataFilePath(mainURI string, path string) string {
+	if filepath.IsAbs(path) || IsPostgresURI(mainURI) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(mainURI), path)
+}
+
+/*
+Attaches the sqlite database file at path to this database, as the schema name.
+Each of this database's connections attaches it when next grabbed from the pool.
+*/
+func (db *SqliteDB) attach(schema string, path string) (attached *SqliteDB, err error) {
+	db.attachMutex.Lock()
+	if len(db.attachments) == MAX_ATTACHED_DBS {
+		db.attachMutex.Unlock()
+		err = fmt.Errorf("Cannot attach database '%s'. At most %d sqlite databases can be attached to the main database.", schema, MAX_ATTACHED_DBS)
+		return
+	}
+	db.attachments = append(db.attachments, sqliteAttachment{schema, path})
+	if db.attachedCounts == nil {
+		db.attachedCounts = make(map[Connection]int)
+	}
+	db.attachMutex.Unlock()
+
+	attached = &SqliteDB{dbName: path, named: true, pool: db.pool, dialect: db.dialect, schema: schema, attachedTo: db}
+	attached.setUp()
+	return
+}
+
+/*
+Attaches, to the connection, the databases attached to this database which it has not yet attached.
+The connection is not in a transaction, since it has just been grabbed from the pool.
+*/
+func (db *SqliteDB) ensureAttached(conn Connection) {
+	db.attachMutex.Lock()
+	defer db.attachMutex.Unlock()
+	for n := db.attachedCounts[conn]; n < len(db.attachments); n++ {
+		attachment := db.attachments[n]
+		stmt, err := conn.Prepare("ATTACH DATABASE ? AS " + attachment.schema)
+		if err == nil {
+			err = stmt.Exec(attachment.path)
+			stmt.Close()
+		}
+		if err != nil {
+			panic(fmt.Sprintf("Unable to attach the database '%s' as %s: %s", attachment.path, attachment.schema, err))
+		}
+		db.attachedCounts[conn] = n + 1
+	}
+}
+
+/*
+The hold on a db connection of the interpreter thread's DBThread of this database, which the thread's
+DBThreads of the databases attached to this one share. If th is nil, that of the default DBThread.
+*/
+func (db *SqliteDB) threadConnection(th InterpreterThread) *dbConnection {
+	var dbt DBT
+	if th == nil {
+		dbt = db.defaultDBThread
+	} else {
+		dbt, _ = th.DatabaseThread("")
+	}
+	if mainDBT, isDBThread := dbt.(*DBThread); isDBThread && mainDBT.db == DB(db) {
+		return mainDBT.dbConnection
+	}
+	return &dbConnection{}
+}
+
+/*
+The statement, with its tables qualified by this database's schema name if it is attached to another database.
+*/
+func (db *SqliteDB) qualify(statement string) string {
+	if db.schema == "" {
+		return statement
+	}
+	return qualifyTables(statement, db.schema)
+}
+
+/*
+The tables which every relish database has, whose names are not enclosed in [].
+*/
+var fixedTables = map[string]bool{
+	"RObject":      true,
+	"RName":        true,
+	"RPackage":     true,
+	"RChangeLog":   true,
+	"RChangeLogTx": true,
+	"RTypeSchema":  true,
+}
+
+/*
+Qualifies the names of the tables, indexes and triggers in the sqlite statement by the schema name.
+Names are only qualified outside of string literals, quoted names and comments.
+The table of a CREATE INDEX or CREATE TRIGGER, after ON, is not qualified, since sqlite requires it
+to be in the same schema as the index or trigger, and nor is the new name of a table after RENAME TO.
+*/
+func qualifyTables(statement string, schema string) string {
+	trimmed := strings.TrimSpace(statement)
+	upper := strings.ToUpper(trimmed)
+	if strings.HasPrefix(upper, "PRAGMA ") {
+		return "PRAGMA " + schema + "." + strings.TrimSpace(trimmed[len("PRAGMA "):])
+	}
+	isCreate := strings.HasPrefix(upper, "CREATE ")
+
+	var buf []byte
+	qualified := func(name string) {
+		buf = append(buf, schema...)
+		buf = append(buf, '.')
+		buf = append(buf, name...)
+	}
+	creating := false  // the next name is of the index or trigger being created
+	unqualified := false  // the next name is not to be qualified
+	prevWord := ""
+	s := statement
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(s[i+1:], c)
+			if end < 0 {
+				buf = append(buf, s[i:]...)
+				return string(buf)
+			}
+			buf = append(buf, s[i:i+end+2]...)
+			i += end + 2
+		case c == '[':
+			end := strings.IndexByte(s[i+1:], ']')
+			if end < 0 {
+				buf = append(buf, s[i:]...)
+				return string(buf)
+			}
+			name := s[i : i+end+2]
+			if unqualified {
+				buf = append(buf, name...)
+			} else {
+				qualified(name)
+			}
+			creating = false
+			unqualified = false
+			i += end + 2
+		case c == '-' && i+1 < len(s) && s[i+1] == '-':
+			end := strings.IndexByte(s[i:], '\n')
+			if end < 0 {
+				end = len(s) - i
+			}
+			buf = append(buf, s[i:i+end]...)
+			i += end
+		case isWordByte(c):
+			j := i + 1
+			for j < len(s) && isWordByte(s[j]) {
+				j++
+			}
+			word := s[i:j]
+			upperWord := strings.ToUpper(word)
+			switch {
+			case creating && upperWord != "IF" && upperWord != "NOT" && upperWord != "EXISTS":
+				qualified(word)
+				creating = false
+			case isCreate && (upperWord == "INDEX" || upperWord == "TRIGGER"):
+				buf = append(buf, word...)
+				creating = true
+			case isCreate && upperWord == "ON", upperWord == "TO" && prevWord == "RENAME":
+				buf = append(buf, word...)
+				unqualified = true
+			case fixedTables[word] && !unqualified:
+				qualified(word)
+			default:
+				if fixedTables[word] {
+					unqualified = false
+				}
+				buf = append(buf, word...)
+			}
+			prevWord = upperWord
+			i = j
+		default:
+			buf = append(buf, c)
+			i++
+		}
+	}
+	return string(buf)
+}
+
+/*
+Reconciles the package short names stored in a database with those of the runtime.
+Short names are part of table names. The short names stored in the main database become the runtime's.
+A named database must use the runtime's short names, so it is an error if it stores a different
+short name for a package, or a package's short name for another package.
+Returns the names of the runtime's packages whose short names the named database does not store yet.
+*/
+func reconcilePackageNames(named bool, stored map[string]string) (unrecorded []string, err error) {
+	if !named {
+		for name, shortName := range stored {
+			RT.PkgNameToShortName[name] = shortName
+			RT.PkgShortNameToName[shortName] = name
+		}
+		return
+	}
+	for name, shortName := range stored {
+		if known, found := RT.PkgNameToShortName[name]; found && known != shortName {
+			err = fmt.Errorf("The database stores the package %s under the short name %s, not %s.", name, shortName, known)
+			return
+		}
+		if other, found := RT.PkgShortNameToName[shortName]; found && other != name {
+			err = fmt.Errorf("The database stores the package %s under the short name %s, which is that of package %s.", name, shortName, other)
+			return
+		}
+	}
+	for name := range RT.PkgNameToShortName {
+		if _, found := stored[name]; !found {
+			unrecorded = append(unrecorded, name)
+		}
+	}
+	sort.Strings(unrecorded)
+	return
+}
@@ -0,0 +1,36 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+package persist
+
+import (
+	"testing"
+)
+
+var qualifyTests = []struct {
+	statement string
+	qualified string
+}{
+	{"SELECT count(*) FROM RObject where id=?", "SELECT count(*) FROM archive.RObject where id=?"},
+	{"SELECT t.id FROM [vehicles/Car] t JOIN RObject ro ON t.id = ro.id WHERE t.make = 'RObject'",
+		"SELECT t.id FROM archive.[vehicles/Car] t JOIN archive.RObject ro ON t.id = ro.id WHERE t.make = 'RObject'"},
+	{"CREATE TABLE IF NOT EXISTS RName(name TEXT PRIMARY KEY, id INTEGER)",
+		"CREATE TABLE IF NOT EXISTS archive.RName(name TEXT PRIMARY KEY, id INTEGER)"},
+	{"CREATE UNIQUE INDEX IF NOT EXISTS [vehicles/Car__vin__idx] ON [vehicles/Car](vin)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS archive.[vehicles/Car__vin__idx] ON [vehicles/Car](vin)"},
+	{"CREATE INDEX IF NOT EXISTS RChangeLog_objId ON RChangeLog(objId)",
+		"CREATE INDEX IF NOT EXISTS archive.RChangeLog_objId ON RChangeLog(objId)"},
+	{"CREATE TRIGGER IF NOT EXISTS RChangeLog_noUpdate BEFORE UPDATE ON RChangeLog BEGIN SELECT RAISE(ABORT, 'RChangeLog is append-only'); END",
+		"CREATE TRIGGER IF NOT EXISTS archive.RChangeLog_noUpdate BEFORE UPDATE ON RChangeLog BEGIN SELECT RAISE(ABORT, 'RChangeLog is append-only'); END"},
+	{"ALTER TABLE [vehicles/Car__new] RENAME TO [vehicles/Car]", "ALTER TABLE archive.[vehicles/Car__new] RENAME TO [vehicles/Car]"},
+	{"PRAGMA table_info([vehicles/Car])", "PRAGMA archive.table_info([vehicles/Car])"},
+	{"BEGIN IMMEDIATE TRANSACTION", "BEGIN IMMEDIATE TRANSACTION"},
+}
+
+func TestQualifyTables(t *testing.T) {
+	for _, test := range qualifyTests {
+		if qualified := qualifyTables(test.statement, "archive"); qualified != test.qualified {
+			t.Errorf("qualifyTables(%q) = %q, want %q", test.statement, qualified, test.qualified)
+		}
+	}
+}
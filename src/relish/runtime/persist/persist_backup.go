@@ -0,0 +1,140 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+// this package implements data persistence in the relish language environment.
+
+package persist
+
+/*
+   persist_backup.go - hot backups of a database, and restoring a database from a backup.
+
+   A backup is a consistent snapshot of the database, taken while the database is in use, through the
+   Connection's Backup method (the sqlite online backup API, for a sqlite database). Copying the database
+   file instead, while writers are active, can give a corrupt copy.
+
+   A database can also be restored from a directory to which its WAL has been shipped. See persist_walship.go.
+*/
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+Copies the database, as a consistent snapshot, to a new database file at path.
+*/
+func (db *SqliteDB) Backup(path string) error {
+	schema := db.schema
+	if schema == "" {
+		schema = "main"
+	}
+	return backupTo(path, func(tmpPath string) error {
+		conn := db.GrabConnection(false)
+		defer db.ReleaseConnection(conn)
+		return conn.Backup(schema, tmpPath)
+	})
+}
+
+/*
+Copies the database, as a consistent snapshot, to a new database file at path.
+*/
+func (db *KVDB) Backup(path string) error {
+	return backupTo(path, func(tmpPath string) error {
+		conn := db.GrabConnection(false)
+		defer db.ReleaseConnection(conn)
+		return conn.Backup("main", tmpPath)
+	})
+}
+
+/*
+Backs up a database to path with the backup function, which writes the backup to the temporary file
+path it is given, so that a backup file is never partly written. The file at path must not exist.
+*/
+func backupTo(path string, backup func(tmpPath string) error) (err error) {
+	if _, statErr := os.Stat(path); statErr == nil {
+		err = fmt.Errorf("Cannot back up the database to %s. The file already exists.", path)
+		return
+	}
+	tmpPath := path + ".tmp"
+	os.Remove(tmpPath)
+	err = backup(tmpPath)
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		err = fmt.Errorf("Unable to back up the database to %s: %s", path, err)
+	}
+	return
+}
+
+/*
+Restores the database file at dbPath from a backup, which is a backup file made by Backup, or a directory
+to which the database's WAL has been shipped, in which case the database is restored to the last transaction
+shipped. The database must not be in use. If the database file exists, it is kept as <dbPath>.replaced,
+and its WAL and shared-memory files are removed, since they belong to the replaced database.
+*/
+func Restore(backupPath string, dbPath string) (err error) {
+	info, err := os.Stat(backupPath)
+	if err != nil {
+		return
+	}
+	basePath := backupPath
+	var segments []string
+	if info.IsDir() {
+		basePath, segments, err = latestWALGeneration(backupPath)
+		if err != nil {
+			return
+		}
+	}
+
+	tmpPath := dbPath + ".restoring"
+	err = copyFile(basePath, tmpPath)
+	if err == nil {
+		err = applyWALSegments(tmpPath, segments)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return
+	}
+
+	if _, statErr := os.Stat(dbPath); statErr == nil {
+		err = os.Rename(dbPath, dbPath+".replaced")
+		if err != nil {
+			return
+		}
+	}
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if removeErr := os.Remove(dbPath + suffix); removeErr != nil && !os.IsNotExist(removeErr) {
+			err = removeErr
+			return
+		}
+	}
+	err = os.Rename(tmpPath, dbPath)
+	return
+}
+
+/*
+Copies the file at fromPath to a new file at toPath, replacing any file there.
+*/
+func copyFile(fromPath string, toPath string) (err error) {
+	from, err := os.Open(fromPath)
+	if err != nil {
+		return
+	}
+	defer from.Close()
+	to, err := os.Create(toPath)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(to, from)
+	if err == nil {
+		err = to.Sync()
+	}
+	closeErr := to.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return
+}
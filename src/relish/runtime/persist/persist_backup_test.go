@@ -0,0 +1,73 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+package persist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPageSize = 512
+
+/*
+A WAL segment with a frame for each page, the last of which commits a database of dbSize pages.
+*/
+func testWALSegment(dbSize uint32, pages map[uint32]byte, order []uint32) []byte {
+	segment := make([]byte, WAL_HEADER_SIZE)
+	binary.BigEndian.PutUint32(segment[8:12], testPageSize)
+	for i, pageNumber := range order {
+		frameHeader := make([]byte, WAL_FRAME_HEADER_SIZE)
+		binary.BigEndian.PutUint32(frameHeader[0:4], pageNumber)
+		if i == len(order)-1 {
+			binary.BigEndian.PutUint32(frameHeader[4:8], dbSize)
+		}
+		segment = append(segment, frameHeader...)
+		segment = append(segment, bytes.Repeat([]byte{pages[pageNumber]}, testPageSize)...)
+	}
+	return segment
+}
+
+func TestRestoreFromShippedWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walship")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	older := filepath.Join(dir, "walship", "20140321-101500.000000000")
+	latest := filepath.Join(dir, "walship", "20140321-111500.000000000")
+	for _, generation := range []string{older, latest} {
+		if err = os.MkdirAll(generation, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base := append(bytes.Repeat([]byte{1}, testPageSize), bytes.Repeat([]byte{2}, testPageSize)...)
+	ioutil.WriteFile(filepath.Join(older, "base.db"), bytes.Repeat([]byte{9}, testPageSize), 0666)
+	ioutil.WriteFile(filepath.Join(latest, "base.db"), base, 0666)
+	ioutil.WriteFile(filepath.Join(latest, "00000001.wal"), testWALSegment(3, map[uint32]byte{2: 5, 3: 6}, []uint32{2, 3}), 0666)
+	ioutil.WriteFile(filepath.Join(latest, "00000002.wal"), testWALSegment(2, map[uint32]byte{1: 7}, []uint32{1}), 0666)
+
+	dbPath := filepath.Join(dir, "db1.db")
+	ioutil.WriteFile(dbPath, []byte("old"), 0666)
+	ioutil.WriteFile(dbPath+"-wal", []byte("old wal"), 0666)
+
+	if err = Restore(filepath.Join(dir, "walship"), dbPath); err != nil {
+		t.Fatal(err)
+	}
+	restored, _ := ioutil.ReadFile(dbPath)
+	expected := append(bytes.Repeat([]byte{7}, testPageSize), bytes.Repeat([]byte{5}, testPageSize)...)
+	if !bytes.Equal(restored, expected) {
+		t.Errorf("restored database of %d bytes does not have the pages of the latest generation's last commit", len(restored))
+	}
+	if replaced, _ := ioutil.ReadFile(dbPath + ".replaced"); string(replaced) != "old" {
+		t.Errorf("the replaced database was not kept")
+	}
+	if _, err = os.Stat(dbPath + "-wal"); !os.IsNotExist(err) {
+		t.Errorf("the replaced database's WAL was not removed")
+	}
+}
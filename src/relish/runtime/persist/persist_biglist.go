@@ -0,0 +1,237 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+// this package implements data persistence in the relish language environment.
+
+package persist
+
+/*
+   persist_biglist.go - sqlite persistence of big lists.
+
+   A big list keeps its elements only in its ordered collection table, which is the table of the
+   multi-valued attribute if the list is the value of an attribute, or e.g. [biglist_of_vehicles/Car]
+   if it is an independent list. So, unlike other lists, its elements are read from the table
+   a page at a time, its membership test is a query, and inserting into or removing from the middle
+   of it renumbers the ord1 column of the following elements in the table.
+*/
+
+import (
+	"fmt"
+	"io"
+	. "relish/dbg"
+	. "relish/runtime/data"
+)
+
+/*
+Returns the collection table of the big list, the name of the table's column which holds the id of
+the list (or of the list's owner object), that id, and the element type.
+*/
+func (db *SqliteDBThread) bigListTable(list BigList) (table string, ownerCol string, ownerId int64, elementType *RType, err error) {
+	if list.Owner() != nil {
+		attr := list.Attribute()
+		table = db.db.TableNameIfy(attr.ShortName())
+		ownerId = list.Owner().DBID()
+		elementType = attr.Part.Type
+	} else {
+		table, _, _, _, elementType, err = db.EnsureCollectionTable(list)
+		if err != nil {
+			return
+		}
+		ownerId = list.DBID()
+	}
+	if elementType.IsPrimitive {
+		ownerCol = "id"
+	} else {
+		ownerCol = "id0"
+	}
+	return
+}
+
+/*
+Persist the insertion of a value into a big list at the index. The elements at and after the index
+move up one place.
+*/
+func (db *SqliteDBThread) persistBigListInsert(th InterpreterThread, list BigList, val RObject, insertIndex int) (err error) {
+	table, ownerCol, ownerId, elementType, err := db.bigListTable(list)
+	if err != nil {
+		return
+	}
+
+	if insertIndex < int(list.Length())-1 {
+		err = db.ExecStatement(fmt.Sprintf("UPDATE %s SET ord1 = ord1 + 1 WHERE %s=? AND ord1 >= ?", table, ownerCol), ownerId, insertIndex)
+		if err != nil {
+			return
+		}
+	}
+
+	if elementType.IsPrimitive {
+		valCols, valVars := elementType.DbCollectionColumnInsert()
+		stmt := Stmt(fmt.Sprintf("INSERT INTO %s(id,%s,ord1) VALUES(?,%s,?)", table, valCols, valVars))
+		stmt.Arg(ownerId)
+		stmt.Args(db.db.primitiveValSQL(val))
+		stmt.Arg(insertIndex)
+		err = db.ExecStatements(stmt)
+	} else {
+		err = db.EnsurePersisted(th, val)
+		if err != nil {
+			return
+		}
+		err = db.ExecStatement(fmt.Sprintf("INSERT INTO %s(id0,id1,ord1) VALUES(?,?,?)", table), ownerId, val.DBID(), insertIndex)
+	}
+	return
+}
+
+/*
+Persist the removal of the element at the index of a big list. The elements after the index
+move down one place.
+*/
+func (db *SqliteDBThread) persistBigListRemove(list BigList, removedIndex int) (err error) {
+	table, ownerCol, ownerId, _, err := db.bigListTable(list)
+	if err != nil {
+		return
+	}
+	err = db.ExecStatement(fmt.Sprintf("DELETE FROM %s WHERE %s=? AND ord1=?", table, ownerCol), ownerId, removedIndex)
+	if err != nil {
+		return
+	}
+	err = db.ExecStatement(fmt.Sprintf("UPDATE %s SET ord1 = ord1 - 1 WHERE %s=? AND ord1 > ?", table, ownerCol), ownerId, removedIndex)
+	return
+}
+
+/*
+Instead of reading the elements of a big list, which is being fetched, counts them,
+and records that they are in the table.
+*/
+func (db *SqliteDBThread) fetchBigList(list BigList, collectionOrOwnerId int64, collectionTableName string) (err error) {
+	defer Un(Trace(PERSIST_TR2, "fetchBigList", collectionOrOwnerId, collectionTableName))
+
+	ownerCol := "id0"
+	if list.ElementType().IsPrimitive {
+		ownerCol = "id"
+	}
+	query := fmt.Sprintf("SELECT count(*) FROM %s WHERE %s=?", collectionTableName, ownerCol)
+
+	selectStmt, err := db.Prepare(query)
+	if err != nil {
+		return
+	}
+
+	defer selectStmt.Reset()
+
+	var length int64
+	err = selectStmt.Query(collectionOrOwnerId)
+	if err == nil {
+		err = selectStmt.Scan(&length)
+	}
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("DB ERROR on query:\n%s\nDetail: %s\n\n", query, err)
+		return
+	}
+	err = nil
+	list.SetStored(length)
+	return
+}
+
+/*
+Reads at most n elements of the persistent big list, starting at index start.
+Non-primitive elements are returned as proxies.
+*/
+func (db *SqliteDBThread) FetchBigListElements(list BigList, start int64, n int) (elements []RObject, err error) {
+	defer Un(Trace(PERSIST_TR2, "FetchBigListElements", start, n))
+
+	table, ownerCol, ownerId, elementType, err := db.bigListTable(list)
+	if err != nil {
+		return
+	}
+
+	if !elementType.IsPrimitive {
+		query := fmt.Sprintf("SELECT id1 FROM %s WHERE id0=? AND ord1 >= ? ORDER BY ord1 LIMIT %d", table, n)
+		err = db.queryRows(query, []interface{}{ownerId, start}, 1, func(row []interface{}) {
+			elements = append(elements, Proxy(row[0].(int64)))
+		})
+		return
+	}
+
+	valCols, _ := elementType.DbCollectionColumnInsert()
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s=? AND ord1 >= ? ORDER BY ord1 LIMIT %d", valCols, table, ownerCol, n)
+
+	selectStmt, err := db.Prepare(query)
+	if err != nil {
+		return
+	}
+
+	defer selectStmt.Reset()
+
+	var numColumns int
+	switch elementType {
+	case ComplexType, Complex32Type, TimeType:
+		numColumns = 2
+	default:
+		numColumns = 1
+	}
+	valsBytes1 := make([][]byte, numColumns)
+	valsBytes := make([]interface{}, numColumns)
+	for i := 0; i < numColumns; i++ {
+		valsBytes[i] = &valsBytes1[i]
+	}
+
+	err = selectStmt.Query(ownerId, start)
+	for ; err == nil; err = selectStmt.Next() {
+		err = selectStmt.Scan(valsBytes...)
+		if err != nil {
+			return
+		}
+		var val RObject
+		var nonNil bool
+		if numColumns == 1 {
+			nonNil = convertVal(valsBytes1[0], elementType, "collection element val", &val)
+		} else {
+			nonNil = convertValTwoFields(valsBytes1[0], valsBytes1[1], elementType, "collection element val", &val)
+		}
+		if !nonNil {
+			panic("nil not valid element in a primitive value collection")
+		}
+		elements = append(elements, val)
+	}
+	if err == io.EOF {
+		err = nil
+	} else {
+		err = fmt.Errorf("DB ERROR on query:\n%s\nDetail: %s\n\n", query, err)
+	}
+	return
+}
+
+/*
+Returns the index of the first occurrence of the value in the persistent big list, at or after index start,
+or -1 if the value is not in the list.
+*/
+func (db *SqliteDBThread) BigListIndex(list BigList, val RObject, start int64) (index int64, err error) {
+	defer Un(Trace(PERSIST_TR2, "BigListIndex", start))
+
+	index = -1
+
+	table, ownerCol, ownerId, elementType, err := db.bigListTable(list)
+	if err != nil {
+		return
+	}
+
+	var query string
+	args := []interface{}{ownerId, start}
+	if elementType.IsPrimitive {
+		query = fmt.Sprintf("SELECT min(ord1) FROM %s WHERE %s=? AND ord1 >= ? AND %s", table, ownerCol, elementType.DbCollectionRemove())
+		args = append(args, db.db.primitiveValSQL(val)...)
+	} else {
+		if !val.IsStoredLocally() {
+			return // An object which is not persistent cannot be in the table.
+		}
+		query = fmt.Sprintf("SELECT min(ord1) FROM %s WHERE id0=? AND ord1 >= ? AND id1=?", table)
+		args = append(args, val.DBID())
+	}
+
+	err = db.queryRows(query, args, 1, func(row []interface{}) {
+		if row[0] != nil {
+			index = row[0].(int64)
+		}
+	})
+	return
+}
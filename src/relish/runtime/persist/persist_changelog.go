@@ -0,0 +1,480 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+// this package implements data persistence in the relish language environment.
+
+package persist
+
+/*
+    persist_changelog.go - sqlite persistence of the audit log of changes to attributes of persistent relish objects.
+
+    In audit log mode (the -auditlog runtime flag) each change to an attribute of a persistent object,
+    and each put to a persistent map, is also recorded as a row in the RChangeLog table.
+    The table is append-only. Values are recorded in the text form in which they are stored in the database,
+    or as the object's dbid if they are objects.
+
+    Each transaction which records changes is given an id by inserting a row into the RChangeLogTx table,
+    so that transaction ids are unique even among programs which share a postgres database.
+
+   `CREATE TABLE RChangeLog(
+       id INTEGER PRIMARY KEY AUTOINCREMENT,
+       txId INTEGER NOT NULL,  -- RChangeLogTx id, or 0 if the change was made outside of a transaction
+       objId INTEGER NOT NULL,
+       attr TEXT NOT NULL,
+       op TEXT NOT NULL,  -- CREATE SET UNSET ADD REMOVE CLEAR PUT
+       mapKey TEXT,
+       oldVal TEXT,  -- NULL if the attribute had no value
+       newVal TEXT,
+       time TEXT NOT NULL,
+       actor TEXT  -- Who the thread which made the change was acting for, or NULL if not known
+    )`
+
+   `CREATE TABLE RChangeLogTx(
+       id INTEGER PRIMARY KEY AUTOINCREMENT,
+       time TEXT NOT NULL  -- When the transaction recorded its first change
+    )`
+*/
+
+import (
+	"fmt"
+	. "relish/dbg"
+	. "relish/runtime/data"
+	"strconv"
+	"strings"
+	"time"
+	"io"
+)
+
+/*
+Creates the RChangeLog and RChangeLogTx tables, with an index on the object id, and triggers which prevent
+changes to the recorded history, if these do not yet exist. Adds the actor column to a change log created
+before actors were recorded.
+*/
+func (db *SqliteDBThread) EnsureChangeLogTable() {
+	stmts := []string{`CREATE TABLE IF NOT EXISTS RChangeLog(
+           id INTEGER PRIMARY KEY AUTOINCREMENT,
+           txId INTEGER NOT NULL,
+           objId INTEGER NOT NULL,
+           attr TEXT NOT NULL,
+           op TEXT NOT NULL,
+           mapKey TEXT,
+           oldVal TEXT,
+           newVal TEXT,
+           time TEXT NOT NULL,
+           actor TEXT
+         )`,
+		"CREATE INDEX IF NOT EXISTS RChangeLog_objId ON RChangeLog(objId)",
+		`CREATE TABLE IF NOT EXISTS RChangeLogTx(
+           id INTEGER PRIMARY KEY AUTOINCREMENT,
+           time TEXT NOT NULL
+         )`,
+	}
+	stmts = append(stmts, db.db.dialect.AppendOnlyStatements("RChangeLog")...)
+	stmts = append(stmts, db.db.dialect.AppendOnlyStatements("RChangeLogTx")...)
+	for _, s := range stmts {
+		err := db.ExecStatement(s)
+		if err != nil {
+			panic(fmt.Sprintf("db.ExecStatement(%s): db error: %s", s, err))
+		}
+	}
+
+	columns, err := db.tableColumns("RChangeLog")
+	if err != nil {
+		panic(fmt.Sprintf("Reading columns of RChangeLog table: db error: %s", err))
+	}
+	for _, columnName := range columns {
+		if columnName == "actor" {
+			return
+		}
+	}
+	err = db.ExecStatement("ALTER TABLE RChangeLog ADD COLUMN actor TEXT")
+	if err != nil {
+		panic(fmt.Sprintf("Adding actor column to RChangeLog table: db error: %s", err))
+	}
+}
+
+/*
+Returns the id of the thread's transaction in the change log, giving the transaction an id, by inserting
+a row into the RChangeLogTx table, if it does not have one yet. The row is inserted in the transaction, so
+no other connection can be given the same id. Returns 0 if the thread is not in a transaction.
+*/
+func (db *SqliteDBThread) changeLogTxId(timeString string) (txId int64, err error) {
+	if db.dbt.th == nil || db.dbt.th.Transaction() == nil {
+		return
+	}
+	tx := db.dbt.th.Transaction()
+	txId = tx.ChangeLogId(db.db.schema)
+	if txId != 0 {
+		return
+	}
+	err = db.ExecStatement("INSERT INTO RChangeLogTx(time) VALUES(?)", timeString)
+	if err != nil {
+		return
+	}
+	idText, _, err := db.queryText(db.db.dialect.LastInsertIdQuery(), 1)
+	if err != nil {
+		return
+	}
+	txId, err = strconv.ParseInt(idText, 10, 64)
+	if err != nil {
+		return
+	}
+	tx.SetChangeLogId(db.db.schema, txId)
+	return
+}
+
+/*
+A change that is about to be made to the db, to be recorded in the change log once made.
+*/
+type pendingChange struct {
+	obj RObject
+	attrName string
+	op string
+	key string
+	oldVal string
+	hasOldVal bool // If false, oldVal is recorded as NULL
+	newVal string
+	clearedVals []string // For a "CLEAR", the values removed. Each is recorded as a "REMOVE" before the "CLEAR".
+	isOrdered bool
+}
+
+/*
+Prepares the record of a change to an attribute of the object. The current value of the attribute, or the affected
+element of a multi-valued attribute, is read from the db now, before the change is made, so that it can be recorded as 
+the old value. index is the index of the element added, removed or set in an ordered multi-valued attribute, 
+or -1 if not applicable.
+*/
+func (db *SqliteDBThread) newAttrChange(obj RObject, attr *AttributeSpec, op string, val RObject, index int) (change *pendingChange, err error) {
+	change = &pendingChange{obj: obj, attrName: attr.Part.Name, op: op, isOrdered: attrIsOrdered(attr)}
+	if index >= 0 {
+		change.key = strconv.Itoa(index)
+	}
+	switch op {
+	case "SET", "UNSET":
+		change.newVal = valText(val)
+		if attr.Part.CollectionType == "" {
+			change.oldVal, change.hasOldVal, err = db.attrValText(obj, attr)
+		} else if index >= 0 {
+			var vals []string
+			vals, err = db.attrValTexts(obj, attr)
+			if index < len(vals) {
+				change.oldVal = vals[index]
+				change.hasOldVal = true
+			}
+		}
+	case "ADD":
+		change.newVal = valText(val)
+	case "REMOVE":
+		change.oldVal = valText(val)
+		change.hasOldVal = true
+	case "CLEAR":
+		change.clearedVals, err = db.attrValTexts(obj, attr)
+	}
+	return
+}
+
+/*
+Prepares the record of a put to the map. If the key is already in the map, the value it maps to
+is read from the db now, before the change is made, and the change is a "PUT". Otherwise the change is an "ADD".
+A map which is the value of a multi-valued attribute is recorded as a change to that attribute of the owner object.
+*/
+func (db *SqliteDBThread) newMapPutChange(theMap Map, key RObject, val RObject, isNewKey bool) (change *pendingChange, err error) {
+	change = &pendingChange{obj: theMap, op: "PUT", key: valText(key), newVal: valText(val)}
+	if theMap.Owner() != nil && theMap.Attribute() != nil {
+		change.obj = theMap.Owner()
+		change.attrName = theMap.Attribute().Part.Name
+	}
+	if isNewKey {
+		change.op = "ADD"
+		return
+	}
+	table, _, _, keyType, elementType, err := db.EnsureCollectionTable(theMap)
+	if err != nil {
+		return
+	}
+	keyCol := "ord1"
+	var keyArg interface{}
+	switch keyType {
+	case StringType:
+		keyCol = "key1"
+		keyArg = SqlStringValueEscape(string(key.(String)))
+	case IntType, Int32Type, UintType, Uint32Type:
+		keyArg = valText(key)
+	default:
+		keyArg = key.DBID()
+	}
+	if elementType.IsPrimitive {
+		valCols, _ := elementType.DbCollectionColumnInsert()
+		query := fmt.Sprintf("SELECT %s FROM %s WHERE id=? AND %s=?", valCols, table, keyCol)
+		change.oldVal, change.hasOldVal, err = db.queryText(query, len(strings.Split(valCols, ",")), theMap.DBID(), keyArg)
+		if err == nil && elementType == StringType {
+			change.oldVal = SqlStringValueUnescape(change.oldVal)
+		}
+	} else {
+		query := fmt.Sprintf("SELECT id1 FROM %s WHERE id0=? AND %s=?", table, keyCol)
+		change.oldVal, change.hasOldVal, err = db.queryText(query, 1, theMap.DBID(), keyArg)
+	}
+	return
+}
+
+/*
+Appends the change to the change log, if the change was made without error (i.e. if *errp is nil).
+Intended to be deferred, so that *errp is the outcome of making the change. If recording the change
+fails, sets *errp.
+*/
+func (db *SqliteDBThread) logChange(change *pendingChange, errp *error) {
+	if *errp != nil {
+		return
+	}
+	timeString := time.Now().UTC().Format(TIME_LAYOUT)
+	txId, err := db.changeLogTxId(timeString)
+	if err != nil {
+		*errp = err
+		return
+	}
+	var actor interface{}
+	if db.dbt.th != nil && db.dbt.th.Actor() != "" {
+		actor = db.dbt.th.Actor()
+	}
+	insert := "INSERT INTO RChangeLog(txId,objId,attr,op,mapKey,oldVal,newVal,time,actor) VALUES(?,?,?,?,?,?,?,?,?)"
+
+	// A cleared collection is recorded as the removal of each of its elements, from the front, so that the
+	// elements and their order can be restored by undoing the removals.
+	removedKey := ""
+	if change.isOrdered {
+		removedKey = "0"
+	}
+	for _, val := range change.clearedVals {
+		err := db.ExecStatement(insert, txId, change.obj.DBID(), change.attrName, "REMOVE", removedKey, val, "", timeString, actor)
+		if err != nil {
+			*errp = err
+			return
+		}
+	}
+
+	var oldVal interface{}
+	if change.hasOldVal {
+		oldVal = change.oldVal
+	}
+	err = db.ExecStatement(insert, txId, change.obj.DBID(), change.attrName, change.op, change.key, oldVal, change.newVal, timeString, actor)
+	if err != nil {
+		*errp = err
+	}
+}
+
+/*
+Returns the text form of the value of the unary attribute of the object as currently stored in the db.
+found is false if the attribute has no value in the db.
+*/
+func (db *SqliteDBThread) attrValText(obj RObject, attr *AttributeSpec) (text string, found bool, err error) {
+	if attr.Part.Type.IsPrimitive && attr.Part.CollectionType == "" {
+		table := db.db.TableNameIfy(attr.WholeType.ShortName())
+		attrName := attr.Part.Name
+		cols := attrName
+		numCols := 1
+		if attr.Part.Type == TimeType {
+			cols = attrName + "," + attrName + "_loc"
+			numCols = 2
+		} else if attr.Part.Type == ComplexType || attr.Part.Type == Complex32Type {
+			cols = attrName + "_r," + attrName + "_i"
+			numCols = 2
+		}
+		text, found, err = db.queryText(fmt.Sprintf("SELECT %s FROM %s WHERE id=?", cols, table), numCols, obj.DBID())
+		if err == nil && attr.Part.Type == StringType {
+			text = SqlStringValueUnescape(text)
+		}
+	} else if ! attr.Part.Type.IsPrimitive && attr.Part.CollectionType == "" {
+		table := db.db.TableNameIfy(attr.ShortName())
+		text, found, err = db.queryText(fmt.Sprintf("SELECT id1 FROM %s WHERE id0=?", table), 1, obj.DBID())
+	}
+	return
+}
+
+/*
+Returns the text forms of the values of the attribute of the object as currently stored in the db, in order if 
+the attribute is ordered. Handles unary non-primitive attributes and multi-valued list and set attributes. 
+Returns nil for other kinds of attribute.
+*/
+func (db *SqliteDBThread) attrValTexts(obj RObject, attr *AttributeSpec) (texts []string, err error) {
+	if attr.IsIndependentCollection() || strings.HasSuffix(attr.Part.CollectionType, "map") {
+		return
+	}
+	if attr.Part.CollectionType == "" {
+		if attr.Part.Type.IsPrimitive {
+			return
+		}
+		text, found, err := db.attrValText(obj, attr)
+		if found {
+			texts = []string{text}
+		}
+		return texts, err
+	}
+
+	table := db.db.TableNameIfy(attr.ShortName())
+	orderClause := ""
+	if attrIsOrdered(attr) {
+		orderClause = " ORDER BY ord1"
+	}
+	if attr.Part.Type.IsPrimitive {
+		valCols, _ := attr.Part.Type.DbCollectionColumnInsert()
+		query := fmt.Sprintf("SELECT %s FROM %s WHERE id=?%s", valCols, table, orderClause)
+		texts, err = db.queryTexts(query, len(strings.Split(valCols, ",")), obj.DBID())
+		if err == nil && attr.Part.Type == StringType {
+			for i, text := range texts {
+				texts[i] = SqlStringValueUnescape(text)
+			}
+		}
+	} else {
+		query := fmt.Sprintf("SELECT id1 FROM %s WHERE id0=?%s", table, orderClause)
+		texts, err = db.queryTexts(query, 1, obj.DBID())
+	}
+	return
+}
+
+/*
+Returns true if the values of the multi-valued attribute are kept in order.
+*/
+func attrIsOrdered(attr *AttributeSpec) bool {
+	return attr.Part.CollectionType == "list" || attr.Part.CollectionType == "biglist" || strings.HasPrefix(attr.Part.CollectionType, "sorted")
+}
+
+/*
+Runs the single-row query, and returns the text of the first numCols columns of the row, separated by spaces.
+found is false if the query returned no rows, or if the columns were all NULL.
+*/
+func (db *SqliteDBThread) queryText(query string, numCols int, args ...interface{}) (text string, found bool, err error) {
+	selectStmt, err := db.Prepare(query)
+	if err != nil {
+		return
+	}
+
+	defer selectStmt.Reset()
+
+	err = selectStmt.Query(args...)
+	if err != nil {
+		if err == io.EOF {
+			err = nil
+		}
+		return
+	}
+	text, found, err = scanText(selectStmt, numCols)
+	return
+}
+
+/*
+Runs the query, and returns, for each row, the text of the first numCols columns of the row, separated by spaces.
+*/
+func (db *SqliteDBThread) queryTexts(query string, numCols int, args ...interface{}) (texts []string, err error) {
+	selectStmt, err := db.Prepare(query)
+	if err != nil {
+		return
+	}
+
+	defer selectStmt.Reset()
+
+	err = selectStmt.Query(args...)
+	for ; err == nil; err = selectStmt.Next() {
+		var text string
+		text, _, err = scanText(selectStmt, numCols)
+		if err != nil {
+			return
+		}
+		texts = append(texts, text)
+	}
+	if err == io.EOF {
+		err = nil
+	} else {
+		err = fmt.Errorf("DB ERROR on query:\n%s\nDetail: %s\n\n", query, err)
+	}
+	return
+}
+
+/*
+Returns the text of the first numCols columns of the current row of the query result, separated by spaces.
+nonNull is false if all of the columns are NULL.
+*/
+func scanText(selectStmt Statement, numCols int) (text string, nonNull bool, err error) {
+	colsBytes := make([][]byte, numCols)
+	dsts := make([]interface{}, numCols)
+	for i := range colsBytes {
+		dsts[i] = &colsBytes[i]
+	}
+	err = selectStmt.Scan(dsts...)
+	if err != nil {
+		return
+	}
+	var cols []string
+	for _, colBytes := range colsBytes {
+		if colBytes != nil {
+			cols = append(cols, string(colBytes))
+		}
+	}
+	text = strings.Join(cols, " ")
+	nonNull = len(cols) > 0
+	return
+}
+
+/*
+Returns the text form of the value to record in the change log. Primitive values are given as they are stored
+in the db (except that Strings are unescaped), and objects as their dbid.
+*/
+func valText(val RObject) string {
+	if val == nil || val == NIL {
+		return ""
+	}
+	if s, isString := val.(String); isString {
+		return string(s)
+	}
+	if val.IsCollection() || ! val.Type().IsPrimitive {
+		return strconv.FormatInt(val.DBID(), 10)
+	}
+	var parts []string
+	for _, part := range (*SqliteDB)(nil).primitiveValSQL(val) {
+		parts = append(parts, fmt.Sprint(part))
+	}
+	return strings.Join(parts, " ")
+}
+
+/*
+Returns the changes to the attributes of the persistent object that were recorded in the change log, oldest first.
+*/
+func (db *SqliteDBThread) ChangeHistory(obj RObject) (changes []*ChangeLogEntry, err error) {
+	defer Un(Trace(PERSIST_TR, "ChangeHistory", obj))
+	query := "SELECT txId,objId,attr,op,mapKey,oldVal,newVal,time,actor FROM RChangeLog WHERE objId=? ORDER BY id"
+	selectStmt, err := db.Prepare(query)
+	if err != nil {
+		return
+	}
+
+	defer selectStmt.Reset() // Ensure statement is not left open
+
+	err = selectStmt.Query(obj.DBID())
+	if err != nil && err != io.EOF {
+		return
+	}
+
+	for ; err == nil; err = selectStmt.Next() {
+		change := &ChangeLogEntry{}
+		var key, oldVal, actor []byte
+		var timeString string
+		err = selectStmt.Scan(&change.TxId, &change.ObjId, &change.AttrName, &change.Op, &key, &oldVal, &change.NewVal, &timeString, &actor)
+		if err != nil {
+			return
+		}
+		change.Key = string(key)
+		change.Actor = string(actor)
+		change.OldVal = string(oldVal)
+		change.HasOldVal = oldVal != nil
+		change.Time, err = time.Parse(TIME_LAYOUT, timeString)
+		if err != nil {
+			return
+		}
+		changes = append(changes, change)
+	}
+	if err == io.EOF {
+		err = nil
+	} else {
+		err = fmt.Errorf("DB ERROR on query:\n%s\nDetail: %s\n\n", query, err)
+	}
+	return
+}
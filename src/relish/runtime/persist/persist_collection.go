@@ -25,6 +25,7 @@ import (
 	. "relish/dbg"
 	. "relish/runtime/data"
    "io"
+	"relish/params"
 )
 
 // 
@@ -39,6 +40,30 @@ import (
 */
 func (db *SqliteDBThread) PersistAddToAttr(th InterpreterThread, obj RObject, attr *AttributeSpec, val RObject, insertIndex int) (err error) {
 
+	err = db.checkVersion(obj)
+	if err != nil {
+		return
+	}
+
+	if params.DbAuditLog {
+		var change *pendingChange
+		change, err = db.newAttrChange(obj, attr, "ADD", val, insertIndex)
+		if err != nil {
+			return
+		}
+		defer db.logChange(change, &err)
+	}
+
+	if attr.Part.CollectionType == "biglist" {
+		var collection RCollection
+		collection, err = RT.EnsureMultiValuedAttributeCollection(obj, attr)
+		if err != nil {
+			return
+		}
+		err = db.persistBigListInsert(th, collection.(BigList), val, insertIndex)
+		return
+	}
+
 	table := db.db.TableNameIfy(attr.ShortName())
 
 	if attr.Part.Type.IsPrimitive {
@@ -62,6 +87,10 @@ func (db *SqliteDBThread) PersistAddToAttr(th InterpreterThread, obj RObject, at
 
       case "list": // id, val, ord1
       
+			err = db.shiftForListInsert(obj, attr, table, "id", insertIndex)
+			if err != nil {
+				return
+			}
 
 			stmt := Stmt(fmt.Sprintf("INSERT INTO %s(id,%s,ord1) VALUES(%v,%s,%v)", table, valCols, obj.DBID(), valVars, insertIndex))
 				
@@ -106,6 +135,10 @@ func (db *SqliteDBThread) PersistAddToAttr(th InterpreterThread, obj RObject, at
           
 
 		case "list": // id0, id1, ord1
+			err = db.shiftForListInsert(obj, attr, table, "id0", insertIndex)
+			if err != nil {
+				return
+			}
 			err = db.ExecStatement(fmt.Sprintf("INSERT INTO %s(id0,id1,ord1) VALUES(?,?,?)", table), obj.DBID(), val.DBID(), insertIndex)	
 			//	     case "map": // id0, id1, ord1
 
@@ -126,6 +159,21 @@ func (db *SqliteDBThread) PersistAddToAttr(th InterpreterThread, obj RObject, at
 	return
 }
 
+/*
+   If the value was inserted into the list-valued attribute before the end of the list, moves the
+   values at and after the insertion index up one place in the table.
+*/
+func (db *SqliteDBThread) shiftForListInsert(obj RObject, attr *AttributeSpec, table string, ownerCol string, insertIndex int) (err error) {
+	collection, err := RT.EnsureMultiValuedAttributeCollection(obj, attr)
+	if err != nil {
+		return
+	}
+	if int64(insertIndex) < collection.Length()-1 {
+		err = db.ExecStatement(fmt.Sprintf("UPDATE %s SET ord1 = ord1 + 1 WHERE %s=? AND ord1 >= ?", table, ownerCol), obj.DBID(), insertIndex)
+	}
+	return
+}
+
 /*
    Persist the removing of a value from a multi-valued attribute.
    Assumes that the the removal has happened from the in-memory collection.
@@ -134,6 +182,30 @@ func (db *SqliteDBThread) PersistAddToAttr(th InterpreterThread, obj RObject, at
 */
 func (db *SqliteDBThread) PersistRemoveFromAttr(obj RObject, attr *AttributeSpec, val RObject, removedIndex int) (err error) {     
 
+	err = db.checkVersion(obj)
+	if err != nil {
+		return
+	}
+
+	if params.DbAuditLog {
+		var change *pendingChange
+		change, err = db.newAttrChange(obj, attr, "REMOVE", val, removedIndex)
+		if err != nil {
+			return
+		}
+		defer db.logChange(change, &err)
+	}
+
+	if attr.Part.CollectionType == "biglist" && removedIndex >= 0 {
+		var collection RCollection
+		collection, err = RT.EnsureMultiValuedAttributeCollection(obj, attr)
+		if err != nil {
+			return
+		}
+		err = db.persistBigListRemove(collection.(BigList), removedIndex)
+		return
+	}
+
 	table := db.db.TableNameIfy(attr.ShortName())
 
 	if attr.Part.Type.IsPrimitive {
@@ -188,6 +260,20 @@ func (db *SqliteDBThread) PersistRemoveFromAttr(obj RObject, attr *AttributeSpec
 */
 func (db *SqliteDBThread) PersistClearAttr(obj RObject, attr *AttributeSpec) (err error) {
 
+	err = db.checkVersion(obj)
+	if err != nil {
+		return
+	}
+
+	if params.DbAuditLog {
+		var change *pendingChange
+		change, err = db.newAttrChange(obj, attr, "CLEAR", nil, -1)
+		if err != nil {
+			return
+		}
+		defer db.logChange(change, &err)
+	}
+
 	table := db.db.TableNameIfy(attr.ShortName())
 
 	if attr.Part.Type.IsPrimitive {
@@ -218,6 +304,20 @@ func (db *SqliteDBThread) PersistClearAttr(obj RObject, attr *AttributeSpec) (er
 
 func (db *SqliteDBThread) PersistSetAttrElement(th InterpreterThread, obj RObject, attr *AttributeSpec, val RObject, index int) (err error) {
 
+	err = db.checkVersion(obj)
+	if err != nil {
+		return
+	}
+
+	if params.DbAuditLog {
+		var change *pendingChange
+		change, err = db.newAttrChange(obj, attr, "SET", val, index)
+		if err != nil {
+			return
+		}
+		defer db.logChange(change, &err)
+	}
+
 	table := db.db.TableNameIfy(attr.ShortName())
 	
    if attr.Part.Type.IsPrimitive {
@@ -255,6 +355,11 @@ func (db *SqliteDBThread) PersistSetAttrElement(th InterpreterThread, obj RObjec
       
 func (db *SqliteDBThread) PersistSetCollectionElement(th InterpreterThread, coll IndexSettable, val RObject, index int) (err error) {
 
+   err = db.checkVersion(coll.(RObject))
+   if err != nil {
+      return
+   }
+
    table,_,_,_,elementType,err := db.EnsureCollectionTable(coll.(RCollection))
    if err != nil {
       return
@@ -299,6 +404,20 @@ Does it remove by key? It should.
 */
 func (db *SqliteDBThread) PersistMapPut(th InterpreterThread, theMap Map, key RObject,val RObject, isNewKey bool) (err error) {
 
+   err = db.checkVersion(theMap)
+   if err != nil {
+      return
+   }
+
+   if params.DbAuditLog {
+   	var change *pendingChange
+   	change, err = db.newMapPutChange(theMap, key, val, isNewKey)
+   	if err != nil {
+   		return
+   	}
+   	defer db.logChange(change, &err)
+   }
+
    table,_,_,keyType,elementType,err := db.EnsureCollectionTable(theMap)
    if err != nil {
       return
@@ -472,6 +591,16 @@ func (db *SqliteDBThread) PersistMapPut(th InterpreterThread, theMap Map, key RO
   
 func (db *SqliteDBThread) PersistAddToCollection(th InterpreterThread, coll AddableCollection, val RObject, insertIndex int) (err error) {
 
+   err = db.checkVersion(coll)
+   if err != nil {
+      return
+   }
+
+   if list, isBig := coll.(BigList); isBig {
+      err = db.persistBigListInsert(th, list, val, insertIndex)
+      return
+   }
+
    table,_,isOrdered,_,elementType,err := db.EnsureCollectionTable(coll)
    if err != nil {
       return
@@ -491,6 +620,12 @@ func (db *SqliteDBThread) PersistAddToCollection(th InterpreterThread, coll Adda
          
       } else if coll.IsList() && ! coll.IsSorting() { // id, val, ord1
       
+			if int64(insertIndex) < coll.Length()-1 {
+				err = db.ExecStatement(fmt.Sprintf("UPDATE %s SET ord1 = ord1 + 1 WHERE id=? AND ord1 >= ?",table), coll.DBID(), insertIndex)
+				if err != nil {
+					return
+				}
+			}
 			stmt := Stmt(fmt.Sprintf("INSERT INTO %s(id,%s,ord1) VALUES(?,%s,%v)", table, valCols, valVars))
          stmt.Arg(coll.DBID())				
 			valParts := db.db.primitiveValSQL(val) 
@@ -524,6 +659,12 @@ func (db *SqliteDBThread) PersistAddToCollection(th InterpreterThread, coll Adda
           
       } else if coll.IsList() && ! coll.IsSorting() { // id0, id1, ord1
 
+			if int64(insertIndex) < coll.Length()-1 {
+				err = db.ExecStatement(fmt.Sprintf("UPDATE %s SET ord1 = ord1 + 1 WHERE id0=? AND ord1 >= ?",table), coll.DBID(), insertIndex)
+				if err != nil {
+					return
+				}
+			}
 			err = db.ExecStatement(fmt.Sprintf("INSERT INTO %s(id0,id1,ord1) VALUES(?,?,?)", table), coll.DBID(), val.DBID(), insertIndex)
 			//	     case "map": // id0, id1, ord1
 
@@ -547,6 +688,16 @@ func (db *SqliteDBThread) PersistAddToCollection(th InterpreterThread, coll Adda
 //
 func (db *SqliteDBThread) PersistRemoveFromCollection(coll RemovableCollection, val RObject, removedIndex int) (err error) {
 
+   err = db.checkVersion(coll)
+   if err != nil {
+      return
+   }
+
+   if list, isBig := coll.(BigList); isBig && removedIndex >= 0 {
+      err = db.persistBigListRemove(list, removedIndex)
+      return
+   }
+
    table,isMap,_,keyType,elementType,err := db.EnsureCollectionTable(coll)
    if err != nil {
       return
@@ -643,6 +794,11 @@ func (db *SqliteDBThread) PersistRemoveFromCollection(coll RemovableCollection,
 
 
 func (db *SqliteDBThread) PersistClearCollection(coll RemovableCollection) (err error) {
+
+   err = db.checkVersion(coll)
+   if err != nil {
+      return
+   }
 	
    table,_,_,_,elementType,err := db.EnsureCollectionTable(coll)
    if err != nil {
@@ -928,6 +1084,11 @@ func (db *SqliteDBThread) fetchPrimitiveAttributeValueCollection(objId int64, ob
 func (db *SqliteDBThread) fetchCollection(collection RCollection, collectionOrOwnerId int64, collectionTableName string, radius int) (err error) {
 	defer Un(Trace(PERSIST_TR2, "fetchCollection", collectionOrOwnerId, collectionTableName))
 
+	if list, isBig := collection.(BigList); isBig {
+		err = db.fetchBigList(list, collectionOrOwnerId, collectionTableName)
+		return
+	}
+
 	remColl := collection.(RemovableMixin)
 	remColl.ClearInMemory()
 
@@ -1100,6 +1261,11 @@ func (db *SqliteDBThread) fetchCollection(collection RCollection, collectionOrOw
 func (db *SqliteDBThread) fetchPrimitiveValueCollection(collection RCollection, collectionOrOwnerId int64, collectionTableName string) (err error) {
 	defer Un(Trace(PERSIST_TR2, "fetchPrimitiveValueCollection", collectionOrOwnerId, collectionTableName))
 
+	if list, isBig := collection.(BigList); isBig {
+		err = db.fetchBigList(list, collectionOrOwnerId, collectionTableName)
+		return
+	}
+
 	remColl := collection.(RemovableMixin)
 	remColl.ClearInMemory()
 
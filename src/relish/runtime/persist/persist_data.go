@@ -26,6 +26,7 @@ import (
 	"fmt"
 	. "relish/dbg"
 	. "relish/runtime/data"
+	"relish/params"
 	"relish/rterr"
 	"strconv"
 	"strings"
@@ -36,6 +37,60 @@ import (
 
 const TIME_LAYOUT = "2006-01-02 15:04:05.000"
 
+/*
+   In optimistic concurrency mode, checks that the version of the object's state in the db is still the version
+   the in-memory object was loaded from, and increments the db version, before the object's first write in 
+   the thread's transaction. A stale object is recorded in the transaction, which will then fail to commit.
+   If the thread is not in a transaction, a stale object is flagged to be re-loaded, and a TX_CONFLICT 
+   *TransactionError is returned, so that the write is not made.
+*/
+func (db *SqliteDBThread) checkVersion(obj RObject) (err error) {
+	if ! params.DbOptimisticConcurrency {
+		return
+	}
+	pers := obj.(Persistable)
+	var tx *RTransaction
+	if db.dbt.th != nil {
+		tx = db.dbt.th.Transaction()
+	}
+	if tx != nil && ! tx.NeedsVersionCheck(pers) {
+		return
+	}
+	version := pers.Version()
+	err = db.ExecStatement("UPDATE RObject SET version=version+1 WHERE id=? AND version=?", obj.DBID(), int64(version))
+	if err != nil {
+		return
+	}
+	isStale := db.dbt.conn.RowsAffected() == 0
+	if tx != nil {
+		tx.RecordVersionCheck(pers, isStale)
+	} else if isStale {
+		obj.SetLoadNeeded()
+		err = &TransactionError{Kind: TX_CONFLICT, Op: "UPDATE", Tries: 1, Err: fmt.Errorf("%v (version %d) was changed by another connection", obj, version)}
+	} else {
+		pers.SetVersion(version + 1)
+	}
+	return
+}
+
+/*
+   In optimistic concurrency mode, checks and increments the version of an object which is about to be deleted.
+   If the object is stale, returns a TX_CONFLICT *TransactionError, so that it is not deleted, since the removal of
+   the object from memory would not be undone when its transaction failed to commit. The object is flagged to be re-loaded.
+*/
+func checkVersionBeforeDelete(dbt *DBThread, obj RObject, checkVersion func() error) (err error) {
+	err = checkVersion()
+	if err != nil || dbt.th == nil {
+		return
+	}
+	tx := dbt.th.Transaction()
+	if tx != nil && tx.IsStale(obj.(Persistable)) {
+		obj.SetLoadNeeded()
+		err = &TransactionError{Kind: TX_CONFLICT, Op: "DELETE", Tries: 1, Err: fmt.Errorf("%v (version %d) was changed by another connection", obj, obj.(Persistable).Version())}
+	}
+	return
+}
+
 /*
    Persist the setting of an attribute to a value.
    Only applies to single-valued attributes.
@@ -43,6 +98,20 @@ const TIME_LAYOUT = "2006-01-02 15:04:05.000"
 */
 func (db *SqliteDBThread) PersistSetAttr(th InterpreterThread, obj RObject, attr *AttributeSpec, val RObject, attrHadValue bool) (err error) {
 
+	err = db.checkVersion(obj)
+	if err != nil {
+		return
+	}
+
+	if params.DbAuditLog {
+		var change *pendingChange
+		change, err = db.newAttrChange(obj, attr, "SET", val, -1)
+		if err != nil {
+			return
+		}
+		defer db.logChange(change, &err)
+	}
+
 	if attr.Part.Type.IsPrimitive {
 
 		table := db.db.TableNameIfy(attr.WholeType.ShortName())
@@ -56,6 +125,7 @@ func (db *SqliteDBThread) PersistSetAttr(th InterpreterThread, obj RObject, attr
 			err = db.ExecStatement(fmt.Sprintf("UPDATE %s SET %s=?, %s=? WHERE id=?", table, attrName, attrLocName), timeString, locationName, obj.DBID())			
 			if err != nil {
 				obj.SetLoadNeeded()
+				err = db.uniqueIndexError(err, obj)
 			}    
 		} else if val.Type() == MutexType || val.Type() == RWMutexType || val.Type() == OwnedMutexType {
 			// skip persisting
@@ -71,6 +141,7 @@ func (db *SqliteDBThread) PersistSetAttr(th InterpreterThread, obj RObject, attr
   	        err = db.ExecStatements(stmt)	
 			if err != nil {
 				obj.SetLoadNeeded()
+				err = db.uniqueIndexError(err, obj)
 			}      	        		
 		}
 	} else { // non-primitive value type
@@ -152,6 +223,20 @@ func (db *SqliteDB) primitiveAttrValSQL(val RObject) (s string, args []interface
 */
 func (db *SqliteDBThread) PersistRemoveAttr(obj RObject, attr *AttributeSpec) (err error) {
 
+	err = db.checkVersion(obj)
+	if err != nil {
+		return
+	}
+
+	if params.DbAuditLog {
+		var change *pendingChange
+		change, err = db.newAttrChange(obj, attr, "UNSET", nil, -1)
+		if err != nil {
+			return
+		}
+		defer db.logChange(change, &err)
+	}
+
 	var stmt string
 
 	if attr.Part.Type.IsPrimitive {
@@ -195,10 +280,7 @@ func (db *SqliteDBThread) EnsurePersisted(th InterpreterThread, obj RObject) (er
     pers := obj.(Persistable)
     tx := pers.Transaction()
 	if tx != nil && tx != th.Transaction() {
-		th.AllowGC()
-		tx.RLock()
-		th.DisallowGC()
-		tx.RUnlock()
+		err = tx.Await(th, obj)
 		return
 	}
 
@@ -207,8 +289,13 @@ func (db *SqliteDBThread) EnsurePersisted(th InterpreterThread, obj RObject) (er
 	}
 	
 	obj.SetBeingStored() 
+	db.dbt.recordStoredDB(obj)
     if th.Transaction() != nil {
-   		obj.(Persistable).SetTransaction(th.Transaction())
+   		err = pers.SetTransaction(th.Transaction())  // Fails if the transaction has timed out.
+   		if err != nil {
+   			obj.ClearBeingStored()
+   			return
+   		}
    	}	
 
 	if obj.HasUUID() {
@@ -318,6 +405,9 @@ func (db *SqliteDBThread) PersistAttributesAndRelations(th InterpreterThread, ob
 						}
 						i++
 					}
+					if list, isBig := collection.(BigList); isBig {
+						list.SetStored(int64(i))
+					}
 				}
 			} else { // a single non-primitive value or independent collection of non-primitive element type.
 
@@ -428,6 +518,9 @@ func (db *SqliteDBThread) PersistAttributesAndRelations(th InterpreterThread, ob
 						}
 						i++
 					}
+					if list, isBig := collection.(BigList); isBig {
+						list.SetStored(int64(i))
+					}
 				}			
 			
 			} else { // attr.IsIndependentCollection()  // independent collection of primitive element type
@@ -507,6 +600,9 @@ func (db *SqliteDBThread) PersistAttributesAndRelations(th InterpreterThread, ob
 							}
 							i++
 						}
+						if list, isBig := collection.(BigList); isBig {
+							list.SetStored(int64(i))
+						}
 					}
 				} else { // a single non-primitive value or independent collection of non-primitive element type.
 
@@ -607,6 +703,9 @@ func (db *SqliteDBThread) PersistAttributesAndRelations(th InterpreterThread, ob
 		   					}
 		   					i++
 		   				}
+		   				if list, isBig := collection.(BigList); isBig {
+		   					list.SetStored(int64(i))
+		   				}
 		   			}							
 				} else {  // attr.IsIndependentCollection()  // independent collection of primitive element type
 
@@ -741,6 +840,9 @@ func (db *SqliteDBThread) persistCollection(th InterpreterThread, collection RCo
 			    }
 				i++
 			}
+			if list, isBig := collection.(BigList); isBig {
+				list.SetStored(int64(i))
+			}
 		}
 
    } else { // a collection of primitive-type objects
@@ -850,6 +952,9 @@ func (db *SqliteDBThread) persistCollection(th InterpreterThread, collection RCo
    			}
    			i++
    		}
+   		if list, isBig := collection.(BigList); isBig {
+   			list.SetStored(int64(i))
+   		}
    	}				
    }
    return
@@ -931,6 +1036,9 @@ func (db *SqliteDBThread) persistNewObject(th InterpreterThread, obj RObject) (e
 			err = db.insert(th, obj, dbid, int64(id2))
             if err != nil {
             	return
+            }
+            if params.DbAuditLog {
+            	db.logChange(&pendingChange{obj: obj, op: "CREATE"}, &err)
             }
 			// obj.SetStoredLocally() // We don't actually know if this is correct yet. The db statements may have failed. TODO!!! FIX
 
@@ -1117,6 +1225,11 @@ func (db *SqliteDBThread)  Delete(obj RObject) (err error) {
     	return
     }
 
+    err = checkVersionBeforeDelete(db.dbt, obj, func() error { return db.checkVersion(obj) })
+    if err != nil {
+    	return
+    }
+
     id := obj.DBID()
 
 	stmts := Stmt("DELETE FROM RObject WHERE id=?;")
@@ -1170,7 +1283,7 @@ func (db *SqliteDBThread) Fetch(id int64, radius int) (obj RObject, err error) {
 		// fmt.Printf("Fetch: found object %s in cache.\n",obj.Debug())
 		return
 	}
-	stmt := "SELECT * FROM RObject where id=?"
+	stmt := "SELECT id,id2,flags,typeName,version FROM RObject where id=?"
 	obj, err = db.fetch1(stmt, id, radius, fmt.Sprintf("id=%v", id), false)
 	return 
 }
@@ -1189,7 +1302,7 @@ func (db *SqliteDBThread) Refresh(obj RObject , radius int) (err error) {
 
 	id := obj.DBID()
 	errSuffix := fmt.Sprintf("id=%v", id)
-    query := "SELECT * FROM RObject where id=?"
+    query := "SELECT id,id2,flags,typeName,version FROM RObject where id=?"
 
 	selectStmt, err := db.Prepare(query)
 	if err != nil {
@@ -1211,8 +1324,9 @@ func (db *SqliteDBThread) Refresh(obj RObject , radius int) (err error) {
 	var id2 int64
 	var flags int
 	var typeName string
+	var version int64
 
-	err = selectStmt.Scan(&id, &id2, &flags, &typeName)
+	err = selectStmt.Scan(&id, &id2, &flags, &typeName, &version)
 	if err != nil {
 		return
 	}
@@ -1231,6 +1345,8 @@ func (db *SqliteDBThread) Refresh(obj RObject , radius int) (err error) {
 
 	ob := obj.(Persistable)
 	ob.RestoreIdsAndFlags(id, id2, flags)
+	db.dbt.recordStoredDB(obj)
+	ob.SetVersion(uint32(version))
 
 	Logln(PERSIST2_, "id:", id, ", id2:", id2, ", flags:", flags, ", typeName:", typeName)
 
@@ -1317,7 +1433,7 @@ func (db *SqliteDBThread) Refresh(obj RObject , radius int) (err error) {
 func (db *SqliteDBThread) FetchByName(name string, radius int) (obj RObject, err error) {
 	defer Un(Trace(PERSIST_TR, "FetchByName", name, radius))
 	name = SqlStringValueEscape(name)	
-	stmt := "SELECT * FROM RObject WHERE id IN (SELECT id FROM RName WHERE name=?)"
+	stmt := "SELECT id,id2,flags,typeName,version FROM RObject WHERE id IN (SELECT id FROM RName WHERE name=?)"
 	//fmt.Printf("FetchByName:  %s\n",name)	
 	return db.fetch1(stmt, name, radius, fmt.Sprintf("name='%s'", name), true)
 	
@@ -1380,8 +1496,9 @@ func (db *SqliteDBThread) fetch1(query string, arg interface{}, radius int, errS
 	var id2 int64
 	var flags int
 	var typeName string
+	var version int64
 
-	err = selectStmt.Scan(&id, &id2, &flags, &typeName)
+	err = selectStmt.Scan(&id, &id2, &flags, &typeName, &version)
 	if err != nil {
 		return
 	}
@@ -1398,55 +1515,10 @@ func (db *SqliteDBThread) fetch1(query string, arg interface{}, radius int, errS
 		}
 	}
 
-   var isCollection bool 
-      
-   if typeName[0] == '[' {
-      isCollection = true
-    	obj, err = RT.NewCollectionFromDB(typeName)
-    	if err != nil {
-    		return
-    	}  
-    	
-    	// TODO Now load the collection using the typeName as the collection table name    
-      
-   } else {
-   
-      // If I am fetching a data object for which I have not loaded into runtime
-      // the package in which its datatype is defined, I load that package now.
-      // Note that the package must have been loaded previously in SOME run of the program
-      // that used the same local database, so that the package's short name has been recorded 
-      // in the artifact local database.
-    
-      typ := RT.Typs[typeName]
-      if typ == nil {
-   
-         fmt.Println("typeName",typeName)
-         pkgShortName := PackageShortName(typeName)
-         fmt.Println("pkgShortName",pkgShortName)         
-   //      localTypeName := LocalTypeName(typeName)   
-         pkgFullName := RT.PkgShortNameToName[pkgShortName]
-         fmt.Println("pkgFullName",pkgFullName)         
-         originAndArtifact := OriginAndArtifact(pkgFullName) 
-         packagePath := LocalPackagePath(pkgFullName)      
-      
-         // TODO Dubious values of version and mustBeFromShared here!!!
-         err = RT.Loader.LoadRelishCodePackage(originAndArtifact,"",packagePath,false)
-     
-         if err != nil {
-            return
-         }
-         
-         typ = RT.Typs[typeName]    
-          
-         // Alternate strategy!!    
-   	   // rterr.Stop("Can't summon object. The package which defines its type, '%s', has not been loaded into the runtime.",localTypeName) 
-       }
-       fullTypeName := typ.Name
-
-   	obj, err = RT.NewObject(fullTypeName)
-   	if err != nil {
-   		return
-   	}
+   isCollection := typeName[0] == '['
+   obj, err = newStoredObject(typeName)
+   if err != nil {
+      return
    }
 
 	// Now we have to store the unit64(id),uint64(id2),byte(flags) into the object.
@@ -1456,6 +1528,8 @@ func (db *SqliteDBThread) fetch1(query string, arg interface{}, radius int, errS
 
 	ob := obj.(Persistable)
 	ob.RestoreIdsAndFlags(id, id2, flags)
+	db.dbt.recordStoredDB(obj)
+	ob.SetVersion(uint32(version))
 
 	Logln(PERSIST2_, "id:", id, ", id2:", id2, ", flags:", flags, ", typeName:", typeName)
 
@@ -1529,9 +1603,84 @@ func (db *SqliteDBThread) fetch1(query string, arg interface{}, radius int, errS
 	return
 }
 
+/*
+   Creates the in-memory object, of the type with the type name stored in the database, into which a stored
+   object is to be restored. A collection's type name is its collection type descriptor.
+*/
+func newStoredObject(typeName string) (obj RObject, err error) {
+   if typeName[0] == '[' {
+    	obj, err = RT.NewCollectionFromDB(typeName)
+    	if err != nil {
+    		return
+    	}  
+    	
+    	// TODO Now load the collection using the typeName as the collection table name    
+      
+   } else {
+   
+      // If I am fetching a data object for which I have not loaded into runtime
+      // the package in which its datatype is defined, I load that package now.
+      // Note that the package must have been loaded previously in SOME run of the program
+      // that used the same local database, so that the package's short name has been recorded 
+      // in the artifact local database.
+    
+      typ := RT.Typs[typeName]
+      if typ == nil {
+   
+         fmt.Println("typeName",typeName)
+         pkgShortName := PackageShortName(typeName)
+         fmt.Println("pkgShortName",pkgShortName)         
+   //      localTypeName := LocalTypeName(typeName)   
+         pkgFullName := RT.PkgShortNameToName[pkgShortName]
+         fmt.Println("pkgFullName",pkgFullName)         
+         originAndArtifact := OriginAndArtifact(pkgFullName) 
+         packagePath := LocalPackagePath(pkgFullName)      
+      
+         // TODO Dubious values of version and mustBeFromShared here!!!
+         err = RT.Loader.LoadRelishCodePackage(originAndArtifact,"",packagePath,false)
+     
+         if err != nil {
+            return
+         }
+         
+         typ = RT.Typs[typeName]    
+          
+         // Alternate strategy!!    
+   	   // rterr.Stop("Can't summon object. The package which defines its type, '%s', has not been loaded into the runtime.",localTypeName) 
+       }
+       fullTypeName := typ.Name
+
+   	obj, err = RT.NewObject(fullTypeName)
+   	if err != nil {
+   		return
+   	}
+   }
+   return
+}
+
 
 
 
+/*
+Converts relish values to be substituted into the ? parameters of a query to the form of the values in the db.
+*/
+func queryArgValues(queryArgObjs []RObject) (queryArgs []interface{}) {
+	if len(queryArgObjs) > 0 {
+		queryArgs = make([]interface{},len(queryArgObjs))
+		for i,arg := range queryArgObjs {
+			var convertedArg interface{}
+			switch arg.(type) {
+			case Bool:
+               convertedArg = bool(arg.(Bool))  
+			default:
+			   convertedArg = fmt.Sprint(arg)
+			}
+			queryArgs[i] = convertedArg
+		}
+	}
+	return
+}
+
 /*
    TODO Retrieve a list of objects stored in the database.
 
@@ -1550,22 +1699,7 @@ func (db *SqliteDBThread) fetchMultiple(query string, queryArgObjs []RObject, id
 
 	defer selectStmt.Reset()
 	
-	var queryArgs []interface{}
-	if len(queryArgObjs) > 0 {
-		queryArgs = make([]interface{},len(queryArgObjs))
-		for i,arg := range queryArgObjs {
-			var convertedArg interface{}
-			switch arg.(type) {
-			case Bool:
-               convertedArg = bool(arg.(Bool))  
-			default:
-			   convertedArg = fmt.Sprint(arg)
-			}
-			queryArgs[i] = convertedArg
-		}
-	}
-
-	err = selectStmt.Query(queryArgs...)  // Exec(args...)
+	err = selectStmt.Query(queryArgValues(queryArgObjs)...)  // Exec(args...)
 	if err != nil && err != io.EOF {
 		return
 	}
@@ -1596,18 +1730,20 @@ func (db *SqliteDBThread) fetchMultiple(query string, queryArgObjs []RObject, id
 			var id2 int64
 			var flags int
 			var typeName string
+			var version int64
 
 			attrValsBytes1 := make([][]byte, numPrimitiveAttrs)
 
-			attrValsBytes := make([]interface{}, numPrimitiveAttrs + 4)
+			attrValsBytes := make([]interface{}, numPrimitiveAttrs + 5)
 
 	        attrValsBytes[0] = &id
 	        attrValsBytes[1] = &id2
 	        attrValsBytes[2] = &flags
 	        attrValsBytes[3] = &typeName
+	        attrValsBytes[4] = &version
 
 	 		for i := 0; i < len(attrValsBytes1); i++ {
-				attrValsBytes[i+4] = &attrValsBytes1[i]
+				attrValsBytes[i+5] = &attrValsBytes1[i]
 			}
 
 
@@ -1663,6 +1799,8 @@ func (db *SqliteDBThread) fetchMultiple(query string, queryArgObjs []RObject, id
 
 			ob := obj.(Persistable)
 			ob.RestoreIdsAndFlags(id, id2, flags)
+			db.dbt.recordStoredDB(obj)
+			ob.SetVersion(uint32(version))
 
 			Logln(PERSIST2_, "id:", id, ", id2:", id2, ", flags:", flags, ", typeName:", typeName)
 
@@ -1678,7 +1816,7 @@ func (db *SqliteDBThread) fetchMultiple(query string, queryArgObjs []RObject, id
 				// and a single row in each such table identified by the object's dbid.
 			
 			    objTyp := obj.Type()
-			    attrValsBytes = attrValsBytes[4:]
+			    attrValsBytes = attrValsBytes[5:]
 		        db.db.restoreAttrs(obj, objTyp, attrValsBytes)		
             }
 
@@ -2350,6 +2488,9 @@ func (db *SqliteDBThread) insert(th InterpreterThread, obj RObject, dbid, dbid2
    }
 
    err = db.ExecStatements(stmt)
+   if err != nil {
+      err = db.uniqueIndexError(err, obj)
+   }
    return
 }
 
@@ -0,0 +1,846 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+// this package implements data persistence in the relish language environment.
+
+package persist
+
+/*
+   persist_dump.go - export of a whole database as a portable JSON or NDJSON dump, and import of a dump
+   into a database, with the objects given new ids.
+
+   A dump is a sequence of JSON records. An NDJSON dump has one record per line. A JSON dump (a file named *.json)
+   is an array of the records. The first record identifies the dump:
+
+      {"format":"relish-dump","version":1}
+
+   It is followed by a record for each object, streamed type by type,
+
+      {"id":"8347","type":"someorigin.com2013/vehicles/pkg/Car","attrs":{"make":"Ford","owner":{"ref":"9120"}}}
+
+   a record for each independent collection which is named or is referred to,
+
+      {"id":"9311","collection":"sortedlist","elementType":"someorigin.com2013/vehicles/pkg/Car","elements":[...]}
+
+   and a record for each object name.
+
+      {"id":"8347","name":"Fred's car"}
+
+   Ids are the object ids of the exporting database, and only identify objects within the dump.
+   Types are given by their full names, not by the package short names of the exporting database, so a dump
+   can be imported into any kind of relish database (sqlite, kv or PostgreSQL).
+
+   Values are JSON strings, numbers and booleans, as the attribute's declared type requires. A Time is
+   {"time":"2014-03-21T10:15:00Z","location":"America/Toronto"}, a Complex is [real,imag], and a primitive value
+   of another type than the declared one is {"type":"Int","value":3}. An object or independent collection is
+   {"ref":"<id>"}. The value of a multi-valued attribute, and the elements of a collection, are an array,
+   of [key,value] pairs for a map. Both attributes of a relation are recorded, and each is imported as recorded.
+
+   Only the objects of the types of the packages which the running program has loaded are exported.
+   On import, a recorded attribute which the object's type no longer has is ignored, so a dump can move
+   data to a new version of a program's types.
+*/
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	. "relish/runtime/data"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DUMP_FORMAT     = "relish-dump"
+	DUMP_VERSION    = 1
+	DUMP_BATCH_SIZE = 500 // how many objects are read from the database at a time while exporting
+)
+
+/*
+A record of a dump. Which fields are present depends on the kind of record.
+*/
+type dumpRecord struct {
+	Format      string                 `json:"format,omitempty"`
+	Version     int                    `json:"version,omitempty"`
+	Id          string                 `json:"id,omitempty"`
+	Type        string                 `json:"type,omitempty"`
+	Attrs       map[string]interface{} `json:"attrs,omitempty"`
+	Collection  string                 `json:"collection,omitempty"` // the kind of collection, e.g. "sortedset"
+	KeyType     string                 `json:"keyType,omitempty"`
+	ElementType string                 `json:"elementType,omitempty"`
+	Elements    []interface{}          `json:"elements,omitempty"`
+	Name        string                 `json:"name,omitempty"`
+}
+
+/*
+The kinds of independent collection which can be recreated from a dump.
+*/
+var dumpCollectionKinds = map[string]bool{
+	"list": true, "sortedlist": true, "biglist": true, "set": true, "sortedset": true,
+	"map": true, "sortedmap": true, "stringmap": true, "sortedstringmap": true, "int64map": true, "uint64map": true,
+}
+
+/*
+Writes the records of a dump, as a JSON array or one per line.
+*/
+type dumpWriter struct {
+	w       *bufio.Writer
+	isArray bool
+	n       int // how many records have been written
+}
+
+func (d *dumpWriter) write(rec *dumpRecord) (err error) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	if d.isArray {
+		if d.n == 0 {
+			d.w.WriteString("[\n")
+		} else {
+			d.w.WriteString(",\n")
+		}
+	}
+	d.w.Write(b)
+	if !d.isArray {
+		d.w.WriteByte('\n')
+	}
+	d.n++
+	return
+}
+
+func (d *dumpWriter) close() error {
+	if d.isArray {
+		d.w.WriteString("\n]\n")
+	}
+	return d.w.Flush()
+}
+
+type exporter struct {
+	th          InterpreterThread
+	dbt         DBT
+	out         *dumpWriter
+	collections []RCollection  // independent collections referred to, which are yet to be exported
+	queued      map[int64]bool // the dbids of the independent collections exported or yet to be exported
+	exported    map[int64]bool // the dbids of the objects exported
+	n           int            // how many objects and collections have been exported
+}
+
+/*
+Exports the objects, independent collections and object names of the thread's database to a dump file at path,
+replacing any file there. The dump is JSON if the file name ends in .json, and NDJSON otherwise.
+Reads the database in a read transaction, so the dump is a consistent snapshot.
+Returns the number of objects and collections exported.
+*/
+func Export(th InterpreterThread, path string) (n int, err error) {
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return
+	}
+	e := &exporter{
+		th:       th,
+		dbt:      th.DBT(),
+		out:      &dumpWriter{w: bufio.NewWriter(file), isArray: strings.HasSuffix(strings.ToLower(path), ".json")},
+		queued:   make(map[int64]bool),
+		exported: make(map[int64]bool),
+	}
+	err = e.dbt.BeginTransaction("DEFERRED")
+	if err == nil {
+		err = e.export()
+		commitErr := e.dbt.CommitTransaction()
+		if err == nil {
+			err = commitErr
+		} else if commitErr != nil {
+			e.dbt.ReleaseDB()
+		}
+	}
+	if err == nil {
+		err = e.out.close()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		err = fmt.Errorf("Unable to export the database to %s: %s", path, err)
+		return
+	}
+	n = e.n
+	return
+}
+
+func (e *exporter) export() (err error) {
+	err = e.out.write(&dumpRecord{Format: DUMP_FORMAT, Version: DUMP_VERSION})
+	if err != nil {
+		return
+	}
+	exportedTypes := make(map[*RType]bool)
+	for _, typ := range RT.StoredTypes() {
+		if exportedTypes[typ] {
+			continue
+		}
+		exportedTypes[typ] = true
+		err = e.exportType(typ)
+		if err != nil {
+			return
+		}
+	}
+
+	names, err := e.dbt.ObjectNames("")
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		var obj RObject
+		obj, err = e.dbt.FetchByName(name, 0)
+		if err != nil {
+			return
+		}
+		if !obj.IsCollection() && !e.exported[obj.DBID()] {
+			continue // of a type which the program has not loaded
+		}
+		err = e.out.write(&dumpRecord{Id: e.ref(obj), Name: name})
+		if err != nil {
+			return
+		}
+	}
+	err = e.exportCollections()
+	return
+}
+
+/*
+Exports the objects whose type is typ, a batch at a time. Objects of its subtypes are exported with their own types.
+*/
+func (e *exporter) exportType(typ *RType) (err error) {
+	cursor, err := e.dbt.OpenCursor(typ, "", nil, nil, 1, DUMP_BATCH_SIZE, nil)
+	if err != nil {
+		return
+	}
+	for {
+		var objs []RObject
+		objs, err = cursor.NextBatch()
+		if err != nil || len(objs) == 0 {
+			return
+		}
+		for _, obj := range objs {
+			if obj.Type() != typ {
+				continue
+			}
+			err = e.exportObject(obj)
+			if err != nil {
+				return
+			}
+		}
+		err = e.exportCollections()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (e *exporter) exportObject(obj RObject) (err error) {
+	attrs := make(map[string]interface{})
+	for _, attr := range dumpAttributes(obj.Type()) {
+		val, found := RT.AttrVal(e.th, obj, attr)
+		if !found || val == NIL {
+			continue
+		}
+		var v interface{}
+		var ok bool
+		if attr.IsMultiValued() {
+			coll := val.(RCollection)
+			if coll.Length() == 0 {
+				continue
+			}
+			v, err = e.elements(coll)
+			ok = true
+		} else {
+			v, ok, err = e.value(val, attr.Part.Type)
+		}
+		if err != nil {
+			err = fmt.Errorf("%s.%s: %s", obj.Type().Name, attr.Part.Name, err)
+			return
+		}
+		if ok {
+			attrs[attr.Part.Name] = v
+		}
+	}
+	err = e.out.write(&dumpRecord{Id: e.ref(obj), Type: obj.Type().Name, Attrs: attrs})
+	e.exported[obj.DBID()] = true
+	e.n++
+	return
+}
+
+/*
+Exports the independent collections referred to since last called, and those they refer to.
+*/
+func (e *exporter) exportCollections() (err error) {
+	for len(e.collections) > 0 {
+		coll := e.collections[0]
+		e.collections = e.collections[1:]
+		descriptor, _, _, keyType, elementType := typeDescriptor(coll)
+		rec := &dumpRecord{
+			Id:          e.ref(coll),
+			Collection:  descriptor[1:strings.Index(descriptor, "_of_")],
+			ElementType: elementType.Name,
+		}
+		if keyType != nil {
+			rec.KeyType = keyType.Name
+		}
+		rec.Elements, err = e.elements(coll)
+		if err != nil {
+			return
+		}
+		err = e.out.write(rec)
+		if err != nil {
+			return
+		}
+		e.n++
+	}
+	return
+}
+
+/*
+The JSON values of the elements of the collection, or the [key,value] pairs of a map.
+*/
+func (e *exporter) elements(coll RCollection) (elements []interface{}, err error) {
+	var members []RObject
+	for member := range coll.Iter(e.th) {
+		members = append(members, member)
+	}
+	elements = []interface{}{}
+	theMap, isMap := coll.(Map)
+	for _, member := range members {
+		var v interface{}
+		var ok bool
+		if isMap {
+			val, _ := theMap.Get(member)
+			var k interface{}
+			var keyOk bool
+			k, keyOk, err = e.value(member, theMap.KeyType())
+			if err == nil {
+				v, ok, err = e.value(val, theMap.ValType())
+			}
+			ok = ok && keyOk
+			v = []interface{}{k, v}
+		} else {
+			v, ok, err = e.value(member, coll.ElementType())
+		}
+		if err != nil {
+			return
+		}
+		if ok {
+			elements = append(elements, v)
+		}
+	}
+	return
+}
+
+/*
+The JSON value of an attribute value or collection element, whose declared type is declaredType.
+Not ok if the value is of a type which is not persisted, such as a Mutex.
+*/
+func (e *exporter) value(val RObject, declaredType *RType) (v interface{}, ok bool, err error) {
+	if proxy, isProxy := val.(Proxy); isProxy {
+		val, err = e.dbt.Fetch(int64(proxy), 0)
+		if err != nil {
+			return
+		}
+	}
+	if !val.Type().IsPrimitive {
+		v = map[string]interface{}{"ref": e.ref(val)}
+		ok = true
+		return
+	}
+	v, ok = primitiveToJSON(val)
+	if ok && val != NIL && val.Type() != declaredType {
+		v = map[string]interface{}{"type": val.Type().Name, "value": v}
+	}
+	return
+}
+
+/*
+The id of the object in the dump. Queues an independent collection to be exported, the first time it is referred to.
+*/
+func (e *exporter) ref(obj RObject) string {
+	id := obj.DBID()
+	if obj.IsCollection() && !e.queued[id] {
+		e.queued[id] = true
+		e.collections = append(e.collections, obj.(RCollection))
+	}
+	return strconv.FormatInt(id, 10)
+}
+
+/*
+The attributes of the type and of its supertypes.
+*/
+func dumpAttributes(typ *RType) (attrs []*AttributeSpec) {
+	attrs = append(attrs, typ.Attributes...)
+	for _, supertype := range typ.Up {
+		attrs = append(attrs, supertype.Attributes...)
+	}
+	return
+}
+
+/*
+The JSON value of a primitive value. Not ok if the value is of a type which is not persisted.
+*/
+func primitiveToJSON(val RObject) (v interface{}, ok bool) {
+	ok = true
+	switch p := val.(type) {
+	case Int:
+		v = int64(p)
+	case Int32:
+		v = int64(p)
+	case Uint:
+		v = uint64(p)
+	case Uint32:
+		v = uint64(p)
+	case Float:
+		f := float64(p)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			v = strconv.FormatFloat(f, 'g', -1, 64) // JSON has no NaN or Inf
+		} else {
+			v = f
+		}
+	case Bool:
+		v = bool(p)
+	case String:
+		v = string(p)
+	case RTime:
+		t := time.Time(p)
+		v = map[string]interface{}{"time": t.UTC().Format(time.RFC3339Nano), "location": t.Location().String()}
+	case Complex:
+		v = []interface{}{real(complex128(p)), imag(complex128(p))}
+	case Complex32:
+		v = []interface{}{float64(real(complex64(p))), float64(imag(complex64(p)))}
+	case Nil:
+		v = nil
+	default:
+		ok = false
+	}
+	return
+}
+
+/*
+The primitive value of type typ given by the JSON value v.
+*/
+func primitiveFromJSON(v interface{}, typ *RType) (val RObject, err error) {
+	switch typ {
+	case IntType, Int32Type:
+		var n int64
+		n, err = jsonInt(v)
+		if typ == IntType {
+			val = Int(n)
+		} else {
+			val = Int32(n)
+		}
+	case UintType, Uint32Type:
+		var n uint64
+		n, err = jsonUint(v)
+		if err != nil {
+			err = fmt.Errorf("%v is not a %s.", v, typ.Name)
+		}
+		if typ == UintType {
+			val = Uint(n)
+		} else {
+			val = Uint32(n)
+		}
+	case FloatType:
+		var f float64
+		f, err = jsonFloat(v)
+		val = Float(f)
+	case BoolType:
+		b, isBool := v.(bool)
+		if !isBool {
+			err = fmt.Errorf("%v is not a Bool.", v)
+		}
+		val = Bool(b)
+	case StringType:
+		s, isString := v.(string)
+		if !isString {
+			err = fmt.Errorf("%v is not a String.", v)
+		}
+		val = String(s)
+	case TimeType:
+		m, _ := v.(map[string]interface{})
+		s, _ := m["time"].(string)
+		var t time.Time
+		t, err = time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			err = fmt.Errorf("%v is not a Time.", v)
+			return
+		}
+		if locationName, hasLocation := m["location"].(string); hasLocation {
+			var location *time.Location
+			location, err = LoadLocation(locationName)
+			if err != nil {
+				return
+			}
+			t = t.In(location)
+		}
+		val = RTime(t)
+	case ComplexType, Complex32Type:
+		parts, _ := v.([]interface{})
+		if len(parts) != 2 {
+			err = fmt.Errorf("%v is not a %s. A complex number is [real,imag].", v, typ.Name)
+			return
+		}
+		var r, i float64
+		r, err = jsonFloat(parts[0])
+		if err == nil {
+			i, err = jsonFloat(parts[1])
+		}
+		if typ == ComplexType {
+			val = Complex(complex(r, i))
+		} else {
+			val = Complex32(complex64(complex(r, i)))
+		}
+	default:
+		err = fmt.Errorf("Cannot import a value of type %s.", typ.Name)
+	}
+	return
+}
+
+func jsonInt(v interface{}) (n int64, err error) {
+	number, isNumber := v.(json.Number)
+	if !isNumber {
+		err = fmt.Errorf("%v is not an integer.", v)
+		return
+	}
+	n, err = number.Int64()
+	return
+}
+
+func jsonUint(v interface{}) (n uint64, err error) {
+	number, isNumber := v.(json.Number)
+	if !isNumber {
+		err = fmt.Errorf("%v is not an integer.", v)
+		return
+	}
+	n, err = strconv.ParseUint(number.String(), 10, 64)
+	return
+}
+
+func jsonFloat(v interface{}) (f float64, err error) {
+	switch x := v.(type) {
+	case json.Number:
+		f, err = x.Float64()
+	case string:
+		f, err = strconv.ParseFloat(x, 64) // NaN, +Inf or -Inf
+	default:
+		err = fmt.Errorf("%v is not a number.", v)
+	}
+	return
+}
+
+/*
+Reads the records of the dump at path, after its identifying record, calling fn with each.
+*/
+func readDump(path string, fn func(rec *dumpRecord) error) (err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	isArray := false
+	for {
+		var c []byte
+		c, err = r.Peek(1)
+		if err != nil {
+			err = fmt.Errorf("%s is empty.", path)
+			return
+		}
+		if c[0] != ' ' && c[0] != '\t' && c[0] != '\r' && c[0] != '\n' {
+			isArray = (c[0] == '[')
+			break
+		}
+		r.ReadByte()
+	}
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if isArray {
+		dec.Token() // the [ of the array
+	}
+	for n := 0; !isArray || dec.More(); n++ {
+		rec := &dumpRecord{}
+		err = dec.Decode(rec)
+		if err == io.EOF && !isArray {
+			err = nil
+			return
+		}
+		if err != nil {
+			err = fmt.Errorf("Record %d of %s is not valid: %s", n+1, path, err)
+			return
+		}
+		if n == 0 {
+			if rec.Format != DUMP_FORMAT || rec.Version > DUMP_VERSION {
+				err = fmt.Errorf("%s is not a relish dump of version %d or earlier.", path, DUMP_VERSION)
+				return
+			}
+			continue
+		}
+		err = fn(rec)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+type importer struct {
+	th      InterpreterThread
+	dbt     DBT
+	objects map[string]RObject // the new objects and collections, by their ids in the dump
+}
+
+/*
+Imports the dump at path into the thread's database, in one transaction. The objects and collections of the dump
+are created as new objects, with new ids, and given their names in the dump.
+The types of the objects must be those of packages loaded by the running program.
+Reads the dump twice, first to create the objects with their primitive attribute values, then to set their
+other attributes, which can refer to objects anywhere in the dump. Returns the number of objects and collections
+imported.
+If the import fails, the transaction is rolled back in memory as well as in the database, so the objects created
+so far are not left behind as persisted.
+*/
+func Import(th InterpreterThread, path string) (n int, err error) {
+	im := &importer{th: th, dbt: th.DBT()}
+	err = RunTransaction(th, "IMMEDIATE", DefaultTransactionRetryPolicy(), func() (blockErr error) {
+		im.objects = make(map[string]RObject) // those of a failed try are rolled back
+		blockErr = readDump(path, im.create)
+		if blockErr == nil {
+			blockErr = readDump(path, im.link)
+		}
+		return
+	})
+	if err != nil {
+		err = fmt.Errorf("Unable to import %s: %s", path, err)
+		return
+	}
+	n = len(im.objects)
+	return
+}
+
+/*
+Creates and persists the object or collection of the record, with its primitive attribute values.
+*/
+func (im *importer) create(rec *dumpRecord) (err error) {
+	if rec.Name != "" {
+		return
+	}
+	if _, found := im.objects[rec.Id]; found {
+		err = fmt.Errorf("More than one record has the id %s.", rec.Id)
+		return
+	}
+	var obj RObject
+	if rec.Collection != "" {
+		obj, err = im.newCollection(rec)
+	} else {
+		typ, found := RT.Types[rec.Type]
+		if !found {
+			err = fmt.Errorf("The object %s is of type %s, which is not loaded by the program.", rec.Id, rec.Type)
+			return
+		}
+		obj, err = RT.NewObject(typ.Name)
+		if err != nil {
+			return
+		}
+		for _, attr := range dumpAttributes(typ) {
+			v, found := rec.Attrs[attr.Part.Name]
+			if !found || !attr.IsSimple() {
+				continue
+			}
+			var val RObject
+			val, err = im.value(v, attr.Part.Type)
+			if err != nil {
+				err = fmt.Errorf("%s.%s of object %s: %s", typ.Name, attr.Part.Name, rec.Id, err)
+				return
+			}
+			if val != NIL {
+				RT.RestoreAttr(obj, attr, val)
+			}
+		}
+	}
+	if err != nil {
+		return
+	}
+	err = im.dbt.EnsurePersisted(im.th, obj)
+	im.objects[rec.Id] = obj
+	return
+}
+
+func (im *importer) newCollection(rec *dumpRecord) (coll RCollection, err error) {
+	if !dumpCollectionKinds[rec.Collection] {
+		err = fmt.Errorf("The collection %s is of an unknown kind, %s.", rec.Id, rec.Collection)
+		return
+	}
+	elementType, found := RT.Types[rec.ElementType]
+	if !found {
+		err = fmt.Errorf("The collection %s has elements of type %s, which is not loaded by the program.", rec.Id, rec.ElementType)
+		return
+	}
+	var keyType *RType
+	if rec.KeyType != "" {
+		keyType, found = RT.Types[rec.KeyType]
+		if !found {
+			err = fmt.Errorf("The map %s has keys of type %s, which is not loaded by the program.", rec.Id, rec.KeyType)
+			return
+		}
+	}
+	coll, err = RT.NewCollection(0, -1, nil, nil, rec.Collection, true, nil, nil, nil, keyType, elementType)
+	return
+}
+
+/*
+Sets the non-primitive and multi-valued attributes of the record's object, adds the elements of the record's
+collection, or names the record's object.
+*/
+func (im *importer) link(rec *dumpRecord) (err error) {
+	obj, found := im.objects[rec.Id]
+	if !found {
+		err = fmt.Errorf("The name '%s' is of object %s, which is not in the dump.", rec.Name, rec.Id)
+		return
+	}
+	context := im.th.EvaluationContext()
+
+	if rec.Name != "" {
+		found, err = im.dbt.ObjectNameExists(rec.Name)
+		if err == nil && found {
+			err = fmt.Errorf("The database already has an object named '%s'.", rec.Name)
+		}
+		if err == nil {
+			err = im.dbt.NameObject(obj, rec.Name)
+		}
+		return
+	}
+
+	if rec.Collection != "" {
+		coll := obj.(RCollection)
+		err = im.addElements(coll, rec.Elements, func(key RObject, val RObject) error {
+			if key != nil {
+				return RT.PutInMapTypeChecked(coll.(Map), key, val, context)
+			}
+			return RT.AddToCollection(coll.(AddableCollection), val, false, context)
+		})
+		if err != nil {
+			err = fmt.Errorf("Collection %s: %s", rec.Id, err)
+		}
+		return
+	}
+
+	for _, attr := range dumpAttributes(obj.Type()) {
+		v, found := rec.Attrs[attr.Part.Name]
+		if !found || attr.IsSimple() {
+			continue
+		}
+		if attr.IsMultiValued() {
+			items, isArray := v.([]interface{})
+			if !isArray {
+				err = fmt.Errorf("%v is not an array of values.", v)
+			} else if collVal, collFound := RT.AttrVal(im.th, obj, attr); !collFound {
+				err = fmt.Errorf("The attribute has no collection of values.")
+			} else {
+				coll := collVal.(RCollection)
+				err = im.addElements(coll, items, func(key RObject, val RObject) error {
+					if key != nil {
+						return RT.PutInMapTypeChecked(coll.(Map), key, val, context)
+					}
+					return RT.AddToAttr(im.th, obj, attr, val, false, context, true)
+				})
+			}
+		} else {
+			var val RObject
+			val, err = im.value(v, attr.Part.Type)
+			if err == nil && val != NIL {
+				RT.RestoreAttr(obj, attr, val)
+				err = im.dbt.PersistSetAttr(im.th, obj, attr, val, false)
+			}
+		}
+		if err != nil {
+			err = fmt.Errorf("%s.%s of object %s: %s", obj.Type().Name, attr.Part.Name, rec.Id, err)
+			return
+		}
+	}
+	return
+}
+
+/*
+Adds the elements given by the JSON values to the collection, with the add function,
+whose key argument is nil unless the collection is a map, whose elements are [key,value] pairs.
+*/
+func (im *importer) addElements(coll RCollection, items []interface{}, add func(key RObject, val RObject) error) (err error) {
+	theMap, isMap := coll.(Map)
+	for _, item := range items {
+		var key RObject
+		declaredType := coll.ElementType()
+		if isMap {
+			pair, isPair := item.([]interface{})
+			if !isPair || len(pair) != 2 {
+				err = fmt.Errorf("%v is not a [key,value] pair of a map.", item)
+				return
+			}
+			key, err = im.value(pair[0], theMap.KeyType())
+			if err != nil {
+				return
+			}
+			item = pair[1]
+			declaredType = theMap.ValType()
+		}
+		var val RObject
+		val, err = im.value(item, declaredType)
+		if err == nil {
+			err = add(key, val)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+/*
+The value given by the JSON value v, whose declared type is declaredType.
+*/
+func (im *importer) value(v interface{}, declaredType *RType) (val RObject, err error) {
+	if v == nil {
+		val = NIL
+		return
+	}
+	if m, isMap := v.(map[string]interface{}); isMap {
+		if ref, isRef := m["ref"]; isRef {
+			id, _ := ref.(string)
+			var found bool
+			val, found = im.objects[id]
+			if !found {
+				err = fmt.Errorf("The object %v is not in the dump.", ref)
+			}
+			return
+		}
+		if typeName, isTyped := m["type"].(string); isTyped {
+			typ, found := RT.Types[typeName]
+			if !found {
+				err = fmt.Errorf("Unknown type %s.", typeName)
+				return
+			}
+			val, err = primitiveFromJSON(m["value"], typ)
+			return
+		}
+	}
+	if !declaredType.IsPrimitive {
+		err = fmt.Errorf("%v is not a reference to an object.", v)
+		return
+	}
+	val, err = primitiveFromJSON(v, declaredType)
+	return
+}
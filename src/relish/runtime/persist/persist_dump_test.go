@@ -0,0 +1,92 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+package persist
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	. "relish/runtime/data"
+	"testing"
+	"time"
+)
+
+func TestPrimitiveJSONRoundTrip(t *testing.T) {
+	toronto, err := time.LoadLocation("America/Toronto")
+	if err != nil {
+		toronto = time.UTC
+	}
+	vals := []RObject{
+		Int(-42), Int32(7), Uint(math.MaxUint64), Uint32(9), Float(0.25), Float(math.Inf(1)),
+		Bool(true), String("Fred's \"car\""), RTime(time.Date(2014, 3, 21, 10, 15, 0, 5, toronto)),
+		Complex(complex(1.5, -2)),
+	}
+	for _, val := range vals {
+		v, ok := primitiveToJSON(val)
+		if !ok {
+			t.Errorf("%v (%s) has no JSON value", val, val.Type().Name)
+			continue
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Errorf("%v: %s", val, err)
+			continue
+		}
+		var decoded interface{}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		dec.Decode(&decoded)
+		restored, err := primitiveFromJSON(decoded, val.Type())
+		if err != nil {
+			t.Errorf("%s: %s", b, err)
+			continue
+		}
+		if original, isTime := val.(RTime); isTime {
+			r := time.Time(restored.(RTime))
+			if !r.Equal(time.Time(original)) || r.Location().String() != time.Time(original).Location().String() {
+				t.Errorf("%s was restored as %v", b, restored)
+			}
+		} else if restored != val {
+			t.Errorf("%s was restored as %v, not %v", b, restored, val)
+		}
+	}
+}
+
+func TestReadDump(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dumps := map[string]string{
+		"d.ndjson": "{\"format\":\"relish-dump\",\"version\":1}\n{\"id\":\"1\",\"type\":\"a/pkg/T\",\"attrs\":{\"n\":3}}\n{\"id\":\"1\",\"name\":\"one\"}\n",
+		"d.json":   " [\n{\"format\":\"relish-dump\",\"version\":1},\n{\"id\":\"1\",\"type\":\"a/pkg/T\",\"attrs\":{\"n\":3}},\n{\"id\":\"1\",\"name\":\"one\"}\n]\n",
+	}
+	for fileName, content := range dumps {
+		path := filepath.Join(dir, fileName)
+		ioutil.WriteFile(path, []byte(content), 0666)
+		var recs []*dumpRecord
+		err = readDump(path, func(rec *dumpRecord) error {
+			recs = append(recs, rec)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: %s", fileName, err)
+			continue
+		}
+		if len(recs) != 2 || recs[0].Type != "a/pkg/T" || recs[0].Attrs["n"] != json.Number("3") || recs[1].Name != "one" {
+			t.Errorf("%s: read %d records, not the object and its name", fileName, len(recs))
+		}
+	}
+
+	notADump := filepath.Join(dir, "other.ndjson")
+	ioutil.WriteFile(notADump, []byte("{\"id\":\"1\"}\n"), 0666)
+	if err = readDump(notADump, func(rec *dumpRecord) error { return nil }); err == nil {
+		t.Errorf("a file without the dump's identifying record was read as a dump")
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+// this package implements data persistence in the relish language environment.
+
+package persist
+
+/*
+   persist_index.go - sqlite indexes on the tables of relish types, attributes and collections.
+
+   The columns of the primitive-valued attributes of a type are indexed if the attributes are declared
+   indexed or unique, e.g.
+
+   Car
+      vin String unique
+      make String indexed
+      model String indexed with make year
+
+   ==>
+
+   CREATE UNIQUE INDEX IF NOT EXISTS [vehicles/Car__vin__idx] ON [vehicles/Car](vin)
+   CREATE INDEX IF NOT EXISTS [vehicles/Car__make__idx] ON [vehicles/Car](make)
+   CREATE INDEX IF NOT EXISTS [vehicles/Car__model__make__year__idx] ON [vehicles/Car](model,make,year)
+
+   The tables of non-primitive attributes, relations and collections are always indexed on the
+   column which holds the owner's id (and the ord1 column if they have one), and on the id1 column
+   which holds the id of the value.
+*/
+
+import (
+	"fmt"
+	. "relish/dbg"
+	. "relish/runtime/data"
+	"strings"
+)
+
+/*
+Creates the index on the columns of the table, if it does not exist.
+*/
+func (db *SqliteDBThread) ensureIndex(table string, unique bool, cols ...string) (err error) {
+	index := db.db.TableNameIfy(db.db.TypeNameIfy(table) + "__" + strings.Join(cols, "__") + "__idx")
+	s := "CREATE INDEX IF NOT EXISTS "
+	if unique {
+		s = "CREATE UNIQUE INDEX IF NOT EXISTS "
+	}
+	s += index + " ON " + table + "(" + strings.Join(cols, ",") + ")"
+
+	Logln(PERSIST_, s)
+
+	err = db.ExecStatement(s)
+	if err != nil {
+		err = fmt.Errorf("db.ExecStatement(%s): db error: %s", s, err)
+	}
+	return
+}
+
+/*
+Creates the indexes declared on the primitive-valued attributes of the type.
+*/
+func (db *SqliteDBThread) ensureTypeIndexes(typ *RType) (err error) {
+	table := db.db.TableNameIfy(typ.ShortName())
+	for _, attr := range typ.Attributes {
+		if !attr.HasIndex() {
+			continue
+		}
+		cols := attr.Part.DbColumnNames()
+		for _, other := range attr.IndexWith {
+			cols = append(cols, other.Part.DbColumnNames()...)
+		}
+		err = db.ensureIndex(table, attr.IsUnique, cols...)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+/*
+Creates the indexes of a table which associates owner objects or collections (by the ownerCol column)
+with values. The id1 column, if hasIdCol, holds the id of each non-primitive value.
+*/
+func (db *SqliteDBThread) ensureAssociationIndexes(table string, ownerCol string, hasIdCol bool, isOrdered bool) (err error) {
+	if isOrdered {
+		err = db.ensureIndex(table, false, ownerCol, "ord1")
+	} else {
+		err = db.ensureIndex(table, false, ownerCol)
+	}
+	if err != nil {
+		return
+	}
+	if hasIdCol {
+		err = db.ensureIndex(table, false, "id1")
+	}
+	return
+}
+
+/*
+The error returned when storing an object, or setting an attribute of a persistent object, would give the
+object the same values of the attributes of a unique index as another object of its type.
+*/
+type UniqueIndexError struct {
+	Obj   RObject
+	Cause error
+}
+
+func (e *UniqueIndexError) Error() string {
+	return fmt.Sprintf("UNIQUE INDEX VIOLATION: another %s has the same %s as %v.", e.Obj.Type().ShortName(), e.attrNames(), e.Obj)
+}
+
+/*
+The names of the attributes of the violated index, from the sqlite error message, which is e.g.
+"UNIQUE constraint failed: [vehicles/Car].model, [vehicles/Car].make", or in older versions of sqlite,
+"columns model, make are not unique". Other databases' messages do not name the attributes.
+*/
+func (e *UniqueIndexError) attrNames() string {
+	msg := e.Cause.Error()
+	if i := strings.LastIndex(msg, " ["); i >= 0 && strings.HasSuffix(msg, "]") { // the result code
+		msg = msg[:i]
+	}
+	if i := strings.Index(msg, "failed: "); i >= 0 {
+		var names []string
+		for _, col := range strings.Split(msg[i+8:], ",") {
+			col = strings.TrimSpace(col)
+			names = append(names, col[strings.LastIndex(col, ".")+1:])
+		}
+		return strings.Join(names, " and ")
+	}
+	if i := strings.Index(msg, "column"); i >= 0 {
+		msg = strings.TrimSuffix(strings.TrimSuffix(msg[i:], " is not unique"), " are not unique")
+		msg = strings.TrimPrefix(strings.TrimPrefix(msg, "columns "), "column ")
+		return strings.Replace(msg, ", ", " and ", -1)
+	}
+	return "indexed attribute values"
+}
+
+/*
+If the database error is a violation of a unique index, returns a *UniqueIndexError
+about the object. Otherwise returns the error unchanged.
+*/
+func (db *SqliteDBThread) uniqueIndexError(err error, obj RObject) error {
+	if !db.db.dialect.IsUniqueViolation(err) {
+		return err
+	}
+	return &UniqueIndexError{obj, dbErrorCause(err)}
+}
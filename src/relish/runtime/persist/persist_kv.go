@@ -0,0 +1,522 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+// this package implements data persistence in the relish language environment.
+
+package persist
+
+/*
+   persist_kv.go - a relish database held in an embedded key-value store, which needs neither sqlite nor cgo.
+
+   A relish database whose name is given as kv:name, e.g.
+
+      relish -db kv:shop ...
+
+   is stored in the file shop.kvdb, in the artifact's data directory, by package relish/runtime/persist/kv.
+   A relish built with the nosqlite build tag, which does not link the sqlite C library, can use such a database.
+   The whole of such a database is held in memory while it is open, so it suits databases which fit comfortably
+   in the memory of the process; a larger database should use sqlite.
+
+   The objects, their attribute values, and the members of collections are stored as keys in order, so that
+   each object's values, and each collection's members, are adjacent. See persist_kv_data.go for the keys.
+   Queries are evaluated by package relish/runtime/persist/oql against the stored values rather than
+   translated to SQL. See persist_kv_query.go.
+
+   Each thread's DBThread holds a connection, as for a SQL database. A write which is not part of a transaction
+   is made in a transaction of its own. A "DEFERRED" (read) transaction reads a snapshot of the store as of when
+   it began, without waiting for writers. Writing transactions are serialized by the store.
+
+   The audit log (-auditlog), and the queries which use it, and aggregate queries, are not supported.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	. "relish/dbg"
+	"relish/params"
+	. "relish/runtime/data"
+	"relish/runtime/persist/kv"
+	"strings"
+	"time"
+)
+
+/*
+The prefix of the -db option value which names a key-value database, e.g. kv:shop
+*/
+const KV_DB_PREFIX = "kv:"
+
+/*
+The file name extension of a key-value database.
+*/
+const KV_DB_SUFFIX = ".kvdb"
+
+/*
+Returns the name of the database file in the artifact's data directory, given the value of the -db option.
+A kv:name option names the key-value database file name.kvdb, and otherwise the option names the sqlite
+database file name.db
+*/
+func DatabaseFileName(dbOption string) string {
+	if strings.HasPrefix(dbOption, KV_DB_PREFIX) {
+		return dbOption[len(KV_DB_PREFIX):] + KV_DB_SUFFIX
+	}
+	return dbOption + ".db"
+}
+
+/*
+Whether the database name (a file path) is that of a key-value database.
+*/
+func IsKVDBName(dbName string) bool {
+	return strings.HasSuffix(dbName, KV_DB_SUFFIX)
+}
+
+/*
+Opens the database of the specified name: a key-value database if the name ends in .kvdb,
+and otherwise a sqlite database file or a PostgreSQL database (see NewDB).
+*/
+func OpenDB(dbName string) DB {
+	if IsKVDBName(dbName) {
+		return NewKVDB(dbName)
+	}
+	return NewDB(dbName)
+}
+
+/*
+   A handle to a key-value database, which holds the open store and the pool of connections to it.
+*/
+type KVDB struct {
+	dbName string
+	store  *kv.Store
+	pool   *ConnectionPool
+
+	defaultDBThread DBT
+
+	named bool // Attached to the running program by name, in addition to the main database.
+}
+
+/*
+   Opens the key-value database file of the specified name, creating it if it does not already exist.
+*/
+func NewKVDB(dbName string) *KVDB {
+	return newKVDB(dbName, false)
+}
+
+func newKVDB(dbName string, named bool) *KVDB {
+	if params.DbAuditLog {
+		Logln(ALWAYS_, "Error. The -auditlog option needs a sqlite or postgres database, not a key-value (kv:) database.")
+		os.Exit(1)
+	}
+	store, err := kv.Open(dbName)
+	if err != nil {
+		panic(fmt.Sprintf("Unable to open the database '%s': %s", dbName, err))
+	}
+	db := &KVDB{dbName: dbName, store: store, named: named}
+
+	newConn := func(dbName string, connectionId int) (conn Connection, err error) {
+		conn = &kvConn{store: store, id: connectionId}
+		return
+	}
+	db.pool = NewConnectionPool(dbName, poolSize(), params.DbMaxWriteConnections, newConn)
+
+	db.defaultDBThread = db.NewDBThread(nil)
+	db.defaultDBThread.EnsureObjectTable()
+	db.defaultDBThread.EnsureObjectNameTable()
+	db.defaultDBThread.EnsurePackageTable()
+	db.defaultDBThread.EnsureTypeSchemaTable()
+	return db
+}
+
+func (db *KVDB) NewDBThread(th InterpreterThread) DBT {
+	dbti := &KVDBThread{db: db}
+	dbt := &DBThread{db: db, dbti: dbti, dbConnection: &dbConnection{}, th: th}
+	dbti.dbt = dbt
+	return dbt
+}
+
+func (db *KVDB) DefaultDBThread() DBT {
+	return db.defaultDBThread
+}
+
+func (db *KVDB) GrabConnection(doingWrite bool) Connection {
+	return db.pool.GrabConnection(doingWrite)
+}
+
+func (db *KVDB) ReleaseConnection(conn Connection) {
+	db.pool.ReleaseConnection(conn)
+}
+
+/*
+A key-value database uses connections of its own.
+*/
+func (db *KVDB) ConnectionDB() DB {
+	return db
+}
+
+/*
+A connection to a key-value database. It holds the transaction the connection is in, if any.
+A key-value database has no SQL statements, so none can be prepared.
+*/
+type kvConn struct {
+	store      *kv.Store
+	tx         *kv.Tx
+	savepoints []kvSavepoint // the savepoints begun in tx, innermost last
+	isReadOnly bool
+	id         int
+}
+
+type kvSavepoint struct {
+	name string
+	sp   int
+}
+
+func (conn *kvConn) Prepare(sql string) (statement Statement, err error) {
+	err = errors.New("A key-value database does not run SQL statements.")
+	return
+}
+
+func (conn *kvConn) PreparedStatement(sql string) (statement Statement, found bool) {
+	return
+}
+
+func (conn *kvConn) CachePreparedStatement(sql string, statement Statement) {
+}
+
+func (conn *kvConn) IsReadOnly() bool {
+	return conn.isReadOnly
+}
+
+func (conn *kvConn) SetReadOnly(isReadOnly bool) {
+	conn.isReadOnly = isReadOnly
+}
+
+/*
+Ends any transaction the connection is in, discarding its changes.
+*/
+func (conn *kvConn) Close() error {
+	if conn.tx != nil {
+		conn.tx.Rollback()
+		conn.tx = nil
+		conn.savepoints = nil
+	}
+	return nil
+}
+
+func (conn *kvConn) Id() int {
+	return conn.id
+}
+
+func (conn *kvConn) RowsAffected() int {
+	return 0
+}
+
+/*
+A key-value database operation does not run long enough to need interrupting.
+*/
+func (conn *kvConn) Interrupt() {
+}
+
+/*
+Copies the store, as of the start of a read-only transaction, to a new store at path.
+*/
+func (conn *kvConn) Backup(schema string, path string) (err error) {
+	dst, err := kv.Open(path)
+	if err != nil {
+		return
+	}
+	src := conn.store.Begin(false)
+	defer src.Rollback()
+	tx := dst.Begin(true)
+	src.Ascend(nil, func(key []byte, val []byte) bool {
+		err = tx.Put(key, val)
+		return err == nil
+	})
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	closeErr := dst.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return
+}
+
+type KVDBThread struct {
+	db  *KVDB     // the database implementation
+	dbt *DBThread // Generic version of myself
+}
+
+/*
+The connection held by the generic DBThread.
+*/
+func (db *KVDBThread) conn() *kvConn {
+	return db.dbt.conn.(*kvConn)
+}
+
+/*
+Begins a store transaction, letting the garbage collector run while a writable transaction waits for
+the one before it to end.
+*/
+func (db *KVDBThread) begin(writable bool) *kv.Tx {
+	th := db.dbt.th
+	if th != nil {
+		th.AllowGC()
+		defer th.DisallowGC()
+	}
+	return db.conn().store.Begin(writable)
+}
+
+/*
+Calls fn with the transaction the connection is in or, if it is in none, with a writable transaction of its own,
+which is then committed. As with a SQL statement outside a transaction, the changes made before an error
+are kept, so fn undoes its own partial changes if it fails part way through.
+*/
+func (db *KVDBThread) update(fn func(tx *kv.Tx) error) (err error) {
+	conn := db.conn()
+	if conn.tx != nil {
+		err = fn(conn.tx)
+		return
+	}
+	tx := db.begin(true)
+	conn.tx = tx
+	defer func() {
+		conn.tx = nil
+		tx.Rollback()
+	}()
+	err = fn(tx)
+	if commitErr := tx.Commit(); err == nil {
+		err = commitErr
+	}
+	return
+}
+
+/*
+Calls fn with the transaction the connection is in or, if it is in none, with a read transaction of its own.
+*/
+func (db *KVDBThread) view(fn func(tx *kv.Tx) error) (err error) {
+	conn := db.conn()
+	if conn.tx != nil {
+		err = fn(conn.tx)
+		return
+	}
+	tx := db.begin(false)
+	conn.tx = tx
+	defer func() {
+		conn.tx = nil
+		tx.Rollback()
+	}()
+	err = fn(tx)
+	return
+}
+
+/*
+Begins a store transaction on the thread's connection. A "DEFERRED" transaction is read-only, and reads
+a snapshot of the store as of when it began. Other transactions wait for any writing transaction to end.
+*/
+func (db *KVDBThread) BeginTransaction(transactionType string) (err error) {
+	conn := db.conn()
+	if conn.tx != nil {
+		err = &TransactionError{Kind: TX_FAILED, Op: "BEGIN " + transactionType, Tries: 1, Err: errors.New("The connection is already in a transaction.")}
+		return
+	}
+	conn.tx = db.begin(transactionType != "DEFERRED")
+	return
+}
+
+func (db *KVDBThread) CommitTransaction() (err error) {
+	conn := db.conn()
+	if conn.tx == nil {
+		err = &TransactionError{Kind: TX_FAILED, Op: "COMMIT", Tries: 1, Err: errors.New("The connection is not in a transaction.")}
+		return
+	}
+	tx := conn.tx
+	conn.tx = nil
+	conn.savepoints = nil
+	if th := db.dbt.th; th != nil {
+		th.AllowGC()
+		defer th.DisallowGC()
+	}
+	if commitErr := tx.Commit(); commitErr != nil {
+		err = &TransactionError{Kind: TX_FAILED, Op: "COMMIT", Tries: 1, Err: commitErr}
+	}
+	return
+}
+
+/*
+Discards the changes of the connection's transaction. Does nothing if the connection is not in a transaction,
+e.g. because its commit failed.
+*/
+func (db *KVDBThread) RollbackTransaction() (err error) {
+	conn := db.conn()
+	if conn.tx != nil {
+		conn.tx.Rollback()
+		conn.tx = nil
+		conn.savepoints = nil
+	}
+	return
+}
+
+/*
+Discards the changes of the connection's transaction, for the transaction watchdog.
+*/
+func (db *KVDBThread) interruptTransaction() (err error) {
+	return db.RollbackTransaction()
+}
+
+func (db *KVDBThread) BindTransaction(tx *RTransaction) {
+	panic("KVDBThread.BindTransaction should not ever be called. Generic DBThread type calls its method instead.")
+}
+
+func (db *KVDBThread) BeginSavepoint(name string) (err error) {
+	conn := db.conn()
+	if conn.tx == nil {
+		err = &TransactionError{Kind: TX_FAILED, Op: "SAVEPOINT", Tries: 1, Err: errors.New("The connection is not in a transaction.")}
+		return
+	}
+	conn.savepoints = append(conn.savepoints, kvSavepoint{name, conn.tx.Savepoint()})
+	return
+}
+
+/*
+Returns the position of the innermost savepoint of the name in the connection's savepoints.
+*/
+func (db *KVDBThread) findSavepoint(op string, name string) (i int, err error) {
+	conn := db.conn()
+	for i = len(conn.savepoints) - 1; i >= 0; i-- {
+		if conn.savepoints[i].name == name {
+			return
+		}
+	}
+	err = &TransactionError{Kind: TX_FAILED, Op: op, Tries: 1, Err: fmt.Errorf("no such savepoint: %s", name)}
+	return
+}
+
+func (db *KVDBThread) ReleaseSavepoint(name string) (err error) {
+	i, err := db.findSavepoint("RELEASE SAVEPOINT", name)
+	if err != nil {
+		return
+	}
+	conn := db.conn()
+	conn.tx.ReleaseSavepoint(conn.savepoints[i].sp)
+	conn.savepoints = conn.savepoints[:i]
+	return
+}
+
+func (db *KVDBThread) RollbackToSavepoint(name string) (err error) {
+	i, err := db.findSavepoint("ROLLBACK TO SAVEPOINT", name)
+	if err != nil {
+		return
+	}
+	conn := db.conn()
+	conn.tx.RollbackTo(conn.savepoints[i].sp)
+	conn.savepoints = conn.savepoints[:i]
+	return
+}
+
+func (db *KVDBThread) UseDB() {
+	panic("KVDBThread.UseDB should not ever be called. Generic DBThread type calls its method instead.")
+}
+
+func (db *KVDBThread) ReleaseDB() bool {
+	panic("KVDBThread.ReleaseDB should not ever be called. Generic DBThread type calls its method instead.")
+}
+
+/*
+A key-value database has no tables. Its keys need no declaring.
+*/
+func (db *KVDBThread) EnsureObjectTable() {
+}
+
+func (db *KVDBThread) EnsureObjectNameTable() {
+}
+
+func (db *KVDBThread) EnsureChangeLogTable() {
+}
+
+func (db *KVDBThread) EnsureTypeSchemaTable() {
+}
+
+func (db *KVDBThread) EnsureAttributeAndRelationTables(t *RType) (err error) {
+	return
+}
+
+/*
+Reads the mappings between the full names and short names of the packages recorded in the database
+into the runtime.
+*/
+func (db *KVDBThread) EnsurePackageTable() {
+	stored := make(map[string]string)
+	err := db.view(func(tx *kv.Tx) error {
+		tx.AscendPrefix([]byte{kvPackage}, func(key []byte, val []byte) bool {
+			stored[string(key[1:])] = string(val)
+			return true
+		})
+		return nil
+	})
+	if err != nil {
+		panic(fmt.Sprintf("restorePackageNameMappings: db error: %s", err))
+	}
+	unrecorded, err := reconcilePackageNames(db.db.named, stored)
+	if err != nil {
+		panic(fmt.Sprintf("restorePackageNameMappings: %s", err))
+	}
+	for _, name := range unrecorded {
+		db.RecordPackageName(name, RT.PkgNameToShortName[name])
+	}
+}
+
+/*
+Record in the db the mapping from the package name to shortName.
+*/
+func (db *KVDBThread) RecordPackageName(name string, shortName string) {
+	err := db.update(func(tx *kv.Tx) error {
+		return tx.Put(kvKey(kvPackage, name), []byte(shortName))
+	})
+	if err != nil {
+		panic(err)
+	}
+	RT.PkgNameToShortName[name] = shortName
+	RT.PkgShortNameToName[shortName] = name
+}
+
+func (db *KVDBThread) ExecStatements(statementGroup *StatementGroup) (err error) {
+	err = errors.New("A key-value database does not run SQL statements.")
+	return
+}
+
+func (db *KVDBThread) ExecStatement(statement string, args ...interface{}) (err error) {
+	err = errors.New("A key-value database does not run SQL statements.")
+	return
+}
+
+var errKVAuditLog = errors.New("A key-value database does not keep an audit log of changes. Use a sqlite or postgres database with -auditlog.")
+
+func (db *KVDBThread) ChangeHistory(obj RObject) (changes []*ChangeLogEntry, err error) {
+	err = errKVAuditLog
+	return
+}
+
+func (db *KVDBThread) FetchAsOf(id int64, radius int, asOf time.Time) (obj RObject, err error) {
+	err = errKVAuditLog
+	return
+}
+
+func (db *KVDBThread) FetchByNameAsOf(name string, radius int, asOf time.Time) (obj RObject, err error) {
+	err = errKVAuditLog
+	return
+}
+
+func (db *KVDBThread) FetchNAsOf(typ *RType, oqlSelectionCriteria string, queryArgs []RObject, coll RCollection, radius int, asOf time.Time, objs *[]RObject) (err error) {
+	err = errKVAuditLog
+	return
+}
+
+/*
+Ends any transaction of the thread's connection, discarding its changes.
+*/
+func (db *KVDBThread) Close() {
+	if db.dbt.conn != nil {
+		db.dbt.conn.Close()
+	}
+}
@@ -0,0 +1,1449 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+// this package implements data persistence in the relish language environment.
+
+package persist
+
+/*
+   persist_kv_data.go - storing and fetching relish objects, their attribute values, and collections,
+   in a key-value database.
+
+   Keys begin with a byte which says what kind of key they are. An id8 is the 8 byte big-endian form of a dbid
+   (with its sign bit flipped, so that ids sort in numeric order). An attrName is e.g. vehicles/Car.speed
+
+   'o' id8                                -> id2 (8) flags (4) version (4) typeName      an object
+   'a' id8 attrName                       -> value                                       a unary attribute value
+   'c' id8 attrName 0x00 member           -> value                                       a member of a multi-valued attribute
+   'c' id8 0x00 member                    -> value                                       a member of an independent collection
+   'x' typeName 0x00 id8                  -> ""                                          the object is of the type (or a subtype)
+   'n' name                               -> id8                                         the object's name
+   'm' id8 name                           -> ""                                          the object has the name
+   'p' packageName                        -> packageShortName
+   's' typeName                           -> the type's schema, as recorded by EnsureTypeTable
+   'u' indexName 0x00 tuple               -> id8                                         see persist_kv_schema.go
+   'v' id8 indexName                      -> tuple
+   'i' typeName 0x00 indexName            -> ""
+
+   The member part of a collection member's key is the encoded key of a map entry, the id8 of the index of an
+   element of a list (or of another ordered collection), or the encoded value of a member of a set.
+
+   A value is encoded as a byte giving its type followed by the value, in a form which sorts in the order of the
+   values. Non-primitive values are encoded as 'R' followed by the id8 of the object.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	. "relish/dbg"
+	"relish/params"
+	. "relish/runtime/data"
+	"relish/runtime/persist/kv"
+	"relish/rterr"
+	"time"
+)
+
+const (
+	kvObject     = 'o'
+	kvAttr       = 'a'
+	kvMember     = 'c'
+	kvExtent     = 'x'
+	kvName       = 'n'
+	kvObjectName = 'm'
+	kvPackage    = 'p'
+	kvSchema     = 's'
+	kvUnique     = 'u'
+	kvUniqueOf   = 'v'
+	kvIndexBuilt = 'i'
+)
+
+/*
+Returns the key made of the kind byte followed by the parts.
+*/
+func kvKey(kind byte, parts ...string) []byte {
+	key := []byte{kind}
+	for _, part := range parts {
+		key = append(key, part...)
+	}
+	return key
+}
+
+/*
+The 8 byte form of a dbid in keys, which sorts in the numeric order of the ids.
+*/
+func kvId(id int64) string {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(id)^(1<<63))
+	return string(b)
+}
+
+func kvIdVal(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b) ^ (1 << 63))
+}
+
+/*
+The name under which the values of the attribute are stored.
+*/
+func kvAttrName(attr *AttributeSpec) string {
+	return attr.WholeType.ShortName() + "." + attr.Part.Name
+}
+
+func kvAttrKey(id int64, attr *AttributeSpec) []byte {
+	return kvKey(kvAttr, kvId(id), kvAttrName(attr))
+}
+
+/*
+The prefix of the keys of the members of the multi-valued attribute (attrName) of the object,
+or of the independent collection whose id it is (attrName "").
+*/
+func kvMemberPrefix(id int64, attrName string) []byte {
+	return kvKey(kvMember, kvId(id), attrName, "\x00")
+}
+
+/*
+The prefix of the keys of the members of the persistent collection, which is either the value of a
+multi-valued attribute of its owner or an independent collection.
+*/
+func kvCollectionPrefix(coll RCollection) []byte {
+	if coll.Owner() != nil {
+		return kvMemberPrefix(coll.Owner().DBID(), kvAttrName(coll.Attribute()))
+	}
+	return kvMemberPrefix(coll.DBID(), "")
+}
+
+func kvExtentPrefix(typ *RType) []byte {
+	return kvKey(kvExtent, typ.ShortName(), "\x00")
+}
+
+/*
+The ids of the stored objects of the type, including the objects of its subtypes, in order.
+*/
+func kvExtentIds(tx *kv.Tx, typ *RType) (ids []int64) {
+	prefix := kvExtentPrefix(typ)
+	tx.AscendPrefix(prefix, func(key []byte, val []byte) bool {
+		ids = append(ids, kvIdVal(key[len(prefix):]))
+		return true
+	})
+	return
+}
+
+/*
+The record of an object, under its 'o' key.
+*/
+type kvObjectRecord struct {
+	id2      int64
+	flags    int
+	version  uint32
+	typeName string
+}
+
+func (r *kvObjectRecord) bytes() []byte {
+	b := make([]byte, 16, 16+len(r.typeName))
+	binary.BigEndian.PutUint64(b, uint64(r.id2))
+	binary.BigEndian.PutUint32(b[8:], uint32(r.flags))
+	binary.BigEndian.PutUint32(b[12:], r.version)
+	return append(b, r.typeName...)
+}
+
+func kvDecodeObjectRecord(b []byte) (r *kvObjectRecord, err error) {
+	if len(b) <= 16 {
+		err = errors.New("Malformed object record in the key-value database.")
+		return
+	}
+	r = &kvObjectRecord{
+		id2:      int64(binary.BigEndian.Uint64(b)),
+		flags:    int(binary.BigEndian.Uint32(b[8:])),
+		version:  binary.BigEndian.Uint32(b[12:]),
+		typeName: string(b[16:]),
+	}
+	return
+}
+
+/////////////////////////////////////////
+// Encoding of values
+/////////////////////////////////////////
+
+func kvUint64(b []byte, x uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], x)
+	return append(b, buf[:]...)
+}
+
+/*
+The bits of the float, changed so that they sort in the numeric order of the floats.
+*/
+func kvFloatBits(f float64) uint64 {
+	bits := math.Float64bits(f)
+	if bits&(1<<63) == 0 {
+		return bits ^ (1 << 63)
+	}
+	return ^bits
+}
+
+func kvBitsFloat(bits uint64) float64 {
+	if bits&(1<<63) != 0 {
+		return math.Float64frombits(bits ^ (1 << 63))
+	}
+	return math.Float64frombits(^bits)
+}
+
+/*
+Encodes a value to be stored. A non-primitive value is encoded as a reference to the object, by its dbid.
+*/
+func kvEncode(val RObject) (b []byte, err error) {
+	switch v := val.(type) {
+	case Int:
+		b = kvUint64([]byte{'I'}, uint64(v)^(1<<63))
+	case Int32:
+		b = kvUint64([]byte{'i'}, uint64(int64(v))^(1<<63))
+	case Uint:
+		b = kvUint64([]byte{'U'}, uint64(v))
+	case Uint32:
+		b = kvUint64([]byte{'u'}, uint64(v))
+	case Float:
+		b = kvUint64([]byte{'F'}, kvFloatBits(float64(v)))
+	case Bool:
+		b = []byte{'B', 0}
+		if v {
+			b[1] = 1
+		}
+	case String:
+		b = append([]byte{'S'}, string(v)...)
+	case RTime:
+		t := time.Time(v)
+		b = kvUint64([]byte{'T'}, uint64(t.Unix())^(1<<63))
+		b = append(b, byte(t.Nanosecond()>>24), byte(t.Nanosecond()>>16), byte(t.Nanosecond()>>8), byte(t.Nanosecond()))
+		b = append(b, t.Location().String()...)
+	case Complex:
+		b = kvUint64(kvUint64([]byte{'C'}, kvFloatBits(real(v))), kvFloatBits(imag(v)))
+	case Complex32:
+		b = kvUint64(kvUint64([]byte{'c'}, kvFloatBits(float64(real(v)))), kvFloatBits(float64(imag(v))))
+	default:
+		if val.Type().IsPrimitive {
+			err = fmt.Errorf("A value of type %s cannot be stored in a key-value database.", val.Type().Name)
+			return
+		}
+		b = append([]byte{'R'}, kvId(val.DBID())...)
+	}
+	return
+}
+
+/*
+Decodes a stored value. A reference to an object is decoded as a Proxy of the object.
+*/
+func kvDecode(b []byte) (val RObject, err error) {
+	if len(b) == 0 {
+		err = errors.New("Empty value in the key-value database.")
+		return
+	}
+	if len(b) < 9 && b[0] != 'S' && b[0] != 'B' {
+		err = fmt.Errorf("Malformed value '%c' in the key-value database.", b[0])
+		return
+	}
+	switch b[0] {
+	case 'I':
+		val = Int(int64(binary.BigEndian.Uint64(b[1:]) ^ (1 << 63)))
+	case 'i':
+		val = Int32(int32(int64(binary.BigEndian.Uint64(b[1:]) ^ (1 << 63))))
+	case 'U':
+		val = Uint(binary.BigEndian.Uint64(b[1:]))
+	case 'u':
+		val = Uint32(uint32(binary.BigEndian.Uint64(b[1:])))
+	case 'F':
+		val = Float(kvBitsFloat(binary.BigEndian.Uint64(b[1:])))
+	case 'B':
+		val = Bool(len(b) > 1 && b[1] != 0)
+	case 'S':
+		val = String(b[1:])
+	case 'T':
+		if len(b) < 13 {
+			err = errors.New("Malformed Time value in the key-value database.")
+			return
+		}
+		secs := int64(binary.BigEndian.Uint64(b[1:]) ^ (1 << 63))
+		nsecs := int64(binary.BigEndian.Uint32(b[9:]))
+		t := time.Unix(secs, nsecs)
+		var location *time.Location
+		location, err = LoadLocation(string(b[13:]))
+		if err != nil {
+			return
+		}
+		val = RTime(t.In(location))
+	case 'C':
+		if len(b) < 17 {
+			err = errors.New("Malformed Complex value in the key-value database.")
+			return
+		}
+		val = Complex(complex(kvBitsFloat(binary.BigEndian.Uint64(b[1:])), kvBitsFloat(binary.BigEndian.Uint64(b[9:]))))
+	case 'c':
+		if len(b) < 17 {
+			err = errors.New("Malformed Complex32 value in the key-value database.")
+			return
+		}
+		val = Complex32(complex(float32(kvBitsFloat(binary.BigEndian.Uint64(b[1:]))), float32(kvBitsFloat(binary.BigEndian.Uint64(b[9:])))))
+	case 'R':
+		val = Proxy(kvIdVal(b[1:]))
+	default:
+		err = fmt.Errorf("Malformed value '%c' in the key-value database.", b[0])
+	}
+	return
+}
+
+/*
+If the stored value is a reference to an object, returns the object's dbid.
+*/
+func kvRefId(b []byte) (id int64, isRef bool) {
+	if len(b) == 9 && b[0] == 'R' {
+		id = kvIdVal(b[1:])
+		isRef = true
+	}
+	return
+}
+
+func isMutexType(typ *RType) bool {
+	return typ == MutexType || typ == RWMutexType || typ == OwnedMutexType
+}
+
+/*
+Returns the encoded value, to be stored as the value of an attribute or a collection member,
+first storing the value, if it is an object, and is not yet persistent.
+*/
+func (db *KVDBThread) storedValue(th InterpreterThread, val RObject) (b []byte, err error) {
+	if ! val.Type().IsPrimitive {
+		err = db.EnsurePersisted(th, val)
+		if err != nil {
+			return
+		}
+	}
+	b, err = kvEncode(val)
+	return
+}
+
+/*
+   In optimistic concurrency mode, checks that the version of the object's state in the db is still the version
+   the in-memory object was loaded from, and increments the db version, before the object's first write in
+   the thread's transaction. See SqliteDBThread.checkVersion.
+*/
+func (db *KVDBThread) checkVersion(tx *kv.Tx, obj RObject) (err error) {
+	if ! params.DbOptimisticConcurrency {
+		return
+	}
+	pers := obj.(Persistable)
+	var rtx *RTransaction
+	if db.dbt.th != nil {
+		rtx = db.dbt.th.Transaction()
+	}
+	if rtx != nil && ! rtx.NeedsVersionCheck(pers) {
+		return
+	}
+	version := pers.Version()
+	key := kvKey(kvObject, kvId(obj.DBID()))
+	isStale := true
+	if b := tx.Get(key); b != nil {
+		var r *kvObjectRecord
+		r, err = kvDecodeObjectRecord(b)
+		if err != nil {
+			return
+		}
+		if r.version == version {
+			isStale = false
+			r.version++
+			err = tx.Put(key, r.bytes())
+			if err != nil {
+				return
+			}
+		}
+	}
+	if rtx != nil {
+		rtx.RecordVersionCheck(pers, isStale)
+	} else if isStale {
+		obj.SetLoadNeeded()
+		err = &TransactionError{Kind: TX_CONFLICT, Op: "UPDATE", Tries: 1, Err: fmt.Errorf("%v (version %d) was changed by another connection", obj, version)}
+	} else {
+		pers.SetVersion(version + 1)
+	}
+	return
+}
+
+/*
+   Persist the setting of an attribute to a value.
+   Only applies to single-valued attributes.
+   Assumes that the the obj is already persisted, but does not assume that the value is.
+*/
+func (db *KVDBThread) PersistSetAttr(th InterpreterThread, obj RObject, attr *AttributeSpec, val RObject, attrHadValue bool) (err error) {
+	err = db.update(func(tx *kv.Tx) (err error) {
+		err = db.checkVersion(tx, obj)
+		if err != nil {
+			return
+		}
+		if isMutexType(val.Type()) {
+			return // skip persisting
+		}
+		b, err := db.storedValue(th, val)
+		if err != nil {
+			return
+		}
+		sp := tx.Savepoint()
+		err = tx.Put(kvAttrKey(obj.DBID(), attr), b)
+		if err == nil && attr.IsSimple() {
+			err = db.indexObject(tx, obj, attr)
+		}
+		if err != nil {
+			tx.RollbackTo(sp)
+			obj.SetLoadNeeded() // Persistence of the change failed. Memory state is invalid.
+			return
+		}
+		tx.ReleaseSavepoint(sp)
+		return
+	})
+	return
+}
+
+/*
+   Persist the setting of an attribute to nil.
+   Only applies to single-valued attributes.
+   Assumes that the the obj is already persisted.
+   Ok to call this even if there is no value of the attribute for the object.
+*/
+func (db *KVDBThread) PersistRemoveAttr(obj RObject, attr *AttributeSpec) (err error) {
+	err = db.update(func(tx *kv.Tx) (err error) {
+		err = db.checkVersion(tx, obj)
+		if err != nil || isMutexType(attr.Part.Type) {
+			return
+		}
+		err = tx.Delete(kvAttrKey(obj.DBID(), attr))
+		if err == nil && attr.IsSimple() {
+			err = db.indexObject(tx, obj, attr)
+		}
+		return
+	})
+	return
+}
+
+/*
+   Store the object in the database for the first time, along with the objects it refers to.
+   If object is stored already, does nothing. See SqliteDBThread.EnsurePersisted.
+*/
+func (db *KVDBThread) EnsurePersisted(th InterpreterThread, obj RObject) (err error) {
+	defer Un(Trace(PERSIST_TR2, "EnsurePersisted", obj))
+
+	// If being persisted in another transaction, just wait it out, and then return.
+	pers := obj.(Persistable)
+	tx := pers.Transaction()
+	if tx != nil && tx != th.Transaction() {
+		err = tx.Await(th, obj)
+		return
+	}
+
+	if obj.IsBeingStored() {
+		return
+	}
+
+	obj.SetBeingStored()
+	db.dbt.recordStoredDB(obj)
+	if th.Transaction() != nil {
+		err = pers.SetTransaction(th.Transaction()) // Fails if the transaction has timed out.
+		if err != nil {
+			obj.ClearBeingStored()
+			return
+		}
+	}
+
+	err = db.update(func(tx *kv.Tx) (err error) {
+		if obj.HasUUID() {
+			err = db.persistRemoteObject(tx, th, obj)
+		} else {
+			err = db.persistNewObject(tx, th, obj)
+		}
+		if err != nil {
+			return
+		}
+
+		RT.Cache(obj) // Put in an in-memory object cache so that the runtime will only contain one object instance for each uuid.
+
+		err = db.persistAttributes(tx, th, obj)
+		if err != nil {
+			return
+		}
+		if obj.IsCollection() {
+			collection := obj.(RCollection)
+			err = db.putMembers(tx, th, collection, kvMemberPrefix(collection.DBID(), ""))
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	if th.Transaction() == nil {
+		obj.SetStoredLocally()
+	}
+	return
+}
+
+/*
+   Persist a remote object which has not yet been persisted locally.
+   If its id is taken by another object, it is stored with its id halves reversed.
+*/
+func (db *KVDBThread) persistRemoteObject(tx *kv.Tx, th InterpreterThread, obj RObject) (err error) {
+	obj.ClearIdReversed()
+	id, id2 := obj.UUIDuint64s()
+
+	dbid := int64(id)
+	dbid2 := int64(id2)
+
+	if tx.Get(kvKey(kvObject, kvId(dbid))) != nil {
+		dbid, dbid2 = dbid2, dbid
+		obj.SetIdReversed()
+		if tx.Get(kvKey(kvObject, kvId(dbid))) != nil {
+			rterr.Stop("Can't store remote object locally because of db id conflict.") // Chance of this is extremely small.
+		}
+	}
+	err = db.insert(tx, th, obj, dbid, dbid2)
+	return
+}
+
+/*
+   Persist a newly created object. Creates a uuid for it.
+*/
+func (db *KVDBThread) persistNewObject(tx *kv.Tx, th InterpreterThread, obj RObject) (err error) {
+	for { // loop til we create a first half of uuid which is unique as an object id in the local db.
+		var id, id2 uint64
+		id, id2, err = obj.EnsureUUIDuint64s()
+		if err != nil {
+			return
+		}
+		dbid := int64(id)
+		if tx.Get(kvKey(kvObject, kvId(dbid))) != nil {
+			obj.RemoveUUID()
+			continue
+		}
+		err = db.insert(tx, th, obj, dbid, int64(id2))
+		return
+	}
+}
+
+/*
+   Stores the record of the object, the object in the extent of its type and supertypes, and the values of
+   its unary primitive-valued attributes. If the object would violate a unique index, stores nothing, and
+   returns a *UniqueIndexError.
+*/
+func (db *KVDBThread) insert(tx *kv.Tx, th InterpreterThread, obj RObject, dbid, dbid2 int64) (err error) {
+	sp := tx.Savepoint()
+	defer func() {
+		if err != nil {
+			tx.RollbackTo(sp)
+		} else {
+			tx.ReleaseSavepoint(sp)
+		}
+	}()
+
+	record := &kvObjectRecord{id2: dbid2, flags: int(obj.Flags()), version: obj.(Persistable).Version()}
+	if obj.IsCollection() {
+		record.typeName, _, _, _, _ = typeDescriptor(obj.(RCollection))
+		err = tx.Put(kvKey(kvObject, kvId(dbid)), record.bytes())
+		return
+	}
+	record.typeName = obj.Type().ShortName()
+	err = tx.Put(kvKey(kvObject, kvId(dbid)), record.bytes())
+	if err != nil {
+		return
+	}
+
+	for _, typ := range append([]*RType{obj.Type()}, obj.Type().Up...) {
+		err = tx.Put(kvKey(kvExtent, typ.ShortName(), "\x00", kvId(dbid)), nil)
+		if err != nil {
+			return
+		}
+		for _, attr := range typ.Attributes {
+			if ! isTypeTableColumn(attr) || isMutexType(attr.Part.Type) {
+				continue
+			}
+			val, found := RT.AttrVal(th, obj, attr)
+			if ! found {
+				continue
+			}
+			var b []byte
+			b, err = kvEncode(val)
+			if err != nil {
+				return
+			}
+			err = tx.Put(kvAttrKey(dbid, attr), b)
+			if err != nil {
+				return
+			}
+		}
+	}
+	err = db.indexObject(tx, obj, nil)
+	return
+}
+
+/*
+   Persists (if necessary) each object which is the value of a non-primitive or collection-valued attribute of
+   the object, and stores the attribute value, or the members of a multi-valued attribute.
+   Assumes that obj has only just now been persisted.
+*/
+func (db *KVDBThread) persistAttributes(tx *kv.Tx, th InterpreterThread, obj RObject) (err error) {
+	defer Un(Trace(PERSIST_TR2, "persistAttributes", obj))
+
+	for _, typ := range append([]*RType{obj.Type()}, obj.Type().Up...) {
+		for _, attr := range typ.Attributes {
+			if ! attr.IsComplex() || attr.IsTransient {
+				continue
+			}
+			val, found := RT.AttrValue(th, obj, attr, false, true, true)
+			if ! found {
+				continue
+			}
+			if attr.IsMultiValued() { // a collection owned by the "whole" object
+				err = db.putMembers(tx, th, val.(RCollection), kvMemberPrefix(obj.DBID(), kvAttrName(attr)))
+			} else { // a single non-primitive value or independent collection
+				var b []byte
+				b, err = db.storedValue(th, val)
+				if err == nil {
+					err = tx.Put(kvAttrKey(obj.DBID(), attr), b)
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+/*
+The member part of the key of a member of the collection: the encoded map key, the index of an element of
+an ordered collection, or the encoded value of a member of a set.
+*/
+func kvMemberKey(coll RCollection, key RObject, index int64, val []byte) (member []byte, err error) {
+	if coll.IsMap() {
+		member, err = kvEncode(key)
+	} else if coll.IsOrdered() {
+		member = []byte(kvId(index))
+	} else {
+		member = val
+	}
+	return
+}
+
+/*
+Stores the members of the collection, which has just been persisted, under the prefix.
+*/
+func (db *KVDBThread) putMembers(tx *kv.Tx, th InterpreterThread, coll RCollection, prefix []byte) (err error) {
+	put := func(key RObject, i int64, val RObject) (err error) {
+		b, err := db.storedValue(th, val)
+		if err != nil {
+			return
+		}
+		if key != nil && ! key.Type().IsPrimitive {
+			err = db.EnsurePersisted(th, key)
+			if err != nil {
+				return
+			}
+		}
+		member, err := kvMemberKey(coll, key, i, b)
+		if err != nil {
+			return
+		}
+		err = tx.Put(append(append([]byte{}, prefix...), member...), b)
+		return
+	}
+
+	if coll.IsMap() {
+		theMap := coll.(Map)
+		for key := range theMap.Iter(nil) {
+			val, _ := theMap.Get(key)
+			err = put(key, 0, val)
+			if err != nil {
+				return
+			}
+		}
+		return
+	}
+	var i int64
+	for val := range coll.Iter(nil) {
+		err = put(nil, i, val)
+		if err != nil {
+			return
+		}
+		i++
+	}
+	if list, isBig := coll.(BigList); isBig {
+		list.SetStored(i)
+	}
+	return
+}
+
+/*
+Moves the elements of an ordered collection, at and after the index, by the number of places.
+*/
+func kvShift(tx *kv.Tx, prefix []byte, index int64, by int64) (err error) {
+	var ords []int64
+	var vals [][]byte
+	tx.Ascend(append(append([]byte{}, prefix...), kvId(index)...), func(key []byte, val []byte) bool {
+		if ! bytes.HasPrefix(key, prefix) {
+			return false
+		}
+		ords = append(ords, kvIdVal(key[len(prefix):]))
+		vals = append(vals, val)
+		return true
+	})
+	for _, ord := range ords {
+		err = tx.Delete(append(append([]byte{}, prefix...), kvId(ord)...))
+		if err != nil {
+			return
+		}
+	}
+	for i, ord := range ords {
+		err = tx.Put(append(append([]byte{}, prefix...), kvId(ord+by)...), vals[i])
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+/*
+Deletes the keys which begin with the prefix.
+*/
+func kvDeletePrefix(tx *kv.Tx, prefix []byte) (err error) {
+	var keys [][]byte
+	tx.AscendPrefix(prefix, func(key []byte, val []byte) bool {
+		keys = append(keys, key)
+		return true
+	})
+	for _, key := range keys {
+		err = tx.Delete(key)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+/*
+Persists the insertion of the value into the collection, whose members are stored under the prefix,
+at the index (of an ordered collection). The elements at and after the index move up one place.
+*/
+func (db *KVDBThread) insertMember(tx *kv.Tx, th InterpreterThread, coll RCollection, prefix []byte, val RObject, insertIndex int) (err error) {
+	b, err := db.storedValue(th, val)
+	if err != nil {
+		return
+	}
+	if coll.IsOrdered() {
+		err = kvShift(tx, prefix, int64(insertIndex), 1)
+		if err != nil {
+			return
+		}
+	}
+	member, err := kvMemberKey(coll, nil, int64(insertIndex), b)
+	if err != nil {
+		return
+	}
+	err = tx.Put(append(append([]byte{}, prefix...), member...), b)
+	return
+}
+
+/*
+Persists the removal of the value from the collection, whose members are stored under the prefix.
+If the collection is a map, val is the key of the removed entry. If the collection is ordered, and removedIndex
+is not -1, the element at the index is removed, and the elements after it move down one place.
+Otherwise the elements equal to the value are removed.
+*/
+func (db *KVDBThread) removeMember(tx *kv.Tx, coll RCollection, prefix []byte, val RObject, removedIndex int) (err error) {
+	b, err := kvEncode(val)
+	if err != nil {
+		return
+	}
+	if coll.IsMap() || ! coll.IsOrdered() {
+		err = tx.Delete(append(append([]byte{}, prefix...), b...))
+		return
+	}
+	if removedIndex >= 0 {
+		err = tx.Delete(append(append([]byte{}, prefix...), kvId(int64(removedIndex))...))
+		if err == nil {
+			err = kvShift(tx, prefix, int64(removedIndex)+1, -1)
+		}
+		return
+	}
+	var keys [][]byte
+	tx.AscendPrefix(prefix, func(key []byte, v []byte) bool {
+		if bytes.Equal(v, b) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	for _, key := range keys {
+		err = tx.Delete(key)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+/*
+   Persist the adding of a value to a multi-valued attribute.
+   Assumes that the the obj is already persisted, but does not assume that the value is.
+*/
+func (db *KVDBThread) PersistAddToAttr(th InterpreterThread, obj RObject, attr *AttributeSpec, val RObject, insertIndex int) (err error) {
+	err = db.update(func(tx *kv.Tx) (err error) {
+		err = db.checkVersion(tx, obj)
+		if err != nil {
+			return
+		}
+		collection, err := RT.EnsureMultiValuedAttributeCollection(obj, attr)
+		if err != nil {
+			return
+		}
+		err = db.insertMember(tx, th, collection, kvMemberPrefix(obj.DBID(), kvAttrName(attr)), val, insertIndex)
+		return
+	})
+	return
+}
+
+/*
+   Persist the removing of a value from a multi-valued attribute.
+   Assumes that the the removal has happened from the in-memory collection.
+*/
+func (db *KVDBThread) PersistRemoveFromAttr(obj RObject, attr *AttributeSpec, val RObject, removedIndex int) (err error) {
+	err = db.update(func(tx *kv.Tx) (err error) {
+		err = db.checkVersion(tx, obj)
+		if err != nil {
+			return
+		}
+		collection, err := RT.EnsureMultiValuedAttributeCollection(obj, attr)
+		if err != nil {
+			return
+		}
+		err = db.removeMember(tx, collection, kvMemberPrefix(obj.DBID(), kvAttrName(attr)), val, removedIndex)
+		return
+	})
+	return
+}
+
+/*
+   Persist the removing of all values from a multi-valued attribute. If the attribute is one end of a relation,
+   the object is also removed from the other end of the relation, in each of the related objects.
+*/
+func (db *KVDBThread) PersistClearAttr(obj RObject, attr *AttributeSpec) (err error) {
+	err = db.update(func(tx *kv.Tx) (err error) {
+		err = db.checkVersion(tx, obj)
+		if err != nil {
+			return
+		}
+		err = kvDeletePrefix(tx, kvMemberPrefix(obj.DBID(), kvAttrName(attr)))
+		if err != nil || attr.Inverse == nil || attr.Part.Type.IsPrimitive {
+			return
+		}
+
+		// The inverse attribute's members are stored under the ids of the related objects, so all of the
+		// members of multi-valued attributes are scanned for references to the object.
+
+		inverseName := []byte(kvAttrName(attr.Inverse) + "\x00")
+		ref, _ := kvEncode(obj)
+		var keys [][]byte
+		tx.AscendPrefix([]byte{kvMember}, func(key []byte, val []byte) bool {
+			if bytes.HasPrefix(key[9:], inverseName) && bytes.Equal(val, ref) {
+				keys = append(keys, key)
+			}
+			return true
+		})
+		for _, key := range keys {
+			err = tx.Delete(key)
+			if err != nil {
+				return
+			}
+		}
+		return
+	})
+	return
+}
+
+func (db *KVDBThread) PersistSetAttrElement(th InterpreterThread, obj RObject, attr *AttributeSpec, val RObject, index int) (err error) {
+	err = db.update(func(tx *kv.Tx) (err error) {
+		err = db.checkVersion(tx, obj)
+		if err != nil {
+			return
+		}
+		b, err := db.storedValue(th, val)
+		if err != nil {
+			return
+		}
+		err = tx.Put(kvKey(kvMember, kvId(obj.DBID()), kvAttrName(attr), "\x00", kvId(int64(index))), b)
+		return
+	})
+	return
+}
+
+func (db *KVDBThread) PersistSetCollectionElement(th InterpreterThread, coll IndexSettable, val RObject, index int) (err error) {
+	err = db.update(func(tx *kv.Tx) (err error) {
+		err = db.checkVersion(tx, coll)
+		if err != nil {
+			return
+		}
+		b, err := db.storedValue(th, val)
+		if err != nil {
+			return
+		}
+		err = tx.Put(append(kvCollectionPrefix(coll), kvId(int64(index))...), b)
+		return
+	})
+	return
+}
+
+func (db *KVDBThread) PersistMapPut(th InterpreterThread, theMap Map, key RObject, val RObject, isNewKey bool) (err error) {
+	err = db.update(func(tx *kv.Tx) (err error) {
+		err = db.checkVersion(tx, theMap)
+		if err != nil {
+			return
+		}
+		b, err := db.storedValue(th, val)
+		if err != nil {
+			return
+		}
+		k, err := db.storedValue(th, key)
+		if err != nil {
+			return
+		}
+		err = tx.Put(append(kvCollectionPrefix(theMap), k...), b)
+		return
+	})
+	return
+}
+
+func (db *KVDBThread) PersistAddToCollection(th InterpreterThread, coll AddableCollection, val RObject, insertIndex int) (err error) {
+	err = db.update(func(tx *kv.Tx) (err error) {
+		err = db.checkVersion(tx, coll)
+		if err != nil {
+			return
+		}
+		err = db.insertMember(tx, th, coll, kvCollectionPrefix(coll), val, insertIndex)
+		return
+	})
+	return
+}
+
+func (db *KVDBThread) PersistRemoveFromCollection(coll RemovableCollection, val RObject, removedIndex int) (err error) {
+	err = db.update(func(tx *kv.Tx) (err error) {
+		err = db.checkVersion(tx, coll)
+		if err != nil {
+			return
+		}
+		err = db.removeMember(tx, coll, kvCollectionPrefix(coll), val, removedIndex)
+		return
+	})
+	return
+}
+
+func (db *KVDBThread) PersistClearCollection(coll RemovableCollection) (err error) {
+	err = db.update(func(tx *kv.Tx) (err error) {
+		err = db.checkVersion(tx, coll)
+		if err != nil {
+			return
+		}
+		err = kvDeletePrefix(tx, kvCollectionPrefix(coll))
+		return
+	})
+	return
+}
+
+/////////////////////////////////////////
+// Names of objects
+/////////////////////////////////////////
+
+/*
+   Gives the (already persisted) object an official name in the database.
+*/
+func (db *KVDBThread) NameObject(obj RObject, name string) (err error) {
+	id := obj.DBID()
+	err = db.update(func(tx *kv.Tx) (err error) {
+		if tx.Get(kvKey(kvName, name)) != nil {
+			err = fmt.Errorf("An object is already named '%s' in the database.", name)
+			return
+		}
+		hasName := false
+		tx.AscendPrefix(kvKey(kvObjectName, kvId(id)), func(key []byte, val []byte) bool {
+			hasName = true
+			return false
+		})
+		if hasName {
+			err = fmt.Errorf("%v already has a name in the database.", obj)
+			return
+		}
+		err = tx.Put(kvKey(kvName, name), []byte(kvId(id)))
+		if err == nil {
+			err = tx.Put(kvKey(kvObjectName, kvId(id), name), nil)
+		}
+		return
+	})
+	return
+}
+
+func (db *KVDBThread) RenameObject(oldName string, newName string) (err error) {
+	err = db.update(func(tx *kv.Tx) (err error) {
+		b := tx.Get(kvKey(kvName, oldName))
+		if b == nil {
+			return
+		}
+		if tx.Get(kvKey(kvName, newName)) != nil {
+			err = fmt.Errorf("An object is already named '%s' in the database.", newName)
+			return
+		}
+		id := kvId(kvIdVal(b))
+		for _, key := range [][]byte{kvKey(kvName, oldName), kvKey(kvObjectName, id, oldName)} {
+			err = tx.Delete(key)
+			if err != nil {
+				return
+			}
+		}
+		err = tx.Put(kvKey(kvName, newName), []byte(id))
+		if err == nil {
+			err = tx.Put(kvKey(kvObjectName, id, newName), nil)
+		}
+		return
+	})
+	return
+}
+
+/*
+Returns true if an object has been named in the database with the argument name.
+*/
+func (db *KVDBThread) ObjectNameExists(name string) (found bool, err error) {
+	err = db.view(func(tx *kv.Tx) error {
+		found = tx.Get(kvKey(kvName, name)) != nil
+		return nil
+	})
+	return
+}
+
+/*
+Returns the names of objects which begin with the prefix, in order.
+*/
+func (db *KVDBThread) ObjectNames(prefix string) (names []string, err error) {
+	err = db.view(func(tx *kv.Tx) error {
+		tx.AscendPrefix(kvKey(kvName, prefix), func(key []byte, val []byte) bool {
+			names = append(names, string(key[1:]))
+			return true
+		})
+		return nil
+	})
+	return
+}
+
+/*
+Deletes the object, its names, its attribute values, and its unique index entries, from the database.
+Does NOT delete the members of its multi-valued attributes, nor its membership in collections.
+Is a safe no-op for objects that are not stored locally.
+*/
+func (db *KVDBThread) Delete(obj RObject) (err error) {
+	if ! obj.IsBeingStored() {
+		return
+	}
+	id := obj.DBID()
+	err = db.update(func(tx *kv.Tx) (err error) {
+		err = checkVersionBeforeDelete(db.dbt, obj, func() error { return db.checkVersion(tx, obj) })
+		if err != nil {
+			return
+		}
+		err = tx.Delete(kvKey(kvObject, kvId(id)))
+		if err != nil {
+			return
+		}
+		var names []string
+		tx.AscendPrefix(kvKey(kvObjectName, kvId(id)), func(key []byte, val []byte) bool {
+			names = append(names, string(key[9:]))
+			return true
+		})
+		for _, name := range names {
+			err = tx.Delete(kvKey(kvName, name))
+			if err != nil {
+				return
+			}
+		}
+		for _, prefix := range [][]byte{kvKey(kvObjectName, kvId(id)), kvKey(kvAttr, kvId(id))} {
+			err = kvDeletePrefix(tx, prefix)
+			if err != nil {
+				return
+			}
+		}
+		if ! obj.IsCollection() {
+			for _, typ := range append([]*RType{obj.Type()}, obj.Type().Up...) {
+				err = tx.Delete(kvKey(kvExtent, typ.ShortName(), "\x00", kvId(id)))
+				if err != nil {
+					return
+				}
+			}
+		}
+		err = db.unindexObject(tx, id)
+		return
+	})
+	if err != nil {
+		return
+	}
+	obj.ClearStoredLocally()
+	obj.ClearBeingStored()
+
+	RT.Uncache(obj)
+	return
+}
+
+/////////////////////////////////////////
+// Fetching objects
+/////////////////////////////////////////
+
+/*
+   Given the local dbid of an object, retrieve and return the object stored in the database.
+   If the object is a unit (structure), the radius determines how many related objects in the tree are also fetched.
+   0 means fetch object only. 1 means referred-to objects, 2 means referred-to by referred to etc.
+*/
+func (db *KVDBThread) Fetch(id int64, radius int) (obj RObject, err error) {
+	defer Un(Trace(PERSIST_TR, "Fetch", id, radius))
+	var found bool
+	obj, found = RT.GetObject(id)
+	if found {
+		return
+	}
+	err = db.view(func(tx *kv.Tx) (err error) {
+		obj, err = db.fetch1(tx, id, radius, fmt.Sprintf("id=%v", id), false)
+		return
+	})
+	return
+}
+
+/*
+   Given a name that some object has been 'dubbed' with, retrieve and return the object stored in the database.
+*/
+func (db *KVDBThread) FetchByName(name string, radius int) (obj RObject, err error) {
+	defer Un(Trace(PERSIST_TR, "FetchByName", name, radius))
+	err = db.view(func(tx *kv.Tx) (err error) {
+		errSuffix := fmt.Sprintf("name='%s'", name)
+		b := tx.Get(kvKey(kvName, name))
+		if b == nil {
+			err = fmt.Errorf("No object found in database with %s.", errSuffix)
+			return
+		}
+		obj, err = db.fetch1(tx, kvIdVal(b), radius, errSuffix, true)
+		return
+	})
+	return
+}
+
+/*
+   Refresh the state of the object from the object data stored in the database.
+*/
+func (db *KVDBThread) Refresh(obj RObject, radius int) (err error) {
+	defer Un(Trace(PERSIST_TR, "Refresh", obj.DBID(), radius))
+	id := obj.DBID()
+	err = db.view(func(tx *kv.Tx) (err error) {
+		b := tx.Get(kvKey(kvObject, kvId(id)))
+		if b == nil {
+			err = fmt.Errorf("No object found in database with id=%v.", id)
+			return
+		}
+		r, err := kvDecodeObjectRecord(b)
+		if err != nil {
+			return
+		}
+		pers := obj.(Persistable)
+		pers.RestoreIdsAndFlags(id, r.id2, r.flags)
+		db.dbt.recordStoredDB(obj)
+		pers.SetVersion(r.version)
+
+		err = db.restorePrimitiveAttrs(tx, id, obj)
+		if err != nil {
+			return
+		}
+		err = db.fetchRelated(tx, obj, radius)
+		return
+	})
+	return
+}
+
+/*
+   Retrieves the object with the id from the database, and restores its values.
+*/
+func (db *KVDBThread) fetch1(tx *kv.Tx, id int64, radius int, errSuffix string, checkCache bool) (obj RObject, err error) {
+	b := tx.Get(kvKey(kvObject, kvId(id)))
+	if b == nil {
+		err = fmt.Errorf("No object found in database with %s.", errSuffix)
+		return
+	}
+	r, err := kvDecodeObjectRecord(b)
+	if err != nil {
+		return
+	}
+
+	if checkCache {
+		var found bool
+		obj, found = RT.GetObject(DBID(id, r.id2, r.flags))
+		if found {
+			return
+		}
+	}
+
+	obj, err = newStoredObject(r.typeName)
+	if err != nil {
+		return
+	}
+
+	pers := obj.(Persistable)
+	pers.RestoreIdsAndFlags(id, r.id2, r.flags)
+	db.dbt.recordStoredDB(obj)
+	pers.SetVersion(r.version)
+
+	Logln(PERSIST2_, "id:", id, ", id2:", r.id2, ", flags:", r.flags, ", typeName:", r.typeName)
+
+	RT.Cache(obj) // Put in an in-memory object cache so that the runtime will only contain one object instance for each uuid.
+
+	err = db.restorePrimitiveAttrs(tx, id, obj)
+	if err != nil {
+		return
+	}
+
+	// Set before fetching related objects, so that reference loops do not cause infinite fetching.
+
+	obj.SetStoredLocally()
+
+	err = db.fetchRelated(tx, obj, radius)
+	return
+}
+
+/*
+   Fetches the members of the object, if it is a collection, or otherwise, if the radius is greater than 0,
+   the values of its non-primitive and multi-valued attributes.
+*/
+func (db *KVDBThread) fetchRelated(tx *kv.Tx, obj RObject, radius int) (err error) {
+	if obj.IsCollection() {
+		collection := obj.(RCollection)
+		err = db.fetchMembers(tx, collection, kvMemberPrefix(collection.DBID(), ""), radius)
+	} else if radius > 0 {
+		err = db.fetchAttributes(tx, obj, radius-1)
+	}
+	return
+}
+
+/*
+   Restores the stored values of the unary primitive-valued attributes of the object.
+*/
+func (db *KVDBThread) restorePrimitiveAttrs(tx *kv.Tx, id int64, obj RObject) (err error) {
+	for _, typ := range append([]*RType{obj.Type()}, obj.Type().Up...) {
+		for _, attr := range typ.Attributes {
+			if ! isTypeTableColumn(attr) || isMutexType(attr.Part.Type) {
+				continue
+			}
+			b := tx.Get(kvAttrKey(id, attr))
+			if b == nil {
+				continue
+			}
+			var val RObject
+			val, err = kvDecode(b)
+			if err != nil {
+				return
+			}
+			RT.RestoreAttrNonLocking(obj, attr, val)
+		}
+	}
+	return
+}
+
+/*
+   Fetches the values of the non-primitive-valued attributes and collection-valued attributes of the object,
+   and the members of its multi-valued attributes. Objects are fetched to the radius.
+*/
+func (db *KVDBThread) fetchAttributes(tx *kv.Tx, obj RObject, radius int) (err error) {
+	for _, typ := range append([]*RType{obj.Type()}, obj.Type().Up...) {
+		for _, attr := range typ.Attributes {
+			if attr.IsTransient {
+				continue
+			}
+			if (attr.Part.CollectionType == "" && ! attr.Part.Type.IsPrimitive) || attr.IsIndependentCollection() {
+				_, err = db.fetchAttributeValue(tx, obj, attr, radius)
+			} else if attr.IsMultiValued() {
+				err = db.fetchAttributeMembers(tx, obj, attr, radius)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+/*
+   Fetches the object which is the value of the unary attribute of the object, and sets the attribute to it.
+   found is false if the attribute has no stored value.
+*/
+func (db *KVDBThread) fetchAttributeValue(tx *kv.Tx, obj RObject, attr *AttributeSpec, radius int) (found bool, err error) {
+	b := tx.Get(kvAttrKey(obj.DBID(), attr))
+	if b == nil {
+		return
+	}
+	id, isRef := kvRefId(b)
+	if ! isRef {
+		err = fmt.Errorf("The stored value of attribute %s of %v is not an object.", attr.Part.Name, obj)
+		return
+	}
+	val, err := db.Fetch(id, radius)
+	if err != nil {
+		return
+	}
+	RT.RestoreAttr(obj, attr, val)
+	found = true
+	return
+}
+
+/*
+   Fetches the members of the multi-valued attribute of the object into the attribute's collection.
+*/
+func (db *KVDBThread) fetchAttributeMembers(tx *kv.Tx, obj RObject, attr *AttributeSpec, radius int) (err error) {
+	collection, err := RT.EnsureMultiValuedAttributeCollection(obj, attr)
+	if err != nil {
+		return
+	}
+	err = db.fetchMembers(tx, collection, kvMemberPrefix(obj.DBID(), kvAttrName(attr)), radius)
+	return
+}
+
+/*
+   Populates the collection with its members, which are stored under the prefix. Members which are
+   objects are fetched to radius - 1, or if the radius is 0, are proxies.
+   A big list only records how many elements it has. Its elements are read as they are needed.
+*/
+func (db *KVDBThread) fetchMembers(tx *kv.Tx, collection RCollection, prefix []byte, radius int) (err error) {
+	defer Un(Trace(PERSIST_TR2, "fetchMembers", collection.Type()))
+
+	var members, vals [][]byte
+	tx.AscendPrefix(prefix, func(key []byte, val []byte) bool {
+		members = append(members, key[len(prefix):])
+		vals = append(vals, val)
+		return true
+	})
+
+	if list, isBig := collection.(BigList); isBig {
+		list.SetStored(int64(len(vals)))
+		return
+	}
+
+	collection.(RemovableMixin).ClearInMemory()
+	collection.SetMayContainProxies(radius <= 0 && ! collection.ElementType().IsPrimitive)
+
+	for i, b := range vals {
+		var val RObject
+		if id, isRef := kvRefId(b); isRef {
+			if radius > 0 { // fetch the full objects
+				val, err = db.Fetch(id, radius-1)
+				if err != nil {
+					return
+				}
+			} else { // Just put proxy objects into the collection.
+				val = Proxy(id)
+			}
+		} else {
+			val, err = kvDecode(b)
+			if err != nil {
+				return
+			}
+		}
+		if collection.IsMap() {
+			var key RObject
+			if id, isRef := kvRefId(members[i]); isRef {
+				key, err = db.Fetch(id, 1)
+			} else {
+				key, err = kvDecode(members[i])
+			}
+			if err != nil {
+				return
+			}
+			collection.(Map).PutSimple(key, val)
+		} else {
+			collection.(AddableMixin).AddSimple(val)
+		}
+	}
+	return
+}
+
+/*
+   Give the dbid of an object, fetches the value of the specified attribute of the object from the database.
+   The attribute should have a non-primitive value type or be multi-valued with primitive type of collection members.
+*/
+func (db *KVDBThread) FetchAttribute(th InterpreterThread, objId int64, obj RObject, attr *AttributeSpec, radius int) (val RObject, err error) {
+	defer Un(Trace(PERSIST_TR, "FetchAttribute", objId, radius))
+
+	err = db.view(func(tx *kv.Tx) (err error) {
+		if (attr.Part.CollectionType == "" && ! attr.Part.Type.IsPrimitive) || attr.IsIndependentCollection() {
+			var found bool
+			found, err = db.fetchAttributeValue(tx, obj, attr, radius)
+			if err == nil && ! found {
+				err = fmt.Errorf("Object %v has no value for attribute %s", objId, attr.Part.Name)
+			}
+		} else if attr.Part.CollectionType != "" {
+			err = db.fetchAttributeMembers(tx, obj, attr, radius)
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+	val, _ = RT.AttrVal(th, obj, attr)
+	return
+}
+
+/*
+Reads at most n elements of the persistent big list, starting at index start.
+Non-primitive elements are returned as proxies.
+*/
+func (db *KVDBThread) FetchBigListElements(list BigList, start int64, n int) (elements []RObject, err error) {
+	defer Un(Trace(PERSIST_TR2, "FetchBigListElements", start, n))
+
+	prefix := kvCollectionPrefix(list)
+	err = db.view(func(tx *kv.Tx) (err error) {
+		tx.Ascend(append(append([]byte{}, prefix...), kvId(start)...), func(key []byte, b []byte) bool {
+			if len(elements) >= n || ! bytes.HasPrefix(key, prefix) {
+				return false
+			}
+			var val RObject
+			val, err = kvDecode(b)
+			elements = append(elements, val)
+			return err == nil
+		})
+		return
+	})
+	return
+}
+
+/*
+Returns the index of the first occurrence of the value in the persistent big list, at or after index start,
+or -1 if the value is not in the list.
+*/
+func (db *KVDBThread) BigListIndex(list BigList, val RObject, start int64) (index int64, err error) {
+	defer Un(Trace(PERSIST_TR2, "BigListIndex", start))
+
+	index = -1
+	if ! list.ElementType().IsPrimitive && ! val.IsStoredLocally() {
+		return // An object which is not persistent cannot be in the list.
+	}
+	b, err := kvEncode(val)
+	if err != nil {
+		return
+	}
+	prefix := kvCollectionPrefix(list)
+	err = db.view(func(tx *kv.Tx) error {
+		tx.Ascend(append(append([]byte{}, prefix...), kvId(start)...), func(key []byte, v []byte) bool {
+			if ! bytes.HasPrefix(key, prefix) {
+				return false
+			}
+			if bytes.Equal(v, b) {
+				index = kvIdVal(key[len(prefix):])
+				return false
+			}
+			return true
+		})
+		return nil
+	})
+	return
+}
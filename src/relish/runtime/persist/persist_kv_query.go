@@ -0,0 +1,313 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+// this package implements data persistence in the relish language environment.
+
+package persist
+
+/*
+   persist_kv_query.go - queries of a key-value database.
+
+   A key-value database cannot run SQL, so the OQL selection criteria of a query are evaluated by the oql package,
+   against the stored attribute values of each object of the queried type (or each member of the collection),
+   within a snapshot of the database.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	. "relish/dbg"
+	. "relish/runtime/data"
+	"relish/runtime/persist/kv"
+	"relish/runtime/persist/oql"
+	"strings"
+	"time"
+)
+
+/*
+The stored objects of a key-value database, as seen by the oql evaluator.
+*/
+type kvObjects struct {
+	tx *kv.Tx
+}
+
+/*
+The values of the attribute of the object, as values of the oql evaluator.
+*/
+func (o kvObjects) AttrValues(obj oql.ObjectRef, attr *AttributeSpec) (vals []interface{}, err error) {
+	var stored [][]byte
+	if attr.IsMultiValued() {
+		o.tx.AscendPrefix(kvMemberPrefix(int64(obj), kvAttrName(attr)), func(key []byte, val []byte) bool {
+			stored = append(stored, val)
+			return true
+		})
+	} else if b := o.tx.Get(kvAttrKey(int64(obj), attr)); b != nil {
+		stored = append(stored, b)
+	}
+	for _, b := range stored {
+		var val interface{}
+		val, err = kvQueryValue(b)
+		if err != nil {
+			return
+		}
+		vals = append(vals, val)
+	}
+	return
+}
+
+func (o kvObjects) Extent(typ *RType) (objs []oql.ObjectRef, err error) {
+	for _, id := range kvExtentIds(o.tx, typ) {
+		objs = append(objs, oql.ObjectRef(id))
+	}
+	return
+}
+
+/*
+Converts a stored value to a value of the oql evaluator, which is the value it would have in a SQL database.
+*/
+func kvQueryValue(b []byte) (val interface{}, err error) {
+	if id, isRef := kvRefId(b); isRef {
+		val = oql.ObjectRef(id)
+		return
+	}
+	v, err := kvDecode(b)
+	if err != nil {
+		return
+	}
+	val, err = queryValue(v)
+	return
+}
+
+/*
+Converts a primitive value to a value of the oql evaluator, which is the value it would have in a SQL database.
+*/
+func queryValue(v RObject) (val interface{}, err error) {
+	switch v := v.(type) {
+	case Int:
+		val = int64(v)
+	case Int32:
+		val = int64(v)
+	case Uint:
+		if uint64(v) > math.MaxInt64 {
+			val = float64(v)
+		} else {
+			val = int64(v)
+		}
+	case Uint32:
+		val = int64(v)
+	case Float:
+		val = float64(v)
+	case Bool:
+		val = bool(v)
+	case String:
+		val = string(v)
+	case RTime:
+		val = time.Time(v).UTC().Format(TIME_LAYOUT)
+	case Complex:
+		val = real(complex128(v))
+	case Complex32:
+		val = float64(real(complex64(v)))
+	default:
+		err = fmt.Errorf("A stored value of type %s cannot be queried.", v.Type().Name)
+	}
+	return
+}
+
+/*
+Parses and typechecks the OQL selection criteria.
+*/
+func parseQuery(typ *RType, oqlSelectionCriteria string) (query *oql.Query, err error) {
+	query, err = oql.Parse(oqlSelectionCriteria)
+	if err == nil {
+		err = oql.Check(query, typ, RT.LookupType)
+	}
+	if err != nil {
+		err = fmt.Errorf("Query syntax error:\n%v\n while translating selection criteria:\n\"%s\"", err, oqlSelectionCriteria)
+	}
+	return
+}
+
+/*
+The objects a query selects from: the objects of the type or, if coll is not nil, those of the type which are
+members of the persistent collection, in order of id.
+*/
+func kvCandidates(tx *kv.Tx, typ *RType, coll RCollection) (candidates []oql.ObjectRef, err error) {
+	ids := kvExtentIds(tx, typ)
+	if coll == nil {
+		for _, id := range ids {
+			candidates = append(candidates, oql.ObjectRef(id))
+		}
+		return
+	}
+	if coll.Owner() == nil {
+		if ! coll.IsBeingStored() {
+			err = errors.New("In asList with OQL query, the collection must be persistent!")
+			return
+		}
+	} else if ! coll.Owner().IsBeingStored() {
+		err = errors.New("In asList with OQL query, the object with multi-valued attribute must be persistent!")
+		return
+	}
+	isMember := make(map[int64]bool)
+	tx.AscendPrefix(kvCollectionPrefix(coll), func(key []byte, val []byte) bool {
+		if id, isRef := kvRefId(val); isRef {
+			isMember[id] = true
+		}
+		return true
+	})
+	for _, id := range ids {
+		if isMember[id] {
+			candidates = append(candidates, oql.ObjectRef(id))
+		}
+	}
+	return
+}
+
+/*
+Fetches the selected objects to radius - 1, or if the radius is 0, returns proxies of them.
+*/
+func (db *KVDBThread) fetchSelected(tx *kv.Tx, selected []oql.ObjectRef, radius int) (objs []RObject, err error) {
+	for _, ref := range selected {
+		id := int64(ref)
+		var obj RObject
+		if radius > 0 {
+			var found bool
+			obj, found = RT.GetObject(id)
+			if ! found {
+				obj, err = db.fetch1(tx, id, radius-1, fmt.Sprintf("id=%v", id), false)
+				if err != nil {
+					return
+				}
+			}
+		} else {
+			obj = Proxy(id)
+		}
+		objs = append(objs, obj)
+	}
+	return
+}
+
+/*
+Selects the objects of the type which meet the OQL selection criteria. See SqliteDBThread.FetchN.
+*/
+func (db *KVDBThread) FetchN(typ *RType, oqlSelectionCriteria string, queryArgs []RObject, coll RCollection, radius int, objs *[]RObject) (mayContainProxies bool, err error) {
+	defer Un(Trace(PERSIST_TR, "FetchN", oqlSelectionCriteria, radius))
+
+	mayContainProxies = (radius == 0)
+
+	query, err := parseQuery(typ, oqlSelectionCriteria)
+	if err != nil {
+		return
+	}
+
+	err = db.view(func(tx *kv.Tx) (err error) {
+		candidates, err := kvCandidates(tx, typ, coll)
+		if err != nil {
+			if strings.HasPrefix(err.Error(), "In asList") {
+				err = fmt.Errorf("%v\n  (call to asList with selection criteria:\n   \"%s\")", err, oqlSelectionCriteria)
+			}
+			return
+		}
+		selected, err := oql.Select(query, candidates, kvObjects{tx}, queryArgValues(queryArgs))
+		if err != nil {
+			err = fmt.Errorf("%v\n while evaluating selection criteria:\n\"%s\"", err, oqlSelectionCriteria)
+			return
+		}
+		fetched, err := db.fetchSelected(tx, selected, radius)
+		*objs = append(*objs, fetched...)
+		return
+	})
+	return
+}
+
+/*
+Aggregate queries are not supported by a key-value database.
+*/
+func (db *KVDBThread) FetchAggregate(typ *RType, oqlAggregateQuery string, queryArgs []RObject, coll RCollection) (rows [][]RObject, err error) {
+	err = fmt.Errorf("Aggregate queries are not supported by a key-value database:\n\"%s\"", oqlAggregateQuery)
+	return
+}
+
+type kvCursor struct {
+	db        *KVDBThread
+	query     *oql.Query
+	queryArgs []interface{}
+	typ       *RType
+	coll      RCollection
+	radius    int
+	batchSize int
+	after     *oql.ObjectRef // the object the cursor starts after, if any
+	last      *oql.ObjectRef // the last object read. nil before the first batch.
+	done      bool
+}
+
+/*
+Returns a cursor over the objects selected by the query. See SqliteDBThread.OpenCursor.
+Each batch is selected anew, continuing from the last object of the previous batch.
+*/
+func (db *KVDBThread) OpenCursor(typ *RType, oqlSelectionCriteria string, queryArgs []RObject, coll RCollection, radius int, batchSize int, after RObject) (cursor Cursor, err error) {
+	defer Un(Trace(PERSIST_TR, "OpenCursor", oqlSelectionCriteria, radius, batchSize))
+
+	if batchSize <= 0 {
+		err = errors.New("The batch size of a query cursor must be positive.")
+		return
+	}
+
+	query, err := parseQuery(typ, oqlSelectionCriteria)
+	if err != nil {
+		return
+	}
+
+	c := &kvCursor{
+		db:        db,
+		query:     query,
+		queryArgs: queryArgValues(queryArgs),
+		typ:       typ,
+		coll:      coll,
+		radius:    radius,
+		batchSize: batchSize,
+	}
+	if after != nil {
+		if ! after.IsStoredLocally() {
+			err = errors.New("The object to start a query cursor after must be persistent.")
+			return
+		}
+		ref := oql.ObjectRef(after.DBID())
+		c.after = &ref
+	}
+	cursor = c
+	return
+}
+
+/*
+Reads the next batch of objects. If the cursor's radius is 0, the objects are proxies;
+otherwise they are fetched to radius - 1.
+*/
+func (c *kvCursor) NextBatch() (objs []RObject, err error) {
+	defer Un(Trace(PERSIST_TR, "NextBatch"))
+
+	if c.done {
+		return
+	}
+	err = c.db.view(func(tx *kv.Tx) (err error) {
+		candidates, err := kvCandidates(tx, c.typ, c.coll)
+		if err != nil {
+			return
+		}
+		selected, err := oql.SelectPage(c.query, candidates, kvObjects{tx}, c.queryArgs, c.after, c.last, c.batchSize)
+		if err != nil {
+			return
+		}
+		if len(selected) < c.batchSize {
+			c.done = true
+		}
+		if len(selected) > 0 {
+			last := selected[len(selected)-1]
+			c.last = &last
+		}
+		objs, err = c.db.fetchSelected(tx, selected, c.radius)
+		return
+	})
+	return
+}
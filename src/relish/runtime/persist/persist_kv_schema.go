@@ -0,0 +1,490 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+// this package implements data persistence in the relish language environment.
+
+package persist
+
+/*
+   persist_kv_schema.go - the schemas, unique indexes, and migration of relish types in a key-value database.
+
+   A key-value database has no tables to create, but the schema of each type is recorded, as in a SQL database
+   (see persist_migrate.go), so that a type whose declaration has changed has its stored attribute values migrated.
+
+   Only unique indexes are kept, since they are constraints. A query reads the objects of its type and evaluates
+   its conditions, so other indexes would not be used. A unique index has an entry for each object of the type
+   which has a value of each of the index's attributes:
+
+   'u' indexName 0x00 tuple               -> id8 of the object
+   'v' id8 indexName                      -> tuple
+   'i' typeName 0x00 indexName            -> ""          the index has been built
+
+   where the tuple is the stored values of the attributes, each preceded by its length (as a uvarint).
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	. "relish/dbg"
+	. "relish/runtime/data"
+	"relish/runtime/persist/kv"
+	"strings"
+)
+
+/*
+A unique index on attributes of a type.
+*/
+type kvUniqueIndex struct {
+	name  string // e.g. vehicles/Car__model__make__idx, as in a SQL database
+	typ   *RType
+	attrs []*AttributeSpec
+}
+
+/*
+The unique indexes declared on the primitive-valued attributes of the type.
+*/
+func kvUniqueIndexes(typ *RType) (indexes []*kvUniqueIndex) {
+	for _, attr := range typ.Attributes {
+		if ! attr.HasIndex() || ! attr.IsUnique {
+			continue
+		}
+		attrs := append([]*AttributeSpec{attr}, attr.IndexWith...)
+		var names []string
+		for _, a := range attrs {
+			names = append(names, a.Part.Name)
+		}
+		indexes = append(indexes, &kvUniqueIndex{typ.ShortName() + "__" + strings.Join(names, "__") + "__idx", typ, attrs})
+	}
+	return
+}
+
+func (idx *kvUniqueIndex) has(attr *AttributeSpec) bool {
+	for _, a := range idx.attrs {
+		if a == attr {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+The stored values of the index's attributes for the object, or nil if the object lacks a value of one of them.
+*/
+func (idx *kvUniqueIndex) tuple(tx *kv.Tx, id int64) (tuple []byte) {
+	var n [binary.MaxVarintLen64]byte
+	tuple = []byte{}
+	for _, attr := range idx.attrs {
+		b := tx.Get(kvAttrKey(id, attr))
+		if b == nil {
+			return nil
+		}
+		tuple = append(tuple, n[:binary.PutUvarint(n[:], uint64(len(b)))]...)
+		tuple = append(tuple, b...)
+	}
+	return
+}
+
+/*
+The error for a violation of the index, with the form of a sqlite error, so that it names the attributes.
+*/
+func (idx *kvUniqueIndex) violation(obj RObject) error {
+	var cols []string
+	for _, attr := range idx.attrs {
+		cols = append(cols, "["+idx.typ.ShortName()+"]."+attr.Part.Name)
+	}
+	return &UniqueIndexError{obj, fmt.Errorf("UNIQUE constraint failed: %s", strings.Join(cols, ", "))}
+}
+
+/*
+Updates the object's entry in the unique index, to the object's stored attribute values.
+Returns a *UniqueIndexError if another object has the same values.
+*/
+func (idx *kvUniqueIndex) update(tx *kv.Tx, obj RObject, id int64) (err error) {
+	tuple := idx.tuple(tx, id)
+	ofKey := kvKey(kvUniqueOf, kvId(id), idx.name)
+	old := tx.Get(ofKey)
+	if old != nil && tuple != nil && bytes.Equal(old, tuple) {
+		return
+	}
+	if old != nil {
+		err = tx.Delete(kvKey(kvUnique, idx.name, "\x00", string(old)))
+		if err == nil {
+			err = tx.Delete(ofKey)
+		}
+		if err != nil {
+			return
+		}
+	}
+	if tuple == nil {
+		return
+	}
+	key := kvKey(kvUnique, idx.name, "\x00", string(tuple))
+	if other := tx.Get(key); other != nil && kvIdVal(other) != id {
+		err = idx.violation(obj)
+		return
+	}
+	err = tx.Put(key, []byte(kvId(id)))
+	if err == nil {
+		err = tx.Put(ofKey, tuple)
+	}
+	return
+}
+
+/*
+Updates the object's entries in the unique indexes of its type and supertypes which include the attribute,
+or in all of them if attr is nil.
+*/
+func (db *KVDBThread) indexObject(tx *kv.Tx, obj RObject, attr *AttributeSpec) (err error) {
+	for _, typ := range append([]*RType{obj.Type()}, obj.Type().Up...) {
+		for _, idx := range kvUniqueIndexes(typ) {
+			if attr != nil && ! idx.has(attr) {
+				continue
+			}
+			err = idx.update(tx, obj, obj.DBID())
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+/*
+Removes the object's entries from all unique indexes.
+*/
+func (db *KVDBThread) unindexObject(tx *kv.Tx, id int64) (err error) {
+	prefix := kvKey(kvUniqueOf, kvId(id))
+	var names []string
+	var tuples [][]byte
+	tx.AscendPrefix(prefix, func(key []byte, val []byte) bool {
+		names = append(names, string(key[len(prefix):]))
+		tuples = append(tuples, val)
+		return true
+	})
+	for i, name := range names {
+		err = tx.Delete(kvKey(kvUnique, name, "\x00", string(tuples[i])))
+		if err == nil {
+			err = tx.Delete(kvKey(kvUniqueOf, kvId(id), name))
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+/*
+Removes the index's entries, and its built marker.
+*/
+func dropKVUniqueIndex(tx *kv.Tx, typ *RType, name string) (err error) {
+	prefix := kvKey(kvUnique, name, "\x00")
+	var ids []int64
+	tx.AscendPrefix(prefix, func(key []byte, val []byte) bool {
+		ids = append(ids, kvIdVal(val))
+		return true
+	})
+	for _, id := range ids {
+		err = tx.Delete(kvKey(kvUniqueOf, kvId(id), name))
+		if err != nil {
+			return
+		}
+	}
+	err = kvDeletePrefix(tx, prefix)
+	if err == nil {
+		err = tx.Delete(kvKey(kvIndexBuilt, typ.ShortName(), "\x00", name))
+	}
+	return
+}
+
+/*
+Records the type's schema, builds the unique indexes declared on the type's attributes which have not yet been
+built, and drops the type's indexes which are no longer declared.
+Should be called after the type has been assigned all of its attribute specifications.
+*/
+func (db *KVDBThread) EnsureTypeTable(typ *RType) (err error) {
+	err = db.update(func(tx *kv.Tx) (err error) {
+		err = tx.Put(kvKey(kvSchema, typ.ShortName()), []byte(schemaText(typeSchema(typ))))
+		if err != nil {
+			return
+		}
+
+		declared := make(map[string]bool)
+		for _, idx := range kvUniqueIndexes(typ) {
+			declared[idx.name] = true
+			builtKey := kvKey(kvIndexBuilt, typ.ShortName(), "\x00", idx.name)
+			if tx.Get(builtKey) != nil {
+				continue
+			}
+			err = db.buildIndex(tx, idx)
+			if err != nil {
+				return
+			}
+			err = tx.Put(builtKey, nil)
+			if err != nil {
+				return
+			}
+		}
+
+		prefix := kvKey(kvIndexBuilt, typ.ShortName(), "\x00")
+		var undeclared []string
+		tx.AscendPrefix(prefix, func(key []byte, val []byte) bool {
+			if name := string(key[len(prefix):]); ! declared[name] {
+				undeclared = append(undeclared, name)
+			}
+			return true
+		})
+		for _, name := range undeclared {
+			Logln(PERSIST_, "Dropping unique index", name)
+			err = dropKVUniqueIndex(tx, typ, name)
+			if err != nil {
+				return
+			}
+		}
+		return
+	})
+	return
+}
+
+/*
+Adds an entry to the index for each stored object of the index's type.
+*/
+func (db *KVDBThread) buildIndex(tx *kv.Tx, idx *kvUniqueIndex) (err error) {
+	Logln(PERSIST_, "Building unique index", idx.name)
+
+	sp := tx.Savepoint()
+	err = dropKVUniqueIndex(tx, idx.typ, idx.name)
+	for _, id := range kvExtentIds(tx, idx.typ) {
+		if err != nil {
+			break
+		}
+		err = idx.update(tx, Proxy(id), id)
+	}
+	if err != nil {
+		tx.RollbackTo(sp)
+		if e, isViolation := err.(*UniqueIndexError); isViolation {
+			err = fmt.Errorf("Cannot create the unique index %s, because more than one %s has the same %s.", idx.name, idx.typ.Name, e.attrNames())
+		}
+		return
+	}
+	tx.ReleaseSavepoint(sp)
+	return
+}
+
+/*
+Compares the type's recorded schema with the type's declared attributes, and if they differ, and dryRun is
+false, migrates the stored attribute values of the type's objects. See SqliteDBThread.MigrateTypeTable.
+The migration has no statements.
+*/
+func (db *KVDBThread) MigrateTypeTable(th InterpreterThread, typ *RType, dryRun bool) (migration *SchemaMigration, err error) {
+	var text []byte
+	err = db.view(func(tx *kv.Tx) error {
+		text = tx.Get(kvKey(kvSchema, typ.ShortName()))
+		return nil
+	})
+	if err != nil || text == nil || string(text) == schemaText(typeSchema(typ)) {
+		return
+	}
+	oldAttrs, err := parseSchemaText(string(text))
+	if err != nil {
+		return
+	}
+
+	migration, moves, err := planKVMigration(typ, oldAttrs)
+	if err != nil || migration == nil || dryRun {
+		return
+	}
+
+	Logln(PERSIST_, migration)
+
+	err = db.update(func(tx *kv.Tx) (err error) {
+		for _, id := range kvExtentIds(tx, typ) {
+			err = db.migrateObject(tx, th, typ, id, moves)
+			if err != nil {
+				return
+			}
+		}
+		// The indexes are rebuilt from the migrated values by EnsureTypeTable.
+
+		for _, idx := range kvUniqueIndexes(typ) {
+			err = dropKVUniqueIndex(tx, typ, idx.name)
+			if err != nil {
+				return
+			}
+		}
+		return
+	})
+	return
+}
+
+/*
+The migration of the stored values of a former attribute. to is nil if the values are dropped.
+*/
+type kvAttrMove struct {
+	from    *attrSchema
+	to      *AttributeSpec
+	convert bool
+}
+
+/*
+Works out the changes which migrate the stored values of the type's objects from the old schema to the
+type's declared attributes, described as for a SQL database. Returns a nil migration if nothing has changed.
+*/
+func planKVMigration(typ *RType, oldAttrs []*attrSchema) (migration *SchemaMigration, moves []*kvAttrMove, err error) {
+	migration = &SchemaMigration{Type: typ}
+
+	oldAttrsByName := make(map[string]*attrSchema)
+	for _, a := range oldAttrs {
+		oldAttrsByName[a.name] = a
+	}
+	moved := make(map[*attrSchema]bool)
+
+	for _, attr := range typ.Attributes {
+		if attr.IsTransient {
+			continue
+		}
+		a := newAttrSchema(attr)
+		old, found := oldAttrsByName[a.name]
+		if ! found && attr.FormerName != "" {
+			old, found = oldAttrsByName[attr.FormerName]
+		}
+		if found && moved[old] {
+			found = false
+		}
+		if ! found {
+			migration.Changes = append(migration.Changes, "add attribute " + a.name + " " + a.typeName)
+			continue
+		}
+		moved[old] = true
+		if old.name != a.name {
+			migration.Changes = append(migration.Changes, "rename attribute " + old.name + " to " + a.name)
+		}
+
+		if ! a.isColumn || ! old.isColumn {
+			if ! a.sameStorage(old) {
+				migration.Changes = append(migration.Changes, fmt.Sprintf("WARNING: attribute %s was %s %s, and is now %s %s. Its stored values are not migrated.",
+					                                                       a.name, old.collectionType, old.typeName, a.collectionType, a.typeName))
+				moves = append(moves, &kvAttrMove{old, nil, false})
+			} else if old.name != a.name {
+				moves = append(moves, &kvAttrMove{old, attr, false})
+			}
+			continue
+		}
+
+		if old.typeName != a.typeName || attr.MigrationMethod != nil {
+			if attr.MigrationMethod != nil {
+				migration.Changes = append(migration.Changes, fmt.Sprintf("convert attribute %s from %s to %s via %s", a.name, old.typeName, a.typeName, attr.MigrationMethod.Name))
+			} else if canConvert(old.typ(), attr.Part.Type) {
+				migration.Changes = append(migration.Changes, fmt.Sprintf("convert attribute %s from %s to %s", a.name, old.typeName, a.typeName))
+			} else {
+				err = fmt.Errorf("Cannot migrate the stored values of attribute %s.%s from type %s to type %s. Declare a via method to convert them.",
+					             typ.Name, a.name, old.typeName, a.typeName)
+				return
+			}
+			moves = append(moves, &kvAttrMove{old, attr, true})
+		} else if old.name != a.name {
+			moves = append(moves, &kvAttrMove{old, attr, false})
+		}
+	}
+
+	for _, old := range oldAttrs {
+		if ! moved[old] {
+			migration.Changes = append(migration.Changes, "remove attribute " + old.name + " " + old.typeName)
+			moves = append(moves, &kvAttrMove{old, nil, false})
+		}
+	}
+
+	if len(migration.Changes) == 0 {
+		migration = nil
+	}
+	return
+}
+
+/*
+Migrates the stored values of the object's former attributes of the type. All of the old values are read
+before any are written, so that attributes may trade names.
+*/
+func (db *KVDBThread) migrateObject(tx *kv.Tx, th InterpreterThread, typ *RType, id int64, moves []*kvAttrMove) (err error) {
+	type entry struct {
+		key []byte
+		val []byte
+	}
+	olds := make([][]entry, len(moves))
+	for i, move := range moves {
+		oldName := typ.ShortName() + "." + move.from.name
+		if move.from.arityHigh == 1 && move.from.collectionType == "" {
+			key := kvKey(kvAttr, kvId(id), oldName)
+			if val := tx.Get(key); val != nil {
+				olds[i] = append(olds[i], entry{key, val})
+			}
+			continue
+		}
+		tx.AscendPrefix(kvMemberPrefix(id, oldName), func(key []byte, val []byte) bool {
+			olds[i] = append(olds[i], entry{key, val})
+			return true
+		})
+	}
+	for _, entries := range olds {
+		for _, e := range entries {
+			err = tx.Delete(e.key)
+			if err != nil {
+				return
+			}
+		}
+	}
+	for i, move := range moves {
+		if move.to == nil {
+			continue
+		}
+		oldKeyPrefixLen := 9 + len(typ.ShortName() + "." + move.from.name)
+		for _, e := range olds[i] {
+			// The rest of a member's key, after the attribute name, is unchanged.
+			key := append(kvKey(e.key[0], kvId(id), kvAttrName(move.to)), e.key[oldKeyPrefixLen:]...)
+			val := e.val
+			if move.convert {
+				val, err = convertKVValue(th, move.to, val)
+				if err != nil {
+					return
+				}
+				if val == nil {
+					continue
+				}
+			}
+			err = tx.Put(key, val)
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+/*
+Converts a stored value of the attribute's old type to the attribute's type, calling the attribute's migration
+method if it has one. Returns nil if the converted value is nil.
+*/
+func convertKVValue(th InterpreterThread, attr *AttributeSpec, b []byte) (converted []byte, err error) {
+	oldVal, err := kvDecode(b)
+	if err != nil {
+		return
+	}
+	var val RObject
+	if attr.MigrationMethod != nil {
+		val = th.EvaluationContext().EvalMultiMethodCall(attr.MigrationMethod, []RObject{oldVal})
+	} else {
+		val, err = convertPrimitive(oldVal, attr.Part.Type)
+		if err != nil {
+			return
+		}
+	}
+	if val == nil || val == NIL {
+		return
+	}
+	if val.Type() != attr.Part.Type {
+		err = fmt.Errorf("Migration method %s returned a %s, not a %s, for attribute %s.%s.",
+			             attr.MigrationMethod.Name, val.Type().Name, attr.Part.Type.Name, attr.WholeType.Name, attr.Part.Name)
+		return
+	}
+	converted, err = kvEncode(val)
+	return
+}
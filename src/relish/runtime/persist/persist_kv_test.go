@@ -0,0 +1,57 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+package persist
+
+import (
+	"bytes"
+	"math"
+	. "relish/runtime/data"
+	"testing"
+)
+
+// Each list is in ascending order of value, which the encoded values must keep.
+var kvOrderTests = [][]RObject{
+	{Int(math.MinInt64), Int(-1000), Int(-1), Int(0), Int(1), Int(1000), Int(math.MaxInt64)},
+	{Int32(math.MinInt32), Int32(-1), Int32(0), Int32(7)},
+	{Uint(0), Uint(1), Uint(math.MaxUint64)},
+	{Float(math.Inf(-1)), Float(-2.5), Float(-0.001), Float(0), Float(0.001), Float(2.5), Float(math.Inf(1))},
+	{Bool(false), Bool(true)},
+	{String(""), String("a"), String("ab"), String("b")},
+}
+
+func TestKVEncodeOrder(t *testing.T) {
+	for _, vals := range kvOrderTests {
+		var prev []byte
+		for _, val := range vals {
+			b, err := kvEncode(val)
+			if err != nil {
+				t.Fatalf("kvEncode(%v): %v", val, err)
+			}
+			if prev != nil && bytes.Compare(prev, b) >= 0 {
+				t.Errorf("encoding of %v does not sort after the encoding of the value before it", val)
+			}
+			prev = b
+
+			decoded, err := kvDecode(b)
+			if err != nil {
+				t.Fatalf("kvDecode(%v): %v", val, err)
+			}
+			if decoded != val {
+				t.Errorf("kvDecode(kvEncode(%v)) = %v", val, decoded)
+			}
+		}
+	}
+}
+
+func TestKVIdOrder(t *testing.T) {
+	ids := []int64{math.MinInt64, -5, 0, 5, math.MaxInt64}
+	for i, id := range ids {
+		if kvIdVal([]byte(kvId(id))) != id {
+			t.Errorf("kvIdVal(kvId(%d)) != %d", id, id)
+		}
+		if i > 0 && kvId(ids[i-1]) >= kvId(id) {
+			t.Errorf("kvId(%d) does not sort after kvId(%d)", id, ids[i-1])
+		}
+	}
+}
@@ -0,0 +1,601 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+// this package implements data persistence in the relish language environment.
+
+package persist
+
+/*
+   persist_migrate.go - migration of the tables of relish types to the types' current declarations.
+
+   The schema of each type's table is recorded, as a description of each of the attributes declared in the type,
+   and a fingerprint (hash) of the description, when the table is created.
+
+   `CREATE TABLE RTypeSchema(
+      typeName TEXT PRIMARY KEY,
+      fingerprint TEXT NOT NULL,
+      attributes TEXT NOT NULL  -- a line per attribute e.g. "mileage Float 1 1 - column"
+    )`
+
+   When the type is loaded again, a different fingerprint means the declaration of the type has changed, so the
+   table is migrated: attributes which were added get new columns, attributes which were removed lose their columns,
+   attributes declared e.g.
+
+   Car
+      fullName String was name
+      mileage Float via kilometres
+
+   have the values of the former attribute name moved to them, and values of an attribute whose type changed,
+   or which has a via method, are converted. A via method is a unary method, of the package that declares the type,
+   which accepts a stored value and returns the value of the attribute's new type. It must not use the database.
+   Values with no via method are converted only between numeric types, and from any primitive type to String.
+
+   If only columns are added, the table is altered. Otherwise, a new table is created, the stored values are copied
+   (and converted) into it, and it replaces the old table. Indexes are then recreated by EnsureTypeTable.
+   The table of a renamed multi-valued or non-primitive attribute is renamed.
+
+   A table created before schemas were recorded is compared by its column names.
+*/
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	. "relish/dbg"
+	. "relish/runtime/data"
+	"strconv"
+	"strings"
+)
+
+/*
+Adds the table to the database which records the schema of each type's table.
+Only creates the table if the table does not yet exist.
+*/
+func (db *SqliteDBThread) EnsureTypeSchemaTable() {
+	s := `CREATE TABLE IF NOT EXISTS RTypeSchema(
+           typeName TEXT PRIMARY KEY,
+           fingerprint TEXT NOT NULL,
+           attributes TEXT NOT NULL
+         )`
+	err := db.ExecStatement(s)
+	if err != nil {
+		panic(fmt.Sprintf("db.ExecStatement(%s): db error: %s", s, err))
+	}
+}
+
+/*
+The recorded description of an attribute of a type.
+*/
+type attrSchema struct {
+	name           string
+	typeName       string  // "" if unknown, for a table created before schemas were recorded
+	arityLow       int32
+	arityHigh      int32
+	collectionType string
+	isColumn       bool  // stored in the type's table rather than in a table of its own
+}
+
+func newAttrSchema(attr *AttributeSpec) *attrSchema {
+	return &attrSchema{attr.Part.Name, attr.Part.Type.Name, attr.Part.ArityLow, attr.Part.ArityHigh, attr.Part.CollectionType, isTypeTableColumn(attr)}
+}
+
+func (a *attrSchema) String() string {
+	collectionType := a.collectionType
+	if collectionType == "" {
+		collectionType = "-"
+	}
+	storage := "table"
+	if a.isColumn {
+		storage = "column"
+	}
+	return fmt.Sprintf("%s %s %d %d %s %s", a.name, a.typeName, a.arityLow, a.arityHigh, collectionType, storage)
+}
+
+/*
+The attribute's type, or nil if it is unknown or no longer exists.
+*/
+func (a *attrSchema) typ() *RType {
+	return RT.Types[a.typeName]
+}
+
+/*
+The names of the attribute's columns in the type's table.
+*/
+func (a *attrSchema) columns() []string {
+	if typ := a.typ(); typ != nil {
+		return RelEnd{Name: a.name, Type: typ}.DbColumnNames()
+	}
+	return []string{a.name}
+}
+
+/*
+Whether the attribute is stored in the same way as the other attribute, so its values can be moved unchanged.
+*/
+func (a *attrSchema) sameStorage(other *attrSchema) bool {
+	return a.typeName == other.typeName && a.isColumn == other.isColumn && a.collectionType == other.collectionType &&
+	       (a.arityHigh == 1) == (other.arityHigh == 1)
+}
+
+/*
+Returns the descriptions of the stored attributes declared in the type.
+*/
+func typeSchema(typ *RType) (attrs []*attrSchema) {
+	for _, attr := range typ.Attributes {
+		if ! attr.IsTransient {
+			attrs = append(attrs, newAttrSchema(attr))
+		}
+	}
+	return
+}
+
+func schemaText(attrs []*attrSchema) string {
+	var lines []string
+	for _, a := range attrs {
+		lines = append(lines, a.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func schemaFingerprint(text string) string {
+	hash := sha1.Sum([]byte(text))
+	return hex.EncodeToString(hash[:])
+}
+
+func parseSchemaText(text string) (attrs []*attrSchema, err error) {
+	for _, line := range strings.Split(text, "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 6 {
+			err = fmt.Errorf("Malformed attribute schema '%s'.", line)
+			return
+		}
+		a := &attrSchema{name: fields[0], typeName: fields[1], isColumn: fields[5] == "column"}
+		if fields[4] != "-" {
+			a.collectionType = fields[4]
+		}
+		var low, high int64
+		low, err = strconv.ParseInt(fields[2], 10, 32)
+		if err == nil {
+			high, err = strconv.ParseInt(fields[3], 10, 32)
+		}
+		if err != nil {
+			err = fmt.Errorf("Malformed attribute schema '%s': %s", line, err)
+			return
+		}
+		a.arityLow = int32(low)
+		a.arityHigh = int32(high)
+		attrs = append(attrs, a)
+	}
+	return
+}
+
+/*
+Records the current schema of the type's table.
+*/
+func (db *SqliteDBThread) recordTypeSchema(typ *RType) (err error) {
+	text := schemaText(typeSchema(typ))
+	err = db.ExecStatement(db.db.dialect.UpsertStatement("RTypeSchema", "typeName", []string{"typeName", "fingerprint", "attributes"}),
+		                   typ.ShortName(), schemaFingerprint(text), text)
+	return
+}
+
+/*
+Returns the recorded schema of the type's table. found is false if none was recorded.
+*/
+func (db *SqliteDBThread) storedTypeSchema(typ *RType) (attrs []*attrSchema, fingerprint string, found bool, err error) {
+	query := "SELECT fingerprint,attributes FROM RTypeSchema WHERE typeName=?"
+	selectStmt, err := db.Prepare(query)
+	if err != nil {
+		return
+	}
+
+	defer selectStmt.Reset()
+
+	err = selectStmt.Query(typ.ShortName())
+	if err != nil {
+		if err == io.EOF {
+			err = nil
+		}
+		return
+	}
+	var text string
+	err = selectStmt.Scan(&fingerprint, &text)
+	if err != nil {
+		return
+	}
+	found = true
+	attrs, err = parseSchemaText(text)
+	return
+}
+
+/*
+Describes the attributes stored in the columns of a type's table which was created before schemas were recorded.
+Columns of the current attributes of the type are assumed to still have their attributes' types, and
+the current attributes which are stored in tables of their own are assumed to be unchanged.
+*/
+func legacyTypeSchema(typ *RType, columns []string) (attrs []*attrSchema) {
+	claimed := map[string]bool{"id": true}
+	isColumn := make(map[string]bool)
+	for _, col := range columns {
+		isColumn[col] = true
+	}
+	for _, attr := range typ.Attributes {
+		if attr.IsTransient {
+			continue
+		}
+		a := newAttrSchema(attr)
+		if ! a.isColumn {
+			attrs = append(attrs, a)
+			continue
+		}
+		cols := a.columns()
+		hasAll := true
+		for _, col := range cols {
+			hasAll = hasAll && isColumn[col]
+		}
+		if hasAll {
+			for _, col := range cols {
+				claimed[col] = true
+			}
+			attrs = append(attrs, a)
+		}
+	}
+	for _, col := range columns {
+		if claimed[col] {
+			continue
+		}
+		a := &attrSchema{name: col, arityLow: 1, arityHigh: 1, isColumn: true}
+		if strings.HasSuffix(col, "_r") && isColumn[col[:len(col)-2] + "_i"] {
+			a.name = col[:len(col)-2]
+			a.typeName = ComplexType.Name
+			claimed[a.name + "_i"] = true
+		} else if isColumn[col + "_loc"] {
+			a.typeName = TimeType.Name
+			claimed[col + "_loc"] = true
+		}
+		claimed[col] = true
+		attrs = append(attrs, a)
+	}
+	return
+}
+
+/*
+Marks the statement of a migration plan which is run for each converted value of an attribute.
+*/
+const FOR_EACH_CONVERTED_VALUE = " -- for each converted value"
+
+/*
+An attribute whose stored values must be converted, one by one, into the new table.
+*/
+type attrConversion struct {
+	from *attrSchema
+	to   *AttributeSpec
+}
+
+/*
+Compares the schema of the type's existing table with the type's declared attributes, and if they differ,
+and dryRun is false, migrates the tables of the type and its attributes.
+*/
+func (db *SqliteDBThread) MigrateTypeTable(th InterpreterThread, typ *RType, dryRun bool) (migration *SchemaMigration, err error) {
+	table := db.db.TableNameIfy(typ.ShortName())
+	columns, err := db.tableColumns(table)
+	if err != nil || len(columns) == 0 {
+		return
+	}
+	oldAttrs, fingerprint, found, err := db.storedTypeSchema(typ)
+	if err != nil {
+		return
+	}
+	newAttrs := typeSchema(typ)
+	if found && fingerprint == schemaFingerprint(schemaText(newAttrs)) {
+		return
+	}
+	if ! found {
+		oldAttrs = legacyTypeSchema(typ, columns)
+	}
+
+	migration, conversions, err := db.planMigration(typ, table, oldAttrs)
+	if err != nil || migration == nil || dryRun {
+		return
+	}
+
+	Logln(PERSIST_, migration)
+
+	err = db.migrate(th, migration, table, conversions)
+	return
+}
+
+/*
+Works out the changes and SQL statements which migrate the type's table, and the tables of its attributes,
+from the old schema to the type's declared attributes. Returns a nil migration if only the schema's description
+has changed, e.g. for a table created before schemas were recorded.
+*/
+func (db *SqliteDBThread) planMigration(typ *RType, table string, oldAttrs []*attrSchema) (migration *SchemaMigration, conversions []*attrConversion, err error) {
+	migration = &SchemaMigration{Type: typ}
+
+	oldAttrsByName := make(map[string]*attrSchema)
+	for _, a := range oldAttrs {
+		oldAttrsByName[a.name] = a
+	}
+	moved := make(map[*attrSchema]bool)
+
+	var newCols, oldCols []string  // the columns whose values are copied unchanged into the new table
+	var addedColumnDefs []string
+	needsCopy := false
+
+	for _, attr := range typ.Attributes {
+		if attr.IsTransient {
+			continue
+		}
+		a := newAttrSchema(attr)
+		old, found := oldAttrsByName[a.name]
+		if ! found && attr.FormerName != "" {
+			old, found = oldAttrsByName[attr.FormerName]
+		}
+		if found && moved[old] {
+			found = false
+		}
+		if ! found {
+			migration.Changes = append(migration.Changes, "add attribute " + a.name + " " + a.typeName)
+			if a.isColumn {
+				addedColumnDefs = append(addedColumnDefs, strings.Split(attr.Part.DbColumnDef(), ",\n")...)
+			}
+			continue
+		}
+		moved[old] = true
+		if old.typeName == "" {  // an attribute of a table created before schemas were recorded
+			old.typeName = a.typeName
+		}
+		if old.name != a.name {
+			migration.Changes = append(migration.Changes, "rename attribute " + old.name + " to " + a.name)
+		}
+
+		if ! a.isColumn || ! old.isColumn {
+			if ! a.sameStorage(old) {
+				migration.Changes = append(migration.Changes, fmt.Sprintf("WARNING: attribute %s was %s %s, and is now %s %s. Its stored values are not migrated.",
+					                                                       a.name, old.collectionType, old.typeName, a.collectionType, a.typeName))
+				if old.isColumn {
+					needsCopy = true
+				}
+				if a.isColumn {
+					addedColumnDefs = append(addedColumnDefs, strings.Split(attr.Part.DbColumnDef(), ",\n")...)
+				}
+			} else if old.name != a.name {
+				oldTable := db.db.TableNameIfy(strings.Replace(attr.ShortName(), "___" + a.name + "__", "___" + old.name + "__", 1))
+				migration.Statements = append(migration.Statements,
+					                          "ALTER TABLE " + oldTable + " RENAME TO " + db.db.TableNameIfy(attr.ShortName()))
+			}
+			continue
+		}
+
+		if old.typeName != a.typeName || attr.MigrationMethod != nil {
+			if attr.MigrationMethod != nil {
+				migration.Changes = append(migration.Changes, fmt.Sprintf("convert attribute %s from %s to %s via %s", a.name, old.typeName, a.typeName, attr.MigrationMethod.Name))
+			} else if canConvert(old.typ(), attr.Part.Type) {
+				migration.Changes = append(migration.Changes, fmt.Sprintf("convert attribute %s from %s to %s", a.name, old.typeName, a.typeName))
+			} else {
+				err = fmt.Errorf("Cannot migrate the stored values of attribute %s.%s from type %s to type %s. Declare a via method to convert them.",
+					             typ.Name, a.name, old.typeName, a.typeName)
+				return
+			}
+			conversions = append(conversions, &attrConversion{old, attr})
+			needsCopy = true
+			continue
+		}
+		if old.name != a.name {
+			needsCopy = true
+		}
+		newCols = append(newCols, a.columns()...)
+		oldCols = append(oldCols, old.columns()...)
+	}
+
+	for _, old := range oldAttrs {
+		if ! moved[old] {
+			migration.Changes = append(migration.Changes, "remove attribute " + old.name + " " + old.typeName)
+			if old.isColumn {
+				needsCopy = true
+			} else if oldTyp := old.typ(); oldTyp != nil {
+				oldAttr := &AttributeSpec{WholeType: typ, Part: RelEnd{Name: old.name, Type: oldTyp, ArityHigh: old.arityHigh, CollectionType: old.collectionType}}
+				migration.Statements = append(migration.Statements, "DROP TABLE IF EXISTS " + db.db.TableNameIfy(oldAttr.ShortName()))
+			}
+		}
+	}
+
+	if len(migration.Changes) == 0 {
+		migration = nil
+		return
+	}
+
+	if needsCopy {
+		newTable := db.db.TableNameIfy(typ.ShortName() + "__migrating")
+		migration.Statements = append(migration.Statements,
+			"DROP TABLE IF EXISTS " + newTable,
+			"CREATE TABLE " + typeTableDef(newTable, typ),
+			"INSERT INTO " + newTable + "(" + strings.Join(append([]string{"id"}, newCols...), ",") + ") SELECT " +
+			                 strings.Join(append([]string{"id"}, oldCols...), ",") + " FROM " + table)
+		for _, conversion := range conversions {
+			migration.Statements = append(migration.Statements,
+				"UPDATE " + newTable + " SET " + strings.Join(conversion.to.Part.DbColumnNames(), "=?,") + "=? WHERE id=?" + FOR_EACH_CONVERTED_VALUE)
+		}
+		migration.Statements = append(migration.Statements,
+			"DROP TABLE " + table,
+			"ALTER TABLE " + newTable + " RENAME TO " + table)
+	} else {
+		for _, colDef := range addedColumnDefs {
+			migration.Statements = append(migration.Statements, "ALTER TABLE " + table + " ADD COLUMN " + colDef)
+		}
+	}
+	return
+}
+
+/*
+Runs the statements of the migration in a transaction, converting the stored values of the converted attributes
+into the new table of the type before it replaces the old table.
+*/
+func (db *SqliteDBThread) migrate(th InterpreterThread, migration *SchemaMigration, table string, conversions []*attrConversion) (err error) {
+	err = db.ExecStatement("BEGIN IMMEDIATE TRANSACTION")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			db.ExecStatement("ROLLBACK TRANSACTION")
+		}
+	}()
+
+	newTable := db.db.TableNameIfy(migration.Type.ShortName() + "__migrating")
+	i := 0
+	for _, statement := range migration.Statements {
+		if strings.HasSuffix(statement, FOR_EACH_CONVERTED_VALUE) {
+			err = db.convertValues(th, conversions[i], table, newTable)
+			if err != nil {
+				return
+			}
+			i++
+			continue
+		}
+		err = db.ExecStatement(statement)
+		if err != nil {
+			return
+		}
+	}
+	err = db.ExecStatement("COMMIT TRANSACTION")
+	return
+}
+
+/*
+Converts each stored value of the old attribute, in the old table, to a value of the attribute's new type,
+calling the attribute's migration method if it has one, and stores the value in the new table.
+*/
+func (db *SqliteDBThread) convertValues(th InterpreterThread, conversion *attrConversion, oldTable string, newTable string) (err error) {
+	oldType := conversion.from.typ()
+	oldCols := conversion.from.columns()
+	attr := conversion.to
+
+	query := "SELECT id," + strings.Join(oldCols, ",") + " FROM " + oldTable
+	selectStmt, err := db.dbt.conn.Prepare(db.db.qualify(query))
+	if err != nil {
+		return
+	}
+	var ids []int64
+	var oldVals []RObject
+	err = selectStmt.Query()
+	for ; err == nil; err = selectStmt.Next() {
+		var id int64
+		colsBytes := make([][]byte, len(oldCols))
+		dsts := []interface{}{&id}
+		for i := range colsBytes {
+			dsts = append(dsts, &colsBytes[i])
+		}
+		err = selectStmt.Scan(dsts...)
+		if err != nil {
+			break
+		}
+		if colsBytes[0] == nil {
+			continue
+		}
+		var val RObject
+		err = restoreVal(colsBytes, oldType, "Migrating "+attr.Part.Name, &val)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+		oldVals = append(oldVals, val)
+	}
+	selectStmt.Close()
+	if err != io.EOF {
+		err = fmt.Errorf("DB ERROR on query:\n%s\nDetail: %s\n\n", query, err)
+		return
+	}
+	err = nil
+
+	update := "UPDATE " + newTable + " SET " + strings.Join(attr.Part.DbColumnNames(), "=?,") + "=? WHERE id=?"
+	for i, oldVal := range oldVals {
+		var val RObject
+		if attr.MigrationMethod != nil {
+			val = th.EvaluationContext().EvalMultiMethodCall(attr.MigrationMethod, []RObject{oldVal})
+		} else {
+			val, err = convertPrimitive(oldVal, attr.Part.Type)
+			if err != nil {
+				return
+			}
+		}
+		if val == nil || val == NIL {
+			continue
+		}
+		if val.Type() != attr.Part.Type {
+			err = fmt.Errorf("Migration method %s returned a %s, not a %s, for attribute %s.%s.",
+				             attr.MigrationMethod.Name, val.Type().Name, attr.Part.Type.Name, attr.WholeType.Name, attr.Part.Name)
+			return
+		}
+		args := append(db.db.primitiveValSQL(val), ids[i])
+		err = db.ExecStatement(update, args...)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+/*
+Converts the column value(s) of a primitive value stored in the db to a value of the type.
+*/
+func restoreVal(colsBytes [][]byte, typ *RType, errPrefix string, val *RObject) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	if len(colsBytes) == 2 {
+		convertValTwoFields(colsBytes[0], colsBytes[1], typ, errPrefix, val)
+	} else {
+		convertVal(colsBytes[0], typ, errPrefix, val)
+	}
+	return
+}
+
+/*
+Whether stored values of the old type can be converted to the new type without a migration method.
+*/
+func canConvert(oldType *RType, newType *RType) bool {
+	isNumeric := func(typ *RType) bool {
+		return typ == IntType || typ == Int32Type || typ == FloatType
+	}
+	return oldType != nil && (newType == StringType || (isNumeric(oldType) && isNumeric(newType)))
+}
+
+/*
+Converts a value to the type, between numeric types, or from any primitive type to String.
+*/
+func convertPrimitive(val RObject, typ *RType) (converted RObject, err error) {
+	if typ == StringType {
+		converted = String(valText(val))
+		return
+	}
+	var f float64
+	switch v := val.(type) {
+	case Int:
+		f = float64(v)
+	case Int32:
+		f = float64(v)
+	case Float:
+		f = float64(v)
+	default:
+		err = fmt.Errorf("Cannot convert %v to type %s.", val, typ.Name)
+		return
+	}
+	switch typ {
+	case IntType:
+		converted = Int(int64(f))
+	case Int32Type:
+		converted = Int32(int32(f))
+	case FloatType:
+		converted = Float(f)
+	default:
+		err = fmt.Errorf("Cannot convert %v to type %s.", val, typ.Name)
+	}
+	return
+}
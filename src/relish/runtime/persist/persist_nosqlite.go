@@ -0,0 +1,34 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+// +build nosqlite
+
+// this package implements data persistence in the relish language environment.
+
+package persist
+
+/*
+   persist_nosqlite.go - stands in for persist_sqlite.go when relish is built with the nosqlite tag,
+   and so without the sqlite3 C library and without cgo.
+
+   Such a relish can store its data only in a key-value database (see persist_kv.go)
+   or in a PostgreSQL database.
+*/
+
+import (
+	"errors"
+	. "relish/runtime/data"
+)
+
+func NewSqliteConn(dbName string, connectionId int) (conn Connection, err error) {
+	err = errors.New("This relish was built without sqlite (the nosqlite build tag). Use a key-value database (-db kv:name) or a postgres:// database.")
+	return
+}
+
+func sqliteClassifyError(err error) int {
+	return TX_FAILED
+}
+
+func sqliteIsUniqueViolation(err error) bool {
+	return false
+}
@@ -0,0 +1,527 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+package persist
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	. "relish/runtime/data"
+	"sync"
+	"testing"
+	"time"
+)
+
+var translateTests = []struct {
+	sqlite   string
+	postgres string
+}{
+	{"SELECT id FROM [vehicles/Car] WHERE make=? AND model=?",
+		`SELECT id FROM "vehicles/Car" WHERE make=$1 AND model=$2`},
+	{"WHERE ((b.k0 < ?1 OR b.k0 IS NULL)) OR (b.k0 = ?1 AND b.id > ?2) LIMIT ?",
+		"WHERE ((b.k0 < $1 OR b.k0 IS NULL)) OR (b.k0 = $1 AND b.id > $2) LIMIT $3"},
+	{"SELECT '[not a table] ?' FROM RObject WHERE typeName=?",
+		"SELECT '[not a table] ?' FROM RObject WHERE typeName=$1"},
+	{"CREATE TABLE IF NOT EXISTS [p/T](id INTEGER PRIMARY KEY,\nflag BOOLEAN, -- why?\nb TINYINT,\nf DOUBLE,\ng FLOAT,\nbits BLOB,\nINTEGERish TEXT)",
+		"CREATE TABLE IF NOT EXISTS \"p/T\"(id BIGINT PRIMARY KEY,\nflag SMALLINT, -- why?\nb SMALLINT,\nf DOUBLE PRECISION,\ng REAL,\nbits BYTEA,\nINTEGERish TEXT)"},
+	{"CREATE TABLE IF NOT EXISTS RChangeLog(id INTEGER PRIMARY KEY AUTOINCREMENT, txId INTEGER NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS RChangeLog(id BIGSERIAL PRIMARY KEY , txId BIGINT NOT NULL)"},
+	{"BEGIN DEFERRED TRANSACTION", "BEGIN ISOLATION LEVEL REPEATABLE READ"},
+	{"BEGIN IMMEDIATE TRANSACTION", "BEGIN ISOLATION LEVEL SERIALIZABLE"},
+	{"PRAGMA table_info([vehicles/Car])",
+		"SELECT ordinal_position, column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = 'vehicles/Car' ORDER BY ordinal_position"},
+	{"PRAGMA table_info(RObject)",
+		"SELECT ordinal_position, column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = 'robject' ORDER BY ordinal_position"},
+}
+
+func TestPostgresTranslate(t *testing.T) {
+	for _, test := range translateTests {
+		if got := PostgresDialect.Translate(test.sqlite); got != test.postgres {
+			t.Errorf("Translate(%q)\n got %q\nwant %q", test.sqlite, got, test.postgres)
+		}
+	}
+}
+
+func TestPostgresUpsert(t *testing.T) {
+	got := PostgresDialect.UpsertStatement("RTypeSchema", "typeName", []string{"typeName", "fingerprint", "attributes"})
+	want := "INSERT INTO RTypeSchema(typeName,fingerprint,attributes) VALUES(?,?,?) ON CONFLICT(typeName) DO UPDATE SET fingerprint=EXCLUDED.fingerprint,attributes=EXCLUDED.attributes"
+	if got != want {
+		t.Errorf("UpsertStatement\n got %q\nwant %q", got, want)
+	}
+}
+
+/*
+Starts a throwaway postgres server, in a temporary directory, using the initdb and pg_ctl programs
+found in $PG_BIN or the PATH. Skips the test if there are none. Returns the URL of the server's
+postgres database, and a function which stops the server and removes its directory.
+*/
+func startLocalPostgres(t *testing.T) (url string, stop func()) {
+	binDir := os.Getenv("PG_BIN")
+	initdb := filepath.Join(binDir, "initdb")
+	pgCtl := filepath.Join(binDir, "pg_ctl")
+	if binDir == "" {
+		var err error
+		if initdb, err = exec.LookPath("initdb"); err != nil {
+			t.Skip("postgres is not installed (no initdb in PATH; set PG_BIN)")
+		}
+		pgCtl = filepath.Join(filepath.Dir(initdb), "pg_ctl")
+	}
+
+	dir, err := ioutil.TempDir("", "relish_pg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataDir := filepath.Join(dir, "data")
+	out, err := exec.Command(initdb, "-D", dataDir, "-U", "relish", "--auth=trust").CombinedOutput()
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("initdb: %s\n%s", err, out)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	options := fmt.Sprintf("-p %d -k %s -c listen_addresses=''", port, dir)
+	out, err = exec.Command(pgCtl, "start", "-w", "-D", dataDir, "-l", filepath.Join(dir, "log"), "-o", options).CombinedOutput()
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("pg_ctl start: %s\n%s", err, out)
+	}
+	stop = func() {
+		exec.Command(pgCtl, "stop", "-w", "-m", "immediate", "-D", dataDir).Run()
+		os.RemoveAll(dir)
+	}
+	url = fmt.Sprintf("postgres://relish@/postgres?host=%s&port=%d&sslmode=disable", dir, port)
+	return
+}
+
+func TestPostgresConn(t *testing.T) {
+	url, stop := startLocalPostgres(t)
+	defer stop()
+
+	if !IsPostgresURI(url) {
+		t.Fatalf("IsPostgresURI(%q) is false", url)
+	}
+	conn, err := NewPostgresConn(url, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	exec := func(sql string, args ...interface{}) {
+		stmt, err := conn.Prepare(sql)
+		if err != nil {
+			t.Fatalf("Prepare(%q): %s", sql, err)
+		}
+		defer stmt.Close()
+		if err = stmt.Exec(args...); err != nil {
+			t.Fatalf("Exec(%q): %s", sql, err)
+		}
+	}
+
+	exec("CREATE TABLE IF NOT EXISTS [test/Car](id INTEGER PRIMARY KEY,\nmake TEXT,\nfast BOOLEAN,\nweight DOUBLE)")
+	exec("BEGIN IMMEDIATE TRANSACTION")
+	exec("INSERT INTO [test/Car](id,make,fast,weight) VALUES(?,?,?,?)", int64(1), "Ford", true, 1200.5)
+	exec("INSERT INTO [test/Car](id,make,fast,weight) VALUES(?,?,?,?)", int64(2), "Fiat", false, 900.0)
+	exec("COMMIT TRANSACTION")
+	exec("UPDATE [test/Car] SET weight=? WHERE make=?", 901.0, "Fiat")
+	if conn.RowsAffected() != 1 {
+		t.Errorf("RowsAffected() = %d, want 1", conn.RowsAffected())
+	}
+
+	stmt, err := conn.Prepare("SELECT id, make, fast, weight FROM [test/Car] WHERE id >= ? ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	var got []string
+	err = stmt.Query(int64(1))
+	for ; err == nil; err = stmt.Next() {
+		var id int64
+		var make string
+		var fast []byte
+		var weight float64
+		if err = stmt.Scan(&id, &make, &fast, &weight); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%d %s %s %g", id, make, fast, weight))
+	}
+	if err != io.EOF {
+		t.Fatal(err)
+	}
+	want := []string{"1 Ford 1 1200.5", "2 Fiat 0 901"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("rows = %q, want %q", got, want)
+	}
+
+	if err = stmt.Query(int64(3)); err != io.EOF {
+		t.Errorf("Query with no rows: err = %v, want io.EOF", err)
+	}
+
+	columns, err := (&SqliteDBThread{dbt: &DBThread{dbConnection: &dbConnection{conn: conn}}}).tableColumns("[test/Car]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(columns) != "[id make fast weight]" {
+		t.Errorf("tableColumns = %v", columns)
+	}
+
+	exec("CREATE UNIQUE INDEX IF NOT EXISTS [test/Car__make__idx] ON [test/Car](make)")
+	stmt2, err := conn.Prepare("INSERT INTO [test/Car](id,make) VALUES(?,?)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt2.Close()
+	err = stmt2.Exec(int64(3), "Ford")
+	if !PostgresDialect.IsUniqueViolation(err) {
+		t.Errorf("duplicate make: err = %v, want a unique violation", err)
+	}
+}
+
+/*
+A fake database/sql driver, so that PostgresConn and PostgresStmt can be tested without a postgres server.
+Each database name is a separate fake server, whose statements' results the test scripts. Like a postgres
+session, a fake connection cannot run a statement while the rows of a query are still being read.
+*/
+type fakePgDriver struct{}
+
+type fakePgServer struct {
+	mutex    sync.Mutex
+	results  map[string]*fakePgResult // By the statement, as translated into postgres
+	execArgs [][]driver.Value         // The arguments of each statement executed
+}
+
+type fakePgResult struct {
+	columns      []string
+	rows         [][]driver.Value
+	rowsAffected int64
+	err          error
+	blocks       bool // The statement runs until it is cancelled
+}
+
+type fakePgError struct{ state string }
+
+func (e *fakePgError) Error() string    { return "pq: fake error " + e.state }
+func (e *fakePgError) SQLState() string { return e.state }
+
+var fakePgServers = struct {
+	sync.Mutex
+	byName map[string]*fakePgServer
+}{byName: make(map[string]*fakePgServer)}
+
+func init() {
+	sql.Register("relish_fakepg", fakePgDriver{})
+}
+
+/*
+Opens a PostgresConn to a new fake server, which gives the results to the statements.
+*/
+func newFakePostgresConn(t *testing.T, results map[string]*fakePgResult) (conn Connection, server *fakePgServer) {
+	server = &fakePgServer{results: results}
+	fakePgServers.Lock()
+	fakePgServers.byName[t.Name()] = server
+	fakePgServers.Unlock()
+	conn, err := newPostgresConn("relish_fakepg", t.Name(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func (fakePgDriver) Open(name string) (driver.Conn, error) {
+	fakePgServers.Lock()
+	defer fakePgServers.Unlock()
+	server := fakePgServers.byName[name]
+	if server == nil {
+		return nil, fmt.Errorf("no fake postgres server %q", name)
+	}
+	return &fakePgConn{server: server}, nil
+}
+
+type fakePgConn struct {
+	server   *fakePgServer
+	openRows int
+}
+
+func (c *fakePgConn) Prepare(query string) (driver.Stmt, error) {
+	c.server.mutex.Lock()
+	defer c.server.mutex.Unlock()
+	result := c.server.results[query]
+	if result == nil {
+		return nil, fmt.Errorf("unexpected statement %q", query)
+	}
+	return &fakePgStmt{conn: c, result: result}, nil
+}
+
+func (c *fakePgConn) Close() error { return nil }
+func (c *fakePgConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are begun by statements")
+}
+
+type fakePgStmt struct {
+	conn   *fakePgConn
+	result *fakePgResult
+}
+
+func (s *fakePgStmt) Close() error  { return nil }
+func (s *fakePgStmt) NumInput() int { return -1 }
+
+func (s *fakePgStmt) Exec(args []driver.Value) (driver.Result, error) {
+	panic("database/sql should call ExecContext")
+}
+
+func (s *fakePgStmt) Query(args []driver.Value) (driver.Rows, error) {
+	panic("database/sql should call QueryContext")
+}
+
+/*
+Records the arguments, then waits for cancellation if the statement blocks, or returns its scripted error.
+*/
+func (s *fakePgStmt) run(ctx context.Context, args []driver.NamedValue) error {
+	if s.conn.openRows > 0 {
+		return errors.New("another command is already in progress")
+	}
+	vals := make([]driver.Value, len(args))
+	for i, arg := range args {
+		vals[i] = arg.Value
+	}
+	s.conn.server.mutex.Lock()
+	s.conn.server.execArgs = append(s.conn.server.execArgs, vals)
+	s.conn.server.mutex.Unlock()
+	if s.result.blocks {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return s.result.err
+}
+
+func (s *fakePgStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	if err := s.run(ctx, args); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(s.result.rowsAffected), nil
+}
+
+func (s *fakePgStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if err := s.run(ctx, args); err != nil {
+		return nil, err
+	}
+	s.conn.openRows++
+	return &fakePgRows{conn: s.conn, result: s.result}, nil
+}
+
+type fakePgRows struct {
+	conn   *fakePgConn
+	result *fakePgResult
+	next   int
+	closed bool
+}
+
+func (r *fakePgRows) Columns() []string { return r.result.columns }
+
+func (r *fakePgRows) Close() error {
+	if !r.closed {
+		r.closed = true
+		r.conn.openRows--
+	}
+	return nil
+}
+
+func (r *fakePgRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.result.rows) {
+		return io.EOF
+	}
+	copy(dest, r.result.rows[r.next])
+	r.next++
+	return nil
+}
+
+/*
+A query's rows are all read at once, so that other statements can run on the connection while the
+rows are being scanned, and NULLs and bools are assigned to the scan destinations as sqlite would.
+*/
+func TestPostgresStmtQuery(t *testing.T) {
+	const query = `SELECT id, make, fast, note FROM "test/Car" WHERE id >= $1 ORDER BY id`
+	const update = `UPDATE "test/Car" SET seen=$1 WHERE id=$2`
+	conn, _ := newFakePostgresConn(t, map[string]*fakePgResult{
+		query: {columns: []string{"id", "make", "fast", "note"},
+			rows: [][]driver.Value{
+				{int64(1), "Ford", true, []byte("quick")},
+				{int64(2), []byte("Fiat"), int64(0), nil},
+			}},
+		update: {rowsAffected: 1},
+	})
+	defer conn.Close()
+
+	stmt, err := conn.Prepare("SELECT id, make, fast, note FROM [test/Car] WHERE id >= ? ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	updateStmt, err := conn.Prepare("UPDATE [test/Car] SET seen=? WHERE id=?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer updateStmt.Close()
+
+	var got []string
+	err = stmt.Query(int64(1))
+	for ; err == nil; err = stmt.Next() {
+		id := int64(-1)
+		make := "unset"
+		fast := true
+		note := []byte("unset")
+		if err = stmt.Scan(&id, &make, &fast, &note); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%d %s %v %q %v", id, make, fast, note, note == nil))
+		if err = updateStmt.Exec(true, id); err != nil {
+			t.Fatalf("Exec while reading rows: %s", err)
+		}
+	}
+	if err != io.EOF {
+		t.Fatal(err)
+	}
+	want := []string{`1 Ford true "quick" false`, `2 Fiat false "" true`}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("rows = %q, want %q", got, want)
+	}
+	if err = stmt.Scan(new(int64)); err != io.EOF {
+		t.Errorf("Scan after the last row: err = %v, want io.EOF", err)
+	}
+
+	if err = stmt.Query(int64(1)); err != nil {
+		t.Fatal(err)
+	}
+	var id int64
+	var anything interface{}
+	if err = stmt.Scan(&id, &anything); err != nil || id != 1 || anything != "Ford" {
+		t.Errorf("Scan of fewer columns: %d %v %v", id, anything, err)
+	}
+	if err = stmt.Scan(&id, &id, &id, &id, &id); err == nil {
+		t.Error("Scan of more columns than the row has did not fail")
+	}
+}
+
+func TestPostgresStmtExec(t *testing.T) {
+	const insert = `INSERT INTO "test/Car"(id,make,fast,slow) VALUES($1,$2,$3,$4)`
+	conn, server := newFakePostgresConn(t, map[string]*fakePgResult{
+		insert:     {rowsAffected: 1},
+		"SELECT 1": {columns: []string{"one"}},
+	})
+	defer conn.Close()
+
+	stmt, err := conn.Prepare("INSERT INTO [test/Car](id,make,fast,slow) VALUES(?,?,?,?)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	if err = stmt.Exec(int64(7), "Fiat", true, false); err != nil {
+		t.Fatal(err)
+	}
+	if conn.RowsAffected() != 1 {
+		t.Errorf("RowsAffected() = %d, want 1", conn.RowsAffected())
+	}
+	if got := fmt.Sprintf("%#v", server.execArgs[0]); got != `[]driver.Value{7, "Fiat", 1, 0}` {
+		t.Errorf("args = %s; bools should be stored as 1 or 0", got)
+	}
+
+	stmt, err = conn.Prepare("SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	if err = stmt.Query(); err != io.EOF {
+		t.Errorf("Query with no rows: err = %v, want io.EOF", err)
+	}
+}
+
+/*
+Errors are classified by their SQLSTATE, whether or not wrapped in a *DbError.
+*/
+func TestPostgresClassifyError(t *testing.T) {
+	tests := []struct {
+		state    string
+		kind     int
+		isUnique bool
+	}{
+		{"40001", TX_CONFLICT, false},
+		{"40P01", TX_CONFLICT, false},
+		{"55P03", TX_LOCKED, false},
+		{"23505", TX_FAILED, true},
+		{"42P01", TX_FAILED, false},
+	}
+	results := make(map[string]*fakePgResult)
+	for _, test := range tests {
+		results["SELECT "+test.state] = &fakePgResult{err: &fakePgError{test.state}}
+	}
+	conn, _ := newFakePostgresConn(t, results)
+	defer conn.Close()
+
+	for _, test := range tests {
+		stmt, err := conn.Prepare("SELECT " + test.state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = stmt.Exec()
+		stmt.Close()
+		for _, e := range []error{err, &DbError{Action: "executing", Statement: "SELECT", Cause: err}} {
+			if kind := PostgresDialect.ClassifyError(e); kind != test.kind {
+				t.Errorf("ClassifyError(%v) = %d, want %d", e, kind, test.kind)
+			}
+			if isUnique := PostgresDialect.IsUniqueViolation(e); isUnique != test.isUnique {
+				t.Errorf("IsUniqueViolation(%v) = %v", e, isUnique)
+			}
+		}
+	}
+	if kind := PostgresDialect.ClassifyError(errors.New("connection refused")); kind != TX_FAILED {
+		t.Errorf("ClassifyError of a non-postgres error = %d, want TX_FAILED", kind)
+	}
+}
+
+/*
+Interrupt cancels the statement which is running, but not the statements run after it.
+*/
+func TestPostgresConnInterrupt(t *testing.T) {
+	conn, _ := newFakePostgresConn(t, map[string]*fakePgResult{
+		"SELECT pg_sleep(60)": {blocks: true},
+		"SELECT 1":            {},
+	})
+	defer conn.Close()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		conn.Interrupt()
+	}()
+	stmt, err := conn.Prepare("SELECT pg_sleep(60)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	if err = stmt.Exec(); err != context.Canceled {
+		t.Errorf("interrupted Exec: err = %v, want context.Canceled", err)
+	}
+
+	stmt, err = conn.Prepare("SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	if err = stmt.Exec(); err != nil {
+		t.Errorf("Exec after the interrupt: %s", err)
+	}
+}
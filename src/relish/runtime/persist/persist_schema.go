@@ -16,7 +16,8 @@ package persist
        id INTEGER PRIMARY KEY,
        id2 INTEGER, 
        idReversed BOOLEAN, --???
-       typeName TEXT   -- Should be typeId because type should be another RObject!!!!
+       typeName TEXT,   -- Should be typeId because type should be another RObject!!!!
+       version INTEGER
     )`
 
 */
@@ -37,31 +38,73 @@ func (db *SqliteDBThread) EnsureObjectTable() {
            id INTEGER PRIMARY KEY,
            id2 INTEGER NOT NULL, 
            flags TINYINT NOT NULL, -- ??? is BOOLEAN a type in sqlite?
-           typeName TEXT NOT NULL  -- Should be typeId because type should be another RObject!!!!
+           typeName TEXT NOT NULL,  -- Should be typeId because type should be another RObject!!!!
+           version INTEGER NOT NULL DEFAULT 0  -- Incremented by each transaction which changes the object, in optimistic concurrency mode
          )`
 	err := db.ExecStatement(s)
 	if err != nil {
 		panic(fmt.Sprintf("db.ExecStatement(%s): db error: %s", s, err))
 	}
+	err = db.ensureObjectVersionColumn()
+	if err != nil {
+		panic(fmt.Sprintf("Adding version column to RObject table: db error: %s", err))
+	}
 }
 
 /*
-Adds a table to the database for a type, if the table does not yet exist.
-Should be called after the type has been assigned all of its attribute specifications and
-relation specifications.
+Adds the version column to the RObject table of a database created before objects had versions.
 */
-func (db *SqliteDBThread) EnsureTypeTable(typ *RType) (err error) {
-	s := "CREATE TABLE IF NOT EXISTS " + db.db.TableNameIfy(typ.ShortName()) +
-		"(id INTEGER PRIMARY KEY"
+func (db *SqliteDBThread) ensureObjectVersionColumn() (err error) {
+	columns, err := db.tableColumns("RObject")
+	if err != nil {
+		return
+	}
+	for _, columnName := range columns {
+		if columnName == "version" {
+			return
+		}
+	}
+	err = db.ExecStatement("ALTER TABLE RObject ADD COLUMN version INTEGER NOT NULL DEFAULT 0")
+	return
+}
 
-	// Loop over primitive-valued attributes - for each, make a column in the table - TBD
+/*
+Returns the names of the columns of the table, in order, or no names if the table does not exist.
+*/
+func (db *SqliteDBThread) tableColumns(table string) (columns []string, err error) {
+	query := "PRAGMA table_info(" + table + ")"
+	selectStmt, err := db.dbt.conn.Prepare(db.db.qualify(query))
+	if err != nil {
+		return
+	}
 
-	for _, attr := range typ.Attributes {
-		if attr.Part.Type.IsPrimitive && attr.Part.CollectionType == "" && ! attr.IsTransient {
-			s += ",\n" + attr.Part.DbColumnDef()
+	defer selectStmt.Close()
 
+	err = selectStmt.Query()
+    for ; err == nil ; err = selectStmt.Next() {   
+		var columnId int
+		var columnName string
+		err = selectStmt.Scan(&columnId, &columnName)
+		if err != nil {
+			return
 		}
+		columns = append(columns, columnName)
 	}
+	if err != io.EOF {
+	   err = fmt.Errorf("DB ERROR on query:\n%s\nDetail: %s\n\n", query, err)   
+	   return  
+	} 
+	err = nil
+	return
+}
+
+/*
+Adds a table to the database for a type, if the table does not yet exist.
+Should be called after the type has been assigned all of its attribute specifications and
+relation specifications.
+*/
+func (db *SqliteDBThread) EnsureTypeTable(typ *RType) (err error) {
+	s := "CREATE TABLE IF NOT EXISTS " + typeTableDef(db.db.TableNameIfy(typ.ShortName()), typ)
 
 	// What about relations? Do separately.
 
@@ -73,14 +116,41 @@ func (db *SqliteDBThread) EnsureTypeTable(typ *RType) (err error) {
 	   someStringAttribute TEXT 
 	*/
 
-	s += ");"
+	s += ";"
 	err = db.ExecStatement(s)
 	if err != nil {
 		err = fmt.Errorf("db.ExecStatement(%s): db error: %s", s, err)
+		return
 	}
+	err = db.recordTypeSchema(typ)
+	if err != nil {
+		return
+	}
+	err = db.ensureTypeIndexes(typ)
 	return
 }
 
+/*
+Returns the table name and column definitions part of the CREATE TABLE statement of the type's table.
+There is a column (or two) for each primitive-valued attribute of the type.
+*/
+func typeTableDef(table string, typ *RType) string {
+	s := table + "(id INTEGER PRIMARY KEY"
+	for _, attr := range typ.Attributes {
+		if isTypeTableColumn(attr) {
+			s += ",\n" + attr.Part.DbColumnDef()
+		}
+	}
+	return s + ")"
+}
+
+/*
+Whether the attribute's values are stored in the column (or columns) of the attribute in its type's table.
+*/
+func isTypeTableColumn(attr *AttributeSpec) bool {
+	return attr.Part.Type.IsPrimitive && attr.Part.CollectionType == "" && ! attr.IsTransient
+}
+
 /*
 Adds the table to the database which associates a unique name to each specially dubbed RObject instance.
 RELISH's local persistence model uses persistence by reachability. Special objects are "dubbed" with
@@ -137,7 +207,7 @@ func (db *SqliteDBThread) restorePackageNameMappings() (err error) {
 
 	query := "SELECT name,shortName FROM RPackage"
 
-	selectStmt, err := db.dbt.conn.Prepare(query)
+	selectStmt, err := db.dbt.conn.Prepare(db.db.qualify(query))
 	if err != nil {
 		return
 	}
@@ -149,6 +219,7 @@ func (db *SqliteDBThread) restorePackageNameMappings() (err error) {
 		return
 	}
 
+	stored := make(map[string]string)
     for ; err == nil ; err = selectStmt.Next() {   
 
 		var name string
@@ -157,11 +228,14 @@ func (db *SqliteDBThread) restorePackageNameMappings() (err error) {
 		if err != nil {
 			return
 		}
-		RT.PkgNameToShortName[name] = shortName
-		RT.PkgShortNameToName[shortName] = name
+		stored[name] = shortName
 	}
 	if err == io.EOF {
-	   err = nil 
+	   var unrecorded []string
+	   unrecorded, err = reconcilePackageNames(db.db.named, stored)
+	   for _, name := range unrecorded {
+	      db.RecordPackageName(name, RT.PkgNameToShortName[name])
+	   }
 	} else {
 	   err = fmt.Errorf("DB ERROR on query:\n%s\nDetail: %s\n\n", query, err)   
 	   return  
@@ -233,7 +307,7 @@ Name string
   Type *RType
   ArityLow int32
   ArityHigh int32
-  CollectionType string // "list","sortedlist", "set", "sortedset", "map", "stringmap","sortedmap","sortedstringmap",""
+  CollectionType string // "list","biglist","sortedlist", "set", "sortedset", "map", "stringmap","sortedmap","sortedstringmap",""
   OrderAttrName string   // What is this?
 */
 func (db *SqliteDBThread) EnsureNonPrimitiveAttributeTable(attr *AttributeSpec) (err error) {
@@ -249,10 +323,12 @@ func (db *SqliteDBThread) EnsureNonPrimitiveAttributeTable(attr *AttributeSpec)
 
 	s += "id1 INTEGER NOT NULL"
 
+   isOrdered := false
    if attr.Part.ArityHigh != 1 { // This is a multi-valued attribute.
    	switch attr.Part.CollectionType {
-   	case "list", "sortedlist", "sortedset", "map", "sortedmap":
+   	case "list", "biglist", "sortedlist", "sortedset", "map", "sortedmap":
    		s += ",\nord1 INTEGER NOT NULL"
+   		isOrdered = true
    	case "stringmap", "sortedstringmap":
    		s += ",\nkey1 TEXT NOT NULL"
    	}
@@ -262,7 +338,9 @@ func (db *SqliteDBThread) EnsureNonPrimitiveAttributeTable(attr *AttributeSpec)
 	err = db.ExecStatement(s)
 	if err != nil {
 		err = fmt.Errorf("db.ExecStatement(%s): db error: %s", s, err)
+		return
 	}
+	err = db.ensureAssociationIndexes(db.db.TableNameIfy(attr.ShortName()), "id0", true, isOrdered)
 	return
 }
 
@@ -284,9 +362,11 @@ func (db *SqliteDBThread) EnsureMultiValuedPrimitiveAttributeTable(attr *Attribu
 		
 	// and add a sorting/ordering column if appropriate
 		
+    isOrdered := false
     switch attr.Part.CollectionType {
-    case "list", "sortedlist", "sortedset", "map", "sortedmap":   	
+    case "list", "biglist", "sortedlist", "sortedset", "map", "sortedmap":   	
 	s += ",\nord1 INTEGER NOT NULL"
+	isOrdered = true
     case "stringmap", "sortedstringmap":
 	s += ",\nkey1 TEXT NOT NULL"
     }	
@@ -296,7 +376,9 @@ func (db *SqliteDBThread) EnsureMultiValuedPrimitiveAttributeTable(attr *Attribu
 	err = db.ExecStatement(s)
 	if err != nil {
 		err = fmt.Errorf("db.ExecStatement(%s): db error: %s", s, err)
+		return
 	}
+	err = db.ensureAssociationIndexes(db.db.TableNameIfy(attr.ShortName()), "id", false, isOrdered)
 	return
 }
 
@@ -342,17 +424,21 @@ func (db *SqliteDBThread) EnsureNonPrimitiveCollectionTable(table string, isMap
 
 	s += "id1 INTEGER NOT NULL"
 
+	hasOrd := false
 	if keyType == StringType {	
 		s += ",\nkey1 TEXT NOT NULL"
 	} else if isMap || isOrdered {
 		s += ",\nord1 INTEGER NOT NULL"
+		hasOrd = true
    }
 
 	s += ");"
 	err = db.ExecStatement(s)
 	if err != nil {
 		err = fmt.Errorf("db.ExecStatement(%s): db error: %s", s, err)
+		return
 	}
+	err = db.ensureAssociationIndexes(table, "id0", true, hasOrd)
 	return
 }
 
@@ -373,10 +459,12 @@ func (db *SqliteDBThread) EnsurePrimitiveCollectionTable(table string, isMap boo
 		
 	// and add a sorting/ordering column if appropriate
 		
+   hasOrd := false
    if keyType == StringType {	
    	s += ",\nkey1 TEXT NOT NULL"
    } else if isMap || isOrdered {
    	s += ",\nord1 INTEGER NOT NULL"
+   	hasOrd = true
    }
 
 	s += ");"
@@ -384,7 +472,9 @@ func (db *SqliteDBThread) EnsurePrimitiveCollectionTable(table string, isMap boo
 	err = db.ExecStatement(s)
 	if err != nil {
 		err = fmt.Errorf("db.ExecStatement(%s): db error: %s", s, err)
+		return
 	}
+	err = db.ensureAssociationIndexes(table, "id", false, hasOrd)
 	return
 }
 
@@ -418,6 +508,14 @@ func (db *SqliteDBThread) EnsureCollectionTable(collection RCollection) (table s
 }
 
 func (db *SqliteDB) TypeDescriptor(collection RCollection) (table string, isMap bool, isOrdered bool, keyType *RType, elementType *RType) {
+   return typeDescriptor(collection)
+}
+
+/*
+Returns the collection type descriptor of the collection, e.g. [sortedlist_of_shapes/Circle], which names the
+table of the collection's members and is stored as the collection's type name, along with what kind of collection it is.
+*/
+func typeDescriptor(collection RCollection) (table string, isMap bool, isOrdered bool, keyType *RType, elementType *RType) {
    
    isMap = collection.IsMap()
    isSorting := collection.IsSorting()
@@ -446,6 +544,8 @@ func (db *SqliteDB) TypeDescriptor(collection RCollection) (table string, isMap
    table = "["
    if isSorting {
       table += "sorted"
+   } else if _, isBig := collection.(BigList); isBig {
+      table += "big"
    }
    switch keyType {
    case StringType:
@@ -0,0 +1,156 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+// +build !nosqlite
+
+// this package implements data persistence in the relish language environment.
+
+package persist
+
+/*
+   persist_sqlite.go - connections to sqlite databases, through the sqlite3 C library (which requires cgo).
+
+   Building with the nosqlite tag leaves this file out, so that relish can be built without cgo.
+   See persist_nosqlite.go.
+*/
+
+import (
+	sqlite "code.google.com/p/go-sqlite/go1/sqlite3"
+	"io"
+	. "relish/runtime/data"
+	"strings"
+)
+
+/*
+A SQLITE3 connection which implements the Connection interface.
+*/
+type SqliteConn struct {
+	conn *sqlite.Conn
+	preparedStatements map[string]*sqlite.Stmt
+  isReadOnly bool
+  id int
+}
+
+/*
+Set whether this connection is only to be used for read operations on the database.
+e.g. selects but not inserts or updates. If never set, the connection defaults to 
+read-or-write-enabled.
+*/
+func (conn *SqliteConn) SetReadOnly(isReadOnly bool) {
+  conn.isReadOnly = isReadOnly
+}
+
+/*
+Returns whether this connection is restricted to reading from the database.
+*/
+func (conn *SqliteConn) IsReadOnly() bool {
+  return conn.isReadOnly
+}
+
+
+/*
+Return a prepared statement based on the sql string.
+Returns a cached, pre-prepared statement if the sql string has been used before in this connection.
+*/
+func (conn *SqliteConn) Prepare(sql string) (statement Statement, err error) {
+	statement, err = conn.conn.Prepare(sql)
+	return
+}
+
+func (conn *SqliteConn) PreparedStatement(sql string) (statement Statement, found bool) {
+	statement, found = conn.preparedStatements[sql]
+	return
+}
+
+func (conn *SqliteConn) CachePreparedStatement(sql string, statement Statement) {
+	conn.preparedStatements[sql] = statement.(*sqlite.Stmt)
+	return
+}
+
+func (conn *SqliteConn) Close() error {
+	return conn.conn.Close()
+}
+
+func (conn *SqliteConn) Id() int {
+  return conn.id
+}
+
+func (conn *SqliteConn) RowsAffected() int {
+  return conn.conn.RowsAffected()
+}
+
+/*
+Makes the running statement fail with SQLITE_INTERRUPT. Safe to call from another goroutine.
+*/
+func (conn *SqliteConn) Interrupt() {
+  conn.conn.Interrupt()
+}
+
+
+/*
+Copies the database to a new database file at path, with the sqlite online backup API.
+The pages are all copied in one step, so the copy is a consistent snapshot. In WAL journal mode,
+the database's writers are not blocked while it is taken.
+*/
+func (conn *SqliteConn) Backup(schema string, path string) (err error) {
+	dst, err := sqlite.Open(path)
+	if err != nil {
+		return
+	}
+	defer dst.Close()
+	backup, err := conn.conn.Backup(schema, dst, "main")
+	if err != nil {
+		return
+	}
+	policy := DefaultTransactionRetryPolicy()
+	for try := 1; ; try++ {
+		err = backup.Step(-1)
+		if err == nil || err == io.EOF {
+			err = nil
+			break
+		}
+		if ! policy.ShouldRetry(sqliteClassifyError(err), try) {
+			break
+		}
+		policy.Wait(try)
+	}
+	closeErr := backup.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return
+}
+
+func NewSqliteConn(dbName string, connectionId int) (conn Connection, err error) {
+	s3conn, err := sqlite.Open(dbName)
+    if err != nil {
+    	return
+    }
+    sConn := &SqliteConn{conn: s3conn, preparedStatements: make(map[string]*sqlite.Stmt), id: connectionId}    
+	conn = sConn
+	return
+}
+
+/*
+Determines whether a sqlite error is due to contention with another connection (TX_BUSY),
+or with a conflicting table lock (TX_LOCKED), or is some other error (TX_FAILED).
+*/
+func sqliteClassifyError(err error) int {
+   if sqliteErr, isSqliteErr := dbErrorCause(err).(*sqlite.Error); isSqliteErr {
+      switch sqliteErr.Code() & 0xff {  // primary result code, without extended result code bits
+      case sqlite.BUSY:
+         return TX_BUSY
+      case sqlite.LOCKED:
+         return TX_LOCKED
+      }
+   }
+   return TX_FAILED
+}
+
+/*
+Whether the sqlite error is a violation of a unique index.
+*/
+func sqliteIsUniqueViolation(err error) bool {
+   sqliteErr, isSqliteErr := dbErrorCause(err).(*sqlite.Error)
+   return isSqliteErr && sqliteErr.Code()&0xff == sqlite.CONSTRAINT && strings.Contains(strings.ToLower(sqliteErr.Error()), "unique")
+}
@@ -0,0 +1,342 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+// this package implements data persistence in the relish language environment.
+
+package persist
+
+/*
+   persist_walship.go - incremental backup of a sqlite database by shipping its write-ahead log (WAL)
+   to a local directory.
+
+   The shipping directory has a subdirectory for each generation of shipped WAL, named by the time it began:
+
+      <dir>/20140321-101500.000000/base.db          a snapshot of the database, taken by the online backup API
+      <dir>/20140321-101500.000000/00000001.wal     the WAL header, followed by the frames of some committed transactions
+      <dir>/20140321-101500.000000/00000002.wal     ...
+
+   Every few seconds, the shipper takes the database's write lock, copies the WAL frames written since it last
+   shipped, up to the last commit, into a new segment, and releases the lock. Between shipments it holds
+   a read transaction, so that sqlite cannot restart the WAL (overwriting it from the beginning) before
+   the frames written since have been shipped. If the WAL was restarted anyway, which can only happen
+   in the moment between shipments, frames may have been missed, so a new generation is begun, with a new base.
+
+   Restoring copies the base of the latest generation and writes the pages of each frame of its segments,
+   in order, into it. Replaying the frames of a WAL generation from its start, over any later snapshot of
+   the database taken during the generation, gives the database as of the last frame replayed.
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	. "relish/dbg"
+	. "relish/runtime/data"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	WAL_HEADER_SIZE       = 32
+	WAL_FRAME_HEADER_SIZE = 24
+)
+
+/*
+Ships the WAL of a sqlite database to a directory.
+*/
+type WALShipper struct {
+	db         *SqliteDB
+	dir        string
+	conn       Connection // the shipper's own connection to the database
+	generation string     // the directory of the generation being shipped. "" before the first shipment.
+	salt       []byte     // the salts of the WAL header of the WAL generation being shipped
+	frames     int64      // how many frames of the WAL generation have been shipped
+	segments   int        // how many segments of the generation have been shipped
+	inRead     bool       // the connection holds a read transaction between shipments
+	stop       chan bool
+}
+
+/*
+Begins shipping the WAL of the database to the directory, every interval, putting the database in WAL journal
+mode if it is not already. Ships once before returning, so the directory has a base snapshot of the database.
+*/
+func (db *SqliteDB) ShipWAL(dir string, interval time.Duration) (shipper *WALShipper, err error) {
+	if db.dialect != SqliteDialect {
+		err = errors.New("WAL shipping needs a sqlite database.")
+		return
+	}
+	err = os.MkdirAll(dir, 0777)
+	if err != nil {
+		return
+	}
+	conn, err := db.pool.newConn(db.dbName, 0)
+	if err != nil {
+		return
+	}
+	shipper = &WALShipper{db: db, dir: dir, conn: conn, stop: make(chan bool)}
+	err = shipper.exec("PRAGMA journal_mode=WAL")
+	if err == nil {
+		err = shipper.Ship()
+	}
+	if err != nil {
+		conn.Close()
+		shipper = nil
+		return
+	}
+	go shipper.run(interval)
+	return
+}
+
+func (s *WALShipper) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.Ship(); err != nil {
+				Logln(ALWAYS_, "WAL shipping to", s.dir, "failed:", err)
+			}
+		}
+	}
+}
+
+/*
+Ships the last frames, then stops shipping and closes the shipper's connection.
+*/
+func (s *WALShipper) Stop() (err error) {
+	s.stop <- true
+	err = s.Ship()
+	if s.inRead {
+		s.exec("COMMIT")
+		s.inRead = false
+	}
+	s.conn.Close()
+	return
+}
+
+/*
+Copies the WAL frames committed since the last shipment to a new segment.
+*/
+func (s *WALShipper) Ship() (err error) {
+	if s.inRead {
+		err = s.exec("COMMIT")
+		if err != nil {
+			return
+		}
+		s.inRead = false
+	}
+	err = s.execRetrying("BEGIN IMMEDIATE TRANSACTION")
+	if err != nil {
+		return
+	}
+	err = s.shipFrames()
+	commitErr := s.exec("COMMIT")
+	if err == nil {
+		err = commitErr
+	}
+	if err != nil {
+		return
+	}
+
+	// Hold a read transaction until the next shipment, so that the WAL cannot be restarted meanwhile.
+
+	err = s.exec("BEGIN DEFERRED TRANSACTION")
+	if err != nil {
+		return
+	}
+	s.inRead = true
+	err = s.exec(s.db.dialect.SnapshotQuery())
+	return
+}
+
+/*
+Copies the frames of the WAL, after those already shipped, up to the last commit, to a new segment.
+Must hold the database's write lock, so the frames are completely written.
+*/
+func (s *WALShipper) shipFrames() (err error) {
+	wal, err := ioutil.ReadFile(s.db.dbName + "-wal")
+	if os.IsNotExist(err) {
+		wal, err = nil, nil
+	}
+	if err != nil {
+		return
+	}
+	if len(wal) < WAL_HEADER_SIZE {
+		if s.generation == "" {
+			err = s.beginGeneration(nil)
+		}
+		return
+	}
+	header := wal[:WAL_HEADER_SIZE]
+	salt := header[16:24]
+	if s.generation == "" || !bytes.Equal(salt, s.salt) {
+		err = s.beginGeneration(salt)
+		if err != nil {
+			return
+		}
+	}
+
+	frameSize := int64(WAL_FRAME_HEADER_SIZE + binary.BigEndian.Uint32(header[8:12]))
+	start := WAL_HEADER_SIZE + s.frames*frameSize
+	end := start
+	for pos := start; pos+frameSize <= int64(len(wal)); pos += frameSize {
+		frameHeader := wal[pos : pos+WAL_FRAME_HEADER_SIZE]
+		if !bytes.Equal(frameHeader[8:16], salt) {
+			break // a frame of an earlier WAL generation
+		}
+		if binary.BigEndian.Uint32(frameHeader[4:8]) != 0 { // a commit frame
+			end = pos + frameSize
+		}
+	}
+	if end == start {
+		return
+	}
+
+	segment := append(append([]byte(nil), header...), wal[start:end]...)
+	segmentPath := filepath.Join(s.generation, fmt.Sprintf("%08d.wal", s.segments+1))
+	err = ioutil.WriteFile(segmentPath+".tmp", segment, 0666)
+	if err == nil {
+		err = os.Rename(segmentPath+".tmp", segmentPath)
+	}
+	if err != nil {
+		return
+	}
+	s.segments++
+	s.frames += (end - start) / frameSize
+	return
+}
+
+/*
+Begins a new generation of shipped WAL, for the WAL generation with the salts, whose base is a snapshot
+of the database. Must hold the database's write lock, so that no frames are written after the snapshot
+is taken and before they can be shipped.
+*/
+func (s *WALShipper) beginGeneration(salt []byte) (err error) {
+	generation := filepath.Join(s.dir, time.Now().UTC().Format("20060102-150405.000000000"))
+	err = os.Mkdir(generation, 0777)
+	if err != nil {
+		return
+	}
+	err = backupTo(filepath.Join(generation, "base.db"), func(tmpPath string) error {
+		return s.conn.Backup("main", tmpPath)
+	})
+	if err != nil {
+		return
+	}
+	if s.generation != "" {
+		Logln(ALWAYS_, "The WAL was restarted before it was shipped. Began a new generation of shipped WAL:", generation)
+	}
+	s.generation = generation
+	s.salt = append([]byte(nil), salt...)
+	s.frames = 0
+	s.segments = 0
+	return
+}
+
+func (s *WALShipper) exec(statement string) (err error) {
+	stmt, err := s.conn.Prepare(statement)
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+	if strings.HasPrefix(strings.ToUpper(statement), "SELECT") {
+		err = stmt.Query()
+	} else {
+		err = stmt.Exec()
+	}
+	return
+}
+
+/*
+Executes the statement, retrying it according to the default transaction retry policy
+if the database is busy or locked.
+*/
+func (s *WALShipper) execRetrying(statement string) (err error) {
+	policy := DefaultTransactionRetryPolicy()
+	for try := 1; ; try++ {
+		err = s.exec(statement)
+		if err == nil || !policy.ShouldRetry(s.db.dialect.ClassifyError(err), try) {
+			return
+		}
+		policy.Wait(try)
+	}
+}
+
+/*
+The base snapshot and the WAL segments, in order, of the latest generation in the WAL shipping directory.
+*/
+func latestWALGeneration(dir string) (basePath string, segments []string, err error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	var generations []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			if _, statErr := os.Stat(filepath.Join(dir, entry.Name(), "base.db")); statErr == nil {
+				generations = append(generations, entry.Name())
+			}
+		}
+	}
+	if len(generations) == 0 {
+		err = fmt.Errorf("%s is not a WAL shipping directory. It has no generation with a base.db snapshot.", dir)
+		return
+	}
+	sort.Strings(generations)
+	generation := filepath.Join(dir, generations[len(generations)-1])
+	basePath = filepath.Join(generation, "base.db")
+	segments, err = filepath.Glob(filepath.Join(generation, "*.wal"))
+	sort.Strings(segments)
+	return
+}
+
+/*
+Writes the page of each frame of the WAL segments, in order, into the database file,
+and truncates the file to the database size of each commit frame.
+*/
+func applyWALSegments(dbPath string, segments []string) (err error) {
+	if len(segments) == 0 {
+		return
+	}
+	file, err := os.OpenFile(dbPath, os.O_RDWR, 0666)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	for _, segmentPath := range segments {
+		var segment []byte
+		segment, err = ioutil.ReadFile(segmentPath)
+		if err != nil {
+			return
+		}
+		if len(segment) < WAL_HEADER_SIZE {
+			err = fmt.Errorf("The WAL segment %s is too short.", segmentPath)
+			return
+		}
+		pageSize := int64(binary.BigEndian.Uint32(segment[8:12]))
+		frameSize := WAL_FRAME_HEADER_SIZE + pageSize
+		for pos := int64(WAL_HEADER_SIZE); pos+frameSize <= int64(len(segment)); pos += frameSize {
+			pageNumber := int64(binary.BigEndian.Uint32(segment[pos : pos+4]))
+			dbSize := int64(binary.BigEndian.Uint32(segment[pos+4 : pos+8]))
+			_, err = file.WriteAt(segment[pos+WAL_FRAME_HEADER_SIZE:pos+frameSize], (pageNumber-1)*pageSize)
+			if err != nil {
+				return
+			}
+			if dbSize != 0 {
+				err = file.Truncate(dbSize * pageSize)
+				if err != nil {
+					return
+				}
+			}
+		}
+	}
+	err = file.Sync()
+	return
+}
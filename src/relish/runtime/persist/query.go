@@ -9,6 +9,8 @@ package persist
    query.go - OQL to SQL translation and multi-object fetch query implementation.
 
    This file contains methods that transform query syntax from an object & object-attribute query language to SQL.
+   The OQL is parsed and typechecked by package relish/runtime/persist/oql, then the syntax tree is translated
+   to SQL in a single pass.
    
    Currently is possibly specific to SQLITE 3 dbs.
 */
@@ -17,20 +19,11 @@ import (
 	"fmt"
 	. "relish/dbg"
 	. "relish/runtime/data"
+	"relish/runtime/persist/oql"
 	"strings"
-	"regexp"
 	"errors"
 )
 
-// Looking for "afunc" or " aFunc" or "aFuncName123" or " aFuncName123"
-//var re *regexp.Regexp = regexp.MustCompile(`[a-z][A-Za-z0-9]*     ^\(   `)
-
-// Before May 20 2014
-//var re *regexp.Regexp = regexp.MustCompile(`([a-z][A-Za-z0-9]*)(?:$|[^(A-Za-z0-9])`)
-
-var re *regexp.Regexp = regexp.MustCompile(`(?:^|[^.A-Za-z0-9])([a-z][A-Za-z0-9]*)(?:$|[^(.A-Za-z0-9])`)	
-var re2 *regexp.Regexp = regexp.MustCompile(`([a-z][A-Za-z0-9]*)\.([a-z][A-Za-z0-9]*)(?:$|[^(A-Za-z0-9])`)
-
 /*
 queryArgs are values to be substituted by the SQL engine into ? parameters in the where clause.
 There may be zero or more of these. The number must match the number of ?s.
@@ -67,487 +60,473 @@ func (db *SqliteDBThread) FetchN(typ *RType, oqlSelectionCriteria string, queryA
 
 
 
+
 /*
 Converts object and object-attribute query language expressions to SQL queries.
 
-e.g. vehicles/Car, "speed > 60"   ==> "select id from [vehicles/Vehicle] where speed > 60"
+e.g. vehicles/Car, "speed > 60"   ==> "SELECT ro.id FROM RObject ro JOIN [vehicles/Car] t1 ON t1.id = ro.id WHERE t1.speed > 60"
+
+The OQL is parsed, and typechecked against the attributes of objType and its supertypes, and any error is 
+reported with its column position in the OQL. 
 
-If lazy is true, the select statement selects only ids.
+If idsOnly is true, the select statement selects only ids.
 If false, it selects everything from all tables: the type and all of its supertypes
 */
 func (db *SqliteDB) oqlWhereToSQLSelect(objType *RType, oqlWhereCriteria string, coll RCollection, idsOnly bool) (sqlSelectQuery string, numPrimAttributeColumns int, err error) {
 
-   // 1. Parse the OQL into an ast?
-
-   // 2. Collect attribute references from the OQL: words not inside single-quotes.
-
-   // 3. Search the supertypes list/lattice, to find the correct type for each attribute
-
-   // 4. create aliases for each type table
-
-   // 5. replace each attribute in the OQL with alias.attribute in sql query
-
-   // 6. select from a join of the needed tables based on the attributes.	
-
-   // Do we do this lazy or all in one?
-
-    attributeNames := make(map[string]bool)
-    otherAttributeNames := make(map[string][]string)  // map from join attr name to list of other attr names
-    joinAttrs := make(map[string]*AttributeSpec)
-
-    // These will have to be made illegal for attribute names in relish TODO !!!
-    reservedWords := map[string]bool {
-	    "and" : true,
-	    "or" : true,
-	    "not" : true,
-	    "in" : true,
-	    "is" : true,
-	    "null": true,
-	    "desc": true,
-	    "asc": true,
-	    "like": true,
-	    "order": true,
-	    "by": true,
-    }
-
-    s := removeLiteralStrings(oqlWhereCriteria)
- 
-    // Find b.c and d.e in expression like b.c < 2 and d.e = 'foo'
-    //
-	joinedAttrMatches := re2.FindAllStringSubmatch(s,-1)
-	
-    hasJoinedConditions := len(joinedAttrMatches) > 0
-
-
-	joinAttrWords := []string{}
-	joinAttrOtherAttrWords := []string{}	
-	for _,match := range joinedAttrMatches {
-		joinAttrWords = append(joinAttrWords, match[1])
-		joinAttrOtherAttrWords = append(joinAttrOtherAttrWords, match[2])		
-	}
-
-    for i := range joinAttrWords {
-        joinAttrWord := joinAttrWords[i]
-        joinAttrOtherAttrWord := joinAttrOtherAttrWords[i]
-
-        otherAttrs,othersFound := otherAttributeNames[joinAttrWord]
-        if othersFound {
-        	otherAttributeNames[joinAttrWord] = append(otherAttrs,joinAttrOtherAttrWord)
-        } else {
-        	otherAttributeNames[joinAttrWord] = []string{joinAttrOtherAttrWord}
-        	attr, attrFound := objType.GetAttribute(joinAttrWord)
-            if ! attrFound {
-            	err = fmt.Errorf("Attribute '%s' not found in type %s or supertypes.", joinAttrWord, objType.Name)
-                return    
-            }    	
-        	joinAttrs[joinAttrWord] = attr
-        }
-    }
-
-
-
-
-
-
-
-
-
-
-
-    // Original code, before join-table handling, is below here.
-
-    // words := re.FindAllString(s,-1)
-	matches := re.FindAllStringSubmatch(s,-1)
-	words := []string{}
-	for _,match := range matches {
-		words = append(words, match[1])
-	}
-
-
-    for _,word := range words {
-  	    if ! reservedWords[word] {
-	       attributeNames[word] = true
-        }
-    } 
-
-    // tableNameAliases is a map from tableName to alias
-    // aliasedAttrNames has each attribute b prefixed by its table's alias e.g. t1.b
-    tableNameAliases, aliasedAttrNames, err := db.findAliases(objType, attributeNames, idsOnly, hasJoinedConditions)
+    query, err := oql.Parse(oqlWhereCriteria)
     if err != nil {
-       return 	
+    	return
     }
-
-    var literalMap map[string]string 
-    oqlWhereCriteria, literalMap = substituteLiteralStrings(oqlWhereCriteria) 
-
-    // replace references to attributes (columns) with table-alias prefixed versions
- 
-    for attrName, aliasedAttrName := range aliasedAttrNames {
-	   oqlWhereCriteria = strings.Replace(oqlWhereCriteria, attrName, aliasedAttrName, -1)
+    err = oql.Check(query, objType, RT.LookupType)
+    if err != nil {
+    	return
     }
 
+    tr := newSQLTranslator(db, "")
 
+    // The table of the queried type must always be joined, to restrict the selection to objects of the type.
 
+    tr.typeAlias(objType)
 
-
-    var first bool
     if idsOnly {
-       sqlSelectQuery = "SELECT ro.id FROM RObject ro"  // TODO This is going to be an ambiguous column name
-       //   first = true
+       sqlSelectQuery = "SELECT ro.id"
     } else {
-		sqlSelectQuery = "SELECT ro.id,id2,flags,typeName"
-		sep := ","		
-		
-
-// Question: What are the right t1, t2 ... table aliases to prepend if hasJoinedConditions ?
-
-        var tableName string 
-        var alias string
-
-        if hasJoinedConditions {
-        	tableName = db.TableNameIfy(objType.ShortName())
-        	alias = tableNameAliases[tableName] + "."
-        }
-
-		for _, attr := range objType.Attributes {
-
-			if attr.Part.Type.IsPrimitive && attr.Part.CollectionType == "" {
-				if attr.Part.Type == TimeType {
-				   sqlSelectQuery += sep + alias + attr.Part.Name + "," + attr.Part.Name + "_loc" 
-				   numPrimAttributeColumns += 2							
-				} else if attr.Part.Type == ComplexType || attr.Part.Type == Complex32Type {
-				   sqlSelectQuery += sep + alias + attr.Part.Name	+ "_r," + attr.Part.Name + "_i" 	
-				   numPrimAttributeColumns += 2
-				} else {
-				   sqlSelectQuery += sep + alias + attr.Part.Name
-				   numPrimAttributeColumns ++
-			    }
-				sep = ","
-			}
-		}		
-		
-		for _, typ := range objType.Up {
-
-	        if hasJoinedConditions {
-	        	tableName = db.TableNameIfy(typ.ShortName())
-	        	alias = tableNameAliases[tableName]
-	        } else {
-	        	alias = ""
-	        }
-
+		sqlSelectQuery = "SELECT ro.id,ro.id2,ro.flags,ro.typeName,ro.version"
+		for _, typ := range append([]*RType{objType}, objType.Up...) {
 			for _, attr := range typ.Attributes {
-					if attr.Part.Type.IsPrimitive && attr.Part.CollectionType == "" {
+				if attr.Part.Type.IsPrimitive && attr.Part.CollectionType == "" {
+					column := tr.typeAlias(typ) + "." + attr.Part.Name
 					if attr.Part.Type == TimeType {
-					   sqlSelectQuery += sep + alias + attr.Part.Name	+ "," + attr.Part.Name + "_loc" 
+					   sqlSelectQuery += "," + column + "," + column + "_loc" 
 					   numPrimAttributeColumns += 2							
 					} else if attr.Part.Type == ComplexType || attr.Part.Type == Complex32Type {
-					   sqlSelectQuery += sep + alias + attr.Part.Name	+ "_r," + attr.Part.Name + "_i" 	
+					   sqlSelectQuery += "," + column + "_r," + column + "_i" 	
 					   numPrimAttributeColumns += 2
 					} else {
-					   sqlSelectQuery += sep + alias + attr.Part.Name
+					   sqlSelectQuery += "," + column
 					   numPrimAttributeColumns ++
 				    }
-					sep = ","				
 				}
 			}
-		}				
-		sqlSelectQuery += " FROM RObject ro"
+		}		
     }
 
-    for tableName,alias := range tableNameAliases {
-	    tableAlias := alias
-	    if tableAlias != "" {
-		   tableAlias = " " + tableAlias 
-	    }
-	    if first {
-		   sqlSelectQuery += tableName + tableAlias
-	    } else {
-	       if hasJoinedConditions {
-		      sqlSelectQuery += " JOIN " + tableName + tableAlias + " ON ro.id =" + tableAlias + ".id"			       	   
-	       } else {	
-		      sqlSelectQuery += " JOIN " + tableName + tableAlias + " USING (id)"		
-		   }
-	    }
-	    first = false
-    }
+    // Translate the conditions first, since doing so determines which tables must be joined.
 
-    collectionMembershipWhereFilter := ""
-
-    if coll != nil {
-       var collectionId int64
-       var collectionTableName string	
-       if coll.Owner() == nil { // Independent persistent collection
-       	  if ! coll.IsBeingStored() {
-       	  	 err = errors.New("In asList with OQL query, the collection must be persistent!")
-       	  	 return
-       	  }
-          collectionId = coll.DBID()
-          collectionTableName,_,_,_,_  = db.TypeDescriptor(coll)          
-       } else {
-       	  if ! coll.Owner().IsBeingStored() {
-       	  	 err = errors.New("In asList with OQL query, the object with multi-valued attribute must be persistent!")
-       	  	 return
-       	  }       	
-          collectionId = coll.Owner().DBID()
-          collectionTableName = db.TableNameIfy(coll.Attribute().ShortName())
-       }
-
-       sqlSelectQuery += " JOIN " + collectionTableName + " ctbl ON ro.id = ctbl.id1"		
-
-       collectionMembershipWhereFilter = fmt.Sprintf("ctbl.id0 = %d AND ",collectionId)     
+    where := ""
+    if query.Where != nil {
+    	where = tr.sql(query.Where)
     }
+    orderByLimit := tr.orderByLimit(query)
 
+    sqlSelectQuery += " FROM RObject ro" + strings.Join(*tr.joins, "")
 
+    collectionJoin, collectionMembershipWhereFilter, err := db.collectionMembership(coll)
+    if err != nil {
+    	return
+    }
+    sqlSelectQuery += collectionJoin
 
-/////////////// JOINED OTHER OBJECT ATTR TABLES
-
-    // otherAttributeNames is a map from joinAttrName to list of other obj primitive attrNames
-    // joinAttrs is a map form joinAttrName to actual attribute object (from which can get table name)
-
-    // THE FOLLOWING MIGHT HAVE TO BE MOVED LATER!!
-
-    otherAttrNamesToAliasedAttrNames :=  make(map[string]string)
-
-    i := 0
-    j := 0
-    for joinAttrName, joinAttr := range joinAttrs {
-        i++
-    	otherAttrNames := otherAttributeNames[joinAttrName]
-
-    	joinTable := db.TableNameIfy(joinAttr.ShortName())
-    	joinTableAlias := fmt.Sprintf("jt%d",i)
-
-
-        sqlSelectQuery += " JOIN " + joinTable + " " + joinTableAlias + " ON ro.id = " + joinTableAlias + ".id0" 
-
-        joinedObjectType := joinAttr.Part.Type
-
-
-
-
-        otherObjectTableAliases := make ( map[string]string )   // table name to alias
-
-    	// find table name for each other attrName, given joinAttr.Part.Type
-
-    	for _,otherAttrName := range otherAttrNames {
-            otherAttr, attrFound := joinedObjectType.GetAttribute(otherAttrName)
-            if ! attrFound {
-            	err = fmt.Errorf("Attribute '%s' not found in attribute type %s or supertypes.", otherAttrName, joinedObjectType.Name)
-                return 
-            }
-            otherObjectTypeWithAttr := otherAttr.WholeType
-            otherTableName := db.TableNameIfy(otherObjectTypeWithAttr.ShortName())
-            otherTableAlias, found := otherObjectTableAliases[otherTableName]
-            if ! found {
-            	j++
-    	        otherTableAlias = fmt.Sprintf("ot%d",j) 
-    	        otherObjectTableAliases[otherTableName] = otherTableAlias      
-
-               sqlSelectQuery += " JOIN " + otherTableName + " " + otherTableAlias + " ON " + joinTableAlias + ".id1 = " + otherTableAlias + ".id" 
+    sqlSelectQuery += whereClause(collectionMembershipWhereFilter, where)
+    sqlSelectQuery += orderByLimit
 
-            }
+	return
+}
 
-            qualifiedOtherAttrName := joinAttrName + "." + otherAttrName
-            otherAttrNamesToAliasedAttrNames[qualifiedOtherAttrName] = otherTableAlias + "." + otherAttrName
-    	} 
+/*
+Returns the SQL ORDER BY, LIMIT and OFFSET clauses of the query, each preceded by a space, or "" if the
+query has none of them.
+*/
+func (tr *sqlTranslator) orderByLimit(query *oql.Query) (s string) {
+    for i, item := range query.OrderBy {
+    	if i == 0 {
+    		s = " ORDER BY "
+    	} else {
+    		s += ","
+    	}
+    	s += tr.sql(item.X)
+    	if item.Desc {
+    		s += " DESC"
+    	}
     }
+    if query.Limit != nil {
+    	s += " LIMIT " + tr.sql(query.Limit)
+    	if query.Offset != nil {
+    		s += " OFFSET " + tr.sql(query.Offset)
+    	}
+    }
+    return
+}
 
+/*
+If coll is not nil, returns the join of the table of the persistent collection's members, and the condition 
+which restricts the selected objects (aliased ro) to members of the collection.
+*/
+func (db *SqliteDB) collectionMembership(coll RCollection) (join string, filter string, err error) {
+    if coll == nil {
+    	return
+    }
+    var collectionId int64
+    var collectionTableName string	
+    if coll.Owner() == nil { // Independent persistent collection
+       if ! coll.IsBeingStored() {
+       	  err = errors.New("In asList with OQL query, the collection must be persistent!")
+       	  return
+       }
+       collectionId = coll.DBID()
+       collectionTableName,_,_,_,_  = db.TypeDescriptor(coll)          
+    } else {
+       if ! coll.Owner().IsBeingStored() {
+       	  err = errors.New("In asList with OQL query, the object with multi-valued attribute must be persistent!")
+       	  return
+       }       	
+       collectionId = coll.Owner().DBID()
+       collectionTableName = db.TableNameIfy(coll.Attribute().ShortName())
+    }
 
+    join = " JOIN " + collectionTableName + " ctbl ON ro.id = ctbl.id1"		
+    filter = fmt.Sprintf("ctbl.id0 = %d",collectionId)     
+    return
+}
 
-
-    // replace references to attributes (columns) with table-alias prefixed versions
- 
-    for qualifiedOtherAttrName, aliasedOtherAttrName := range otherAttrNamesToAliasedAttrNames {
-	   oqlWhereCriteria = strings.Replace(oqlWhereCriteria, qualifiedOtherAttrName, aliasedOtherAttrName, -1)
+/*
+Returns the WHERE clause, preceded by a space, which requires both the collection membership filter and
+the translated conditions, either of which may be "". Returns "" if both are "".
+*/
+func whereClause(collectionMembershipWhereFilter string, where string) string {
+    if collectionMembershipWhereFilter != "" && where != "" {
+    	return " WHERE " + collectionMembershipWhereFilter + " AND (" + where + ")"
+    } else if collectionMembershipWhereFilter != "" || where != "" {
+    	return " WHERE " + collectionMembershipWhereFilter + where
     }
+    return ""
+}
 
-    oqlWhereCriteria = restoreLiteralStrings(oqlWhereCriteria, literalMap)
-
+/*
+Translates a checked OQL syntax tree to SQL, accumulating the table joins that the translated expressions need.
 
+The tables of the queried type and its supertypes are inner-joined to RObject, since every object of the type 
+has a row in each of them. The tables which hold the attribute values along an attribute path such as 
+owner.company.name are left-joined, so that an object with no owner simply has NULL for owner.company.name.
 
-/////////////// END OF JOINED OTHER OBJECT ATTR TABLES
+A multi-valued attribute cannot be joined in this way without selecting each object once per value, so
+each predicate which refers to a multi-valued attribute, such as cars.speed > 60, is translated to an EXISTS 
+subquery over the attribute's table. Its translation is done by a scope translator, which joins the tables 
+of the part of the path after the multi-valued attribute inside the subquery, and translates all other paths
+with the translator of the enclosing query.
 
+Subqueries (x IN (SELECT ...)) are translated by a translator of their own. The conditions of an 
+EXISTS (path WHERE ...) are translated by a translator rooted at the id of the object at the end of the path.
 
+Each translator's table aliases begin with its own prefix, so that they are unique across the whole query.
+*/
+type sqlTranslator struct {
+	db *SqliteDB
+	ns string // prefix of the table aliases
+	rootId string // SQL expression for the id of the object that attribute paths start from
+	typeAliases map[*RType]string // Aliases of the joined tables of the queried type and its supertypes. nil if not a query.
+	pathAliases map[string]string // Aliases of the tables joined for attribute paths, by path prefix.
+	joins *[]string
+	numTranslators *int // shared by all of the translators of a query
+
+	outer *sqlTranslator // translator of the enclosing query, for a scope translator 
+	scopePrefix string // the path prefix up to the multi-valued attribute of a scope translator 
+	scopeId string // SQL expression for the value of the multi-valued attribute
+}
 
+/*
+Returns a translator of a query (or subquery), whose tables are joined to the RObject table aliased ns + "ro".
+*/
+func newSQLTranslator(db *SqliteDB, ns string) *sqlTranslator {
+	return &sqlTranslator{
+		db: db,
+		ns: ns,
+		rootId: ns + "ro.id",
+		typeAliases: make(map[*RType]string),
+		pathAliases: make(map[string]string),
+		joins: new([]string),
+		numTranslators: new(int),
+	}
+}
 
+/*
+Returns a new translator for part of the query, with a unique alias prefix.
+*/
+func (tr *sqlTranslator) newTranslator() *sqlTranslator {
+	*tr.numTranslators++
+	return &sqlTranslator{
+		db: tr.db,
+		ns: fmt.Sprintf("s%d_", *tr.numTranslators),
+		pathAliases: make(map[string]string),
+		joins: new([]string),
+		numTranslators: tr.numTranslators,
+	}
+}
 
+/*
+Returns the alias of the table of the queried type or one of its supertypes, joining the table if it 
+is not yet joined.
+*/
+func (tr *sqlTranslator) typeAlias(typ *RType) string {
+	alias, found := tr.typeAliases[typ]
+	if ! found {
+		alias = fmt.Sprintf("%st%d", tr.ns, len(tr.typeAliases)+1)
+		tr.typeAliases[typ] = alias
+		*tr.joins = append(*tr.joins, fmt.Sprintf(" JOIN %s %s ON %s.id = %s", tr.db.TableNameIfy(typ.ShortName()), alias, alias, tr.rootId))
+	}
+	return alias
+}
 
+/*
+Returns the alias of a table left-joined for an attribute path, joining the table if it is not yet joined.
+key identifies the table's role in the query. The table is joined on its idColumn being equal to ownerId.
+*/
+func (tr *sqlTranslator) pathAlias(key string, tableName string, idColumn string, ownerId string) string {
+	alias, found := tr.pathAliases[key]
+	if ! found {
+		alias = fmt.Sprintf("%sp%d", tr.ns, len(tr.pathAliases)+1)
+		tr.pathAliases[key] = alias
+		*tr.joins = append(*tr.joins, fmt.Sprintf(" LEFT JOIN %s %s ON %s.%s = %s", tableName, alias, alias, idColumn, ownerId))
+	}
+	return alias
+}
 
+/*
+Returns the SQL column expression for the value at the end of the attribute path.
+For a path ending in a non-primitive attribute, this is the dbid of the object that is the attribute's value.
+*/
+func (tr *sqlTranslator) column(path *oql.Path) string {
+	if tr.outer != nil {
+		if path.MultiPrefix() != tr.scopePrefix {
+			return tr.outer.column(path)
+		}
+		return tr.walk(path.Attrs[path.MultiIndex()+1:], tr.scopeId, tr.scopePrefix+".")
+	}
+	return tr.walk(path.Attrs, tr.rootId, "")
+}
 
-    sqlSelectQuery += " WHERE " + collectionMembershipWhereFilter + oqlWhereCriteria 
+/*
+Joins the tables holding the values of the attributes, starting from the object whose id is ownerId, 
+and returns the SQL column expression for the value of the last attribute. 
+prefix is the path to the object whose id is ownerId, and identifies the joined tables' roles in the query.
+*/
+func (tr *sqlTranslator) walk(attrs []*AttributeSpec, ownerId string, prefix string) string {
+	for _, attr := range attrs {
+		if attr.Part.Type.IsPrimitive {
+			if attr.IsCollection() { // a multi-valued primitive attribute
+				alias := tr.pathAlias(prefix+attr.Part.Name, tr.db.TableNameIfy(attr.ShortName()), "id", ownerId)
+				return alias + ".val"
+			}
+			if ownerId == tr.rootId && tr.typeAliases != nil {
+				return tr.typeAlias(attr.WholeType) + "." + attr.Part.Name
+			}
+			key := prefix + "|" + attr.WholeType.Name
+			alias := tr.pathAlias(key, tr.db.TableNameIfy(attr.WholeType.ShortName()), "id", ownerId)
+			return alias + "." + attr.Part.Name
+		}
+		prefix += attr.Part.Name + "."
+		alias := tr.pathAlias(prefix, tr.db.TableNameIfy(attr.ShortName()), "id0", ownerId)
+		ownerId = alias + ".id1"
+	}
+	return ownerId
+}
 
-	return
+/*
+Translates a predicate which refers to the multi-valued attribute at the end of the path prefix, 
+e.g. prefix "cars" of cars.speed > 60, to
+   EXISTS (SELECT 1 FROM <table of cars> s1_m WHERE s1_m.id0 = ro.id AND s1_p1.speed > 60)
+(with s1_p1 joined inside the subquery) which is true if any of the values of the attribute satisfies it.
+*/
+func (tr *sqlTranslator) exists(x oql.Expr, prefix string) string {
+	var path *oql.Path
+	oql.Walk(x, func(y oql.Expr) {
+		if p, isPath := y.(*oql.Path); isPath && path == nil && p.MultiPrefix() == prefix {
+			path = p
+		}
+	})
+	m := path.MultiIndex()
+	attr := path.Attrs[m]
+	ownerId := tr.column(&oql.Path{Names: path.Names[:m], Cols: path.Cols[:m], Attrs: path.Attrs[:m]})
+
+	scope := tr.newTranslator()
+	scope.outer = tr
+	scope.scopePrefix = prefix
+	alias := scope.ns + "m"
+	var ownerCondition string
+	if attr.Part.Type.IsPrimitive {
+		scope.scopeId = alias + ".val"
+		ownerCondition = alias + ".id = " + ownerId
+	} else {
+		scope.scopeId = alias + ".id1"
+		ownerCondition = alias + ".id0 = " + ownerId
+	}
+	cond := scope.sql(x)
+	return fmt.Sprintf("EXISTS (SELECT 1 FROM %s %s%s WHERE %s AND %s)", 
+		tr.db.TableNameIfy(attr.ShortName()), alias, strings.Join(*scope.joins, ""), ownerCondition, cond)
 }
 
+/*
+Translates EXISTS path or EXISTS (path WHERE conditions). The conditions are translated by a translator
+rooted at the object at the end of the path, whose joins are added to this translator's joins.
+*/
+func (tr *sqlTranslator) existsPath(x *oql.ExistsExpr) string {
+	id := tr.column(x.Path)
+	if x.Cond == nil {
+		return id + " IS NOT NULL"
+	}
+	elem := tr.newTranslator()
+	elem.rootId = id
+	elem.joins = tr.joins
+	return id + " IS NOT NULL AND " + elem.operand(x.Cond)
+}
 
 /*
-Removes single-quoted literal strings from sql query text and returns all of the query text
-except for the quotes and quoted literals. Handles double '' escapes in literals.
+Translates a subquery to SELECT <the selected objects' ids or path values> FROM RObject s1_ro ... WHERE ...
 */
-func removeLiteralStrings(queryString string) string {
-	s := ""
-	strs := strings.Split(queryString, "'")
-	for i, r := range strs {
-		if i%2 == 0 {
-			s += r
-		}
+func (tr *sqlTranslator) subquery(q *oql.Subquery) string {
+	*tr.numTranslators++
+	sub := newSQLTranslator(tr.db, fmt.Sprintf("s%d_", *tr.numTranslators))
+	sub.numTranslators = tr.numTranslators
+	sub.typeAlias(q.Type)
+	selected := sub.rootId
+	var conditions []string
+	if q.Select != nil {
+		selected = sub.column(q.Select)
+		conditions = append(conditions, selected + " IS NOT NULL")
+	}
+	if q.Where != nil {
+		conditions = append(conditions, sub.operand(q.Where))
+	}
+	s := "SELECT " + selected + " FROM RObject " + sub.ns + "ro" + strings.Join(*sub.joins, "")
+	if len(conditions) > 0 {
+		s += " WHERE " + strings.Join(conditions, " AND ")
 	}
 	return s
 }
 
-func substituteLiteralStrings(queryString string) (subbed string, literalMap map[string]string) {
-	literalMap = make(map[string]string)
-	strs := strings.Split(queryString, "'")
-	for i, r := range strs {
-		if i%2 == 0 {
-			subbed += r
-		} else {
-			token := fmt.Sprintf("'%d'",i)
-
-			subbed += token
-			literalMap[token] = "'" + r + "'"
+var sqlOperators = map[oql.Token]string {
+	oql.EQL: "=",
+	oql.NEQ: "<>",
+	oql.LSS: "<",
+	oql.LEQ: "<=",
+	oql.GTR: ">",
+	oql.GEQ: ">=",
+	oql.ADD: "+",
+	oql.SUB: "-",
+	oql.MUL: "*",
+	oql.QUO: "/",
+	oql.REM: "%",
+	oql.CONCAT: "||",
+	oql.AND: "AND",
+	oql.OR: "OR",
+}
+
+/*
+Returns the SQL translation of the OQL expression.
+*/
+func (tr *sqlTranslator) sql(x oql.Expr) string {
+	if prefix := multiPrefix(x); prefix != "" && prefix != tr.scopePrefix {
+		return tr.exists(x, prefix)
+	}
+	switch x := x.(type) {
+	case *oql.Path:
+		return tr.column(x)
+	case *oql.Literal:
+		switch x.Tok {
+		case oql.TRUE:
+			return "1"
+		case oql.FALSE:
+			return "0"
+		case oql.NULL:
+			return "NULL"
+		}
+		return x.Value
+	case *oql.Param:
+		// Numbered, so that a cursor can add params of its own after the query's params.
+		return fmt.Sprintf("?%d", x.Index+1)
+	case *oql.Call:
+		if x.Star {
+			return x.Fun + "(*)"
+		}
+		args := make([]string, len(x.Args))
+		for i, arg := range x.Args {
+			args[i] = tr.sql(arg)
+		}
+		return x.Fun + "(" + strings.Join(args, ",") + ")"
+	case *oql.ParenExpr:
+		return "(" + tr.sql(x.X) + ")"
+	case *oql.UnaryExpr:
+		if x.Op == oql.NOT {
+			return "NOT " + tr.operand(x.X)
+		}
+		return "-" + tr.operand(x.X)
+	case *oql.BinaryExpr:
+		return tr.operand(x.X) + " " + sqlOperators[x.Op] + " " + tr.operand(x.Y)
+	case *oql.IsNullExpr:
+		if x.Not {
+			return tr.operand(x.X) + " IS NOT NULL"
 		}
+		return tr.operand(x.X) + " IS NULL"
+	case *oql.LikeExpr:
+		return tr.operand(x.X) + not(x.Not) + " LIKE " + tr.operand(x.Pattern)
+	case *oql.InExpr:
+		if x.Query != nil {
+			return tr.operand(x.X) + not(x.Not) + " IN (" + tr.subquery(x.Query) + ")"
+		}
+		items := make([]string, len(x.List))
+		for i, item := range x.List {
+			items[i] = tr.sql(item)
+		}
+		return tr.operand(x.X) + not(x.Not) + " IN (" + strings.Join(items, ",") + ")"
+	case *oql.BetweenExpr:
+		return tr.operand(x.X) + not(x.Not) + " BETWEEN " + tr.operand(x.Lo) + " AND " + tr.operand(x.Hi)
+	case *oql.ExistsExpr:
+		return tr.existsPath(x)
 	}
-	return 
+	panic(fmt.Sprintf("Unexpected OQL expression %T", x))
 }
 
-func restoreLiteralStrings(queryString string, literalMap map[string]string) string {
-	for token,original := range literalMap {
-       queryString = strings.Replace(queryString, token, original, 1)
+/*
+Returns the SQL translation of an operand of an operator, parenthesized unless it is a simple term, 
+so that the SQL evaluates with the grouping of the OQL syntax tree.
+*/
+func (tr *sqlTranslator) operand(x oql.Expr) string {
+	switch x.(type) {
+	case *oql.Path, *oql.Literal, *oql.Param, *oql.Call, *oql.ParenExpr:
+		return tr.sql(x)
 	}
-	return queryString
+	return "(" + tr.sql(x) + ")"
 }
 
 /*
-Given a type, and a set of attribute names that are included in where clause criteria, return
-a map from table names to table aliases, and a map from attribute names to table-alias-qualified attribute names
-Returns an error if an attribute name is not found as a primitive-valued attribute in the type or its supertypes.
-
-If idsOnly is true, returns only table names which hold one of the attributes, plus the tableName for the argument type.
-If idsOnly is false, returns tables for the type and all supertypes.
-
-func (db *SqliteDB) findAliases(typ *RType, attributeNames map[string]bool, lazy bool) (tableNamesToAliases map[string]string, attrNamesToAliasedAttrNames map[string]string, err error) {
-   tableNamesToAliases = make(map[string]string)
-   attrNamesToAliasedAttrNames =  make(map[string]string)
-   aliasNum := 1
-   var alias string
-   QueryAttributeLoop:
-	   for attrName := range attributeNames {
-		   for _, attr := range typ.Attributes {
-			  if attr.Part.Type.IsPrimitive {
-		          if attr.Part.Name == attrName {
-		          	 alias = fmt.Sprintf("t%v",aliasNum)
-		          	 aliasNum ++
-		          	 tableNamesToAliases[db.TableNameIfy(typ.ShortName())] = alias
-	                 attrNamesToAliasedAttrNames[attrName] = alias + "." + attrName
-		          	 continue QueryAttributeLoop
-		          } else if ! la
-			  }
-		   }
-	       for _, superType := range typ.Up {	
-			  for _, attr := range superType.Attributes {
-				  if attr.Part.Type.IsPrimitive {
-			          if attr.Part.Name == attrName {
-			          	 alias = fmt.Sprintf("t%v",aliasNum)
-			          	 aliasNum ++
-			          	 tableNamesToAliases[db.TableNameIfy(superType.ShortName())] = alias
-		                 attrNamesToAliasedAttrNames[attrName] = alias + "." + attrName
-			          	 continue QueryAttributeLoop
-			          }
-			      }
-			  }	       	
-	       }
-
-           // attribute name from query was not matched by a primitive-valued attribute of the type or its supertypes.
-	       err = fmt.Errorf("'%s' is not a primitive-valued attribute of type %v or its supertypes",attrName,typ)
-	       return	   
-	   }
+Returns the multi-valued attribute path prefix that a predicate refers to, or "" if it refers to none.
+Returns "" for an and, or or not expression, whose operands are translated as separate predicates.
+*/
+func multiPrefix(x oql.Expr) (prefix string) {
+	switch y := x.(type) {
+	case *oql.BinaryExpr:
+		if y.Op == oql.AND || y.Op == oql.OR {
+			return
+		}
+	case *oql.UnaryExpr:
+		if y.Op == oql.NOT {
+			return
+		}
+	case *oql.ParenExpr:
+		return
+	}
+	oql.Walk(x, func(y oql.Expr) {
+		if path, isPath := y.(*oql.Path); isPath && prefix == "" {
+			prefix = path.MultiPrefix()
+		}
+	})
 	return
 }
-*/
 
-func (db *SqliteDB) findAliases(typ *RType, attributeNames map[string]bool, idsOnly bool, hasJoinedCondition bool) (tableNamesToAliases map[string]string, attrNamesToAliasedAttrNames map[string]string, err error) {
-   tableNamesToAliases = make(map[string]string)
-   attrNamesToAliasedAttrNames =  make(map[string]string)
-   aliasNum := 1
-   var alias string
-   typeTableName := db.TableNameIfy(typ.ShortName())
-   var foundAttribute bool  // Whether type has at least one primitive attribute
-   var matchedAttribute bool   // Whether an attribute from the type is mentioned in the where conditions of the query
-   for _, attr := range typ.Attributes {
-	  if attr.Part.Type.IsPrimitive && attr.Part.CollectionType == "" {
-		 foundAttribute = true // type has at least one primitive attribute
-		 alias = tableNamesToAliases[typeTableName]
-
-         for attrName := range attributeNames {
-	        if attr.Part.Name == attrName {	
-		       matchedAttribute = true
-		       if alias == "" {
-			      alias = fmt.Sprintf("t%v",aliasNum)
-		          aliasNum ++
-		          tableNamesToAliases[typeTableName] = alias
-		       }		
-	           attrNamesToAliasedAttrNames[attrName] = alias + "." + attrName	
-	        }
-	     }		
-	  }
-   }
-
-   if hasJoinedCondition && alias == "" {
-	  alias = fmt.Sprintf("t%v",aliasNum)
-	  aliasNum ++   	   
-   }
-   tableNamesToAliases[typeTableName] = alias  // original type must always be included in the join. 	
-   /*
-   if (foundAttribute && ! idsOnly) || matchedAttribute {
-      tableNamesToAliases[typeTableName] = alias	
-   }
-   */
-
-   // TODO: Need to ensure that if idsOnly, the argument typ is included in tableNamesToAliases
-
-   for _, superType := range typ.Up {	
-	  foundAttribute = false   // Whether at least one attribute of this type has been found in the query expression
-	  matchedAttribute = false // Whether an attribute from the type is mentioned in the where conditions of the query
-	  alias = ""
-      typeTableName = db.TableNameIfy(superType.ShortName())	
-	  for _, attr := range superType.Attributes {
-		  if attr.Part.Type.IsPrimitive && attr.Part.CollectionType == "" {
-		     foundAttribute = true // type has at least one primitive attribute			
-			 alias = tableNamesToAliases[typeTableName]
-	         for attrName := range attributeNames {
-		        if attr.Part.Name == attrName {		
-			       matchedAttribute = true
-			       if alias == "" {
-				      alias = fmt.Sprintf("t%v",aliasNum)
-			          aliasNum ++
-			          tableNamesToAliases[typeTableName] = alias
-			       }			
-		           attrNamesToAliasedAttrNames[attrName] = alias + "." + attrName	
-		        }
-		     }
-	      }
-	  }	
-	  if (foundAttribute && ! idsOnly) || matchedAttribute {
-	     if hasJoinedCondition && alias == "" {
-		     alias = fmt.Sprintf("t%v",aliasNum)
-		     aliasNum ++   	   
-	     }
-	     tableNamesToAliases[typeTableName] = alias	
-	  }	      	
-   }
-
-   // Make sure each (non-join) attribute in select conditions is a primitive attribute of the object type
-   // being selected or of one of the object type's supertypes.
-   for attrName := range attributeNames {
-	   if attrNamesToAliasedAttrNames[attrName] == "" {
-           // attribute name from query was not matched by a primitive-valued attribute of the type or its supertypes.
-	       err = fmt.Errorf("'%s' is not a primitive-valued attribute of type %v or its supertypes",attrName,typ)
-	       return	   
-	   }
-   }
-   return
+func not(isNot bool) string {
+	if isNot {
+		return " NOT"
+	}
+	return ""
 }
-
-
-
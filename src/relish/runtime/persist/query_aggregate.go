@@ -0,0 +1,199 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+// this package implements data persistence in the relish language environment.
+
+package persist
+
+/*
+   query_aggregate.go - aggregate and projection queries, which compute values from the objects of a type 
+   in the database, rather than fetching the objects.
+
+   e.g. vehicles/Car, "make, count(*), avg(speed) where speed > 0 group by make"  ==>
+
+   SELECT t1.make,count(*),avg(t1.speed) FROM RObject ro JOIN [vehicles/Car] t1 ON t1.id = ro.id 
+   WHERE t1.speed > 0 GROUP BY t1.make
+*/
+
+import (
+	"fmt"
+	. "relish/dbg"
+	. "relish/runtime/data"
+	"relish/runtime/persist/oql"
+	"strconv"
+	"strings"
+	"time"
+	"io"
+)
+
+/*
+Runs the aggregate query against the objects of the type (restricted to the members of coll if coll is not nil),
+and returns the rows of selected values. Each value is a primitive value, or an object if a selected value is
+an attribute path ending in an object-valued attribute, or NIL if the value is NULL in the db.
+*/
+func (db *SqliteDBThread) FetchAggregate(typ *RType, oqlAggregateQuery string, queryArgs []RObject, coll RCollection) (rows [][]RObject, err error) {
+	defer Un(Trace(PERSIST_TR, "FetchAggregate", oqlAggregateQuery))
+
+	sqlQuery, resultTypes, err := db.db.oqlAggregateToSQLSelect(typ, oqlAggregateQuery, coll)
+	if err != nil {
+		err = fmt.Errorf("Query syntax error:\n%v\n while translating aggregate query:\n\"%s\"", err, oqlAggregateQuery)
+		return
+	}
+
+	Logln(PERSIST_, sqlQuery)
+
+	selectStmt, err := db.Prepare(sqlQuery)
+	if err != nil {
+		return
+	}
+
+	defer selectStmt.Reset()
+
+	err = selectStmt.Query(queryArgValues(queryArgs)...)
+	for ; err == nil; err = selectStmt.Next() {
+		colsBytes := make([][]byte, len(resultTypes))
+		dsts := make([]interface{}, len(resultTypes))
+		for i := range colsBytes {
+			dsts[i] = &colsBytes[i]
+		}
+		err = selectStmt.Scan(dsts...)
+		if err != nil {
+			return
+		}
+		row := make([]RObject, len(resultTypes))
+		for i, colBytes := range colsBytes {
+			row[i], err = db.resultVal(colBytes, resultTypes[i])
+			if err != nil {
+				return
+			}
+		}
+		rows = append(rows, row)
+	}
+	if err == io.EOF {
+		err = nil
+	} else {
+		err = fmt.Errorf("DB ERROR on query:\n%s\nDetail: %s\n\n", sqlQuery, err)
+	}
+	return
+}
+
+/*
+Converts a column value of a row returned by an aggregate query to a relish value of the type.
+If typ is nil, the type of the value is not known from the query, so the value becomes an Int or Float if 
+it is a number, or otherwise a String.
+*/
+func (db *SqliteDBThread) resultVal(colBytes []byte, typ *RType) (val RObject, err error) {
+	if colBytes == nil {
+		val = NIL
+		return
+	}
+	text := string(colBytes)
+	switch {
+	case typ == IntType || typ == Int32Type || typ == FloatType || typ == BoolType || typ == StringType:
+		convertVal(colBytes, typ, "aggregate query value", &val)
+	case typ == TimeType:
+		var t time.Time
+		t, err = time.ParseInLocation(TIME_LAYOUT, text, time.UTC)
+		val = RTime(t)
+	case typ != nil && ! typ.IsPrimitive:
+		var id int64
+		id, err = strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return
+		}
+		val, err = db.Fetch(id, 0)
+	default:
+		if i, intErr := strconv.ParseInt(text, 10, 64); intErr == nil {
+			val = Int(i)
+		} else if f, floatErr := strconv.ParseFloat(text, 64); floatErr == nil {
+			val = Float(f)
+		} else {
+			val = String(text)
+		}
+	}
+	return
+}
+
+/*
+Translates an aggregate query to SQL, and returns the relish type of each selected value, or nil for a value
+whose type is not known from the query.
+*/
+func (db *SqliteDB) oqlAggregateToSQLSelect(objType *RType, oqlAggregateQuery string, coll RCollection) (sqlSelectQuery string, resultTypes []*RType, err error) {
+
+    query, err := oql.ParseAggregate(oqlAggregateQuery)
+    if err != nil {
+    	return
+    }
+    err = oql.CheckAggregate(query, objType, RT.LookupType)
+    if err != nil {
+    	return
+    }
+
+    tr := newSQLTranslator(db, "")
+    tr.typeAlias(objType)
+
+    items := make([]string, len(query.Items))
+    for i, item := range query.Items {
+    	items[i] = tr.sql(item)
+    	resultTypes = append(resultTypes, resultType(item))
+    }
+    where := ""
+    if query.Where != nil {
+    	where = tr.sql(query.Where)
+    }
+    groupBy := ""
+    for i, x := range query.GroupBy {
+    	if i == 0 {
+    		groupBy = " GROUP BY "
+    	} else {
+    		groupBy += ","
+    	}
+    	groupBy += tr.sql(x)
+    }
+    if query.Having != nil {
+    	groupBy += " HAVING " + tr.sql(query.Having)
+    }
+    orderByLimit := tr.orderByLimit(&query.Query)
+
+    sqlSelectQuery = "SELECT " + strings.Join(items, ",") + " FROM RObject ro" + strings.Join(*tr.joins, "")
+
+    collectionJoin, collectionMembershipWhereFilter, err := db.collectionMembership(coll)
+    if err != nil {
+    	return
+    }
+    sqlSelectQuery += collectionJoin
+
+    sqlSelectQuery += whereClause(collectionMembershipWhereFilter, where)
+    sqlSelectQuery += groupBy + orderByLimit
+    return
+}
+
+/*
+Returns the relish type of the values of a selected expression of an aggregate query, or nil if it is not known.
+*/
+func resultType(x oql.Expr) *RType {
+	switch x := x.(type) {
+	case *oql.Path:
+		return x.Attrs[len(x.Attrs)-1].Part.Type
+	case *oql.ParenExpr:
+		return resultType(x.X)
+	case *oql.Call:
+		switch x.Fun {
+		case "count":
+			return IntType
+		case "avg", "total":
+			return FloatType
+		case "sum", "min", "max":
+			return resultType(x.Args[0])
+		}
+	}
+	switch x.Kind() {
+	case oql.StringKind:
+		return StringType
+	case oql.BoolKind:
+		return BoolType
+	case oql.TimeKind:
+		return TimeType
+	}
+	return nil
+}
@@ -0,0 +1,412 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+// this package implements data persistence in the relish language environment.
+
+package persist
+
+/*
+   query_cursor.go - cursors, which read the objects selected by a query from the database a batch at a time.
+
+   A cursor does not hold a SQL statement open between batches. Each batch is selected by its own query,
+   which continues from the last object of the previous batch, in the order given by the query
+   (keyset pagination). The object id is always the last ordering key, so that the order is total.
+   The condition which continues from the last object is part of the query's WHERE clause, so that
+   the database can use an index to find where the batch begins. The query's LIMIT is shared out among 
+   the batches, and its OFFSET is skipped by the first batch.
+
+   e.g. vehicles/Car, "speed > 60 order by speed desc limit 1000", batches of 100  ==>  (after the first batch)
+
+   SELECT ro.id AS id,t1.speed AS k0 FROM RObject ro JOIN [vehicles/Car] t1 ON t1.id = ro.id
+   WHERE t1.speed > 60 AND (((t1.speed < ?1 OR t1.speed IS NULL)) OR (t1.speed = ?2 AND ro.id > ?3))
+   ORDER BY t1.speed DESC,ro.id LIMIT 100
+
+   Each batch is read in a read transaction of its own (or in the thread's transaction, if it is in one),
+   so the batches may see different snapshots of the database. An object which is not changed while the
+   cursor is read is read exactly once, if it is selected. An object which is changed between batches may
+   be missed, or read twice, if the change moves it across the point at which the cursor has arrived.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	. "relish/dbg"
+	. "relish/runtime/data"
+	"relish/runtime/persist/oql"
+	"strconv"
+	"strings"
+)
+
+type sqliteCursor struct {
+	db *SqliteDBThread
+	selection string // the SELECT and FROM clauses of the query, whose columns are id, k0, k1, ...
+	where string // the query's WHERE clause, without the keyset condition
+	keys []string // the SQL expressions of the ordering keys
+	orderBy string // the query's ORDER BY clause
+	queryArgs []interface{}
+	descs []bool // whether each ordering key k0, k1, ... is in descending order
+	radius int
+	batchSize int
+	remaining int64 // how many more rows the query's LIMIT allows, or -1 if it has no LIMIT
+	offset int64 // how many rows the first batch skips
+	last []interface{} // the ordering key values then the id of the last row read. nil before the first batch.
+	done bool
+}
+
+/*
+Returns a cursor over the objects selected by the query. If after is not nil, the cursor starts after
+the object after, which must be one of the objects of the type.
+*/
+func (db *SqliteDBThread) OpenCursor(typ *RType, oqlSelectionCriteria string, queryArgs []RObject, coll RCollection, radius int, batchSize int, after RObject) (cursor Cursor, err error) {
+	defer Un(Trace(PERSIST_TR, "OpenCursor", oqlSelectionCriteria, radius, batchSize))
+
+	if batchSize <= 0 {
+		err = errors.New("The batch size of a query cursor must be positive.")
+		return
+	}
+
+	tr, query, keys, err := db.db.oqlToSQLCursorSelect(typ, oqlSelectionCriteria)
+	if err != nil {
+		err = fmt.Errorf("Query syntax error:\n%v\n while translating selection criteria:\n\"%s\"", err, oqlSelectionCriteria)
+		return
+	}
+
+	args := queryArgValues(queryArgs)
+
+	limit, offset, err := oql.Limits(query, args)
+	if err != nil {
+		return
+	}
+
+	afterCondition := ""
+	if after != nil {
+		if ! after.IsStoredLocally() {
+			err = errors.New("The object to start a query cursor after must be persistent.")
+			return
+		}
+		var afterKeys []interface{}
+		afterKeys, err = db.keyValues(tr, keys, args, after)
+		if err != nil {
+			return
+		}
+		var afterArgs []interface{}
+		afterCondition, afterArgs = keysetCondition(keys, "ro.id", descs(query), afterKeys, len(args))
+		args = append(args, afterArgs...)
+	}
+
+	where := ""
+	if query.Where != nil {
+		where = tr.sql(query.Where)
+	}
+	if where != "" && afterCondition != "" {
+		where = "(" + where + ") AND (" + afterCondition + ")"
+	} else if afterCondition != "" {
+		where = afterCondition
+	}
+
+	selection := "SELECT ro.id AS id"
+	for i, key := range keys {
+		selection += fmt.Sprintf(",%s AS k%d", key, i)
+	}
+	selection += " FROM RObject ro" + strings.Join(*tr.joins, "")
+
+	collectionJoin, collectionMembershipWhereFilter, err := db.db.collectionMembership(coll)
+	if err != nil {
+		return
+	}
+	selection += collectionJoin
+
+	cursor = &sqliteCursor{
+		db:        db,
+		selection: selection,
+		where:     whereClause(collectionMembershipWhereFilter, where),
+		keys:      keys,
+		orderBy:   cursorOrderBy(query, keys),
+		queryArgs: args,
+		descs:     descs(query),
+		radius:    radius,
+		batchSize: batchSize,
+		remaining: limit,
+		offset:    offset,
+	}
+	return
+}
+
+/*
+Reads the next batch of objects. If the cursor's radius is 0, the objects are proxies;
+otherwise they are fetched to radius - 1.
+*/
+func (c *sqliteCursor) NextBatch() (objs []RObject, err error) {
+	defer Un(Trace(PERSIST_TR, "NextBatch"))
+
+	if c.done {
+		return
+	}
+	n := int64(c.batchSize)
+	if c.remaining >= 0 && c.remaining < n {
+		n = c.remaining
+	}
+	if n == 0 {
+		c.done = true
+		return
+	}
+
+	args := c.queryArgs
+	where := c.where
+	if c.last != nil {
+		keysetCond, keysetArgs := keysetCondition(c.keys, "ro.id", c.descs, c.last, len(args))
+		args = append(append([]interface{}{}, c.queryArgs...), keysetArgs...)
+		if where == "" {
+			where = " WHERE " + keysetCond
+		} else {
+			where += " AND (" + keysetCond + ")"
+		}
+	}
+
+	sqlQuery := c.selection + where + c.orderBy + fmt.Sprintf(" LIMIT %d", n)
+	if c.last == nil && c.offset > 0 {
+		sqlQuery += fmt.Sprintf(" OFFSET %d", c.offset)
+	}
+
+	// The LIMIT and OFFSET are given as numbers, so the query may not refer to all of the query's params.
+	sqlQuery, args = compactParams(sqlQuery, args)
+
+	Logln(PERSIST_, sqlQuery)
+
+	// Read the whole batch before fetching any of the objects, so that the statement is not open while
+	// the fetches use the connection.
+
+	var ids []int64
+	var last []interface{}
+	err = c.db.queryRows(sqlQuery, args, len(c.descs)+1, func(row []interface{}) {
+		ids = append(ids, row[0].(int64))
+		last = row
+	})
+	if err != nil {
+		return
+	}
+
+	if int64(len(ids)) < n {
+		c.done = true
+	}
+	if c.remaining >= 0 {
+		c.remaining -= int64(len(ids))
+	}
+	if last != nil {
+		// The keyset condition takes the key values first, then the id.
+		c.last = append(last[1:], last[0])
+	}
+
+	for _, id := range ids {
+		var obj RObject
+		if c.radius > 0 {
+			obj, err = c.db.Fetch(id, c.radius-1)
+			if err != nil {
+				return
+			}
+		} else {
+			obj = Proxy(id)
+		}
+		objs = append(objs, obj)
+	}
+	return
+}
+
+/*
+Runs the query and calls f with the values of the numColumns columns of each row, as the SQL engine's
+own values (int64, float64, string, []byte or nil), so that they can be passed back to the engine
+in another query.
+*/
+func (db *SqliteDBThread) queryRows(sqlQuery string, args []interface{}, numColumns int, f func(row []interface{})) (err error) {
+	selectStmt, err := db.Prepare(sqlQuery)
+	if err != nil {
+		return
+	}
+
+	defer selectStmt.Reset()
+
+	err = selectStmt.Query(args...)
+	for ; err == nil; err = selectStmt.Next() {
+		row := make([]interface{}, numColumns)
+		dsts := make([]interface{}, numColumns)
+		for i := range row {
+			dsts[i] = &row[i]
+		}
+		err = selectStmt.Scan(dsts...)
+		if err != nil {
+			return
+		}
+		f(row)
+	}
+	if err == io.EOF {
+		err = nil
+	} else {
+		err = fmt.Errorf("DB ERROR on query:\n%s\nDetail: %s\n\n", sqlQuery, err)
+	}
+	return
+}
+
+/*
+Returns the values of the ordering keys of the object, followed by its id.
+*/
+func (db *SqliteDBThread) keyValues(tr *sqlTranslator, keys []string, queryArgs []interface{}, obj RObject) (vals []interface{}, err error) {
+	if len(keys) == 0 {
+		vals = []interface{}{obj.DBID()}
+		return
+	}
+	sqlQuery := "SELECT " + strings.Join(keys, ",") + " FROM RObject ro" + strings.Join(*tr.joins, "") +
+	            fmt.Sprintf(" WHERE ro.id = ?%d", len(queryArgs)+1)
+
+	Logln(PERSIST_, sqlQuery)
+
+	args := append(append([]interface{}{}, queryArgs...), obj.DBID())
+
+	found := false
+	err = db.queryRows(sqlQuery, args, len(keys), func(row []interface{}) {
+		vals = row
+		found = true
+	})
+	if err != nil {
+		return
+	}
+	if ! found {
+		err = fmt.Errorf("The object to start a query cursor after, %v, is not of the queried type.", obj)
+		return
+	}
+	vals = append(vals, obj.DBID())
+	return
+}
+
+/*
+Translates the selection criteria, and returns the translator, which holds the joins the translation needs,
+and the SQL expressions of the ordering keys.
+*/
+func (db *SqliteDB) oqlToSQLCursorSelect(objType *RType, oqlSelectionCriteria string) (tr *sqlTranslator, query *oql.Query, keys []string, err error) {
+	query, err = oql.Parse(oqlSelectionCriteria)
+	if err != nil {
+		return
+	}
+	err = oql.Check(query, objType, RT.LookupType)
+	if err != nil {
+		return
+	}
+
+	tr = newSQLTranslator(db, "")
+	tr.typeAlias(objType)
+
+	for _, item := range query.OrderBy {
+		keys = append(keys, tr.sql(item.X))
+	}
+	return
+}
+
+/*
+Returns the ORDER BY clause of the selection of a cursor, which ends with the object id so that the order
+is total.
+*/
+func cursorOrderBy(query *oql.Query, keys []string) (s string) {
+	s = " ORDER BY "
+	for i, item := range query.OrderBy {
+		s += keys[i]
+		if item.Desc {
+			s += " DESC"
+		}
+		s += ","
+	}
+	s += "ro.id"
+	return
+}
+
+/*
+Renumbers the ?N params of the SQL query, which need not refer to all of args, as ?1, ?2, ... in order of
+their first appearance, and returns the renumbered query and the args which it refers to, in their new order.
+Quoted strings and names in the query are left as they are.
+*/
+func compactParams(sqlQuery string, args []interface{}) (string, []interface{}) {
+	var b strings.Builder
+	var newArgs []interface{}
+	newNumbers := make(map[int]int)
+	var quote byte
+	for i := 0; i < len(sqlQuery); i++ {
+		ch := sqlQuery[i]
+		switch {
+		case quote != 0:
+			if ch == quote || (quote == '[' && ch == ']') {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"' || ch == '[':
+			quote = ch
+		case ch == '?':
+			j := i + 1
+			for j < len(sqlQuery) && sqlQuery[j] >= '0' && sqlQuery[j] <= '9' {
+				j++
+			}
+			n, err := strconv.Atoi(sqlQuery[i+1 : j])
+			if err != nil || n < 1 || n > len(args) {
+				break
+			}
+			newNumber, found := newNumbers[n]
+			if ! found {
+				newArgs = append(newArgs, args[n-1])
+				newNumber = len(newArgs)
+				newNumbers[n] = newNumber
+			}
+			fmt.Fprintf(&b, "?%d", newNumber)
+			i = j - 1
+			continue
+		}
+		b.WriteByte(ch)
+	}
+	return b.String(), newArgs
+}
+
+func descs(query *oql.Query) (ds []bool) {
+	for _, item := range query.OrderBy {
+		ds = append(ds, item.Desc)
+	}
+	return
+}
+
+/*
+Returns the condition that selects the rows that come after the row with the ordering key values vals
+(the key values then the id), in the order given by the key columns and the id, and the args of the
+condition's parameters, which are numbered from numArgs + 1.
+
+SQLite orders NULL before any other value, so in ascending order, the rows after a NULL key value are those
+whose key value is not NULL, and in descending order, no rows are after a NULL key value on that key alone.
+*/
+func keysetCondition(cols []string, idCol string, descs []bool, vals []interface{}, numArgs int) (cond string, args []interface{}) {
+	param := func(val interface{}) string {
+		args = append(args, val)
+		return fmt.Sprintf("?%d", numArgs+len(args))
+	}
+	var alternatives []string
+	equal := ""
+	for i, col := range cols {
+		var after string
+		if vals[i] == nil {
+			if descs[i] {
+				after = "0"
+			} else {
+				after = col + " IS NOT NULL"
+			}
+		} else if descs[i] {
+			after = "(" + col + " < " + param(vals[i]) + " OR " + col + " IS NULL)"
+		} else {
+			after = col + " > " + param(vals[i])
+		}
+		if after != "0" {
+			alternatives = append(alternatives, "("+equal+after+")")
+		}
+
+		if vals[i] == nil {
+			equal += col + " IS NULL AND "
+		} else {
+			equal += col + " = " + param(vals[i]) + " AND "
+		}
+	}
+	alternatives = append(alternatives, "("+equal+idCol+" > "+param(vals[len(cols)])+")")
+	cond = strings.Join(alternatives, " OR ")
+	return
+}
@@ -0,0 +1,21 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+package persist
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCompactParams(t *testing.T) {
+	sqlQuery, args := compactParams("SELECT ro.id FROM RObject ro JOIN [a?2] t1 ON t1.id = ro.id WHERE t1.x = '?2' AND t1.y > ?3 AND (t1.z = ?1 OR t1.y = ?3) LIMIT 10",
+		[]interface{}{"z", int64(5), int64(7)})
+	want := "SELECT ro.id FROM RObject ro JOIN [a?2] t1 ON t1.id = ro.id WHERE t1.x = '?2' AND t1.y > ?1 AND (t1.z = ?2 OR t1.y = ?1) LIMIT 10"
+	if sqlQuery != want {
+		t.Errorf("compactParams query = %s, want %s", sqlQuery, want)
+	}
+	if fmt.Sprint(args) != "[7 z]" {
+		t.Errorf("compactParams args = %v, want [7 z]", args)
+	}
+}
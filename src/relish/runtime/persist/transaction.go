@@ -8,118 +8,117 @@ package persist
 /*
    transaction.go 
    
-   This file implements transaction management and database access serialization aspects of
-   sqlite persistence of relish objects
+   This file implements transaction management aspects of sqlite persistence of relish objects.
+
+   There is no global database lock. Writers are serialized by the write connection pool (-wpool)
+   and by sqlite's own write locking. Readers in DEFERRED (READ) transactions use the read connection pool
+   (-rpool) and, with the database in WAL journal mode, each sees a consistent snapshot of the database 
+   as of the start of its transaction, without waiting for writers.
 
    SEE ALSO the dbThread type in interp/interpreter.go for an extended implementation of the methods
    below that fully implements safe multi-threaded access to the database.
 */
 
 import (
-   sqlite "code.google.com/p/go-sqlite/go1/sqlite3"   
-	"sync"
-   "math/rand"
-   "time"
+   . "relish/runtime/data"
    . "relish/dbg"
 )
 
 
-// A mutual-exclusion lock which ensures single-goroutine-at-a-time serialized access to the database.
-var dbMutex sync.Mutex
-
-const N_BEGIN_TRIES = 10
-const N_COMMIT_TRIES = 10
+/*
+Determines whether a database error is due to contention with another connection (TX_BUSY),
+or with a conflicting table lock (TX_LOCKED), in which case the operation may succeed if retried,
+or is some other, real error (TX_FAILED).
+*/
+func (db *SqliteDBThread) classifyDbError(err error) int {
+   return db.db.dialect.ClassifyError(err)
+}
 
-var TRY_GAP_WIDENING_MS_INCREMENT = 100  // ms 
- 
-var dummyQuery *sqlite.Stmt
+/*
+Executes the sql statement, re-trying it according to the retry policy if it fails 
+because the database is busy or locked.
+If it finally fails, returns a *TransactionError which says whether the failure was retryable.
+The op argument names the operation for the error message.
+*/
+func (db *SqliteDBThread) execTransactionStatement(op string, statement string, policy *TransactionRetryPolicy) (err error) {
+   for try := 1; ; try++ {
+      err = db.ExecStatement(statement)
+      if err == nil {
+         return
+      }
+      kind := db.classifyDbError(err)
+      Logln(PERSIST2_, op, "ERR:", err)
+      if ! policy.ShouldRetry(kind, try) {
+         err = &TransactionError{Kind: kind, Op: op, Tries: try, Err: err}
+         return
+      }
+      policy.Wait(try)
+   }
+}
 
 /*
-Begins an immediate-mode database transaction.
+Begins a database transaction of the specified type.
+Busy or locked failures are retried according to the default transaction retry policy.
+If the transaction cannot be begun, returns a *TransactionError.
 */
 func (db *SqliteDBThread) BeginTransaction(transactionType string) (err error) {
    
    db.dbt.th.AllowGC()
    defer db.dbt.th.DisallowGC()
+
+   policy := DefaultTransactionRetryPolicy()
    
-   stmt := "BEGIN " + transactionType + " TRANSACTION"
-   err = db.ExecStatement(stmt)
-
-   var TRY_GAP_WIDENING_MS_INCREMENT int64 = 100  // ms - longest wait will be 6 seconds + random factor 
-   var tryGapWidth int64 = TRY_GAP_WIDENING_MS_INCREMENT
-   var r int64
-   for i := 0; err != nil && i < N_BEGIN_TRIES ; i ++ {
-      Logln(PERSIST2_,"BEGIN", transactionType, "ERR:",err)
-      r = rand.Int63n(500 + tryGapWidth)
-      if i > 5 {
-         TRY_GAP_WIDENING_MS_INCREMENT = 1000
-      }
-      tryGapWidth += TRY_GAP_WIDENING_MS_INCREMENT
-      time.Sleep( time.Duration( (tryGapWidth + r) * 1000000 ) )
-      err = db.ExecStatement(stmt)
+   err = db.execTransactionStatement("BEGIN " + transactionType, "BEGIN " + transactionType + " TRANSACTION", policy)
+   if err != nil {
+      return
    }
 
    if transactionType == "DEFERRED" {
       // We really don't want a deferred transaction. We want to create a SHARED lock right
       // away in the SQLITE database. If we cannot, we need to fail-fast here, so that
       // the code inside the transaction-protected block will not be executed.
+      // In WAL journal mode, this first read is also what fixes the snapshot of the database
+      // that the rest of the read transaction will see, regardless of concurrent writers.
 
       // So do a dummy read query.
 
-      if dummyQuery == nil {
-          dummyQuery, err = db.Prepare("select rowid from RPackage where rowid=1")
-          if err != nil {
-             panic(err)
-          }
+      // The query is prepared (and cached) separately in each connection, since a prepared statement 
+      // belongs to one connection.
+      dummyQuery, prepErr := db.Prepare(db.db.dialect.SnapshotQuery())
+      if prepErr != nil {
+         panic(prepErr)
       }
 
-      err = dummyQuery.Query()  
-      dummyQuery.Reset()
-
-      var TRY_GAP_WIDENING_MS_INCREMENT int64 = 100  // ms - longest wait will be 6 seconds + random factor 
-      var tryGapWidth int64 = TRY_GAP_WIDENING_MS_INCREMENT
-      var r int64
-      for j := 0; err != nil && j < N_BEGIN_TRIES  ; j++ {
+      for try := 1; ; try++ {
+         err = dummyQuery.Query()  
+         dummyQuery.Reset()
+         if err == nil {
+            break
+         }
          Logln(PERSIST2_,"BEGIN DEFERRED: ERR executing dummy select query:",err)
-         r = rand.Int63n(500 + tryGapWidth)
-         if j > 5 {
-            TRY_GAP_WIDENING_MS_INCREMENT = 1000
+         kind := db.classifyDbError(err)
+         if ! policy.ShouldRetry(kind, try) {
+            db.ExecStatement("ROLLBACK TRANSACTION")
+            err = &TransactionError{Kind: kind, Op: "BEGIN DEFERRED", Tries: try, Err: err}
+            return
          }
-         tryGapWidth += TRY_GAP_WIDENING_MS_INCREMENT
-         time.Sleep( time.Duration( (tryGapWidth + r) * 1000000 ) )
-         err = dummyQuery.Query()
-         dummyQuery.Reset()
+         policy.Wait(try)
       }
    }
 
-
-
-   if err == nil {
-      Logln(PERSIST2_,">>>>>>>>>>>>>>>>>>>>>>>>> SUCCESSFULLY BEGAN", transactionType, "TRANSACTION")
-   }
+   Logln(PERSIST2_,">>>>>>>>>>>>>>>>>>>>>>>>> SUCCESSFULLY BEGAN", transactionType, "TRANSACTION")
    return
 }
 
 /*
 Commits the in-effect database transaction.
+Busy or locked failures are retried according to the default transaction retry policy.
+If the commit finally fails, returns a *TransactionError.
 */
 func (db *SqliteDBThread) CommitTransaction() (err error) {
    db.dbt.th.AllowGC()
    defer db.dbt.th.DisallowGC()
-   err = db.ExecStatement("COMMIT TRANSACTION")
-   var TRY_GAP_WIDENING_MS_INCREMENT int64 = 100  
-   var tryGapWidth int64 = TRY_GAP_WIDENING_MS_INCREMENT
-   var r int64
-   for i := 0;  err != nil && i < N_COMMIT_TRIES ; i ++ {
-      Logln(PERSIST2_,"COMMIT ERR:", err)      
-      r = rand.Int63n(500 + tryGapWidth)
-      if i > 5 {
-         TRY_GAP_WIDENING_MS_INCREMENT = 1000
-      }      
-      tryGapWidth += TRY_GAP_WIDENING_MS_INCREMENT
-      time.Sleep(  time.Duration( (tryGapWidth + r) * 1000000 ) )
-      err = db.ExecStatement("COMMIT TRANSACTION")
-   }
+   err = db.execTransactionStatement("COMMIT", "COMMIT TRANSACTION", DefaultTransactionRetryPolicy())
    if err == nil {
       Logln(PERSIST2_,"<<<<<<<<<<<<<<<<<<<<<<<<<< SUCCESSFULLY COMMITTED TRANSACTION")
    }
@@ -137,11 +136,65 @@ func (db *SqliteDBThread) RollbackTransaction() (err error) {
       Logln(PERSIST2_,"<<<<<<<<<<<<<<<<<<<<<<<<<< SUCCESSFULLY ROLLED BACK TRANSACTION")
    } else {
       Logln(PERSIST2_,"FAILED !!!!! To ROLLBACK TRANSACTION !!!!!!!! ???")
+      err = &TransactionError{Kind: db.classifyDbError(err), Op: "ROLLBACK", Tries: 1, Err: err}
    }   
    return
 }
 
 
+/*
+Begins a nested transaction scope within the in-effect database transaction.
+*/
+func (db *SqliteDBThread) BeginSavepoint(name string) (err error) {
+   err = db.ExecStatement("SAVEPOINT " + name)
+   if err != nil {
+      err = &TransactionError{Kind: db.classifyDbError(err), Op: "SAVEPOINT", Tries: 1, Err: err}
+   }
+   return
+}
+
+/*
+Ends the nested transaction scope, merging its changes into the enclosing scope.
+*/
+func (db *SqliteDBThread) ReleaseSavepoint(name string) (err error) {
+   err = db.ExecStatement("RELEASE SAVEPOINT " + name)
+   if err != nil {
+      err = &TransactionError{Kind: db.classifyDbError(err), Op: "RELEASE SAVEPOINT", Tries: 1, Err: err}
+   }
+   return
+}
+
+/*
+Undoes the changes made in the nested transaction scope, then ends the scope.
+ROLLBACK TO leaves the savepoint open in sqlite, so it is released as well.
+*/
+func (db *SqliteDBThread) RollbackToSavepoint(name string) (err error) {
+   err = db.ExecStatement("ROLLBACK TRANSACTION TO SAVEPOINT " + name)
+   if err == nil {
+      err = db.ExecStatement("RELEASE SAVEPOINT " + name)
+   }
+   if err != nil {
+      err = &TransactionError{Kind: db.classifyDbError(err), Op: "ROLLBACK TO SAVEPOINT", Tries: 1, Err: err}
+   }
+   return
+}
+
+
+/*
+Rolls back the in-effect database transaction, for the transaction watchdog.
+*/
+func (db *SqliteDBThread) interruptTransaction() (err error) {
+   err = db.ExecStatement("ROLLBACK TRANSACTION")
+   if err == nil {
+      Logln(PERSIST2_,"<<<<<<<<<<<<<<<<<<<<<<<<<< INTERRUPTED AND ROLLED BACK TRANSACTION")
+   }
+   return
+}
+
+func (db *SqliteDBThread) BindTransaction(tx *RTransaction) { 
+   panic("should not ever be called. Generic DBThread type calls its method instead.")
+}
+
 func (db *SqliteDBThread) UseDB() { 
    panic("should not ever be called. Generic DBThread type calls its method instead.")
 }
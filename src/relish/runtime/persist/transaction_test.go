@@ -0,0 +1,176 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+package persist
+
+import (
+	"path/filepath"
+	"relish/params"
+	. "relish/runtime/data"
+	"testing"
+	"time"
+)
+
+/*
+A transaction which passes its deadline while its thread is idle is rolled back in the database by the
+watchdog, so that it no longer holds the write lock, and the thread cannot go on using it.
+*/
+func TestWatchdogRollsBackDbTransaction(t *testing.T) {
+	defer func(n int) { params.DbMaxConnections = n }(params.DbMaxConnections)
+	params.DbMaxConnections = 2 // So that the other writer does not wait for the connection instead of the lock
+	db := NewKVDB(filepath.Join(t.TempDir(), "watchdog.kv"))
+	dbt := db.NewDBThread(nil).(*DBThread)
+	if err := dbt.BeginTransaction("EXCLUSIVE"); err != nil {
+		t.Fatal(err)
+	}
+	tx := NewTransaction()
+	dbt.BindTransaction(tx)
+
+	dbt.UseDB()
+	dbt.dbti.(*KVDBThread).conn().tx.Put([]byte("k"), []byte("uncommitted"))
+	dbt.ReleaseDB()
+
+	tx.SetTimeout(time.Millisecond)
+	otherDone := make(chan struct{})
+	go func() { // Waits for the write lock
+		other := db.NewDBThread(nil)
+		if err := other.BeginTransaction("EXCLUSIVE"); err != nil {
+			t.Error(err)
+		}
+		if val := other.(*DBThread).dbti.(*KVDBThread).conn().tx.Get([]byte("k")); val != nil {
+			t.Errorf("the timed out transaction's write was kept: %q", val)
+		}
+		other.RollbackTransaction()
+		close(otherDone)
+	}()
+	select {
+	case <-otherDone:
+	case <-time.After(5 * WATCHDOG_INTERVAL):
+		t.Fatal("the timed out transaction still holds the write lock")
+	}
+
+	if !tx.IsTimedOut() {
+		t.Error("the transaction is not timed out")
+	}
+	if err := tx.MarkDirty(nil); err == nil {
+		t.Error("an object was dirtied in the timed out transaction")
+	}
+	func() {
+		defer func() {
+			if recover() != errTransactionInterrupted {
+				t.Error("a db operation in the timed out transaction did not fail")
+			}
+		}()
+		dbt.UseDB()
+	}()
+	if err := dbt.CommitTransaction(); err != errTransactionInterrupted {
+		t.Errorf("committing the timed out transaction gave %v", err)
+	}
+	if err := dbt.RollbackTransaction(); err != nil {
+		t.Error(err)
+	}
+	if dbt.dbLockOwnershipDepth != 0 || dbt.txDepth != 0 {
+		t.Error("the thread still holds its connection")
+	}
+}
+
+/*
+Stands in for an interpreter thread which runs transactions in one database.
+*/
+type testThread struct {
+	InterpreterThread
+	dbt DBT
+	tx  *RTransaction
+}
+
+func (th *testThread) DBT() DBT                        { return th.dbt }
+func (th *testThread) Transaction() *RTransaction      { return th.tx }
+func (th *testThread) SetTransaction(tx *RTransaction) { th.tx = tx; th.dbt.BindTransaction(tx) }
+
+/*
+A transaction whose block panics part way through a db operation is rolled back, and releases its connection,
+so that the next transaction can use the database.
+*/
+func TestPanickingTransactionIsAbandoned(t *testing.T) {
+	defer func(n int) { params.DbMaxConnections = n }(params.DbMaxConnections)
+	params.DbMaxConnections = 1
+	db := NewKVDB(filepath.Join(t.TempDir(), "panic.kv"))
+	th := &testThread{dbt: db.NewDBThread(nil)}
+	func() {
+		defer func() {
+			if r := recover(); r != "runtime error" {
+				t.Errorf("the block's panic became %v", r)
+			}
+		}()
+		RunTransaction(th, "EXCLUSIVE", DefaultTransactionRetryPolicy(), func() error {
+			dbt := th.dbt.(*DBThread)
+			dbt.UseDB()
+			dbt.dbti.(*KVDBThread).conn().tx.Put([]byte("k"), []byte("uncommitted"))
+			panic("runtime error")
+		})
+	}()
+	if th.tx != nil {
+		t.Error("the thread is still in the panicked transaction")
+	}
+
+	otherDone := make(chan struct{})
+	go func() {
+		other := &testThread{dbt: db.NewDBThread(nil)}
+		err := RunTransaction(other, "EXCLUSIVE", DefaultTransactionRetryPolicy(), func() error {
+			if val := other.dbt.(*DBThread).dbti.(*KVDBThread).conn().tx.Get([]byte("k")); val != nil {
+				t.Errorf("the panicked transaction's write was kept: %q", val)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		close(otherDone)
+	}()
+	select {
+	case <-otherDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the panicked transaction still holds the db connection")
+	}
+}
+
+/*
+A transaction which the watchdog times out while its block is running is abandoned when the block's next
+db operation panics, so that it releases its connection.
+*/
+func TestInterruptedTransactionIsAbandoned(t *testing.T) {
+	defer func(n int) { params.DbMaxConnections = n }(params.DbMaxConnections)
+	params.DbMaxConnections = 1
+	db := NewKVDB(filepath.Join(t.TempDir(), "interrupted.kv"))
+	th := &testThread{dbt: db.NewDBThread(nil)}
+	func() {
+		defer func() {
+			if r := recover(); r != errTransactionInterrupted {
+				t.Errorf("the interrupted db operation gave %v", r)
+			}
+		}()
+		RunTransaction(th, "EXCLUSIVE", DefaultTransactionRetryPolicy(), func() error {
+			th.tx.SetTimeout(time.Millisecond)
+			if err := th.tx.Await(nil, nil); err == nil {
+				t.Error("the transaction did not time out")
+			}
+			th.dbt.UseDB()
+			th.dbt.ReleaseDB()
+			return nil
+		})
+	}()
+
+	otherDone := make(chan struct{})
+	go func() {
+		other := &testThread{dbt: db.NewDBThread(nil)}
+		if err := RunTransaction(other, "EXCLUSIVE", DefaultTransactionRetryPolicy(), func() error { return nil }); err != nil {
+			t.Error(err)
+		}
+		close(otherDone)
+	}()
+	select {
+	case <-otherDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the interrupted transaction still holds the db connection")
+	}
+}
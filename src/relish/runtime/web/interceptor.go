@@ -0,0 +1,321 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+package web
+
+/*
+   interceptor.go - interceptors, which run before and after the web dialog handler methods
+   of a web package subtree, for cross-cutting concerns such as authentication, rate limiting,
+   logging, request ids or CORS headers.
+
+   A relish interceptor is a public method named before or after, in the web package or in
+   one of its web/something packages. It applies to the handler methods of its package and of
+   the packages below it, and is not itself mapped to a URL. Its parameters are filled as a
+   handler's are, from the http_srv.Request, the http_srv.Session, and those request arguments
+   and route arguments that name one of its parameters.
+
+   before request http_srv.Request > String Any
+   """
+   """
+      if not loggedIn request
+         => "REDIRECT" "/login"
+      => "CONTINUE" nil
+
+   An interceptor returns "CONTINUE", optionally after a HEADERS directive whose headers are added
+   to the response, to let the request proceed; or any other response directive, which is processed
+   as the response instead. The before interceptors run outermost package first, then the handler,
+   then the after interceptors innermost package first. An after interceptor's response replaces
+   the handler's. A before interceptor's response skips the handler, the inner interceptors, and
+   the after interceptors of its own and inner packages. Interceptors run in the handler's transaction.
+
+   Go-level hooks, added with AddInterceptor, run around all of that, before the request's URL
+   is resolved to a handler method, and after its response has been sent.
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	. "relish/runtime/data"
+	"relish/runtime/interp"
+	"strings"
+	"sync"
+)
+
+/*
+The names of relish interceptor methods.
+*/
+const (
+	BEFORE_INTERCEPTOR = "before"
+	AFTER_INTERCEPTOR  = "after"
+)
+
+/*
+The response directive with which an interceptor lets the request proceed.
+*/
+const CONTINUE_DIRECTIVE = "CONTINUE"
+
+/*
+A BeforeHook is run before a web request is resolved to a handler method. It may return a
+replacement for the request, for example one carrying a value in its context. If it has written
+the response itself, for example an error response, it returns handled true, and the request
+goes no further.
+*/
+type BeforeHook func(w http.ResponseWriter, r *http.Request) (rr *http.Request, handled bool)
+
+/*
+An AfterHook is run after the response to a web request has been sent, or after a BeforeHook
+has handled the request. ResponseStatus(w) is the response's HTTP status code.
+*/
+type AfterHook func(w http.ResponseWriter, r *http.Request)
+
+type goInterceptor struct {
+	pathPrefix string
+	before     BeforeHook
+	after      AfterHook
+}
+
+var goInterceptors []*goInterceptor
+var goInterceptorsMutex sync.RWMutex
+
+/*
+Adds Go-level hooks, either of which may be nil, to be run around the handling of web requests
+whose URL path is pathPrefix or is below it. Hooks run in the order they were added, and their
+after hooks in the reverse order.
+*/
+func AddInterceptor(pathPrefix string, before BeforeHook, after AfterHook) {
+	pathPrefix = strings.TrimSuffix(pathPrefix, "/")
+	goInterceptorsMutex.Lock()
+	defer goInterceptorsMutex.Unlock()
+	goInterceptors = append(goInterceptors, &goInterceptor{pathPrefix, before, after})
+}
+
+/*
+The Go-level interceptors that apply to the URL path.
+*/
+func findGoInterceptors(path string) (interceptors []*goInterceptor) {
+	goInterceptorsMutex.RLock()
+	defer goInterceptorsMutex.RUnlock()
+	for _, ic := range goInterceptors {
+		if path == ic.pathPrefix || strings.HasPrefix(path, ic.pathPrefix+"/") {
+			interceptors = append(interceptors, ic)
+		}
+	}
+	return
+}
+
+/*
+Runs the before hooks of the interceptors. Returns the possibly replaced request, the interceptors
+whose after hooks must be run, and whether a before hook handled the request.
+*/
+func runBeforeHooks(interceptors []*goInterceptor, w http.ResponseWriter, r *http.Request) (rr *http.Request, entered []*goInterceptor, handled bool) {
+	rr = r
+	for _, ic := range interceptors {
+		entered = append(entered, ic)
+		if ic.before == nil {
+			continue
+		}
+		var r2 *http.Request
+		r2, handled = ic.before(w, rr)
+		if r2 != nil {
+			rr = r2
+		}
+		if handled {
+			return
+		}
+	}
+	return
+}
+
+/*
+Runs the after hooks of the interceptors, in reverse order.
+*/
+func runAfterHooks(interceptors []*goInterceptor, w http.ResponseWriter, r *http.Request) {
+	for k := len(interceptors) - 1; k >= 0; k-- {
+		if interceptors[k].after != nil {
+			interceptors[k].after(w, r)
+		}
+	}
+}
+
+/*
+A ResponseWriter that remembers the status code of the response, for after hooks.
+It can still be flushed and hijacked, if the ResponseWriter it wraps can be.
+*/
+type interceptedResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *interceptedResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *interceptedResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *interceptedResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *interceptedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("The http.ResponseWriter cannot be hijacked.")
+	}
+	return hijacker.Hijack()
+}
+
+/*
+The HTTP status code of the response written so far to w, which must be the ResponseWriter passed to
+an AfterHook for this to be known. 0 if nothing has been written yet.
+*/
+func ResponseStatus(w http.ResponseWriter) int {
+	if iw, ok := w.(*interceptedResponseWriter); ok {
+		return iw.status
+	}
+	return 0
+}
+
+/*
+The relish before and after interceptor methods of a web package.
+*/
+type webInterceptor struct {
+	pkg    *RPackage
+	before *RMultiMethod
+	after  *RMultiMethod
+}
+
+func isInterceptorName(methodName string) bool {
+	return methodName == BEFORE_INTERCEPTOR || methodName == AFTER_INTERCEPTOR
+}
+
+/*
+The relish interceptors that apply to the handler methods of the web package, outermost package first.
+*/
+func findInterceptors(pkg *RPackage) (interceptors []*webInterceptor) {
+	webPkgName := RT.RunningArtifact + "/pkg/web"
+	pkgName := pkg.Name
+	for {
+		if p := RT.Packages[pkgName]; p != nil {
+			before := findHandlerMethod(p, BEFORE_INTERCEPTOR)
+			after := findHandlerMethod(p, AFTER_INTERCEPTOR)
+			if before != nil || after != nil {
+				interceptors = append([]*webInterceptor{{p, before, after}}, interceptors...)
+			}
+		}
+		slashPos := strings.LastIndex(pkgName, "/")
+		if pkgName == webPkgName || slashPos < len(webPkgName) {
+			break
+		}
+		pkgName = pkgName[:slashPos]
+	}
+	return
+}
+
+/*
+Whether the handler method or any of the interceptors must be given the request's session.
+*/
+func interceptedMethodUsesSession(interceptors []*webInterceptor, handlerMethod *RMultiMethod) bool {
+	if interpreter.ServiceMethodUsesSession(handlerMethod) {
+		return true
+	}
+	for _, ic := range interceptors {
+		if (ic.before != nil && interpreter.ServiceMethodUsesSession(ic.before)) ||
+			(ic.after != nil && interpreter.ServiceMethodUsesSession(ic.after)) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Runs the before interceptors, then the handler method unless a before interceptor responded instead,
+then the after interceptors of the packages whose before interceptors let the request proceed.
+Returns the results to be processed into the response, with the method that returned them and its package.
+*/
+func runInterceptedServiceMethod(t *interp.Thread, w http.ResponseWriter, r *http.Request, interceptors []*webInterceptor, pkg *RPackage, handlerMethod *RMultiMethod, routeArgStringValues map[string]string, positionalArgStringValues []string, keywordArgStringValues url.Values) (results []RObject, resultPkg *RPackage, resultMethod *RMultiMethod, err error) {
+	entered := 0
+	for _, ic := range interceptors {
+		if ic.before != nil {
+			var proceed bool
+			results, proceed, err = runInterceptor(t, w, r, ic.before, routeArgStringValues, keywordArgStringValues)
+			if err != nil {
+				return
+			}
+			if !proceed {
+				resultPkg, resultMethod = ic.pkg, ic.before
+				break
+			}
+		}
+		entered++
+	}
+	if entered == len(interceptors) {
+		results, err = interpreter.RunServiceMethod(t, handlerMethod, routeArgStringValues, positionalArgStringValues, keywordArgStringValues, r)
+		if err != nil {
+			return
+		}
+		results = append([]RObject(nil), results...)
+		resultPkg, resultMethod = pkg, handlerMethod
+	}
+	for k := entered - 1; k >= 0; k-- {
+		ic := interceptors[k]
+		if ic.after == nil {
+			continue
+		}
+		var afterResults []RObject
+		var proceed bool
+		afterResults, proceed, err = runInterceptor(t, w, r, ic.after, routeArgStringValues, keywordArgStringValues)
+		if err != nil {
+			return
+		}
+		if !proceed {
+			results, resultPkg, resultMethod = afterResults, ic.pkg, ic.after
+		}
+	}
+	return
+}
+
+/*
+Runs an interceptor method. If it lets the request proceed, sends the headers of its HEADERS directive, if any.
+*/
+func runInterceptor(t *interp.Thread, w http.ResponseWriter, r *http.Request, interceptorMethod *RMultiMethod, routeArgStringValues map[string]string, keywordArgStringValues url.Values) (results []RObject, proceed bool, err error) {
+	results, err = interpreter.RunServiceInterceptor(t, interceptorMethod, routeArgStringValues, keywordArgStringValues, r)
+	if err != nil {
+		return
+	}
+	if len(results) == 0 {
+		proceed = true
+		return
+	}
+	directive, isString := results[0].(String)
+	if !isString {
+		err = fmt.Errorf("%s must return a response directive or \"%s\".", interceptorMethod.Name, CONTINUE_DIRECTIVE)
+		return
+	}
+	if strings.HasPrefix(string(directive), "HEADERS") && len(results) > 1 {
+		if next, isString := results[1].(String); isString && string(next) == CONTINUE_DIRECTIVE {
+			firstLineEndPos := strings.Index(string(directive), "\n")
+			if firstLineEndPos == -1 {
+				err = fmt.Errorf(`%s HEADERS directive must include some http headers, each on a separate line.`, interceptorMethod.Name)
+				return
+			}
+			err = sendHeaders(w, string(directive)[firstLineEndPos+1:])
+			proceed = err == nil
+			return
+		}
+	}
+	proceed = string(directive) == CONTINUE_DIRECTIVE
+	return
+}
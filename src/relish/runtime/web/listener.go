@@ -24,9 +24,11 @@ import (
     "errors"
 	. "relish/runtime/data"
 	"relish/runtime/interp"
+	"relish/runtime/native_methods/standard_lib/http_methods"
 	"sync"
   "relish/rterr"
   "net/url"
+  "sort"
 )
 
 
@@ -36,6 +38,53 @@ Decisions:
 1. web or webservice dialog handler functions are public-section functions found
    in the web package or web/something, web/something/else packages.
 
+   A URL path /foo/bar is mapped to the handler foo in package web, or to the handler bar in package web/foo.
+   A handler can be restricted to some HTTP methods with modifier keywords after its """,
+   or by a name with a verb prefix: 
+
+   getOrders > String Any     // GET /orders
+   postOrders customer String > String Any    // POST /orders?customer=Ann
+
+   A handler named with a verb prefix is used only if the path segment does not name a handler that handles
+   the request's HTTP method, nor a subpackage, and the package has no default handler that handles it.
+
+   widget > String Any
+   """ PUT DELETE
+
+   or can instead be mapped by a route pattern, relative to the URL path of its package,
+   whose {name} path segments are passed as the method parameters of the same names:
+
+   orderItems id Int > String Any
+   """ GET /orders/{id}/items
+
+   A request whose path is handled, but not for the request's HTTP method, is answered with
+   405 Method Not Allowed, with an Allow header listing the HTTP methods that are handled.
+
+   A handler method with a parameter of type http_srv.Session is given the request's session,
+   which is identified by a cookie and kept by the configured session store (see configureSessions).
+   A POST, PUT, PATCH or DELETE request to such a handler must carry the session's CSRF token,
+   as the csrf_token form field or the X-CSRF-Token header, or is answered with 403 Forbidden.
+   The session's changes are saved in the handler method's transaction, so are kept only if it commits.
+
+   login session http_srv.Session name String password String > String Any
+   """ POST
+
+   A handler method with the WEBSOCKET modifier answers a request to open a web socket. It is given the
+   web socket as its parameter of type Channel, and exchanges messages with the client, by receiving from
+   and sending to the channel, until it returns (see http_methods/websocket.go).
+
+   chat ws Channel name String
+   """ WEBSOCKET
+   """
+      msg = <- ws
+      while msg
+         ws <- cat name ": " msg
+         msg = <- ws
+
+   Public methods named before and after are not handlers, but interceptors, which run before and
+   after the handlers of their package and of the packages below it, and can respond instead of
+   the handler (see interceptor.go). Go code can add hooks around request handling with AddInterceptor.
+
 2. These methods must have a pattern of return arguments which directs the relish runtime as to how
 to find, format, and return the response to a web request. The return argument pattern are as follows:
 
@@ -81,6 +130,16 @@ TEMPLATE "literal template text" SomeObjToPassToTemplate
 "HTTP ERROR" 404  ["message"] // or 403 (no permission) etc - message defaults to ""
 
 
+"SSE" anInChannel  // streams each value received from the channel to the client as a server-sent event,
+                   // until nil is received from the channel or the client goes away
+
+
+"STREAM" ["text/csv"] anInChannelOrGenerator  // streams the values to the client as the response body, in chunks,
+                                               // until the source gives nil or the client goes away. The generator is
+                                               // a closure with no parameters, applied again for each value.
+                                               // Strings and Bytes are sent as is, other values as lines of JSON.
+
+
 """
 HEADERS 
 Content-Type: application/octetstream
@@ -297,6 +356,20 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	
 	  return
    }
+
+   // Run the before hooks of the Go-level interceptors for the path, and their after hooks
+   // once the request has been handled.
+
+   if goInterceptors := findGoInterceptors(path); goInterceptors != nil {
+      w = &interceptedResponseWriter{ResponseWriter: w}
+      var entered []*goInterceptor
+      var handled bool
+      r, entered, handled = runBeforeHooks(goInterceptors, w, r)
+      defer runAfterHooks(entered, w, r)
+      if handled {
+         return
+      }
+   }
  	
    pathSegments := strings.Split(path, "/") 
    if len(pathSegments) > 0 && len(pathSegments[0]) == 0 {
@@ -332,59 +405,36 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	  rterr.Stop("No web package has been defined in " + RT.RunningArtifact)
    }
 
+   verb := r.Method
+   if verb == "HEAD" {
+      verb = "GET"
+   }
 
-   //    /foo/bar
+   //    /orders/{id}/items
 
    remainingPathSegments := pathSegments[:]
-   for len(remainingPathSegments) > 0 {
-      name := remainingPathSegments[0]
-      methodName := underscoresToCamelCase(name)
-
-      handlerMethod = findHandlerMethod(pkg,methodName) 
-      if handlerMethod != nil {
-        Log(WEB_, "1. %s %s\n",pkg.Name,methodName)  
-	      remainingPathSegments = remainingPathSegments[1:]
-        Log(WEB_, "    remainingPathSegments: %v\n",remainingPathSegments)       
-	      break
-	  }
-      pkgName += "/" + name
-      Log(WEB_, "2. pkgName: %s\n", pkgName)       
-      nextPkg := RT.Packages[pkgName]
-      if nextPkg != nil {
-	     remainingPathSegments = remainingPathSegments[1:]
-         pkg = nextPkg
-         continue  	   
-      }  
-      Logln(WEB_, "     package was not found in RT.Packages")           
+   route, routeArgStringValues, allowedVerbs := matchRoute(pathSegments, verb)
+   if route != nil {
+      Log(WEB_, "0. %s %s\n",route.pkg.Name,route.pattern)  
+      handlerMethod = route.handlerMethod
+      pkg = route.pkg
+      remainingPathSegments = nil
+   } else if allowedVerbs != nil {
+      methodNotAllowed(w, allowedVerbs)
+      return
+   }
 
-      if strings.HasSuffix(pkgName,"/pkg/web/favicon.ico") {
-         handlerMethod = findHandlerMethod(pkg,"icon")
-         if handlerMethod != nil {  
-            Log(WEB_, "%s %s\n",pkg.Name,methodName)  
-            remainingPathSegments = remainingPathSegments[1:]      
-            break
-         } else {
-            http.Error(w, "", http.StatusNotFound) 
-            return
-         }
-      } 
+   //    /foo/bar
 
-      // Note that default only handles paths that do not proceed down to 
-      // a subdirectory controller package.
-      handlerMethod = findHandlerMethod(pkg,"default") 
-      if handlerMethod != nil {   
-	     // remainingPathSegments = remainingPathSegments[1:]     
-         Log(WEB_,"3. Found default handler method in %s\n",pkg.Name) 
-	     break
-	  }    
-      http.Error(w, "404 page or resource not found", http.StatusNotFound)	
-      return	
-   }
    if handlerMethod == nil {
-      handlerMethod = findHandlerMethod(pkg,"index")        	
-   }	
+      handlerMethod, pkg, remainingPathSegments, allowedVerbs = findPathHandlerMethod(pkgName, pkg, remainingPathSegments, verb)
+   }
    if handlerMethod == nil {
-      http.Error(w, "404 page or resource not found", http.StatusNotFound) 
+      if allowedVerbs != nil {
+         methodNotAllowed(w, allowedVerbs)
+      } else {
+         http.Error(w, "404 page or resource not found", http.StatusNotFound) 
+      }
       return       	
    }   
 
@@ -415,6 +465,40 @@ func handler(w http.ResponseWriter, r *http.Request) {
 
    defer interpreter.DeregisterThread(t)   
 
+   // Changes are recorded in the audit log as made for the basic auth user, unless the handler or an
+   // interceptor calls setActor, e.g. once it has found the logged-in user in the session.
+
+   if user, _, hasAuth := r.BasicAuth(); hasAuth {
+      t.SetActor(user)
+   }
+
+   // The before and after interceptor methods of the handler's package and of the packages above it.
+
+   interceptors := findInterceptors(pkg)
+
+   // Load the session, if the handler method or an interceptor has an http_srv.Session parameter.
+   // A request that may change state in the session must carry the session's CSRF token.
+
+   var session *http_methods.Session
+   if interceptedMethodUsesSession(interceptors, handlerMethod) {
+      session, err = http_methods.LoadSession(t, r)
+      if err != nil {
+         fmt.Println(err)  
+         http.Error(w, err.Error(), http.StatusInternalServerError)
+         return  
+      }
+      csrfToken := r.Header.Get(http_methods.CSRF_TOKEN_HEADER)
+      if csrfToken == "" {
+         csrfToken = keywordArgStringValues.Get(http_methods.CSRF_TOKEN_FIELD)
+      }
+      keywordArgStringValues.Del(http_methods.CSRF_TOKEN_FIELD)
+      if contains(csrfCheckedVerbs, verb) && ! session.CheckCSRFToken(csrfToken) {
+         http.Error(w, "403 missing or invalid CSRF token", http.StatusForbidden)
+         return
+      }
+      r = http_methods.WithSession(r, session)
+   }
+
    Log(GC2_,"Running dialog handler method: %s\n",handlerMethod.Name)   
    Log(GC2_," Args: %v\n",positionalArgStringValues)   
    Log(GC2_," KW Args: %v\n",keywordArgStringValues)   
@@ -423,8 +507,11 @@ func handler(w http.ResponseWriter, r *http.Request) {
    // Get annotations of the URL-mapped method.
    // These determine what kind of transaction behaviour it will have.
    // Options:
-   // <none>  Wrap method execution and response processing in an IMMEDIATE (reserved for write) TRANSACTION
-   // "READ" Wrap method execution and response processing in a DEFERRED TRANSACTION which has done a trial db read.
+   // <none>  Wrap method execution in an EXCLUSIVE (reserved for write) TRANSACTION, which is committed before
+   //         the response is processed. If the commit fails because the db is busy or locked, 
+   //         the method is re-run in a new transaction, according to the transaction retry policy.
+   // "READ" Wrap method execution in a DEFERRED TRANSACTION which has done a trial db read, which is ended
+   //        before the response is processed, so that a streamed response does not hold it.
    // "NOTX" Do not use a long transaction at all. Use AUTOCOMMIT transactions, one per db statement.
    // If not doing any persistence in the service method, use NOTX
    //
@@ -433,51 +520,160 @@ func handler(w http.ResponseWriter, r *http.Request) {
       panic(err)
    }
 
-   if ! mods["NOTX"] {
+   // A WEBSOCKET handler method runs, without a long transaction, for as long as its web socket is open.
+
+   if mods["WEBSOCKET"] {
+      err = serveWebSocket(t, w, r, session, interceptors, handlerMethod, routeArgStringValues, positionalArgStringValues, keywordArgStringValues)
+      if err != nil {
+         fmt.Println(err)
+         t.SetErr(err.Error())
+         return
+      }
+      t.SetErr("")
+      return
+   }
+
+   var resultObjects []RObject
+   resultPkg := pkg
+   resultMethod := handlerMethod
+   var endReadTransaction func()
+   var sessionCookie *http.Cookie
+   sessionSaved := false
+
+   if ! mods["NOTX"] && ! mods["READ"] {
+
+      // Run the handler method in an EXCLUSIVE transaction, and commit before processing the response,
+      // so that if the commit fails because the db is busy or locked, the whole handler method
+      // can be re-run in a new transaction.
+      // The session is saved in the transaction, so that the db session store keeps the session's changes
+      // only if the handler's changes are committed, and a failed save rolls back the handler's changes.
+      // Each re-run begins with the session as the request brought it.
+      // If the handler method or an interceptor panics, RunTransaction rolls back the transaction, 
+      // and releases its db connection, before the panic carries on.
+
+      var sessionSnapshot *http_methods.Session
+      if session != nil {
+         sessionSnapshot = session.Snapshot()
+      }
+      err = RunTransaction(t, "EXCLUSIVE", DefaultTransactionRetryPolicy(), func() (blockErr error) {
+         if session != nil {
+            session.Reset(sessionSnapshot)
+         }
+         t.SetErr("Uncaught panic while running web app method.")
+         resultObjects, resultPkg, resultMethod, blockErr = runInterceptedServiceMethod(t, w, r,
+                                                                interceptors,
+                                                                pkg,
+                                                                handlerMethod, 
+                                                                routeArgStringValues, 
+                                                                positionalArgStringValues, 
+                                                                keywordArgStringValues) 
+         if blockErr == nil && session != nil {
+            sessionCookie, blockErr = session.Save(t, r)
+         }
+         return  
+      })
+      sessionSaved = true
+
+      Log(GC2_,"Finished running dialog handler method: %s\n",handlerMethod.Name)   
+      Log(GC2_," Args: %v\n",positionalArgStringValues)   
+      Log(GC2_," KW Args: %v\n",keywordArgStringValues)      
+
+      if err != nil {
+         fmt.Println(err) 
+         if txErr, isTxErr := err.(*TransactionError); isTxErr && txErr.Kind == TX_CONFLICT {
+            http.Error(w, err.Error(), http.StatusConflict)
+         } else if IsRetryableTransactionError(err) {
+            http.Error(w, err.Error(), http.StatusServiceUnavailable)
+         } else {
+            fmt.Fprintln(w, err)
+         }
+         t.SetErr(err.Error())
+         return  
+      } 
+   } else {
+
+      // If the handler method panics in a transaction which it began, e.g. because the transaction watchdog
+      // interrupted the transaction, the transaction is rolled back and its db connection released.
+
+      defer func() {
+         if r := recover(); r != nil {
+            if t.Transaction() != nil {
+               AbandonTransaction(t)
+            }
+            panic(r)
+         }
+      }()
 
-      var transactionType string
       if mods["READ"] {
-         transactionType = "DEFERRED"
-      } else {
-         transactionType = "EXCLUSIVE"
+         err := t.DBT().BeginTransaction("DEFERRED")
+         if err != nil {
+            fmt.Println(err)  
+            fmt.Fprintln(w, err)
+            t.SetErr(err.Error())
+            return  
+         }       
+         t.SetTransaction(NewTransaction())   
+
+         // Ended before the response is processed, so that a streamed response does not hold
+         // the read transaction, and its db connection, for as long as the client is connected.
+
+         readTransactionEnded := false
+         endReadTransaction = func() {
+            if ! readTransactionEnded {
+               readTransactionEnded = true
+               t.CommitOrRollback()
+               t.SetTransaction(nil)
+            }
+         }
+         defer endReadTransaction()
       }
+   
+      t.SetErr("Uncaught panic while running web app method.")
 
-      err := t.DBT().BeginTransaction(transactionType)
+      // fmt.Printf("Began transaction now running dialog handler method: %s\n",handlerMethod.Name)   
+	
+      resultObjects, resultPkg, resultMethod, err = runInterceptedServiceMethod(t, w, r,
+	                                                    interceptors,
+	                                                    pkg,
+	                                                    handlerMethod, 
+	                                                    routeArgStringValues, 
+	                                                    positionalArgStringValues, 
+	                                                    keywordArgStringValues)   
+
+      // fmt.Printf("Finished running dialog handler method: %s\n",handlerMethod.Name)   
+      Log(GC2_,"Finished running dialog handler method: %s\n",handlerMethod.Name)   
+      Log(GC2_," Args: %v\n",positionalArgStringValues)   
+      Log(GC2_," KW Args: %v\n",keywordArgStringValues)      
+     
       if err != nil {
          fmt.Println(err)  
          fmt.Fprintln(w, err)
          t.SetErr(err.Error())
          return  
-      }       
-      t.SetTransaction(NewTransaction())   
+      }   
+   }
 
-      defer t.SetTransaction(nil)
-      defer t.CommitOrRollback()
+   if endReadTransaction != nil {
+      endReadTransaction()
    }
-   
-   t.SetErr("Uncaught panic while running web app method.")
 
-   // fmt.Printf("Began transaction now running dialog handler method: %s\n",handlerMethod.Name)   
-	
-   resultObjects,err := interpreter.RunServiceMethod(t, 
-	                                                 handlerMethod, 
-	                                                 positionalArgStringValues, 
-	                                                 keywordArgStringValues,
-	                                                 r)   
+   // A READ or NOTX handler makes no changes which a failed save of the session would have to undo,
+   // so its session is saved after its transaction, if any.
 
-   // fmt.Printf("Finished running dialog handler method: %s\n",handlerMethod.Name)   
-   Log(GC2_,"Finished running dialog handler method: %s\n",handlerMethod.Name)   
-   Log(GC2_," Args: %v\n",positionalArgStringValues)   
-   Log(GC2_," KW Args: %v\n",keywordArgStringValues)      
-     
-   if err != nil {
-      fmt.Println(err)  
-      fmt.Fprintln(w, err)
-      t.SetErr(err.Error())
-      return  
-   }   
+   if session != nil && ! sessionSaved {
+      sessionCookie, err = session.Save(t, r)
+      if err != nil {
+         fmt.Println(err)	
+         fmt.Fprintln(w, err)
+         t.SetErr(err.Error())      
+         return	
+      }
+   }
+   if sessionCookie != nil {
+      http.SetCookie(w, sessionCookie)
+   }
 
-   err = processResponse(w,r,pkg, handlerMethod.Name, resultObjects, t)
+   err = processResponse(w,r,resultPkg, resultMethod.Name, resultObjects, t)
    if err != nil {
       fmt.Println(err)	
       fmt.Fprintln(w, err)
@@ -616,6 +812,10 @@ func explorerHandler(w http.ResponseWriter, r *http.Request) {
 
    defer interpreter.DeregisterThread(t)
 
+   if user, _, hasAuth := r.BasicAuth(); hasAuth {
+      t.SetActor(user)
+   }
+
    t.DBT().BeginTransaction("EXCLUSIVE")
 
    t.SetTransaction(NewTransaction())   
@@ -626,6 +826,7 @@ func explorerHandler(w http.ResponseWriter, r *http.Request) {
 	
    resultObjects,err := interpreter.RunServiceMethod(t, 
 	                                                 handlerMethod, 
+	                                                 nil, 
 	                                                 positionalArgStringValues, 
 	                                                 keywordArgStringValues,
 	                                                 r)   
@@ -1086,6 +1287,41 @@ func processResponse(w http.ResponseWriter, r *http.Request, pkg *RPackage, meth
        } 
        http.Error(w, message, code)  
 
+    case "SSE":
+       var c RInChannel
+       if len(results) < 2 {
+         err = fmt.Errorf("%s SSE response requires an InChannel as second return value", methodName)
+         return
+       } else if len(results) == 2 || ( len(results) == 3 && results[2].IsZero() ) {
+          var isInChannel bool
+          c, isInChannel = results[1].(RInChannel)
+          if ! isInChannel {
+             err = fmt.Errorf("%s SSE response requires an InChannel as second return value", methodName)
+             return
+          }
+       } else {
+              err = fmt.Errorf("%s SSE response has too many return values. Should be 'SSE' then an InChannel", methodName)
+              return
+       }
+       err = sendEvents(w, r, c, thread)
+
+    case "STREAM":
+       mimeType := "text/plain; charset=utf-8"
+       var source RObject
+       if len(results) < 2 {
+         err = fmt.Errorf("%s STREAM response requires an InChannel or a generator closure, optionally preceded by a mimetype", methodName)
+         return
+       } else if len(results) == 2 || ( len(results) == 3 && results[2].IsZero() ) {
+          source = results[1]
+       } else if len(results) == 3 {
+          mimeType = string(results[1].(String))
+          source = results[2]
+       } else {
+              err = fmt.Errorf("%s STREAM response has too many return values. Should be 'STREAM' then a mimetype then an InChannel or a generator closure", methodName)
+              return
+       }
+       err = sendStream(w, r, mimeType, source, thread)
+
 			
 	  // Do we not need a MIME type argument for this one???
 	  case "TEMPLATE": // An inline template as a string	
@@ -1139,6 +1375,324 @@ func findHandlerMethod(pkg *RPackage, methodName string) *RMultiMethod {
 	return pkg.MultiMethods[methodName]
 }
 
+/*
+The HTTP methods (verbs) that a web dialog handler method can be restricted to, either with modifier keywords
+after the """ at the top of the method, as in
+   """ POST PUT
+or by naming the method with a verb prefix, so that postOrders handles POST requests to /orders.
+A handler with neither handles requests of any HTTP method. A HEAD request is handled as a GET request.
+*/
+var httpVerbs []string = []string{"GET","POST","PUT","PATCH","DELETE"}
+
+/*
+The HTTP methods whose requests must carry the session's CSRF token, if the handler method receives the session.
+*/
+var csrfCheckedVerbs []string = []string{"POST","PUT","PATCH","DELETE"}
+
+/*
+Finds the handler method for the URL path segments below the web package pkg, whose full name is pkgName,
+that handles requests of the HTTP method verb. Returns it with the package it is in, and the path segments
+that remain after those that selected it, which are passed to it as positional arguments.
+
+Each path segment is resolved, in order, to
+   the handler of that name (e.g. orders), if it handles the verb;
+   the subpackage of that name, in which the remaining path segments are resolved;
+   the default handler of the package, if it handles the verb;
+   the handler of that name with the verb prefix (e.g. getOrders).
+So a handler named with a verb prefix never shadows a handler, subpackage or default that the path would
+otherwise reach. When the path segments are used up, the index handler of the package is found the same way.
+
+If there is no such handler method, but there are handlers for the path that handle other HTTP methods,
+returns those HTTP methods, so that the request can be answered with 405 Method Not Allowed.
+*/
+func findPathHandlerMethod(pkgName string, pkg *RPackage, pathSegments []string, verb string) (handlerMethod *RMultiMethod, handlerPkg *RPackage, remainingPathSegments []string, allowedVerbs []string) {
+   remainingPathSegments = pathSegments
+   for len(remainingPathSegments) > 0 {
+      name := remainingPathSegments[0]
+      methodName := underscoresToCamelCase(name)
+
+      handlerMethod, allowedVerbs = findNamedHandlerMethod(pkg,methodName,verb) 
+      if handlerMethod != nil {
+         Log(WEB_, "1. %s %s\n",pkg.Name,methodName)  
+         remainingPathSegments = remainingPathSegments[1:]
+         Log(WEB_, "    remainingPathSegments: %v\n",remainingPathSegments)       
+         handlerPkg = pkg
+         return
+      }
+      pkgName += "/" + name
+      Log(WEB_, "2. pkgName: %s\n", pkgName)       
+      nextPkg := RT.Packages[pkgName]
+      if nextPkg != nil {
+         remainingPathSegments = remainingPathSegments[1:]
+         pkg = nextPkg
+         allowedVerbs = nil
+         continue  	   
+      }  
+      Logln(WEB_, "     package was not found in RT.Packages")           
+
+      if strings.HasSuffix(pkgName,"/pkg/web/favicon.ico") {
+         handlerMethod = findHandlerMethod(pkg,"icon")
+         if handlerMethod != nil {  
+            Log(WEB_, "%s %s\n",pkg.Name,methodName)  
+            remainingPathSegments = remainingPathSegments[1:]      
+            handlerPkg = pkg
+         }
+         allowedVerbs = nil
+         return
+      } 
+
+      // Note that default only handles paths that do not proceed down to 
+      // a subdirectory controller package.
+      var defaultAllowedVerbs []string
+      handlerMethod, defaultAllowedVerbs = findNamedHandlerMethod(pkg,"default",verb) 
+      if handlerMethod != nil {   
+         Log(WEB_,"3. Found default handler method in %s\n",pkg.Name) 
+         handlerPkg = pkg
+         allowedVerbs = nil
+         return
+      }
+      allowedVerbs = addVerbs(allowedVerbs, defaultAllowedVerbs)
+
+      var prefixedAllowedVerbs []string
+      handlerMethod, prefixedAllowedVerbs = findVerbPrefixedHandlerMethod(pkg,methodName,verb) 
+      if handlerMethod != nil {
+         Log(WEB_, "4. %s %s %s\n",pkg.Name,verb,methodName)  
+         remainingPathSegments = remainingPathSegments[1:]
+         handlerPkg = pkg
+         allowedVerbs = nil
+         return
+      }
+      allowedVerbs = addVerbs(allowedVerbs, prefixedAllowedVerbs)
+      return
+   }
+   handlerMethod, allowedVerbs = findNamedHandlerMethod(pkg,"index",verb)        	
+   if handlerMethod == nil {
+      var prefixedAllowedVerbs []string
+      handlerMethod, prefixedAllowedVerbs = findVerbPrefixedHandlerMethod(pkg,"index",verb)        	
+      allowedVerbs = addVerbs(allowedVerbs, prefixedAllowedVerbs)
+   }
+   if handlerMethod != nil {
+      handlerPkg = pkg
+      allowedVerbs = nil
+   }
+   return
+}
+
+/*
+Find the handler method named methodName, if it handles requests of the HTTP method verb, because its modifiers
+allow the verb or it has no verb modifiers. Methods with a route pattern are only found through their route.
+If the method does not handle the verb, returns the HTTP methods that it does handle.
+*/
+func findNamedHandlerMethod(pkg *RPackage, methodName string, verb string) (handlerMethod *RMultiMethod, allowedVerbs []string) {
+   if isInterceptorName(methodName) {
+      return  // interceptors are not mapped to URLs
+   }
+   mm := findHandlerMethod(pkg, methodName)
+   if mm == nil || handlerRoute(mm) != "" {
+      return
+   }
+   verbs := handlerVerbs(mm)
+   if verbs == nil || contains(verbs, verb) {
+      handlerMethod = mm
+      return
+   }
+   allowedVerbs = verbs
+   return
+}
+
+/*
+Find the handler method for the URL path segment methodName that is named with the prefix of the HTTP method verb,
+such as getOrders for a GET request to /orders. If there is none, but there are handlers for methodName
+with other verb prefixes, returns those HTTP methods.
+*/
+func findVerbPrefixedHandlerMethod(pkg *RPackage, methodName string, verb string) (handlerMethod *RMultiMethod, allowedVerbs []string) {
+   if methodName == "" {
+      return
+   }
+   for _,v := range httpVerbs {
+      mm := findHandlerMethod(pkg, strings.ToLower(v) + strings.ToUpper(methodName[:1]) + methodName[1:])
+      if mm != nil && handlerRoute(mm) == "" {
+         if v == verb {
+            handlerMethod = mm
+            allowedVerbs = nil
+            return
+         }
+         allowedVerbs = append(allowedVerbs, v)
+      }
+   }
+   return
+}
+
+/*
+Adds to allowedVerbs those of the verbs that it does not already contain.
+*/
+func addVerbs(allowedVerbs []string, verbs []string) []string {
+   for _,v := range verbs {
+      if ! contains(allowedVerbs, v) {
+         allowedVerbs = append(allowedVerbs, v)
+      }
+   }
+   return allowedVerbs
+}
+
+/*
+The HTTP methods that the handler method is restricted to by its modifier keywords, or nil if it handles any.
+*/
+func handlerVerbs(handlerMethod *RMultiMethod) (verbs []string) {
+   mods, err := interpreter.GetServiceMethodModifiers(handlerMethod)
+   if err != nil {
+      return
+   }
+   for _,v := range httpVerbs {
+      if mods[v] {
+         verbs = append(verbs, v)
+      }
+   }
+   return
+}
+
+/*
+The route pattern of the handler method, or "".
+*/
+func handlerRoute(handlerMethod *RMultiMethod) string {
+   route, err := interpreter.GetServiceMethodRoute(handlerMethod)
+   if err != nil {
+      return ""
+   }
+   return route
+}
+
+func contains(ss []string, s string) bool {
+   for _,si := range ss {
+      if si == s {
+         return true
+      }
+   }
+   return false
+}
+
+/*
+Responds 405 Method Not Allowed, with an Allow header listing the HTTP methods that the resource does handle.
+*/
+func methodNotAllowed(w http.ResponseWriter, allowedVerbs []string) {
+   if contains(allowedVerbs, "GET") {
+      allowedVerbs = append(allowedVerbs, "HEAD")
+   }
+   w.Header().Set("Allow", strings.Join(allowedVerbs, ", "))
+   http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+}
+
+/*
+A web dialog handler method that has a route pattern, such as
+   """ GET /orders/{id}/items
+The pattern is relative to the URL path of the handler's package, so the route of that method in
+the web/shop package matches /shop/orders/1234/items. Each {name} path segment matches any one
+path segment, whose value is passed to the method parameter of the same name.
+*/
+type webRoute struct {
+   pattern string
+   segments []string  // the package path segments below web, then the pattern's segments
+   verbs []string  // nil if the handler handles any HTTP method
+   pkg *RPackage
+   handlerMethod *RMultiMethod
+}
+
+var webRoutes []*webRoute
+var webRoutesFound bool
+var webRoutesMutex sync.Mutex
+
+/*
+Returns the routes of the handler methods in the web packages of the running artifact, finding them
+the first time. Where two routes could match the same path, the one with a literal path segment where
+the other has a {name} segment comes first.
+*/
+func findRoutes() []*webRoute {
+   webRoutesMutex.Lock()
+   defer webRoutesMutex.Unlock()
+   if webRoutesFound {
+      return webRoutes
+   }
+   webPkgName := RT.RunningArtifact + "/pkg/web"
+   for pkgName, pkg := range RT.Packages {
+      if pkgName != webPkgName && ! strings.HasPrefix(pkgName, webPkgName + "/") {
+         continue
+      }
+      var pkgSegments []string
+      if pkgName != webPkgName {
+         pkgSegments = strings.Split(pkgName[len(webPkgName)+1:], "/")
+      }
+      for name, mm := range pkg.MultiMethods {
+         if ! strings.HasPrefix(name, pkg.Path) || strings.Contains(name[len(pkg.Path):], "/") {
+            continue  // not defined in this package
+         }
+         pattern := handlerRoute(mm)
+         if pattern == "" {
+            continue
+         }
+         segments := append([]string{}, pkgSegments...)
+         for _,segment := range strings.Split(pattern[1:], "/") {
+            if segment != "" {
+               segments = append(segments, segment)
+            }
+         }
+         webRoutes = append(webRoutes, &webRoute{pattern, segments, handlerVerbs(mm), pkg, mm})
+      }
+   }
+   sort.Slice(webRoutes, func(i, j int) bool {
+      si := webRoutes[i].segments
+      sj := webRoutes[j].segments
+      for k := 0; k < len(si) && k < len(sj); k++ {
+         iIsParam := strings.HasPrefix(si[k], "{")
+         jIsParam := strings.HasPrefix(sj[k], "{")
+         if iIsParam != jIsParam {
+            return jIsParam
+         }
+      }
+      return len(si) < len(sj)
+   })
+   webRoutesFound = true
+   return webRoutes
+}
+
+/*
+Finds the route that matches the URL path segments and handles requests of the HTTP method verb,
+and returns it with the values of its {name} path segments.
+If no route handles the verb, but some route matches the path, returns the HTTP methods that the
+matching routes do handle, so that the request can be answered with 405 Method Not Allowed.
+*/
+func matchRoute(pathSegments []string, verb string) (route *webRoute, routeArgStringValues map[string]string, allowedVerbs []string) {
+   for _,rt := range findRoutes() {
+      if len(rt.segments) != len(pathSegments) {
+         continue
+      }
+      args := make(map[string]string)
+      matched := true
+      for k,segment := range rt.segments {
+         if strings.HasPrefix(segment, "{") {
+            args[segment[1:len(segment)-1]] = pathSegments[k]
+         } else if segment != pathSegments[k] {
+            matched = false
+            break
+         }
+      }
+      if ! matched {
+         continue
+      }
+      if rt.verbs == nil || contains(rt.verbs, verb) {
+         route = rt
+         routeArgStringValues = args
+         allowedVerbs = nil
+         return
+      }
+      for _,v := range rt.verbs {
+         if ! contains(allowedVerbs, v) {
+            allowedVerbs = append(allowedVerbs, v)
+         }
+      }
+   }
+   return
+}
+
 /*
 Given a file path which is either relative to current src package directory 
 e.g. "foo.html" "bar/foo.html"
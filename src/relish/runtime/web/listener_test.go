@@ -0,0 +1,71 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+package web
+
+import (
+	"fmt"
+	"relish/compiler/ast"
+	. "relish/runtime/data"
+	"testing"
+)
+
+// testWebPackage adds a web package with handler methods of the given names, each restricted
+// to the HTTP methods listed after its name, to the runtime's packages.
+func testWebPackage(name string, handlers map[string][]string) *RPackage {
+	pkg := &RPackage{Name: name, Path: name + "/", MultiMethods: make(map[string]*RMultiMethod)}
+	for methodName, verbs := range handlers {
+		modifiers := make(map[string]bool)
+		for _, v := range verbs {
+			modifiers[v] = true
+		}
+		mm := &RMultiMethod{Name: pkg.Path + methodName, Methods: make(map[int][]*RMethod), CachedMethods: make(map[*RTypeTuple]*RMethod), Pkg: pkg}
+		mm.Methods[0] = []*RMethod{&RMethod{Code: &ast.MethodDeclaration{ModifierKeywords: modifiers}, Pkg: pkg}}
+		pkg.MultiMethods[mm.Name] = mm
+	}
+	RT.Packages[name] = pkg
+	return pkg
+}
+
+func TestVerbPrefixedHandlerDoesNotShadow(t *testing.T) {
+	web := testWebPackage("test.org/shadow/pkg/web", map[string][]string{
+		"getUser":   nil,
+		"default":   nil,
+		"getOrders": nil,
+	})
+	testWebPackage("test.org/shadow/pkg/web/user", map[string][]string{"index": nil})
+
+	noDefault := testWebPackage("test.org/nodefault/pkg/web", map[string][]string{
+		"getOrders": nil,
+		"item":      {"PUT"},
+		"getItem":   nil,
+	})
+
+	tests := []struct {
+		pkg     *RPackage
+		path    []string
+		verb    string
+		handler string // the handler found, or the allowed verbs if none
+	}{
+		{web, []string{"user"}, "GET", "test.org/shadow/pkg/web/user/index"},
+		{web, []string{"user"}, "POST", "test.org/shadow/pkg/web/user/index"},
+		{web, []string{"orders"}, "GET", "test.org/shadow/pkg/web/default"},
+		{web, []string{"orders"}, "DELETE", "test.org/shadow/pkg/web/default"},
+		{noDefault, []string{"orders"}, "GET", "test.org/nodefault/pkg/web/getOrders"},
+		{noDefault, []string{"orders"}, "POST", "[GET]"},
+		{noDefault, []string{"item"}, "PUT", "test.org/nodefault/pkg/web/item"},
+		{noDefault, []string{"item"}, "GET", "test.org/nodefault/pkg/web/getItem"},
+		{noDefault, []string{"item"}, "POST", "[PUT GET]"},
+		{noDefault, []string{"nothing"}, "GET", "[]"},
+	}
+	for _, test := range tests {
+		mm, _, _, allowedVerbs := findPathHandlerMethod(test.pkg.Name, test.pkg, test.path, test.verb)
+		found := fmt.Sprint(allowedVerbs)
+		if mm != nil {
+			found = mm.Name
+		}
+		if found != test.handler {
+			t.Errorf("%s /%s in %s found %s, want %s", test.verb, test.path[0], test.pkg.Name, found, test.handler)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright 2012-2014 EveryBitCounts Software Services Inc. All rights reserved.
+// Use of this source code is governed by the GNU GPL v3 license, found in the LICENSE_GPL3 file.
+
+package web
+
+/*
+   push.go - pushing values to the client as they become available, rather than in a one-shot response:
+   through a web socket, with a WEBSOCKET handler method, as server-sent events, with the SSE response directive,
+   or as the body of a response sent in chunks, with the STREAM response directive.
+
+   dashboard > String InChannel
+   """
+   """
+      c = Channel
+      go watchReadings c
+      => "SSE" c
+
+   export > String String InChannel
+   """
+   """
+      c = Channel
+      go writeCsvRows c
+      => "STREAM"
+         "text/csv"
+         c
+*/
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	. "relish/runtime/data"
+	"relish/runtime/interp"
+	"relish/runtime/native_methods/standard_lib/http_methods"
+	"strings"
+	"time"
+)
+
+/*
+How often a comment is sent on a server-sent event stream which has had no events, so that proxies
+do not close the connection as idle.
+*/
+const SSE_KEEPALIVE_INTERVAL = 15 * time.Second
+
+/*
+How long values from a generator of a streamed response may wait in the response buffer before they are
+sent to the client.
+*/
+const STREAM_FLUSH_INTERVAL = 100 * time.Millisecond
+
+/*
+Opens the web socket which the request asks for, and runs the WEBSOCKET handler method, which is given
+the web socket as its Channel parameter, then closes the web socket. The before interceptors can refuse
+the web socket by responding instead. The after interceptors do not run, as there is no response to replace.
+The handler's changes to the session are kept only by the db session store, as no cookie can then be sent.
+*/
+func serveWebSocket(t *interp.Thread, w http.ResponseWriter, r *http.Request, session *http_methods.Session, interceptors []*webInterceptor, handlerMethod *RMultiMethod, routeArgStringValues map[string]string, positionalArgStringValues []string, keywordArgStringValues url.Values) (err error) {
+	if !http_methods.IsWebSocketRequest(r) {
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(w, "426 web socket upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	if !http_methods.IsSameOriginRequest(r) {
+		http.Error(w, "403 web socket request from another site", http.StatusForbidden)
+		return
+	}
+	for _, ic := range interceptors {
+		if ic.before == nil {
+			continue
+		}
+		var results []RObject
+		var proceed bool
+		results, proceed, err = runInterceptor(t, w, r, ic.before, routeArgStringValues, keywordArgStringValues)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !proceed {
+			err = processResponse(w, r, ic.pkg, ic.before.Name, results, t)
+			return
+		}
+	}
+	ws, err := http_methods.AcceptWebSocket(w, r)
+	if err != nil {
+		http.Error(w, "400 "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer ws.Close()
+	defer interpreter.EndAbandonedThread(t) // the handler method sent to the web socket after it closed
+	r = http_methods.WithWebSocket(r, ws)
+
+	t.SetErr("Uncaught panic while running web app method.")
+	_, err = interpreter.RunServiceMethod(t, handlerMethod, routeArgStringValues, positionalArgStringValues, keywordArgStringValues, r)
+	if err != nil {
+		return
+	}
+	if session != nil {
+		_, err = session.Save(t, r)
+	}
+	return
+}
+
+/*
+Sends each value received from the channel to the client as a server-sent event, until nil is received
+from the channel or the client goes away, after which a thread sending to the channel is stopped
+with an error. A String is sent as the event's data, and any other value as
+its JSON encoding.
+*/
+func sendEvents(w http.ResponseWriter, r *http.Request, c RInChannel, thread *interp.Thread) (err error) {
+	defer abandonChannel(c)
+	flusher, canFlush := w.(http.Flusher)
+	if !canFlush {
+		err = errors.New("The web server cannot stream server-sent events.")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(SSE_KEEPALIVE_INTERVAL)
+	defer keepalive.Stop()
+	clientGone := r.Context().Done()
+	for {
+		val, keepaliveDue := receiveValue(c, thread, keepalive.C, clientGone)
+		if keepaliveDue {
+			_, err = io.WriteString(w, ": keepalive\n\n")
+		} else if val == nil || val == NIL {
+			return
+		} else {
+			var data string
+			if s, isString := val.(String); isString {
+				data = string(s)
+			} else {
+				data, err = JsonMarshal(thread, val, false)
+				if err != nil {
+					return
+				}
+			}
+			_, err = io.WriteString(w, "data: "+strings.Replace(data, "\n", "\ndata: ", -1)+"\n\n")
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+/*
+Sends the values from the source to the client as the body of the response, in chunks, until the source
+gives nil or the client goes away, after which a thread sending to an InChannel source is stopped
+with an error. The source is an InChannel, whose values are sent as they are received,
+or a closure with no parameters and one return value, a generator, which is applied again for each value.
+A String or Bytes is sent as is, and any other value as a line of its JSON encoding.
+The values are not sent faster than the client receives them, so the source need not be held in memory.
+*/
+func sendStream(w http.ResponseWriter, r *http.Request, mimeType string, source RObject, thread *interp.Thread) (err error) {
+	flusher, canFlush := w.(http.Flusher)
+	if !canFlush {
+		err = errors.New("The web server cannot stream a response.")
+		return
+	}
+	c, isInChannel := source.(RInChannel)
+	if isInChannel {
+		defer abandonChannel(c)
+	}
+	generator, isClosure := source.(*RClosure)
+	if isClosure && (generator.Method.NumReturnArgs != 1 || len(generator.Method.ParameterNames) > 0) {
+		err = errors.New("A streamed response's generator must have no parameters and one return value.")
+		return
+	}
+	if !isInChannel && !isClosure {
+		err = errors.New("A streamed response requires an InChannel or a generator closure.")
+		return
+	}
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff") // so the browser shows the content as it arrives
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	clientGone := r.Context().Done()
+	lastFlush := time.Now()
+	for {
+		var val RObject
+		if isInChannel {
+			val, _ = receiveValue(c, thread, nil, clientGone)
+		} else {
+			select {
+			case <-clientGone:
+			default:
+				val = thread.EvalContext.EvalClosureCall(generator, nil)[0]
+			}
+		}
+		if val == nil || val == NIL {
+			return
+		}
+
+		var data []byte
+		switch v := val.(type) {
+		case String:
+			data = []byte(string(v))
+		case Bytes:
+			data = []byte(v)
+		default:
+			var encoded string
+			encoded, err = JsonMarshal(thread, val, false)
+			if err != nil {
+				return
+			}
+			data = []byte(encoded + "\n")
+		}
+
+		thread.AllowGC()
+		_, err = w.Write(data)
+		if err == nil && (isInChannel && channelIsEmpty(c) || isClosure && time.Since(lastFlush) >= STREAM_FLUSH_INTERVAL) {
+			flusher.Flush()
+			lastFlush = time.Now()
+		}
+		thread.DisallowGC()
+		if err != nil { // the client has gone away
+			err = nil
+			return
+		}
+	}
+}
+
+/*
+Receives the next value from the channel, or nil if the client goes away first, or tickDue if the
+ticker ticks first. A nil ticker never ticks.
+*/
+func receiveValue(c RInChannel, thread *interp.Thread, ticker <-chan time.Time, clientGone <-chan struct{}) (val RObject, tickDue bool) {
+	inTransit := true
+	thread.AllowGC()
+	switch ch := c.(type) {
+	case *Channel:
+		select {
+		case val = <-ch.Ch:
+		case <-ticker:
+			tickDue = true
+		case <-clientGone:
+		}
+	case *TimeChannel:
+		inTransit = false
+		select {
+		case tm := <-ch.Ch:
+			val = RTime(tm)
+		case <-ticker:
+			tickDue = true
+		case <-clientGone:
+		}
+	default:
+		val = c.From()
+	}
+	thread.DisallowGC()
+	if inTransit && val != nil && (val.IsUnit() || val.IsCollection() || val.Type() == ClosureType) {
+		RT.DecrementInTransitCount(val)
+	}
+	return
+}
+
+/*
+Stops the threads which send to the channel, once the response no longer receives from it, such as
+when the client has gone away, so that they do not wait forever to send.
+*/
+func abandonChannel(c RInChannel) {
+	if ch, isChannel := c.(*Channel); isChannel {
+		ch.Abandon()
+	}
+}
+
+/*
+Whether no value is waiting to be received from the channel.
+*/
+func channelIsEmpty(c RInChannel) bool {
+	if ch, isChannel := c.(*Channel); isChannel {
+		return len(ch.Ch) == 0
+	}
+	return true
+}